@@ -0,0 +1,294 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// content is sampled from the start of a file to estimate its entropy in bits per byte. Compressed
+// or encrypted data sits close to 8, text and most documents well below compressibleEntropy.
+const (
+	entropySampleSize   = 64 * 1024
+	entropyMinSample    = 1024
+	highEntropy         = 7.5
+	compressibleEntropy = 6.0
+	// anomalySampleLimit bounds how many overwritten files are sampled in one run
+	anomalySampleLimit = 100
+)
+
+// ransomwareExtensions are appended to files by well known ransomware families
+var ransomwareExtensions = []string{
+	".aesir", ".cerber", ".cerber3", ".conti", ".crinf", ".crypt", ".crypted", ".cryptolocker",
+	".djvu", ".ecc", ".encrypted", ".exx", ".ezz", ".globe", ".kraken", ".lockbit", ".locked",
+	".locky", ".micro", ".odin", ".osiris", ".petya", ".r5a", ".ryk", ".ryuk", ".sage", ".thor",
+	".vvv", ".wcry", ".wncry", ".wnry", ".xtbl", ".zepto", ".zzzzz",
+}
+
+// AnomalyConfig controls the checks run before a push sync overwrites or removes anything. A run
+// that trips a check pauses the destination until an operator approves it. Thresholds left at 0
+// use the defaults below.
+type AnomalyConfig struct {
+	Enabled bool
+	// ChangeRatio is the share of a destination's keys that can be overwritten or removed in one run
+	ChangeRatio float64
+	// MinKeys is how many keys a destination needs before ChangeRatio is checked
+	MinKeys int
+	// EntropyFiles is how many compressible files can be replaced by high entropy content in one run
+	EntropyFiles int
+	// Extensions are checked along with the built in list of ransomware extensions
+	Extensions []string
+}
+
+const (
+	defaultAnomalyChangeRatio  = 0.25
+	defaultAnomalyMinKeys      = 100
+	defaultAnomalyEntropyFiles = 5
+)
+
+// withDefaults fills in thresholds that weren't configured
+func (c AnomalyConfig) withDefaults() AnomalyConfig {
+	if c.ChangeRatio == 0 {
+		c.ChangeRatio = defaultAnomalyChangeRatio
+	}
+	if c.MinKeys == 0 {
+		c.MinKeys = defaultAnomalyMinKeys
+	}
+	if c.EntropyFiles == 0 {
+		c.EntropyFiles = defaultAnomalyEntropyFiles
+	}
+	return c
+}
+
+// flagsExtension reports if key ends in one of the built in or configured ransomware extensions
+func (c AnomalyConfig) flagsExtension(key string) bool {
+	extension := strings.ToLower(path.Ext(key))
+	for _, extensions := range [][]string{ransomwareExtensions, c.Extensions} {
+		for _, flagged := range extensions {
+			if extension == "."+strings.TrimPrefix(strings.ToLower(flagged), ".") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// AnomalyReport is why a destination was paused. It's kept in the state directory until approved.
+type AnomalyReport struct {
+	DetectedAt time.Time
+	Reasons    []string
+	// Skipped is how many overwrites and removals the current run held back
+	Skipped int
+	// Approved is set by the approve command, the next sync goes ahead without checking
+	Approved bool
+}
+
+// pauseStatePath is where a destination's anomaly report is kept while it's paused.
+func pauseStatePath(sc SyncConfig, destination SyncDestination) string {
+	return filepath.Join(stateDirectory, "paused", stateFileName(".json", sc.SourceFolder, destination.Name()))
+}
+
+// readPauseState returns the report a destination was paused with, nil when it isn't paused.
+func readPauseState(sc SyncConfig, destination SyncDestination) (*AnomalyReport, error) {
+	var report *AnomalyReport
+	readErr := readStateFile(pauseStatePath(sc, destination), &report)
+	return report, readErr
+}
+
+// approveAnomaly lets the next sync of a paused destination go ahead, returning false when it
+// isn't paused.
+func approveAnomaly(sc SyncConfig, destination SyncDestination) (bool, error) {
+	report, readErr := readPauseState(sc, destination)
+	if readErr != nil || report == nil {
+		return false, readErr
+	}
+	report.Approved = true
+	return true, writeStateFile(pauseStatePath(sc, destination), report)
+}
+
+// guardAnomalies checks a push sync's requests before they're run. When the destination is paused,
+// or this run pauses it, overwrites and removals are dropped and only new keys are uploaded. The
+// report is returned so the caller can alert on it.
+func guardAnomalies(
+	ctx context.Context,
+	client BucketClient,
+	sc SyncConfig,
+	destination SyncDestination,
+	objReqs ObjectRequests,
+	newKeys map[string]string,
+	managedKeys int,
+	now time.Time,
+) (ObjectRequests, *AnomalyReport, error) {
+	report, readErr := readPauseState(sc, destination)
+	if readErr != nil {
+		return objReqs, nil, fmt.Errorf("Error reading pause state: %s", readErr)
+	}
+	if report != nil && report.Approved {
+		log.Info(fmt.Sprintf("Anomalies for %s in %s were approved, resuming", sc.SourceFolder, destination.Name()))
+		if removeErr := os.Remove(pauseStatePath(sc, destination)); removeErr != nil {
+			return objReqs, nil, removeErr
+		}
+		return objReqs, nil, nil
+	}
+
+	if report == nil {
+		reasons := detectAnomalies(ctx, client, sc, destination, objReqs, newKeys, managedKeys)
+		if len(reasons) == 0 {
+			return objReqs, nil, nil
+		}
+		report = &AnomalyReport{DetectedAt: now, Reasons: reasons}
+		if writeErr := writeStateFile(pauseStatePath(sc, destination), report); writeErr != nil {
+			return objReqs, nil, fmt.Errorf("Error writing pause state: %s", writeErr)
+		}
+	}
+
+	guarded := objReqs
+	guarded.TombstoneKeys = make([]string, 0)
+	guarded.DeleteKeys = make([]string, 0)
+	guarded.UploadKeys = make(map[string]string)
+	guarded.MoveKeys = make(map[string]string)
+	for key, localPath := range objReqs.UploadKeys {
+		if _, ok := newKeys[key]; ok {
+			guarded.UploadKeys[key] = localPath
+		}
+	}
+	report.Skipped = len(objReqs.UploadKeys) - len(guarded.UploadKeys) + len(objReqs.TombstoneKeys) + len(objReqs.DeleteKeys) + len(objReqs.MoveKeys)
+	// a move removes the old key, upload the new key from scratch instead
+	for newKey := range objReqs.MoveKeys {
+		guarded.UploadKeys[newKey] = newKeys[newKey]
+	}
+	log.Warn(fmt.Sprintf("Sync for %s to %s is paused, skipping %d overwrites and removals: %s",
+		sc.SourceFolder, destination.Name(), report.Skipped, strings.Join(report.Reasons, "; ")))
+
+	return guarded, report, nil
+}
+
+// detectAnomalies returns a reason for every check the requests trip. newKeys holds the uploads
+// that don't exist in the destination yet, managedKeys how many keys the job has there.
+func detectAnomalies(ctx context.Context, client BucketClient, sc SyncConfig, destination SyncDestination, objReqs ObjectRequests, newKeys map[string]string, managedKeys int) []string {
+	reasons := make([]string, 0)
+	config := sc.Anomaly.withDefaults()
+
+	overwrites := make([]string, 0)
+	for key := range objReqs.UploadKeys {
+		if _, ok := newKeys[key]; !ok {
+			overwrites = append(overwrites, key)
+		}
+	}
+	sort.Strings(overwrites)
+
+	changed := len(overwrites) + len(objReqs.TombstoneKeys) + len(objReqs.DeleteKeys)
+	if managedKeys > 0 && managedKeys >= config.MinKeys {
+		ratio := float64(changed) / float64(managedKeys)
+		if ratio > config.ChangeRatio {
+			reasons = append(reasons, fmt.Sprintf("%d of %d keys would be overwritten or removed (%.0f%%, limit %.0f%%)",
+				changed, managedKeys, ratio*100, config.ChangeRatio*100))
+		}
+	}
+
+	flagged := make([]string, 0)
+	for _, keys := range []map[string]string{objReqs.UploadKeys, objReqs.MoveKeys} {
+		for key := range keys {
+			if config.flagsExtension(key) {
+				flagged = append(flagged, key)
+			}
+		}
+	}
+	if len(flagged) != 0 {
+		sort.Strings(flagged)
+		reasons = append(reasons, fmt.Sprintf("%d new or changed files have ransomware extensions, IE: %s", len(flagged), flagged[0]))
+	}
+
+	replaced := make([]string, 0)
+	for i, key := range overwrites {
+		if i == anomalySampleLimit || len(replaced) == config.EntropyFiles {
+			break
+		}
+		localSample, localErr := sampleLocalFile(objReqs.UploadKeys[key])
+		if localErr != nil || len(localSample) < entropyMinSample || shannonEntropy(localSample) < highEntropy {
+			continue
+		}
+		remoteSample, remoteErr := sampleObject(ctx, client, destination.Bucket, key)
+		if remoteErr != nil {
+			log.Debug(fmt.Sprintf("Error sampling %s: %s", key, remoteErr))
+			continue
+		}
+		if len(remoteSample) >= entropyMinSample && shannonEntropy(remoteSample) < compressibleEntropy {
+			replaced = append(replaced, key)
+		}
+	}
+	if len(replaced) == config.EntropyFiles {
+		reasons = append(reasons, fmt.Sprintf("%d compressible files were replaced by high entropy content, IE: %s", len(replaced), replaced[0]))
+	}
+
+	return reasons
+}
+
+// shannonEntropy returns the entropy of data in bits per byte
+func shannonEntropy(data []byte) float64 {
+	if len(data) == 0 {
+		return 0
+	}
+	var counts [256]int
+	for _, b := range data {
+		counts[b]++
+	}
+	entropy := 0.0
+	for _, count := range counts {
+		if count == 0 {
+			continue
+		}
+		p := float64(count) / float64(len(data))
+		entropy -= p * math.Log2(p)
+	}
+	return entropy
+}
+
+func sampleLocalFile(localPath string) ([]byte, error) {
+	file, openErr := os.Open(localPath)
+	if openErr != nil {
+		return nil, openErr
+	}
+	defer file.Close()
+
+	sample := make([]byte, entropySampleSize)
+	n, readErr := io.ReadFull(file, sample)
+	if readErr == io.ErrUnexpectedEOF || readErr == io.EOF {
+		readErr = nil
+	}
+	return sample[:n], readErr
+}
+
+// sampleWriter keeps the first limit bytes written to it, then fails the write to stop the download
+type sampleWriter struct {
+	data  []byte
+	limit int
+}
+
+func (w *sampleWriter) Write(p []byte) (int, error) {
+	room := w.limit - len(w.data)
+	if len(p) > room {
+		w.data = append(w.data, p[:room]...)
+		return room, io.ErrShortWrite
+	}
+	w.data = append(w.data, p...)
+	return len(p), nil
+}
+
+func sampleObject(ctx context.Context, client BucketClient, bucket, key string) ([]byte, error) {
+	sample := &sampleWriter{limit: entropySampleSize}
+	_, downloadErr := client.DownloadObject(ctx, bucket, key, sample)
+	if downloadErr != nil && len(sample.data) < sample.limit {
+		return nil, downloadErr
+	}
+	return sample.data, nil
+}
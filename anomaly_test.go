@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAnomalyPausesOverwritesUntilApproved(t *testing.T) {
+	mockStateDir, mockStateDirErr := ioutil.TempDir(os.TempDir(), "go-test-stuff")
+	assert.Nil(t, mockStateDirErr)
+	defer os.RemoveAll(mockStateDir)
+	stateDirectory = mockStateDir
+	mockTempDir, mockTempDirErr := ioutil.TempDir(os.TempDir(), "go-test-stuff")
+	assert.Nil(t, mockTempDirErr)
+	defer os.RemoveAll(mockTempDir)
+
+	concreteWalkFunc = walkDirectory
+	mockS3Client := NewMockClient(map[string]ObjectInfo{})
+	mockS3Client.UploadFile(context.Background(), "not-real-bucket", "gone.txt", strings.NewReader("removed locally"), nil)
+	compressible := strings.Repeat("quarterly report ", 256)
+	for i := 0; i < defaultAnomalyEntropyFiles; i++ {
+		mockS3Client.UploadFile(context.Background(), "not-real-bucket", fmt.Sprintf("doc%d.txt", i), strings.NewReader(compressible), nil)
+		encrypted := make([]byte, 4096)
+		rand.Read(encrypted)
+		assert.Nil(t, ioutil.WriteFile(filepath.Join(mockTempDir, fmt.Sprintf("doc%d.txt", i)), encrypted, 0644))
+	}
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(mockTempDir, "fresh.txt"), []byte("new file"), 0644))
+	mockSyncConfig := SyncConfig{
+		SourceFolder:      mockTempDir,
+		DestinationBucket: "not-real-bucket",
+		Destructive:       true,
+		Anomaly:           AnomalyConfig{Enabled: true},
+	}
+	destination := mockSyncConfig.DestinationList()[0]
+
+	lock := &sync.Mutex{}
+	syncedObjects, syncErr := doSingleDestinationSync(mockS3Client, mockSyncConfig, lock)
+
+	assert.Nil(t, syncErr)
+	assert.NotNil(t, syncedObjects.Anomaly)
+	assert.Len(t, syncedObjects.Anomaly.Reasons, 1)
+	assert.Contains(t, syncedObjects.Anomaly.Reasons[0], "high entropy")
+	assert.Equal(t, defaultAnomalyEntropyFiles+1, syncedObjects.Anomaly.Skipped)
+	assert.Equal(t, map[string]error{"/fresh.txt": nil}, syncedObjects.Upload)
+	assert.Len(t, syncedObjects.Delete, 0)
+
+	// stays paused on later runs until approved
+	syncedObjects, syncErr = doSingleDestinationSync(mockS3Client, mockSyncConfig, lock)
+	assert.Nil(t, syncErr)
+	assert.NotNil(t, syncedObjects.Anomaly)
+	assert.Len(t, syncedObjects.Upload, 0)
+
+	approved, approveErr := approveAnomaly(mockSyncConfig, destination)
+	assert.Nil(t, approveErr)
+	assert.True(t, approved)
+	syncedObjects, syncErr = doSingleDestinationSync(mockS3Client, mockSyncConfig, lock)
+	assert.Nil(t, syncErr)
+	assert.Nil(t, syncedObjects.Anomaly)
+	assert.Len(t, syncedObjects.Upload, defaultAnomalyEntropyFiles)
+	assert.Contains(t, syncedObjects.Delete, "/gone.txt")
+	report, readErr := readPauseState(mockSyncConfig, destination)
+	assert.Nil(t, readErr)
+	assert.Nil(t, report)
+}
+
+func TestAnomalyChangeRatioAndRansomwareExtensions(t *testing.T) {
+	mockSyncConfig := SyncConfig{
+		SourceFolder:      "/folder1",
+		DestinationBucket: "not-real-bucket",
+		Anomaly:           AnomalyConfig{Enabled: true, Extensions: []string{"pwned"}},
+	}
+	newKeys := map[string]string{
+		"/report.docx.locky": "/folder1/report.docx.locky",
+		"/notes.PWNED":       "/folder1/notes.PWNED",
+	}
+	objectRequests := ObjectRequests{UploadKeys: newKeys}
+	for i := 0; i < 30; i++ {
+		objectRequests.TombstoneKeys = append(objectRequests.TombstoneKeys, fmt.Sprintf("/file%d", i))
+	}
+
+	reasons := detectAnomalies(context.Background(), NewMockClient(nil), mockSyncConfig, mockSyncConfig.DestinationList()[0], objectRequests, newKeys, 100)
+
+	assert.Len(t, reasons, 2)
+	assert.Contains(t, reasons[0], "30 of 100 keys")
+	assert.Contains(t, reasons[1], "2 new or changed files have ransomware extensions")
+
+	// small destinations aren't held to the change ratio
+	reasons = detectAnomalies(context.Background(), NewMockClient(nil), mockSyncConfig, mockSyncConfig.DestinationList()[0], ObjectRequests{TombstoneKeys: objectRequests.TombstoneKeys}, nil, 40)
+	assert.Len(t, reasons, 0)
+}
@@ -0,0 +1,294 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/blob"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/blockblob"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/container"
+)
+
+// azureCopyPollInterval is how often a pending server side copy is checked on
+var azureCopyPollInterval = 500 * time.Millisecond
+
+// AzureClient maps buckets to blob containers in a single storage account.
+type AzureClient struct {
+	Client *azblob.Client
+}
+
+// NewAzureBucketClient authenticates with the first of a connection string, a shared account key or
+// a SAS token that is configured. The endpoint defaults to the account's public blob endpoint, it's
+// set for the Azurite emulator or sovereign clouds, IE: http://127.0.0.1:10000/devstoreaccount1
+func NewAzureBucketClient(providerConfig CloudProviderConfig) (BucketClient, error) {
+	var bucketClient BucketClient
+	serviceURL := providerConfig.Endpoint
+	if serviceURL == "" {
+		serviceURL = fmt.Sprintf("https://%s.blob.core.windows.net/", providerConfig.Account)
+	}
+
+	var client *azblob.Client
+	var clientErr error
+	switch {
+	case providerConfig.ConnectionString != "":
+		client, clientErr = azblob.NewClientFromConnectionString(providerConfig.ConnectionString, nil)
+	case providerConfig.AccountKey != "":
+		credential, credentialErr := azblob.NewSharedKeyCredential(providerConfig.Account, providerConfig.AccountKey)
+		if credentialErr != nil {
+			return bucketClient, fmt.Errorf("Invalid azure account key: %s", credentialErr)
+		}
+		client, clientErr = azblob.NewClientWithSharedKeyCredential(serviceURL, credential, nil)
+	case providerConfig.SASToken != "":
+		client, clientErr = azblob.NewClientWithNoCredential(strings.TrimSuffix(serviceURL, "/")+"/?"+strings.TrimPrefix(providerConfig.SASToken, "?"), nil)
+	default:
+		return bucketClient, fmt.Errorf("Azure provider %s needs a connectionstring, accountkey or sastoken", providerConfig.ID)
+	}
+	if clientErr != nil {
+		return bucketClient, fmt.Errorf("Error creating azure client: %s", clientErr)
+	}
+	bucketClient = &AzureClient{Client: client}
+
+	return bucketClient, nil
+}
+
+func (s *AzureClient) container(bucketName string) *container.Client {
+	return s.Client.ServiceClient().NewContainerClient(bucketName)
+}
+
+func (s *AzureClient) blob(bucketName, key string) *blob.Client {
+	return s.container(bucketName).NewBlobClient(strings.TrimPrefix(key, "/"))
+}
+
+// azureMetadata renames metadata keys to valid Azure names, which have to be C# identifiers. Only
+// warden's own keys are stored, none of them contain underscores so the rename can be reversed.
+func azureMetadata(metadata map[string]string) map[string]*string {
+	if len(metadata) == 0 {
+		return nil
+	}
+	renamed := make(map[string]*string, len(metadata))
+	for name, value := range metadata {
+		value := value
+		renamed[strings.ReplaceAll(name, "-", "_")] = &value
+	}
+	return renamed
+}
+
+func objectMetadata(metadata map[string]*string) map[string]string {
+	if len(metadata) == 0 {
+		return nil
+	}
+	renamed := make(map[string]string, len(metadata))
+	for name, value := range metadata {
+		if value != nil {
+			renamed[strings.ReplaceAll(strings.ToLower(name), "_", "-")] = *value
+		}
+	}
+	return renamed
+}
+
+// azureObjectInfo converts listing properties. Blobs uploaded in blocks have no Content-MD5, like S3
+// multipart uploads they are listed without a hash.
+func azureObjectInfo(properties *container.BlobProperties, metadata map[string]*string) ObjectInfo {
+	var objectInfo ObjectInfo
+	if properties != nil {
+		if properties.LastModified != nil {
+			objectInfo.ModTime = *properties.LastModified
+		}
+		if properties.ContentLength != nil {
+			objectInfo.Size = *properties.ContentLength
+		}
+		objectInfo.Hash = hex.EncodeToString(properties.ContentMD5)
+	}
+	objectInfo.Metadata = objectMetadata(metadata)
+	return objectInfo
+}
+
+func (s *AzureClient) WalkObjects(ctx context.Context, bucketName string, opts ListOptions, walkFn ObjectWalkFunc) error {
+	include := container.ListBlobsInclude{Metadata: true}
+	var prefix *string
+	if opts.Prefix != "" {
+		prefix = &opts.Prefix
+	}
+
+	if opts.Delimiter == "" {
+		pager := s.container(bucketName).NewListBlobsFlatPager(&container.ListBlobsFlatOptions{Include: include, Prefix: prefix})
+		for pager.More() {
+			page, pageErr := pager.NextPage(ctx)
+			if pageErr != nil {
+				return pageErr
+			}
+			for _, item := range page.Segment.BlobItems {
+				if walkErr := walkFn(*item.Name, azureObjectInfo(item.Properties, item.Metadata)); walkErr != nil {
+					return ignoreStopWalk(walkErr)
+				}
+			}
+		}
+		return nil
+	}
+
+	pager := s.container(bucketName).NewListBlobsHierarchyPager(opts.Delimiter, &container.ListBlobsHierarchyOptions{Include: include, Prefix: prefix})
+	for pager.More() {
+		page, pageErr := pager.NextPage(ctx)
+		if pageErr != nil {
+			return pageErr
+		}
+		for _, blobPrefix := range page.Segment.BlobPrefixes {
+			if walkErr := walkFn(*blobPrefix.Name, ObjectInfo{IsPrefix: true}); walkErr != nil {
+				return ignoreStopWalk(walkErr)
+			}
+		}
+		for _, item := range page.Segment.BlobItems {
+			if walkErr := walkFn(*item.Name, azureObjectInfo(item.Properties, item.Metadata)); walkErr != nil {
+				return ignoreStopWalk(walkErr)
+			}
+		}
+	}
+
+	return nil
+}
+
+func (s *AzureClient) UploadFile(ctx context.Context, bucketName, key string, body io.Reader, metadata map[string]string) error {
+	blockBlob := s.container(bucketName).NewBlockBlobClient(strings.TrimPrefix(key, "/"))
+	_, uploadErr := blockBlob.UploadStream(ctx, body, &blockblob.UploadStreamOptions{Metadata: azureMetadata(metadata)})
+
+	return uploadErr
+}
+
+func (s *AzureClient) DownloadObject(ctx context.Context, bucketName, key string, w io.Writer) (ObjectInfo, error) {
+	return s.DownloadObjectVersion(ctx, bucketName, key, "", w)
+}
+
+func (s *AzureClient) DownloadObjectVersion(ctx context.Context, bucketName, key, versionID string, w io.Writer) (ObjectInfo, error) {
+	var objectInfo ObjectInfo
+	blobClient := s.blob(bucketName, key)
+	if versionID != "" {
+		var versionErr error
+		blobClient, versionErr = blobClient.WithVersionID(versionID)
+		if versionErr != nil {
+			return objectInfo, versionErr
+		}
+	}
+	getResp, getErr := blobClient.DownloadStream(ctx, nil)
+	if getErr != nil {
+		return objectInfo, getErr
+	}
+	defer getResp.Body.Close()
+
+	if getResp.ContentLength != nil {
+		objectInfo.Size = *getResp.ContentLength
+	}
+	if getResp.LastModified != nil {
+		objectInfo.ModTime = *getResp.LastModified
+	}
+	objectInfo.Metadata = objectMetadata(getResp.Metadata)
+	_, copyErr := io.Copy(w, getResp.Body)
+
+	return objectInfo, copyErr
+}
+
+func (s *AzureClient) ObjectMetadata(ctx context.Context, bucketName, key string) (map[string]string, error) {
+	propsResp, propsErr := s.blob(bucketName, key).GetProperties(ctx, nil)
+	if propsErr != nil {
+		return nil, propsErr
+	}
+	return objectMetadata(propsResp.Metadata), nil
+}
+
+// CopyObject starts a server side copy and waits for it to finish. Copies within a storage account
+// are authorized by the account itself, or the SAS token which is part of the source URL.
+func (s *AzureClient) CopyObject(ctx context.Context, sourceBucket, sourceKey, destinationBucket, destinationKey string, opts CopyOptions) error {
+	source := s.blob(sourceBucket, sourceKey)
+	if opts.SourceVersion != "" {
+		var versionErr error
+		source, versionErr = source.WithVersionID(opts.SourceVersion)
+		if versionErr != nil {
+			return versionErr
+		}
+	}
+	copyOpts := &blob.StartCopyFromURLOptions{}
+	if opts.StorageClass != "" {
+		tier := blob.AccessTier(opts.StorageClass)
+		copyOpts.Tier = &tier
+	}
+
+	destination := s.blob(destinationBucket, destinationKey)
+	copyResp, copyErr := destination.StartCopyFromURL(ctx, source.URL(), copyOpts)
+	if copyErr != nil {
+		return copyErr
+	}
+	status := copyResp.CopyStatus
+	for status != nil && *status == blob.CopyStatusTypePending {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(azureCopyPollInterval):
+		}
+		propsResp, propsErr := destination.GetProperties(ctx, nil)
+		if propsErr != nil {
+			return propsErr
+		}
+		status = propsResp.CopyStatus
+		if status != nil && *status != blob.CopyStatusTypePending && *status != blob.CopyStatusTypeSuccess {
+			description := ""
+			if propsResp.CopyStatusDescription != nil {
+				description = *propsResp.CopyStatusDescription
+			}
+			return fmt.Errorf("Copy of %s %s: %s", sourceKey, *status, description)
+		}
+	}
+
+	return nil
+}
+
+func (s *AzureClient) DeleteObject(ctx context.Context, bucket string, key string) error {
+	includeSnapshots := blob.DeleteSnapshotsOptionTypeInclude
+	_, delErr := s.blob(bucket, key).Delete(ctx, &blob.DeleteOptions{DeleteSnapshots: &includeSnapshots})
+
+	return delErr
+}
+
+// DeleteObjects deletes keys in parallel, blob batch requests aren't part of the Go SDK.
+func (s *AzureClient) DeleteObjects(ctx context.Context, bucket string, keys []string) map[string]error {
+	return deleteInParallel(ctx, bucket, keys, s.DeleteObject)
+}
+
+// DeleteObjectVersioned deletes the blob only while its ETag is still the one read along with its
+// version ID, so the version returned is the one the delete made a previous version.
+func (s *AzureClient) DeleteObjectVersioned(ctx context.Context, bucket string, key string) (string, error) {
+	propsResp, propsErr := s.blob(bucket, key).GetProperties(ctx, nil)
+	if propsErr != nil {
+		return "", propsErr
+	}
+	if propsResp.VersionID == nil {
+		return "", notVersionedError(bucket)
+	}
+	includeSnapshots := blob.DeleteSnapshotsOptionTypeInclude
+	_, delErr := s.blob(bucket, key).Delete(ctx, &blob.DeleteOptions{
+		DeleteSnapshots: &includeSnapshots,
+		AccessConditions: &blob.AccessConditions{
+			ModifiedAccessConditions: &blob.ModifiedAccessConditions{IfMatch: propsResp.ETag},
+		},
+	})
+	if delErr != nil {
+		return "", delErr
+	}
+	return *propsResp.VersionID, nil
+}
+
+// ObjectVersion returns the blob's version ID, which is only set when the storage account has blob
+// versioning enabled.
+func (s *AzureClient) ObjectVersion(ctx context.Context, bucket string, key string) (string, error) {
+	propsResp, propsErr := s.blob(bucket, key).GetProperties(ctx, nil)
+	if propsErr != nil {
+		return "", propsErr
+	}
+	if propsResp.VersionID == nil {
+		return "", nil
+	}
+	return *propsResp.VersionID, nil
+}
@@ -0,0 +1,301 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAzureMetadataRoundTrip(t *testing.T) {
+	metadata := map[string]string{"mode": "644", "warden-mtime": "1700000000", "warden-xattrs": "user.tag=blue"}
+
+	renamed := azureMetadata(metadata)
+	assert.Contains(t, renamed, "warden_mtime")
+	assert.NotContains(t, renamed, "warden-mtime")
+
+	// the service may return names in a different case
+	value := "1700000000"
+	renamed["Warden_Mtime"] = &value
+	delete(renamed, "warden_mtime")
+	assert.Equal(t, metadata, objectMetadata(renamed))
+	assert.Nil(t, azureMetadata(nil))
+}
+
+func TestNewAzureBucketClient(t *testing.T) {
+	_, noAuthErr := NewAzureBucketClient(CloudProviderConfig{ID: "azure-archive", Name: "azure", Account: "wardenbackups"})
+	assert.ErrorContains(t, noAuthErr, "needs a connectionstring, accountkey or sastoken")
+
+	_, keyErr := NewAzureBucketClient(CloudProviderConfig{ID: "azure-archive", Name: "azure", Account: "wardenbackups", AccountKey: "not base64!"})
+	assert.ErrorContains(t, keyErr, "Invalid azure account key")
+
+	azurite, azuriteErr := NewAzureBucketClient(CloudProviderConfig{
+		ID:               "azurite",
+		Name:             "azure",
+		ConnectionString: "DefaultEndpointsProtocol=http;AccountName=devstoreaccount1;AccountKey=Eby8vdM02xNOcqFlqUwJPLlmEtlCDXJ1OUzFT50uSRZ6IFsuFq2UVErCz4I6tq/K1SZFPTOtr/KBHBeksoGMGw==;BlobEndpoint=http://127.0.0.1:10000/devstoreaccount1;",
+	})
+	assert.Nil(t, azuriteErr)
+	assert.Equal(t, "http://127.0.0.1:10000/devstoreaccount1/container/file.txt", azurite.(*AzureClient).blob("container", "/file.txt").URL())
+
+	sas, sasErr := NewAzureBucketClient(CloudProviderConfig{
+		ID:       "azure-sas",
+		Name:     "azure",
+		Account:  "wardenbackups",
+		SASToken: "?sv=2021-08-06&sig=abc",
+	})
+	assert.Nil(t, sasErr)
+	assert.Equal(t, "https://wardenbackups.blob.core.windows.net/container/file.txt?sv=2021-08-06&sig=abc", sas.(*AzureClient).blob("container", "file.txt").URL())
+}
+
+// fakeAzureBlob is a blob kept by fakeAzureServer
+type fakeAzureBlob struct {
+	data     []byte
+	metadata map[string]string
+	modTime  time.Time
+	// copyPolls is how many more times a copy to this blob is reported pending
+	copyPolls  int
+	copyStatus string
+}
+
+// fakeAzureServer implements enough of the blob service REST API for AzureClient: listing, block
+// uploads, downloads, properties, server side copies and deletes. Copies are reported pending for
+// copyPolls property reads before they end with copyStatus.
+type fakeAzureServer struct {
+	lock       sync.Mutex
+	blobs      map[string]*fakeAzureBlob
+	blocks     map[string][]byte
+	copyPolls  int
+	copyStatus string
+	heads      int
+}
+
+// startAzureServer serves a fake storage account named devstoreaccount1, like Azurite does, and
+// returns a client for it along with the server
+func startAzureServer(t *testing.T) (*AzureClient, *fakeAzureServer) {
+	fake := &fakeAzureServer{blobs: make(map[string]*fakeAzureBlob), blocks: make(map[string][]byte), copyStatus: "success"}
+	server := httptest.NewServer(fake)
+	t.Cleanup(server.Close)
+	client, clientErr := NewAzureBucketClient(CloudProviderConfig{
+		ID:               "azurite",
+		Name:             "azure",
+		ConnectionString: "DefaultEndpointsProtocol=http;AccountName=devstoreaccount1;AccountKey=Eby8vdM02xNOcqFlqUwJPLlmEtlCDXJ1OUzFT50uSRZ6IFsuFq2UVErCz4I6tq/K1SZFPTOtr/KBHBeksoGMGw==;BlobEndpoint=" + server.URL + "/devstoreaccount1;",
+	})
+	assert.Nil(t, clientErr)
+	return client.(*AzureClient), fake
+}
+
+func (f *fakeAzureServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	query := r.URL.Query()
+	path := strings.TrimPrefix(r.URL.Path, "/devstoreaccount1/")
+	if query.Get("restype") == "container" && query.Get("comp") == "list" {
+		f.list(w, path, query.Get("prefix"), query.Get("delimiter"))
+		return
+	}
+
+	body, _ := ioutil.ReadAll(r.Body)
+	switch {
+	case r.Method == http.MethodPut && query.Get("comp") == "block":
+		f.blocks[path+"?"+query.Get("blockid")] = body
+		w.WriteHeader(http.StatusCreated)
+	case r.Method == http.MethodPut && query.Get("comp") == "blocklist":
+		var blockList struct {
+			Latest []string `xml:"Latest"`
+		}
+		xml.Unmarshal(body, &blockList)
+		data := make([]byte, 0)
+		for _, blockID := range blockList.Latest {
+			data = append(data, f.blocks[path+"?"+blockID]...)
+		}
+		f.blobs[path] = &fakeAzureBlob{data: data, metadata: fakeAzureMetadata(r.Header), modTime: time.Now()}
+		w.WriteHeader(http.StatusCreated)
+	case r.Method == http.MethodPut && r.Header.Get("x-ms-copy-source") != "":
+		sourceURL, _ := url.Parse(r.Header.Get("x-ms-copy-source"))
+		source, ok := f.blobs[strings.TrimPrefix(sourceURL.Path, "/devstoreaccount1/")]
+		if !ok {
+			fakeAzureError(w, http.StatusNotFound, "CannotVerifyCopySource")
+			return
+		}
+		f.blobs[path] = &fakeAzureBlob{data: source.data, metadata: source.metadata, modTime: time.Now(), copyPolls: f.copyPolls, copyStatus: f.copyStatus}
+		w.Header().Set("x-ms-copy-id", "copy-1")
+		w.Header().Set("x-ms-copy-status", f.blobs[path].status())
+		w.WriteHeader(http.StatusAccepted)
+	case r.Method == http.MethodPut:
+		f.blobs[path] = &fakeAzureBlob{data: body, metadata: fakeAzureMetadata(r.Header), modTime: time.Now()}
+		w.WriteHeader(http.StatusCreated)
+	case r.Method == http.MethodHead || r.Method == http.MethodGet:
+		blob, ok := f.blobs[path]
+		if !ok {
+			fakeAzureError(w, http.StatusNotFound, "BlobNotFound")
+			return
+		}
+		if r.Method == http.MethodHead {
+			f.heads++
+			if blob.copyPolls > 0 {
+				blob.copyPolls--
+			}
+		}
+		if blob.copyStatus != "" {
+			w.Header().Set("x-ms-copy-status", blob.status())
+			w.Header().Set("x-ms-copy-status-description", "copy source went away")
+		}
+		for name, value := range blob.metadata {
+			w.Header().Set("x-ms-meta-"+name, value)
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(blob.data)))
+		w.Header().Set("Last-Modified", blob.modTime.UTC().Format(http.TimeFormat))
+		w.Header().Set("x-ms-blob-type", "BlockBlob")
+		w.WriteHeader(http.StatusOK)
+		if r.Method == http.MethodGet {
+			w.Write(blob.data)
+		}
+	case r.Method == http.MethodDelete:
+		if _, ok := f.blobs[path]; !ok {
+			fakeAzureError(w, http.StatusNotFound, "BlobNotFound")
+			return
+		}
+		delete(f.blobs, path)
+		w.WriteHeader(http.StatusAccepted)
+	default:
+		w.WriteHeader(http.StatusNotImplemented)
+	}
+}
+
+func (b *fakeAzureBlob) status() string {
+	if b.copyPolls > 0 {
+		return "pending"
+	}
+	return b.copyStatus
+}
+
+// list answers List Blobs for a container, grouping names past the delimiter into blob prefixes
+func (f *fakeAzureServer) list(w http.ResponseWriter, containerName, prefix, delimiter string) {
+	names := make([]string, 0)
+	for path := range f.blobs {
+		if name := strings.TrimPrefix(path, containerName+"/"); name != path && strings.HasPrefix(name, prefix) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	var listing strings.Builder
+	listing.WriteString(`<?xml version="1.0" encoding="utf-8"?><EnumerationResults ContainerName="` + containerName + `"><Blobs>`)
+	seenPrefixes := make(map[string]bool)
+	for _, name := range names {
+		if delimiter != "" {
+			if i := strings.Index(name[len(prefix):], delimiter); i >= 0 {
+				blobPrefix := name[:len(prefix)+i+len(delimiter)]
+				if !seenPrefixes[blobPrefix] {
+					seenPrefixes[blobPrefix] = true
+					listing.WriteString("<BlobPrefix><Name>" + blobPrefix + "</Name></BlobPrefix>")
+				}
+				continue
+			}
+		}
+		blob := f.blobs[containerName+"/"+name]
+		listing.WriteString("<Blob><Name>" + name + "</Name><Properties>")
+		listing.WriteString("<Last-Modified>" + blob.modTime.UTC().Format(http.TimeFormat) + "</Last-Modified>")
+		listing.WriteString("<Content-Length>" + strconv.Itoa(len(blob.data)) + "</Content-Length>")
+		listing.WriteString("<BlobType>BlockBlob</BlobType></Properties><Metadata>")
+		for metadataName, value := range blob.metadata {
+			listing.WriteString("<" + metadataName + ">" + value + "</" + metadataName + ">")
+		}
+		listing.WriteString("</Metadata></Blob>")
+	}
+	listing.WriteString("</Blobs><NextMarker/></EnumerationResults>")
+	w.Header().Set("Content-Type", "application/xml")
+	w.Write([]byte(listing.String()))
+}
+
+func fakeAzureMetadata(header http.Header) map[string]string {
+	metadata := make(map[string]string)
+	for name := range header {
+		if strings.HasPrefix(strings.ToLower(name), "x-ms-meta-") {
+			metadata[strings.ToLower(strings.TrimPrefix(strings.ToLower(name), "x-ms-meta-"))] = header.Get(name)
+		}
+	}
+	return metadata
+}
+
+func fakeAzureError(w http.ResponseWriter, status int, code string) {
+	w.Header().Set("x-ms-error-code", code)
+	w.WriteHeader(status)
+}
+
+func TestAzureClientUploadAndWalk(t *testing.T) {
+	client, _ := startAzureServer(t)
+	ctx := context.Background()
+	metadata := map[string]string{metadataMode: "644", metadataMtime: "2023-11-14T22:13:20Z"}
+	for _, key := range []string{"/dir/a.txt", "/dir/sub/b.txt", "/other.txt"} {
+		assert.Nil(t, client.UploadFile(ctx, "backups", strings.TrimPrefix(key, "/"), strings.NewReader("content of "+key), metadata))
+	}
+
+	flat := make(map[string]ObjectInfo)
+	assert.Nil(t, client.WalkObjects(ctx, "backups", ListOptions{Prefix: "dir/"}, func(key string, info ObjectInfo) error {
+		flat[key] = info
+		return nil
+	}))
+	assert.Len(t, flat, 2)
+	assert.Equal(t, int64(len("content of /dir/a.txt")), flat["dir/a.txt"].Size)
+	assert.Equal(t, metadata, flat["dir/sub/b.txt"].Metadata)
+
+	delimited := make(map[string]bool)
+	assert.Nil(t, client.WalkObjects(ctx, "backups", ListOptions{Prefix: "dir/", Delimiter: "/"}, func(key string, info ObjectInfo) error {
+		delimited[key] = info.IsPrefix
+		return nil
+	}))
+	assert.Equal(t, map[string]bool{"dir/a.txt": false, "dir/sub/": true}, delimited)
+
+	var downloaded bytes.Buffer
+	objectInfo, downloadErr := client.DownloadObject(ctx, "backups", "/dir/sub/b.txt", &downloaded)
+	assert.Nil(t, downloadErr)
+	assert.Equal(t, "content of /dir/sub/b.txt", downloaded.String())
+	assert.Equal(t, metadata, objectInfo.Metadata)
+}
+
+func TestAzureClientCopyWaitsForPendingCopies(t *testing.T) {
+	defer func(interval time.Duration) { azureCopyPollInterval = interval }(azureCopyPollInterval)
+	azureCopyPollInterval = time.Millisecond
+	client, fake := startAzureServer(t)
+	ctx := context.Background()
+	assert.Nil(t, client.UploadFile(ctx, "backups", "file.txt", strings.NewReader("content"), nil))
+
+	fake.copyPolls = 2
+	assert.Nil(t, client.CopyObject(ctx, "backups", "/file.txt", "backups", "/copy.txt", CopyOptions{}))
+	assert.Equal(t, 2, fake.heads)
+	var copied bytes.Buffer
+	_, downloadErr := client.DownloadObject(ctx, "backups", "copy.txt", &copied)
+	assert.Nil(t, downloadErr)
+	assert.Equal(t, "content", copied.String())
+
+	// a copy that ends in anything but success fails once it's done
+	fake.copyPolls, fake.copyStatus = 1, "failed"
+	copyErr := client.CopyObject(ctx, "backups", "/file.txt", "backups", "/failed.txt", CopyOptions{})
+	assert.ErrorContains(t, copyErr, "Copy of /file.txt failed: copy source went away")
+}
+
+func TestAzureClientDeleteObjects(t *testing.T) {
+	client, fake := startAzureServer(t)
+	ctx := context.Background()
+	for _, key := range []string{"a.txt", "b.txt", "c.txt"} {
+		assert.Nil(t, client.UploadFile(ctx, "backups", key, strings.NewReader(key), nil))
+	}
+
+	delErrs := client.DeleteObjects(ctx, "backups", []string{"/a.txt", "/b.txt", "/missing.txt"})
+	assert.Len(t, delErrs, 1)
+	assert.ErrorContains(t, delErrs["/missing.txt"], "BlobNotFound")
+	assert.Len(t, fake.blobs, 1)
+	assert.Contains(t, fake.blobs, "backups/c.txt")
+}
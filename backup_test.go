@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"io/ioutil"
 	"os"
@@ -30,7 +31,7 @@ func TestTarAndUploadSimple(t *testing.T) {
 	keyBase := strings.TrimPrefix(strings.ReplaceAll(mockTempDir, "/", "_"), "_")
 	keyRegex := fmt.Sprintf("^%s.*\\.tar\\.gz$", keyBase)
 
-	doBackup(mockClient, mockBackupConfig, nil)
+	doBackup(context.Background(), mockClient, mockBackupConfig, nil)
 
 	assert.Len(t, mockClient.UploadRequests, 1)
 	assert.Equal(t, mockClient.UploadRequests[0].DestBucket, "notatallarealbucket")
@@ -59,7 +60,7 @@ func TestTarAndUploadNested(t *testing.T) {
 	keyBase := strings.TrimPrefix(strings.ReplaceAll(mockTempDir, "/", "_"), "_")
 	keyRegex := fmt.Sprintf("^%s.*\\.tar\\.gz$", keyBase)
 
-	doBackup(mockClient, mockBackupConfig, nil)
+	doBackup(context.Background(), mockClient, mockBackupConfig, nil)
 	assert.Len(t, mockClient.UploadRequests, 1)
 	assert.Equal(t, mockClient.UploadRequests[0].DestBucket, "notatallarealbucket")
 	assert.Regexp(t, regexp.MustCompile(keyRegex), mockClient.UploadRequests[0].Key)
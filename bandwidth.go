@@ -0,0 +1,225 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+)
+
+// uploadLimiter caps upload bandwidth across every sync and backup job, nil when unlimited
+var uploadLimiter *RateLimiter
+
+// rateLimitedReadSize bounds how much is read at once so throttled uploads stay smooth
+const rateLimitedReadSize = 32 * 1024
+
+// BandwidthConfig caps upload bandwidth. Limits are bytes per second with an optional unit and /s
+// suffix (IE: 2MB or 2MB/s), an empty or zero limit is unlimited. The first schedule window
+// containing the current local time overrides the default limit.
+type BandwidthConfig struct {
+	Limit    string
+	Schedule []BandwidthWindow
+}
+
+// BandwidthWindow applies a limit between two HH:MM local times. A window whose end is before its
+// start wraps past midnight.
+type BandwidthWindow struct {
+	Start string `required:"true"`
+	End   string `required:"true"`
+	Limit string
+}
+
+type bandwidthWindow struct {
+	start time.Duration
+	end   time.Duration
+	limit int64
+}
+
+// RateLimiter is a token bucket holding up to one second worth of bytes at the current limit.
+type RateLimiter struct {
+	limit   int64
+	windows []bandwidthWindow
+	tokens  float64
+	last    time.Time
+	lock    sync.Mutex
+	now     func() time.Time
+	sleep   func(time.Duration)
+}
+
+// NewRateLimiter returns nil when the config doesn't limit bandwidth at any time of day.
+func NewRateLimiter(bc BandwidthConfig) (*RateLimiter, error) {
+	limit, limitErr := parseBandwidth(bc.Limit)
+	if limitErr != nil {
+		return nil, limitErr
+	}
+
+	limited := limit != 0
+	windows := make([]bandwidthWindow, 0, len(bc.Schedule))
+	for _, window := range bc.Schedule {
+		start, startErr := parseTimeOfDay(window.Start)
+		if startErr != nil {
+			return nil, startErr
+		}
+		end, endErr := parseTimeOfDay(window.End)
+		if endErr != nil {
+			return nil, endErr
+		}
+		windowLimit, windowLimitErr := parseBandwidth(window.Limit)
+		if windowLimitErr != nil {
+			return nil, windowLimitErr
+		}
+		limited = limited || windowLimit != 0
+		windows = append(windows, bandwidthWindow{start: start, end: end, limit: windowLimit})
+	}
+	if !limited {
+		return nil, nil
+	}
+
+	return &RateLimiter{
+		limit:   limit,
+		windows: windows,
+		now:     time.Now,
+		sleep:   time.Sleep,
+	}, nil
+}
+
+// LimitAt returns the limit in bytes per second in effect at t, 0 means unlimited.
+func (l *RateLimiter) LimitAt(t time.Time) int64 {
+	sinceMidnight := time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute + time.Duration(t.Second())*time.Second
+	for _, window := range l.windows {
+		inWindow := sinceMidnight >= window.start && sinceMidnight < window.end
+		if window.end <= window.start {
+			inWindow = sinceMidnight >= window.start || sinceMidnight < window.end
+		}
+		if inWindow {
+			return window.limit
+		}
+	}
+	return l.limit
+}
+
+// wait takes n bytes worth of tokens, sleeping until the bucket has refilled enough to cover them.
+// Tokens are reserved before sleeping so concurrent readers queue up behind each other.
+func (l *RateLimiter) wait(n int) {
+	l.lock.Lock()
+	now := l.now()
+	limit := float64(l.LimitAt(now))
+	if limit == 0 {
+		l.tokens = 0
+		l.last = now
+		l.lock.Unlock()
+		return
+	}
+
+	if !l.last.IsZero() {
+		l.tokens += now.Sub(l.last).Seconds() * limit
+	}
+	if l.tokens > limit {
+		l.tokens = limit
+	}
+	l.last = now
+	l.tokens -= float64(n)
+
+	var delay time.Duration
+	if l.tokens < 0 {
+		delay = time.Duration(-l.tokens / limit * float64(time.Second))
+	}
+	l.lock.Unlock()
+
+	if delay > 0 {
+		l.sleep(delay)
+	}
+}
+
+type rateLimitedReader struct {
+	reader   io.Reader
+	limiters []*RateLimiter
+}
+
+func (r *rateLimitedReader) Read(p []byte) (int, error) {
+	if len(p) > rateLimitedReadSize {
+		p = p[:rateLimitedReadSize]
+	}
+	n, readErr := r.reader.Read(p)
+	for _, limiter := range r.limiters {
+		limiter.wait(n)
+	}
+	return n, readErr
+}
+
+// rateLimitedClient throttles the bodies passed to UploadFile, everything else goes straight
+// through to the wrapped client.
+type rateLimitedClient struct {
+	BucketClient
+	limiters []*RateLimiter
+}
+
+func (c rateLimitedClient) UploadFile(ctx context.Context, bucketName string, key string, body io.Reader, metadata map[string]string) error {
+	return c.BucketClient.UploadFile(ctx, bucketName, key, &rateLimitedReader{reader: body, limiters: c.limiters}, metadata)
+}
+
+func (c rateLimitedClient) unwrap() BucketClient {
+	return c.BucketClient
+}
+
+func (c rateLimitedClient) wrapMultipart(client MultipartClient) MultipartClient {
+	return rateLimitedMultipartClient{MultipartClient: client, limiters: c.limiters}
+}
+
+// wrapMove leaves moves alone, they don't send a body to throttle
+func (c rateLimitedClient) wrapMove(client MoveClient) MoveClient {
+	return client
+}
+
+// rateLimitedReadSeeker throttles multipart bodies, which have to be seekable so parts can be retried
+type rateLimitedReadSeeker struct {
+	rateLimitedReader
+	seeker io.Seeker
+}
+
+func (r *rateLimitedReadSeeker) Seek(offset int64, whence int) (int64, error) {
+	return r.seeker.Seek(offset, whence)
+}
+
+// rateLimitedMultipartClient throttles the parts of multipart uploads made through a rateLimitedClient
+type rateLimitedMultipartClient struct {
+	MultipartClient
+	limiters []*RateLimiter
+}
+
+func (c rateLimitedMultipartClient) UploadPart(ctx context.Context, bucket string, key string, uploadID string, partNumber int, body io.ReadSeeker, size int64) (string, error) {
+	limited := &rateLimitedReadSeeker{rateLimitedReader: rateLimitedReader{reader: body, limiters: c.limiters}, seeker: body}
+	return c.MultipartClient.UploadPart(ctx, bucket, key, uploadID, partNumber, limited, size)
+}
+
+// limitUploads wraps client so uploads respect the global limit and the job's own limiter, which is
+// shared by all of a job's destinations.
+func limitUploads(client BucketClient, jobLimiter *RateLimiter) BucketClient {
+	limiters := make([]*RateLimiter, 0, 2)
+	for _, limiter := range []*RateLimiter{uploadLimiter, jobLimiter} {
+		if limiter != nil {
+			limiters = append(limiters, limiter)
+		}
+	}
+	if len(limiters) == 0 {
+		return client
+	}
+
+	return rateLimitedClient{BucketClient: client, limiters: limiters}
+}
+
+// parseBandwidth parses a rate such as 2MB or 512KB/s into bytes per second
+func parseBandwidth(bandwidthStr string) (int64, error) {
+	trimmed := strings.TrimSuffix(strings.ToLower(strings.TrimSpace(bandwidthStr)), "/s")
+	return parseByteSize(trimmed)
+}
+
+func parseTimeOfDay(timeStr string) (time.Duration, error) {
+	parsed, parseErr := time.Parse("15:04", timeStr)
+	if parseErr != nil {
+		return 0, fmt.Errorf("%q is not a valid HH:MM time", timeStr)
+	}
+	return time.Duration(parsed.Hour())*time.Hour + time.Duration(parsed.Minute())*time.Minute, nil
+}
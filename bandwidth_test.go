@@ -0,0 +1,62 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBandwidthScheduleSelectsLimit(t *testing.T) {
+	limiter, limiterErr := NewRateLimiter(BandwidthConfig{
+		Schedule: []BandwidthWindow{
+			{Start: "08:00", End: "18:00", Limit: "2MB/s"},
+			{Start: "22:00", End: "02:00", Limit: "512KB"},
+		},
+	})
+	assert.Nil(t, limiterErr)
+	assert.NotNil(t, limiter)
+
+	day := time.Date(2023, 5, 1, 0, 0, 0, 0, time.Local)
+	assert.Equal(t, int64(2<<20), limiter.LimitAt(day.Add(9*time.Hour)))
+	assert.Equal(t, int64(0), limiter.LimitAt(day.Add(18*time.Hour)))
+	assert.Equal(t, int64(512<<10), limiter.LimitAt(day.Add(23*time.Hour)))
+	assert.Equal(t, int64(512<<10), limiter.LimitAt(day.Add(1*time.Hour)))
+	assert.Equal(t, int64(0), limiter.LimitAt(day.Add(3*time.Hour)))
+}
+
+func TestBandwidthUnlimitedConfigHasNoLimiter(t *testing.T) {
+	limiter, limiterErr := NewRateLimiter(BandwidthConfig{})
+	assert.Nil(t, limiterErr)
+	assert.Nil(t, limiter)
+
+	_, limiterErr = NewRateLimiter(BandwidthConfig{Schedule: []BandwidthWindow{{Start: "8am", End: "18:00", Limit: "1MB"}}})
+	assert.NotNil(t, limiterErr)
+	_, limiterErr = NewRateLimiter(BandwidthConfig{Limit: "fast"})
+	assert.NotNil(t, limiterErr)
+}
+
+func TestRateLimitedReaderThrottles(t *testing.T) {
+	limiter, limiterErr := NewRateLimiter(BandwidthConfig{Limit: "64KB"})
+	assert.Nil(t, limiterErr)
+
+	// a fake clock that only moves forward when the limiter sleeps
+	clock := time.Date(2023, 5, 1, 12, 0, 0, 0, time.Local)
+	var slept time.Duration
+	limiter.now = func() time.Time { return clock }
+	limiter.sleep = func(d time.Duration) {
+		slept += d
+		clock = clock.Add(d)
+	}
+
+	body := bytes.Repeat([]byte("a"), 256<<10)
+	reader := &rateLimitedReader{reader: bytes.NewReader(body), limiters: []*RateLimiter{limiter}}
+	read, readErr := ioutil.ReadAll(reader)
+
+	assert.Nil(t, readErr)
+	assert.Equal(t, body, read)
+	// the bucket starts empty, so 256KB at 64KB/s takes four seconds
+	assert.Equal(t, 4*time.Second, slept)
+}
@@ -0,0 +1,294 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	SyncModePush          = "push"
+	SyncModeBidirectional = "bidirectional"
+
+	// ConflictNewest keeps whichever side was modified most recently
+	ConflictNewest = "newest"
+	// ConflictLocal always keeps the local copy
+	ConflictLocal = "local"
+	// ConflictKeepBoth keeps the local copy at its path and downloads the remote copy next to it
+	// with a conflict suffix
+	ConflictKeepBoth = "keepboth"
+)
+
+// BaselineEntry records the state of both sides of a key at the end of the last bidirectional sync
+// that left them in agreement. Comparing against it is what tells a deletion on one side apart from
+// a creation on the other.
+type BaselineEntry struct {
+	LocalModTime  time.Time
+	LocalSize     int64
+	RemoteModTime time.Time
+	RemoteSize    int64
+}
+
+func validSyncMode(mode string) bool {
+	return mode == "" || mode == SyncModePush || mode == SyncModeBidirectional
+}
+
+func validConflictPolicy(policy string) bool {
+	return policy == "" || policy == ConflictNewest || policy == ConflictLocal || policy == ConflictKeepBoth
+}
+
+func baselinePath(sc SyncConfig, destination SyncDestination) string {
+	return filepath.Join(stateDirectory, "baselines", stateFileName(".json", sc.SourceFolder, destination.Name()))
+}
+
+// syncBidirectional reconciles local files and a destination in both directions. Each key is
+// compared against the baseline from the previous run to work out which side changed, keys changed
+// on both sides are resolved with the job's conflict policy.
+func syncBidirectional(
+	ctx context.Context,
+	client BucketClient,
+	job *WorkQueueJob,
+	sc SyncConfig,
+	destination SyncDestination,
+	pathFilter *PathFilter,
+	localFiles, uploadCandidates map[string]os.FileInfo,
+	resultMap *ResultMap,
+) error {
+	baseline := make(map[string]BaselineEntry)
+	if readErr := readStateFile(baselinePath(sc, destination), &baseline); readErr != nil {
+		return fmt.Errorf("Error reading sync baseline: %s", readErr)
+	}
+
+	localKeys := make(map[string]string)
+	for localPath, _ := range localFiles {
+		localKeys[sc.KeyForPath(localPath)] = localPath
+	}
+	remoteObjects, listErr := listManagedObjects(ctx, client, sc, destination)
+	if listErr != nil {
+		return fmt.Errorf("Error listing bucket %s: %s", destination.Bucket, listErr)
+	}
+
+	objectRequests := ObjectRequests{
+		TombstoneKeys:   make([]string, 0),
+		DeleteKeys:      make([]string, 0),
+		UploadKeys:      make(map[string]string),
+		SymlinkKeys:     make(map[string]string),
+		DownloadKeys:    make(map[string]string),
+		LocalDeleteKeys: make(map[string]string),
+		MoveKeys:        make(map[string]string),
+		LocalFolder:     sc.SourceFolder,
+	}
+
+	allKeys := make(map[string]bool)
+	for key, _ := range localKeys {
+		allKeys[key] = true
+	}
+	for key, _ := range remoteObjects {
+		allKeys[key] = true
+	}
+	for key, _ := range baseline {
+		allKeys[key] = true
+	}
+
+	// keys that are excluded or filtered this run are left untouched, along with their baseline
+	skippedKeys := make(map[string]bool)
+	now := time.Now()
+	for key, _ := range allKeys {
+		localPath, hasLocal := localKeys[key]
+		remoteObj, hasRemote := remoteObjects[key]
+		base, hasBase := baseline[key]
+
+		if !hasLocal {
+			var pathErr error
+			if localPath, pathErr = sc.LocalPathForKey(sc.SourceFolder, key); pathErr != nil {
+				log.Warn(fmt.Sprintf("Skipping %s: %s", key, pathErr))
+				resultMap.AddDownloadResult(key, pathErr)
+				skippedKeys[key] = true
+				continue
+			}
+		}
+		_, isCandidate := uploadCandidates[localPath]
+		if (hasLocal && !isCandidate) || pathFilter.Excluded(localPath, false) {
+			skippedKeys[key] = true
+			continue
+		}
+
+		localInfo := localFiles[localPath]
+		localChanged := hasLocal && (!hasBase || localInfo.Size() != base.LocalSize || !localInfo.ModTime().Equal(base.LocalModTime))
+		remoteChanged := hasRemote && (!hasBase || remoteObj.Size != base.RemoteSize || !remoteObj.ModTime.Equal(base.RemoteModTime))
+
+		switch {
+		case hasLocal && hasRemote:
+			if !hasBase && !objectModified(localInfo, remoteObj) {
+				log.Debug(fmt.Sprintf("%s is in sync, no action required", localPath))
+			} else if !hasBase || (localChanged && remoteChanged) {
+				resolveConflict(sc, key, localPath, localInfo, remoteObj, now, objectRequests, resultMap)
+			} else if localChanged {
+				log.Info(fmt.Sprintf("%s has been modified locally, will upload", localPath))
+				objectRequests.UploadKeys[key] = localPath
+			} else if remoteChanged {
+				log.Info(fmt.Sprintf("%s has been modified remotely, will download", key))
+				objectRequests.DownloadKeys[key] = localPath
+			}
+		case hasLocal:
+			if hasBase && !localChanged {
+				if sc.Destructive {
+					log.Info(fmt.Sprintf("%s was deleted remotely, will delete locally", key))
+					objectRequests.LocalDeleteKeys[key] = localPath
+				}
+			} else {
+				objectRequests.UploadKeys[key] = localPath
+			}
+		case hasRemote:
+			if hasBase && !remoteChanged {
+				if sc.Destructive {
+					log.Info(fmt.Sprintf("%s was deleted locally, will remove from bucket", localPath))
+					if sc.TombstonePolicy(destination).Enabled() {
+						objectRequests.TombstoneKeys = append(objectRequests.TombstoneKeys, key)
+					} else {
+						objectRequests.DeleteKeys = append(objectRequests.DeleteKeys, key)
+					}
+				}
+			} else {
+				objectRequests.DownloadKeys[key] = localPath
+			}
+		}
+	}
+
+	for key, localPath := range objectRequests.UploadKeys {
+		if localFiles[localPath].Mode()&os.ModeSymlink != 0 {
+			delete(objectRequests.UploadKeys, key)
+			objectRequests.SymlinkKeys[key] = localPath
+		}
+	}
+
+	syncObjectRequests(ctx, client, job, objectRequests, resultMap, destination, sc.TombstonePolicy(destination))
+
+	// uploads change the remote modification time, so list again to record what the bucket holds now
+	if len(objectRequests.UploadKeys) != 0 || len(objectRequests.SymlinkKeys) != 0 {
+		remoteObjects, listErr = listManagedObjects(ctx, client, sc, destination)
+		if listErr != nil {
+			return fmt.Errorf("Error listing bucket %s after sync, baseline not updated: %s", destination.Bucket, listErr)
+		}
+	}
+
+	newBaseline := make(map[string]BaselineEntry)
+	for key, _ := range allKeys {
+		if skippedKeys[key] || resultMap.Failed(key) {
+			if base, hasBase := baseline[key]; hasBase {
+				newBaseline[key] = base
+			}
+			continue
+		}
+		remoteObj, hasRemote := remoteObjects[key]
+		if _, deletedLocally := objectRequests.LocalDeleteKeys[key]; deletedLocally || !hasRemote {
+			continue
+		}
+
+		localPath, hasLocal := localKeys[key]
+		localInfo := localFiles[localPath]
+		if !hasLocal || objectRequests.DownloadKeys[key] == localPath {
+			// downloaded this run, the walk either didn't see the file or saw the old copy
+			downloadedPath, pathErr := sc.LocalPathForKey(sc.SourceFolder, key)
+			if pathErr != nil {
+				continue
+			}
+			var statErr error
+			localInfo, statErr = os.Lstat(downloadedPath)
+			if statErr != nil {
+				continue
+			}
+		}
+
+		newBaseline[key] = BaselineEntry{
+			LocalModTime:  localInfo.ModTime(),
+			LocalSize:     localInfo.Size(),
+			RemoteModTime: remoteObj.ModTime,
+			RemoteSize:    remoteObj.Size,
+		}
+	}
+
+	if writeErr := writeStateFile(baselinePath(sc, destination), newBaseline); writeErr != nil {
+		return fmt.Errorf("Error writing sync baseline: %s", writeErr)
+	}
+
+	return nil
+}
+
+// resolveConflict queues the requests needed to settle a key that changed on both sides.
+func resolveConflict(
+	sc SyncConfig,
+	key, localPath string,
+	localInfo os.FileInfo,
+	remoteObj ObjectInfo,
+	now time.Time,
+	objectRequests ObjectRequests,
+	resultMap *ResultMap,
+) {
+	remoteModTime := remoteObj.ModTime
+	if originalModTime, ok := metadataModTime(remoteObj.Metadata); ok {
+		remoteModTime = originalModTime
+	}
+
+	resolution := ""
+	switch sc.ConflictPolicy {
+	case ConflictLocal:
+		objectRequests.UploadKeys[key] = localPath
+		resolution = "keeping local copy"
+	case ConflictKeepBoth:
+		conflictCopy := conflictPath(localPath, now)
+		objectRequests.UploadKeys[key] = localPath
+		objectRequests.DownloadKeys[key] = conflictCopy
+		resolution = fmt.Sprintf("keeping both, remote copy saved as %s", conflictCopy)
+	default:
+		if localInfo.ModTime().After(remoteModTime) {
+			objectRequests.UploadKeys[key] = localPath
+			resolution = "local copy is newer"
+		} else {
+			objectRequests.DownloadKeys[key] = localPath
+			resolution = "remote copy is newer"
+		}
+	}
+
+	log.Warn(fmt.Sprintf("%s changed locally and remotely, %s", key, resolution))
+	resultMap.AddConflictResult(key, nil)
+}
+
+// doKeepBoth saves the remote copy of a conflict kept on both sides to conflictCopy, then uploads the
+// local copy over it. Both run in a single task, queued as two the upload could run first and the
+// remote copy would be lost.
+func doKeepBoth(ctx context.Context, client BucketClient, bucket, key, folder, conflictCopy, localPath string, resultMap *ResultMap) {
+	if downloadErr := doDownloadObject(ctx, client, bucket, key, folder, conflictCopy, resultMap); downloadErr != nil {
+		resultMap.AddUploadResult(key, fmt.Errorf("Skipped, remote copy could not be saved: %s", downloadErr))
+		return
+	}
+	doUploadFile(ctx, client, bucket, key, localPath, resultMap)
+}
+
+// conflictPath inserts a conflict marker before the extension, IE: report.docx becomes
+// report.conflict-20220102-150405.docx
+func conflictPath(localPath string, now time.Time) string {
+	extension := filepath.Ext(localPath)
+	base := strings.TrimSuffix(localPath, extension)
+	return fmt.Sprintf("%s.conflict-%s%s", base, now.UTC().Format("20060102-150405"), extension)
+}
+
+// listManagedObjects lists every key under the sync job's prefix, keyed with a leading slash like
+// the rest of the sync code.
+func listManagedObjects(ctx context.Context, client BucketClient, sc SyncConfig, destination SyncDestination) (map[string]ObjectInfo, error) {
+	remoteObjects := make(map[string]ObjectInfo)
+	walkErr := client.WalkObjects(ctx, destination.Bucket, ListOptions{Prefix: sc.KeyPrefix()}, func(objectKey string, objectInfo ObjectInfo) error {
+		key := "/" + strings.TrimPrefix(objectKey, "/")
+		if sc.ManagesKey(key) && !objectInfo.IsPrefix {
+			remoteObjects[key] = objectInfo
+		}
+		return nil
+	})
+
+	return remoteObjects, walkErr
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func setupBidirectionalTest(t *testing.T) (string, *MockS3Client, SyncConfig) {
+	mockTempDir, mockTempDirErr := ioutil.TempDir(os.TempDir(), "go-test-stuff")
+	assert.Nil(t, mockTempDirErr)
+	sourceFolder := filepath.Join(mockTempDir, "source")
+	assert.Nil(t, os.MkdirAll(sourceFolder, os.ModePerm))
+
+	concreteWalkFunc = walkDirectory
+	stateDirectory = filepath.Join(mockTempDir, "state")
+	mockS3Client := NewMockClient(map[string]ObjectInfo{})
+	mockSyncConfig := SyncConfig{
+		SourceFolder:      sourceFolder,
+		DestinationBucket: "not-real-bucket",
+		Mode:              SyncModeBidirectional,
+		ConflictPolicy:    ConflictNewest,
+		Destructive:       true,
+	}
+
+	return mockTempDir, mockS3Client, mockSyncConfig
+}
+
+func TestBidirectionalUploadsDownloadsAndDeletes(t *testing.T) {
+	mockTempDir, mockS3Client, mockSyncConfig := setupBidirectionalTest(t)
+	defer os.RemoveAll(mockTempDir)
+	localOnlyPath := filepath.Join(mockSyncConfig.SourceFolder, "local-only")
+	assert.Nil(t, ioutil.WriteFile(localOnlyPath, []byte("local"), 0644))
+	mockS3Client.UploadFile(context.Background(), "not-real-bucket", "remote/remote-only", strings.NewReader("remote"), nil)
+
+	lock := &sync.Mutex{}
+	syncedObjects, syncErr := doSingleDestinationSync(mockS3Client, mockSyncConfig, lock)
+
+	assert.Nil(t, syncErr)
+	assert.Contains(t, syncedObjects.Upload, "/local-only")
+	assert.Contains(t, syncedObjects.Download, "/remote/remote-only")
+	remoteOnly, readErr := ioutil.ReadFile(filepath.Join(mockSyncConfig.SourceFolder, "remote/remote-only"))
+	assert.Nil(t, readErr)
+	assert.Equal(t, "remote", string(remoteOnly))
+
+	// a second run with nothing changed is a no-op
+	syncedObjects, syncErr = doSingleDestinationSync(mockS3Client, mockSyncConfig, lock)
+	assert.Nil(t, syncErr)
+	assert.Len(t, syncedObjects.Upload, 0)
+	assert.Len(t, syncedObjects.Download, 0)
+
+	// deleting on either side propagates to the other
+	assert.Nil(t, os.Remove(localOnlyPath))
+	assert.Nil(t, mockS3Client.DeleteObject(context.Background(), "not-real-bucket", "remote/remote-only"))
+	syncedObjects, syncErr = doSingleDestinationSync(mockS3Client, mockSyncConfig, lock)
+
+	assert.Nil(t, syncErr)
+	assert.Contains(t, syncedObjects.Delete, "/local-only")
+	assert.Contains(t, syncedObjects.LocalDelete, "/remote/remote-only")
+	assert.NoFileExists(t, filepath.Join(mockSyncConfig.SourceFolder, "remote/remote-only"))
+	assert.NotContains(t, mockS3Client.mockList, "local-only")
+}
+
+func TestBidirectionalConflictKeepBoth(t *testing.T) {
+	mockTempDir, mockS3Client, mockSyncConfig := setupBidirectionalTest(t)
+	defer os.RemoveAll(mockTempDir)
+	mockSyncConfig.ConflictPolicy = ConflictKeepBoth
+	sharedPath := filepath.Join(mockSyncConfig.SourceFolder, "shared.txt")
+	assert.Nil(t, ioutil.WriteFile(sharedPath, []byte("original"), 0644))
+
+	lock := &sync.Mutex{}
+	_, syncErr := doSingleDestinationSync(mockS3Client, mockSyncConfig, lock)
+	assert.Nil(t, syncErr)
+
+	// change both sides before the next run
+	oneMinuteAgo := time.Now().Add(-1 * time.Minute)
+	assert.Nil(t, ioutil.WriteFile(sharedPath, []byte("local edit"), 0644))
+	assert.Nil(t, os.Chtimes(sharedPath, oneMinuteAgo, oneMinuteAgo))
+	mockS3Client.UploadFile(context.Background(), "not-real-bucket", "shared.txt", strings.NewReader("remote edit!"), nil)
+	syncedObjects, syncErr := doSingleDestinationSync(mockS3Client, mockSyncConfig, lock)
+
+	assert.Nil(t, syncErr)
+	assert.Contains(t, syncedObjects.Conflict, "/shared.txt")
+	assert.Contains(t, syncedObjects.Upload, "/shared.txt")
+	assert.Equal(t, []byte("local edit"), mockS3Client.mockBodies["shared.txt"])
+	conflictCopies, globErr := filepath.Glob(filepath.Join(mockSyncConfig.SourceFolder, "shared.conflict-*.txt"))
+	assert.Nil(t, globErr)
+	assert.Len(t, conflictCopies, 1)
+	conflictCopy, readErr := ioutil.ReadFile(conflictCopies[0])
+	assert.Nil(t, readErr)
+	assert.Equal(t, "remote edit!", string(conflictCopy))
+}
+
+func TestBidirectionalRejectsKeysEscapingTheSourceFolder(t *testing.T) {
+	mockTempDir, mockS3Client, mockSyncConfig := setupBidirectionalTest(t)
+	defer os.RemoveAll(mockTempDir)
+	mockS3Client.UploadFile(context.Background(), "not-real-bucket", "../escaped", strings.NewReader("hostile"), nil)
+	mockS3Client.UploadFile(context.Background(), "not-real-bucket", "remote-only", strings.NewReader("remote"), nil)
+
+	syncedObjects, syncErr := doSingleDestinationSync(mockS3Client, mockSyncConfig, &sync.Mutex{})
+
+	assert.Nil(t, syncErr)
+	assert.ErrorContains(t, syncedObjects.Download["/../escaped"], "outside of")
+	assert.Contains(t, syncedObjects.Download, "/remote-only")
+	assert.NoFileExists(t, filepath.Join(mockTempDir, "escaped"))
+	assert.FileExists(t, filepath.Join(mockSyncConfig.SourceFolder, "remote-only"))
+}
+
+func TestBidirectionalRefusesToDownloadThroughSymlinks(t *testing.T) {
+	mockTempDir, mockS3Client, mockSyncConfig := setupBidirectionalTest(t)
+	defer os.RemoveAll(mockTempDir)
+	outside := filepath.Join(mockTempDir, "outside")
+	assert.Nil(t, os.Mkdir(outside, 0755))
+	assert.Nil(t, os.Symlink(outside, filepath.Join(mockSyncConfig.SourceFolder, "a")))
+	mockS3Client.UploadFile(context.Background(), "not-real-bucket", "a/evil", strings.NewReader("hostile"), nil)
+
+	syncedObjects, _ := doSingleDestinationSync(mockS3Client, mockSyncConfig, &sync.Mutex{})
+
+	assert.ErrorContains(t, syncedObjects.Download["/a/evil"], "symlink")
+	assert.NoFileExists(t, filepath.Join(outside, "evil"))
+}
+
+// slowDownloadClient holds downloads up long enough for anything queued alongside them to run first
+type slowDownloadClient struct {
+	*MockS3Client
+}
+
+func (c slowDownloadClient) DownloadObjectVersion(ctx context.Context, bucketName string, key string, versionID string, w io.Writer) (ObjectInfo, error) {
+	time.Sleep(100 * time.Millisecond)
+	return c.MockS3Client.DownloadObjectVersion(ctx, bucketName, key, versionID, w)
+}
+
+func TestBidirectionalKeepBothSavesRemoteCopyBeforeUploading(t *testing.T) {
+	mockTempDir, mockS3Client, mockSyncConfig := setupBidirectionalTest(t)
+	defer os.RemoveAll(mockTempDir)
+	// with several workers a separately queued upload would overwrite the remote copy mid download
+	previousQueue := workQueue
+	workQueue = NewWorkQueue(4)
+	defer func() { workQueue = previousQueue }()
+	mockSyncConfig.ConflictPolicy = ConflictKeepBoth
+	sharedPath := filepath.Join(mockSyncConfig.SourceFolder, "shared.txt")
+	assert.Nil(t, ioutil.WriteFile(sharedPath, []byte("original"), 0644))
+	client := slowDownloadClient{MockS3Client: mockS3Client}
+	_, syncErr := doSingleDestinationSync(client, mockSyncConfig, &sync.Mutex{})
+	assert.Nil(t, syncErr)
+
+	oneMinuteAgo := time.Now().Add(-1 * time.Minute)
+	assert.Nil(t, ioutil.WriteFile(sharedPath, []byte("local edit"), 0644))
+	assert.Nil(t, os.Chtimes(sharedPath, oneMinuteAgo, oneMinuteAgo))
+	mockS3Client.UploadFile(context.Background(), "not-real-bucket", "shared.txt", strings.NewReader("remote edit!"), nil)
+	_, syncErr = doSingleDestinationSync(client, mockSyncConfig, &sync.Mutex{})
+
+	assert.Nil(t, syncErr)
+	assert.Equal(t, []byte("local edit"), mockS3Client.mockBodies["shared.txt"])
+	conflictCopies, globErr := filepath.Glob(filepath.Join(mockSyncConfig.SourceFolder, "shared.conflict-*.txt"))
+	assert.Nil(t, globErr)
+	assert.Len(t, conflictCopies, 1)
+	conflictCopy, readErr := ioutil.ReadFile(conflictCopies[0])
+	assert.Nil(t, readErr)
+	assert.Equal(t, "remote edit!", string(conflictCopy))
+}
@@ -0,0 +1,577 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// backup modes
+const (
+	// BackupModeTarball uploads a full tar.gz of the source folder every run
+	BackupModeTarball = "tarball"
+	// BackupModeChunked splits files into content defined chunks that are stored once per bucket
+	BackupModeChunked = "chunked"
+)
+
+func validBackupMode(mode string) bool {
+	return mode == "" || mode == BackupModeTarball || mode == BackupModeChunked
+}
+
+// chunk boundaries are placed where a rolling gear hash has its top chunkAverageBits bits clear,
+// giving chunks of about 1MB that stay put when bytes are inserted or removed earlier in a file.
+const (
+	chunkMinSize     = 256 * 1024
+	chunkMaxSize     = 4 * 1024 * 1024
+	chunkAverageBits = 20
+	chunkMask        = uint64(1<<chunkAverageBits-1) << (64 - chunkAverageBits)
+)
+
+// chunked backups keep chunks and indexes under these prefixes of the backup bucket
+const (
+	chunkKeyPrefix      = "chunks/"
+	chunkIndexKeyPrefix = "indexes/"
+	// chunkUploadsInFlight bounds how many chunks are held in memory waiting to be uploaded
+	chunkUploadsInFlight = 16
+)
+
+// gearTable maps every byte to a pseudo random value. It must never change, or chunk boundaries
+// would move and every file would be uploaded again.
+var gearTable = func() [256]uint64 {
+	var table [256]uint64
+	// splitmix64
+	state := uint64(0x77617264656e)
+	for i := range table {
+		state += 0x9e3779b97f4a7c15
+		z := state
+		z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+		z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+		table[i] = z ^ (z >> 31)
+	}
+	return table
+}()
+
+// chunker splits a stream into content defined chunks
+type chunker struct {
+	reader *bufio.Reader
+}
+
+func newChunker(r io.Reader) *chunker {
+	return &chunker{reader: bufio.NewReaderSize(r, 64*1024)}
+}
+
+// next returns the next chunk, or io.EOF once the stream is exhausted
+func (c *chunker) next() ([]byte, error) {
+	chunk := make([]byte, 0, chunkMinSize)
+	var hash uint64
+	for len(chunk) < chunkMaxSize {
+		b, readErr := c.reader.ReadByte()
+		if readErr == io.EOF {
+			if len(chunk) == 0 {
+				return nil, io.EOF
+			}
+			return chunk, nil
+		}
+		if readErr != nil {
+			return nil, readErr
+		}
+		chunk = append(chunk, b)
+		hash = (hash << 1) + gearTable[b]
+		if len(chunk) >= chunkMinSize && hash&chunkMask == 0 {
+			return chunk, nil
+		}
+	}
+	return chunk, nil
+}
+
+// ChunkedFile is a file in a chunked backup, rebuilt by concatenating its chunks in order.
+type ChunkedFile struct {
+	// Path is relative to the backup's SourceFolder, slash separated
+	Path     string
+	Size     int64
+	ModTime  time.Time
+	Metadata map[string]string
+	Chunks   []string
+}
+
+// ChunkIndex lists every file a chunked backup run saw.
+type ChunkIndex struct {
+	CreatedAt    time.Time
+	SourceFolder string
+	Files        []ChunkedFile
+}
+
+// chunkKey is where the chunk with the given sha256 hash is stored. Hashes come from indexes in the
+// bucket, so anything but a hex encoded sha256 is refused.
+func chunkKey(hash string) (string, error) {
+	if len(hash) != sha256.Size*2 {
+		return "", fmt.Errorf("Invalid chunk hash %q", hash)
+	}
+	if _, decodeErr := hex.DecodeString(hash); decodeErr != nil {
+		return "", fmt.Errorf("Invalid chunk hash %q", hash)
+	}
+	return chunkKeyPrefix + hash[:2] + "/" + hash, nil
+}
+
+// ChunkIndexKeyPrefix is where a backup job's indexes are kept. Flattening the source folder's path
+// keeps the prefix readable but isn't unique (/data/a_b and /data_a/b both become data_a_b), so a
+// hash of the path is appended to tell jobs apart.
+func (bc BackupConfig) ChunkIndexKeyPrefix() string {
+	sum := sha256.Sum256([]byte(bc.SourceFolder))
+	keyBase := strings.TrimPrefix(strings.ReplaceAll(bc.SourceFolder, "/", "_"), "_")
+	return chunkIndexKeyPrefix + keyBase + "_" + hex.EncodeToString(sum[:8]) + "/"
+}
+
+func doChunkedBackup(ctx context.Context, client BucketClient, bc BackupConfig, notifier Notifier) {
+	now := time.Now().UTC()
+	keyBase := strings.TrimPrefix(strings.ReplaceAll(bc.SourceFolder, "/", "_"), "_")
+	indexFile, tempErr := ioutil.TempFile(os.TempDir(), fmt.Sprintf("%s_%s_*.json.gz", keyBase, now.Format(tombstoneTimeLayout)))
+	if tempErr != nil {
+		log.Error(fmt.Sprintf("Error creating backup index: %s", tempErr))
+		return
+	}
+	defer os.Remove(indexFile.Name())
+	defer indexFile.Close()
+
+	backupErr := writeChunkedBackup(ctx, client, bc, indexFile, now)
+	if backupErr != nil {
+		log.Warn(fmt.Sprintf("Chunked backup of %s failed: %s", bc.SourceFolder, backupErr))
+	}
+
+	if notifier != nil {
+		notifier.NotifyBackupResults(bc, indexFile, backupErr)
+	}
+}
+
+// writeChunkedBackup uploads the chunks of every file that aren't in the bucket yet, then writes the
+// run's index to indexFile and uploads it. Files whose size and modification time match the
+// previous index reuse its chunks without being read. Jobs with a retention collect garbage once
+// the index is up.
+func writeChunkedBackup(ctx context.Context, client BucketClient, bc BackupConfig, indexFile *os.File, now time.Time) error {
+	storeLock := chunkStoreLock(bc)
+	storeLock.Lock()
+	defer storeLock.Unlock()
+
+	fileMap, walkErr := collectFiles(bc.SourceFolder, WalkOptions{Symlinks: bc.Symlinks})
+	if walkErr != nil {
+		return fmt.Errorf("Backup directory walk failed: %s", walkErr)
+	}
+
+	previousFiles := make(map[string]ChunkedFile)
+	indexes, listErr := listChunkIndexes(ctx, client, bc)
+	if listErr != nil {
+		return fmt.Errorf("Error listing backup indexes: %s", listErr)
+	}
+	if len(indexes) != 0 {
+		previous, readErr := readChunkIndex(ctx, client, bc.DestinationBucket, indexes[len(indexes)-1].Key)
+		if readErr != nil {
+			return fmt.Errorf("Error reading backup index %s: %s", indexes[len(indexes)-1].Key, readErr)
+		}
+		for _, file := range previous.Files {
+			previousFiles[file.Path] = file
+		}
+	}
+
+	storedChunks, listedAt, chunksErr := knownChunks(ctx, client, bc, now)
+	if chunksErr != nil {
+		return chunksErr
+	}
+
+	localPaths := make([]string, 0, len(fileMap))
+	for localPath := range fileMap {
+		localPaths = append(localPaths, localPath)
+	}
+	sort.Strings(localPaths)
+
+	job := workQueue.NewJob(bc.SourceFolder, bc.Priority, bc.Concurrency)
+	inFlight := make(chan struct{}, chunkUploadsInFlight)
+	var uploadLock sync.Mutex
+	var uploadWg sync.WaitGroup
+	// chunks may still be uploading when a file can't be read, they're waited for on every return
+	defer uploadWg.Wait()
+	var uploadErr error
+	failedChunks, newChunks, newBytes := 0, 0, int64(0)
+
+	index := ChunkIndex{CreatedAt: now, SourceFolder: bc.SourceFolder, Files: make([]ChunkedFile, 0, len(localPaths))}
+	for _, localPath := range localPaths {
+		info := fileMap[localPath]
+		relativePath, relErr := filepath.Rel(bc.SourceFolder, localPath)
+		if relErr != nil {
+			return relErr
+		}
+		file := ChunkedFile{
+			Path:     filepath.ToSlash(relativePath),
+			Size:     info.Size(),
+			ModTime:  info.ModTime(),
+			Metadata: posixMetadata(localPath, info),
+		}
+
+		if info.Mode()&os.ModeSymlink != 0 {
+			linkTarget, linkErr := os.Readlink(localPath)
+			if os.IsNotExist(linkErr) {
+				log.Info(fmt.Sprintf("%s was removed during the backup, skipping it", localPath))
+				continue
+			}
+			if linkErr != nil {
+				return fmt.Errorf("Error reading symlink %s: %s", localPath, linkErr)
+			}
+			file.Metadata[metadataSymlinkTarget] = linkTarget
+			index.Files = append(index.Files, file)
+			continue
+		}
+
+		if previous, ok := previousFiles[file.Path]; ok && previous.Size == file.Size && previous.ModTime.Equal(file.ModTime) {
+			file.Chunks = previous.Chunks
+			index.Files = append(index.Files, file)
+			continue
+		}
+
+		localFile, openErr := os.Open(localPath)
+		if os.IsNotExist(openErr) {
+			log.Info(fmt.Sprintf("%s was removed during the backup, skipping it", localPath))
+			continue
+		}
+		if openErr != nil {
+			return fmt.Errorf("Error opening %s: %s", localPath, openErr)
+		}
+		file.Chunks = make([]string, 0)
+		fileChunker := newChunker(localFile)
+		for {
+			chunk, chunkErr := fileChunker.next()
+			if chunkErr == io.EOF {
+				break
+			}
+			if chunkErr != nil {
+				localFile.Close()
+				return fmt.Errorf("Error reading %s: %s", localPath, chunkErr)
+			}
+			sum := sha256.Sum256(chunk)
+			hash := hex.EncodeToString(sum[:])
+			file.Chunks = append(file.Chunks, hash)
+			if storedChunks[hash] {
+				continue
+			}
+
+			storedChunks[hash] = true
+			newChunks++
+			newBytes += int64(len(chunk))
+			// the hash was just computed, so it's always valid
+			key, _ := chunkKey(hash)
+			inFlight <- struct{}{}
+			uploadWg.Add(1)
+			job.Submit(func() {
+				defer uploadWg.Done()
+				defer func() { <-inFlight }()
+				if putErr := client.UploadFile(ctx, bc.DestinationBucket, key, bytes.NewReader(chunk), nil); putErr != nil {
+					log.Warn(fmt.Sprintf("Error uploading chunk %s: %s", hash, putErr))
+					uploadLock.Lock()
+					failedChunks++
+					uploadErr = putErr
+					uploadLock.Unlock()
+				}
+			})
+		}
+		localFile.Close()
+		index.Files = append(index.Files, file)
+	}
+	uploadWg.Wait()
+	if failedChunks != 0 {
+		return fmt.Errorf("%d of %d new chunks failed to upload: %s", failedChunks, newChunks, uploadErr)
+	}
+
+	gzipWriter := gzip.NewWriter(indexFile)
+	if encodeErr := json.NewEncoder(gzipWriter).Encode(index); encodeErr != nil {
+		return encodeErr
+	}
+	if closeErr := gzipWriter.Close(); closeErr != nil {
+		return closeErr
+	}
+	if _, seekErr := indexFile.Seek(0, io.SeekStart); seekErr != nil {
+		return seekErr
+	}
+	// runs less than a second apart would overwrite each other's index with a second precision key
+	indexKey := bc.ChunkIndexKeyPrefix() + now.Format(tombstoneKeyTimeLayout) + ".json.gz"
+	if putErr := client.UploadFile(ctx, bc.DestinationBucket, indexKey, indexFile, nil); putErr != nil {
+		return fmt.Errorf("Error uploading backup index: %s", putErr)
+	}
+	if cacheErr := writeChunkCache(bc, storedChunks, listedAt); cacheErr != nil {
+		log.Warn(fmt.Sprintf("Error saving chunk cache: %s", cacheErr))
+	}
+
+	log.Info(fmt.Sprintf("Chunked backup of %s complete: %d files, %d new chunks, %d new bytes", bc.SourceFolder, len(index.Files), newChunks, newBytes))
+	if bc.Retention > 0 {
+		expired, swept, gcErr := collectChunkGarbage(ctx, client, bc, now)
+		if gcErr != nil {
+			return fmt.Errorf("Error collecting chunk garbage: %s", gcErr)
+		}
+		log.Info(fmt.Sprintf("Deleted %d backup indexes older than %d days and %d unreferenced chunks from %s", expired, bc.Retention, swept, bc.DestinationBucket))
+	}
+	return nil
+}
+
+// chunkStoreLocks serializes chunked backups writing to the same bucket. A sweep must never run
+// while another backup is between uploading chunks and uploading the index that references them.
+var chunkStoreLocks sync.Map
+
+func chunkStoreLock(bc BackupConfig) *sync.Mutex {
+	lock, _ := chunkStoreLocks.LoadOrStore(providerIDOrDefault(bc.Provider)+"/"+bc.DestinationBucket, &sync.Mutex{})
+	return lock.(*sync.Mutex)
+}
+
+// chunkCacheMaxAge is how long the chunk cache is trusted before the chunk store is listed again,
+// chunks removed behind warden's back are uploaded again after at most this long.
+const chunkCacheMaxAge = 7 * 24 * time.Hour
+
+// chunkCache records the chunks known to be in a bucket, so a run doesn't have to list the whole
+// chunk store. Chunked backups writing to the same bucket share it.
+type chunkCache struct {
+	ListedAt time.Time
+	Chunks   []string
+}
+
+func chunkCachePath(bc BackupConfig) string {
+	return filepath.Join(stateDirectory, "chunks", stateFileName(".json", providerIDOrDefault(bc.Provider), bc.DestinationBucket))
+}
+
+// knownChunks returns the hashes of the chunks stored in the bucket and when they were last listed.
+// The chunk cache is used while it's fresh, otherwise the chunk store is listed.
+func knownChunks(ctx context.Context, client BucketClient, bc BackupConfig, now time.Time) (map[string]bool, time.Time, error) {
+	var cache chunkCache
+	if readErr := readStateFile(chunkCachePath(bc), &cache); readErr != nil {
+		log.Warn(fmt.Sprintf("Error reading chunk cache, listing chunks instead: %s", readErr))
+		cache = chunkCache{}
+	}
+	storedChunks := make(map[string]bool, len(cache.Chunks))
+	if !cache.ListedAt.IsZero() && now.Sub(cache.ListedAt) < chunkCacheMaxAge {
+		for _, hash := range cache.Chunks {
+			storedChunks[hash] = true
+		}
+		return storedChunks, cache.ListedAt, nil
+	}
+
+	chunkWalkErr := client.WalkObjects(ctx, bc.DestinationBucket, ListOptions{Prefix: chunkKeyPrefix}, func(key string, objectInfo ObjectInfo) error {
+		storedChunks[path.Base(key)] = true
+		return nil
+	})
+	if chunkWalkErr != nil {
+		return nil, now, fmt.Errorf("Error listing chunks: %s", chunkWalkErr)
+	}
+	return storedChunks, now, nil
+}
+
+func writeChunkCache(bc BackupConfig, storedChunks map[string]bool, listedAt time.Time) error {
+	cache := chunkCache{ListedAt: listedAt, Chunks: make([]string, 0, len(storedChunks))}
+	for hash := range storedChunks {
+		cache.Chunks = append(cache.Chunks, hash)
+	}
+	sort.Strings(cache.Chunks)
+	return writeStateFile(chunkCachePath(bc), cache)
+}
+
+// collectChunkGarbage deletes the job's indexes older than its retention, the latest index is always
+// kept. When any expire the chunk store is marked and swept: every index left in the bucket, those
+// of other chunked backups included, marks the chunks it references and unmarked chunks are
+// deleted. Returns how many indexes and chunks were deleted.
+func collectChunkGarbage(ctx context.Context, client BucketClient, bc BackupConfig, now time.Time) (int, int, error) {
+	indexes, listErr := listChunkIndexes(ctx, client, bc)
+	if listErr != nil {
+		return 0, 0, fmt.Errorf("Error listing backup indexes: %s", listErr)
+	}
+	cutoff := now.Add(-time.Duration(bc.Retention) * 24 * time.Hour)
+	expiredKeys := make([]string, 0)
+	for i, index := range indexes {
+		if i < len(indexes)-1 && index.CreatedAt.Before(cutoff) {
+			expiredKeys = append(expiredKeys, index.Key)
+		}
+	}
+	if len(expiredKeys) == 0 {
+		return 0, 0, nil
+	}
+	for _, batch := range deleteBatches(expiredKeys) {
+		for key, delErr := range client.DeleteObjects(ctx, bc.DestinationBucket, batch) {
+			return 0, 0, fmt.Errorf("Error deleting backup index %s: %s", key, delErr)
+		}
+	}
+
+	// a partial mark would sweep chunks that are still referenced, so any error stops the sweep
+	markedChunks := make(map[string]bool)
+	indexKeys := make([]string, 0)
+	indexWalkErr := client.WalkObjects(ctx, bc.DestinationBucket, ListOptions{Prefix: chunkIndexKeyPrefix}, func(key string, objectInfo ObjectInfo) error {
+		if strings.HasSuffix(key, ".json.gz") {
+			indexKeys = append(indexKeys, key)
+		}
+		return nil
+	})
+	if indexWalkErr != nil {
+		return len(expiredKeys), 0, fmt.Errorf("Error listing backup indexes: %s", indexWalkErr)
+	}
+	for _, indexKey := range indexKeys {
+		index, readErr := readChunkIndex(ctx, client, bc.DestinationBucket, indexKey)
+		if readErr != nil {
+			return len(expiredKeys), 0, fmt.Errorf("Error reading backup index %s: %s", indexKey, readErr)
+		}
+		for _, file := range index.Files {
+			for _, hash := range file.Chunks {
+				markedChunks[hash] = true
+			}
+		}
+	}
+
+	storedChunks := make(map[string]bool)
+	garbageKeys := make([]string, 0)
+	chunkWalkErr := client.WalkObjects(ctx, bc.DestinationBucket, ListOptions{Prefix: chunkKeyPrefix}, func(key string, objectInfo ObjectInfo) error {
+		if hash := path.Base(key); markedChunks[hash] {
+			storedChunks[hash] = true
+		} else {
+			garbageKeys = append(garbageKeys, key)
+		}
+		return nil
+	})
+	if chunkWalkErr != nil {
+		return len(expiredKeys), 0, fmt.Errorf("Error listing chunks: %s", chunkWalkErr)
+	}
+	failed := 0
+	for _, batch := range deleteBatches(garbageKeys) {
+		for key, delErr := range client.DeleteObjects(ctx, bc.DestinationBucket, batch) {
+			log.Warn(fmt.Sprintf("Error deleting chunk %s: %s", key, delErr))
+			storedChunks[path.Base(key)] = true
+			failed++
+		}
+	}
+	// the sweep listed every chunk, so the cache starts over from it
+	if cacheErr := writeChunkCache(bc, storedChunks, now); cacheErr != nil {
+		log.Warn(fmt.Sprintf("Error saving chunk cache: %s", cacheErr))
+	}
+	if failed != 0 {
+		return len(expiredKeys), len(garbageKeys) - failed, fmt.Errorf("%d of %d unreferenced chunks could not be deleted", failed, len(garbageKeys))
+	}
+
+	return len(expiredKeys), len(garbageKeys), nil
+}
+
+// listChunkIndexes returns a backup job's indexes, oldest first.
+func listChunkIndexes(ctx context.Context, client BucketClient, bc BackupConfig) ([]SnapshotInfo, error) {
+	indexes := make([]SnapshotInfo, 0)
+	listOpts := ListOptions{Prefix: bc.ChunkIndexKeyPrefix(), Delimiter: "/"}
+	walkErr := client.WalkObjects(ctx, bc.DestinationBucket, listOpts, func(key string, objectInfo ObjectInfo) error {
+		if objectInfo.IsPrefix {
+			return nil
+		}
+		name := strings.TrimSuffix(strings.TrimPrefix(key, listOpts.Prefix), ".json.gz")
+		createdAt, parseErr := time.Parse(tombstoneTimeLayout, name)
+		if parseErr != nil {
+			return nil
+		}
+		indexes = append(indexes, SnapshotInfo{Key: key, CreatedAt: createdAt})
+		return nil
+	})
+	sort.Slice(indexes, func(i, j int) bool {
+		return indexes[i].CreatedAt.Before(indexes[j].CreatedAt)
+	})
+
+	return indexes, walkErr
+}
+
+func readChunkIndex(ctx context.Context, client BucketClient, bucket, key string) (ChunkIndex, error) {
+	var index ChunkIndex
+	indexData := &bytes.Buffer{}
+	if _, downloadErr := client.DownloadObject(ctx, bucket, key, indexData); downloadErr != nil {
+		return index, downloadErr
+	}
+	gzipReader, gzipErr := gzip.NewReader(indexData)
+	if gzipErr != nil {
+		return index, gzipErr
+	}
+	decodeErr := json.NewDecoder(gzipReader).Decode(&index)
+	return index, decodeErr
+}
+
+// doRestoreChunkedBackup rebuilds the files of a chunked backup under targetFolder, narrowed to
+// subPrefix relative to SourceFolder when it's set. Chunks are checked against their hash as they
+// are downloaded. Per path results are returned.
+func doRestoreChunkedBackup(ctx context.Context, client BucketClient, bc BackupConfig, index ChunkIndex, targetFolder, subPrefix string) map[string]error {
+	restoreResults := make(map[string]error)
+	subPrefix = strings.Trim(subPrefix, "/")
+	for _, file := range index.Files {
+		if subPrefix != "" && file.Path != subPrefix && !strings.HasPrefix(file.Path, subPrefix+"/") {
+			continue
+		}
+		localPath, restoreErr := containedPath(targetFolder, file.Path)
+		if restoreErr == nil {
+			restoreErr = restoreChunkedFile(ctx, client, bc.DestinationBucket, file, targetFolder, localPath)
+		}
+		if restoreErr != nil {
+			log.Warn(fmt.Sprintf("Error restoring %s to %s: %s", file.Path, targetFolder, restoreErr))
+		} else {
+			log.Info(fmt.Sprintf("Restored %s to %s", file.Path, localPath))
+		}
+		restoreResults[file.Path] = restoreErr
+	}
+
+	return restoreResults
+}
+
+// restoreChunkedFile writes a file to a temp file next to localPath and renames it into place, like
+// restoreObject does for synced objects.
+func restoreChunkedFile(ctx context.Context, client BucketClient, bucket string, file ChunkedFile, folder, localPath string) error {
+	if mkdirErr := mkdirContained(folder, filepath.Dir(localPath)); mkdirErr != nil {
+		return mkdirErr
+	}
+
+	if linkTarget, ok := file.Metadata[metadataSymlinkTarget]; ok {
+		if removeErr := os.Remove(localPath); removeErr != nil && !os.IsNotExist(removeErr) {
+			return removeErr
+		}
+		if linkErr := os.Symlink(linkTarget, localPath); linkErr != nil {
+			return linkErr
+		}
+		return applyPosixMetadata(localPath, file.Metadata)
+	}
+
+	tempFile, tempErr := ioutil.TempFile(filepath.Dir(localPath), ".warden-restore-*")
+	if tempErr != nil {
+		return tempErr
+	}
+	defer os.Remove(tempFile.Name())
+
+	for _, hash := range file.Chunks {
+		key, keyErr := chunkKey(hash)
+		if keyErr != nil {
+			tempFile.Close()
+			return keyErr
+		}
+		hasher := sha256.New()
+		if _, downloadErr := client.DownloadObject(ctx, bucket, key, io.MultiWriter(tempFile, hasher)); downloadErr != nil {
+			tempFile.Close()
+			return fmt.Errorf("Error downloading chunk %s: %s", hash, downloadErr)
+		}
+		if hex.EncodeToString(hasher.Sum(nil)) != hash {
+			tempFile.Close()
+			return fmt.Errorf("Chunk %s is corrupt", hash)
+		}
+	}
+	if closeErr := tempFile.Close(); closeErr != nil {
+		return closeErr
+	}
+
+	if renameErr := os.Rename(tempFile.Name(), localPath); renameErr != nil {
+		return renameErr
+	}
+	return applyPosixMetadata(localPath, file.Metadata)
+}
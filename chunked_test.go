@@ -0,0 +1,363 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func chunkHashes(t *testing.T, data []byte) [][32]byte {
+	hashes := make([][32]byte, 0)
+	dataChunker := newChunker(bytes.NewReader(data))
+	for {
+		chunk, chunkErr := dataChunker.next()
+		if chunkErr == io.EOF {
+			return hashes
+		}
+		assert.Nil(t, chunkErr)
+		assert.LessOrEqual(t, len(chunk), chunkMaxSize)
+		hashes = append(hashes, sha256.Sum256(chunk))
+	}
+}
+
+func countChunkUploads(client *MockS3Client) int {
+	uploads := 0
+	for _, request := range client.UploadRequests {
+		if strings.HasPrefix(request.Key, chunkKeyPrefix) {
+			uploads++
+		}
+	}
+	return uploads
+}
+
+func TestChunkBoundariesSurviveInsertions(t *testing.T) {
+	data := make([]byte, 8*1024*1024)
+	rand.New(rand.NewSource(1)).Read(data)
+	original := chunkHashes(t, data)
+
+	edited := append(append(append([]byte{}, data[:1000]...), []byte("inserted bytes")...), data[1000:]...)
+	shifted := chunkHashes(t, edited)
+
+	assert.Greater(t, len(original), 2)
+	unchanged := 0
+	for _, hash := range shifted {
+		for _, originalHash := range original {
+			if hash == originalHash {
+				unchanged++
+				break
+			}
+		}
+	}
+	// only the chunk holding the insertion should differ
+	assert.GreaterOrEqual(t, unchanged, len(original)-1)
+}
+
+func TestChunkedBackupUploadsOnlyNewChunks(t *testing.T) {
+	mockTempDir, mockTempDirErr := ioutil.TempDir(os.TempDir(), "go-test-stuff")
+	assert.Nil(t, mockTempDirErr)
+	defer os.RemoveAll(mockTempDir)
+	restoreDir, restoreDirErr := ioutil.TempDir(os.TempDir(), "go-test-stuff")
+	assert.Nil(t, restoreDirErr)
+	defer os.RemoveAll(restoreDir)
+
+	// chunks are capped at chunkMaxSize, so 8MB of seeded data always spans several
+	bigData := make([]byte, 8*1024*1024)
+	rand.New(rand.NewSource(2)).Read(bigData)
+	bigChunks := chunkHashes(t, bigData)
+	assert.Greater(t, len(bigChunks), 2)
+	assert.Nil(t, os.MkdirAll(filepath.Join(mockTempDir, "share"), os.ModePerm))
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(mockTempDir, "share/big.bin"), bigData, 0644))
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(mockTempDir, "small.txt"), []byte("small file"), 0600))
+
+	concreteWalkFunc = walkDirectory
+	stateDirectory = t.TempDir()
+	mockClient := NewMockClient(map[string]ObjectInfo{})
+	mockBackupConfig := BackupConfig{
+		SourceFolder:      mockTempDir,
+		DestinationBucket: "notatallarealbucket",
+		Mode:              BackupModeChunked,
+		At:                "*/1 * * * *",
+	}
+	monday := time.Date(2023, 5, 1, 12, 0, 0, 0, time.UTC)
+	runBackup := func(at time.Time) {
+		indexFile, tempErr := ioutil.TempFile(os.TempDir(), "go-test-index")
+		assert.Nil(t, tempErr)
+		defer os.Remove(indexFile.Name())
+		defer indexFile.Close()
+		assert.Nil(t, writeChunkedBackup(context.Background(), mockClient, mockBackupConfig, indexFile, at))
+	}
+
+	runBackup(monday)
+	firstUploads := countChunkUploads(mockClient)
+	// every chunk of the big file plus the small file's single chunk
+	assert.Equal(t, len(bigChunks)+1, firstUploads)
+
+	// nothing changed, only the index is uploaded
+	runBackup(monday.Add(24 * time.Hour))
+	assert.Equal(t, firstUploads, countChunkUploads(mockClient))
+
+	// appending to the file only changes its last chunk
+	editedData := append(append([]byte{}, bigData...), []byte("appended")...)
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(mockTempDir, "share/big.bin"), editedData, 0644))
+	assert.Nil(t, os.Chtimes(filepath.Join(mockTempDir, "share/big.bin"), monday, monday.Add(48*time.Hour)))
+	runBackup(monday.Add(48 * time.Hour))
+	assert.Equal(t, firstUploads+1, countChunkUploads(mockClient))
+
+	indexes, listErr := listChunkIndexes(context.Background(), mockClient, mockBackupConfig)
+	assert.Nil(t, listErr)
+	assert.Len(t, indexes, 3)
+	selected, ok := snapshotAt(indexes, monday.Add(30*time.Hour))
+	assert.True(t, ok)
+	index, readErr := readChunkIndex(context.Background(), mockClient, "notatallarealbucket", selected.Key)
+	assert.Nil(t, readErr)
+
+	restoreResults := doRestoreChunkedBackup(context.Background(), mockClient, mockBackupConfig, index, restoreDir, "")
+	assert.Equal(t, map[string]error{"share/big.bin": nil, "small.txt": nil}, restoreResults)
+	restored, readFileErr := ioutil.ReadFile(filepath.Join(restoreDir, "share/big.bin"))
+	assert.Nil(t, readFileErr)
+	assert.True(t, bytes.Equal(bigData, restored))
+	restoredInfo, statErr := os.Stat(filepath.Join(restoreDir, "small.txt"))
+	assert.Nil(t, statErr)
+	assert.Equal(t, os.FileMode(0600), restoredInfo.Mode().Perm())
+}
+
+func validChunkKey(t *testing.T, hash string) string {
+	key, keyErr := chunkKey(hash)
+	assert.Nil(t, keyErr)
+	return key
+}
+
+func TestChunkKeyRefusesInvalidHashes(t *testing.T) {
+	sum := sha256.Sum256([]byte("data"))
+	hash := hex.EncodeToString(sum[:])
+	assert.Equal(t, "chunks/"+hash[:2]+"/"+hash, validChunkKey(t, hash))
+	for _, invalid := range []string{"", "a", hash[:63], hash + "0", "../" + hash[3:], strings.Replace(hash, hash[:1], "g", 1)} {
+		_, keyErr := chunkKey(invalid)
+		assert.ErrorContains(t, keyErr, "Invalid chunk hash", invalid)
+	}
+}
+
+func TestChunkedRestoreRefusesInvalidChunkHashes(t *testing.T) {
+	restoreDir := t.TempDir()
+	mockClient := NewMockClient(map[string]ObjectInfo{})
+	// a tampered index can name anything as a chunk
+	index := ChunkIndex{Files: []ChunkedFile{{Path: "file", Size: 4, Chunks: []string{"a"}}}}
+
+	restoreResults := doRestoreChunkedBackup(context.Background(), mockClient, BackupConfig{DestinationBucket: "notatallarealbucket"}, index, restoreDir, "")
+
+	assert.ErrorContains(t, restoreResults["file"], "Invalid chunk hash")
+	assert.NoFileExists(t, filepath.Join(restoreDir, "file"))
+}
+
+func TestChunkedRestoreDetectsCorruptChunks(t *testing.T) {
+	restoreDir, restoreDirErr := ioutil.TempDir(os.TempDir(), "go-test-stuff")
+	assert.Nil(t, restoreDirErr)
+	defer os.RemoveAll(restoreDir)
+
+	mockClient := NewMockClient(map[string]ObjectInfo{})
+	sum := sha256.Sum256([]byte("original"))
+	hash := hex.EncodeToString(sum[:])
+	mockClient.UploadFile(context.Background(), "notatallarealbucket", validChunkKey(t, hash), strings.NewReader("tampered"), nil)
+	index := ChunkIndex{Files: []ChunkedFile{{Path: "file", Size: 8, Chunks: []string{hash}}}}
+
+	restoreResults := doRestoreChunkedBackup(context.Background(), mockClient, BackupConfig{DestinationBucket: "notatallarealbucket"}, index, restoreDir, "")
+
+	assert.ErrorContains(t, restoreResults["file"], "corrupt")
+	_, statErr := os.Stat(filepath.Join(restoreDir, "file"))
+	assert.True(t, os.IsNotExist(statErr))
+}
+
+func TestChunkedRestoreRejectsPathsEscapingTheTarget(t *testing.T) {
+	mockTempDir := t.TempDir()
+	mockClient := NewMockClient(map[string]ObjectInfo{})
+	sum := sha256.Sum256([]byte("data"))
+	hash := hex.EncodeToString(sum[:])
+	mockClient.UploadFile(context.Background(), "notatallarealbucket", validChunkKey(t, hash), strings.NewReader("data"), nil)
+	// a tampered index can name any path
+	index := ChunkIndex{Files: []ChunkedFile{
+		{Path: "../../etc/cron.d/x", Size: 4, Chunks: []string{hash}},
+		{Path: "docs/file", Size: 4, Chunks: []string{hash}},
+	}}
+
+	restoreDir := filepath.Join(mockTempDir, "restore")
+	restoreResults := doRestoreChunkedBackup(context.Background(), mockClient, BackupConfig{DestinationBucket: "notatallarealbucket"}, index, restoreDir, "")
+
+	assert.ErrorContains(t, restoreResults["../../etc/cron.d/x"], "outside of")
+	assert.Nil(t, restoreResults["docs/file"])
+	assert.NoDirExists(t, filepath.Join(mockTempDir, "etc"))
+	assert.FileExists(t, filepath.Join(restoreDir, "docs", "file"))
+}
+
+func TestChunkedRestoreRefusesToWriteThroughRestoredSymlinks(t *testing.T) {
+	mockTempDir := t.TempDir()
+	outside := filepath.Join(mockTempDir, "outside")
+	assert.Nil(t, os.Mkdir(outside, 0755))
+	mockClient := NewMockClient(map[string]ObjectInfo{})
+	sum := sha256.Sum256([]byte("evil"))
+	hash := hex.EncodeToString(sum[:])
+	mockClient.UploadFile(context.Background(), "notatallarealbucket", validChunkKey(t, hash), strings.NewReader("evil"), nil)
+	// a symlink pointing outside of the target, then a file under it
+	index := ChunkIndex{Files: []ChunkedFile{
+		{Path: "a", Metadata: map[string]string{metadataSymlinkTarget: outside}},
+		{Path: "a/evil", Size: 4, Chunks: []string{hash}},
+	}}
+
+	restoreDir := filepath.Join(mockTempDir, "restore")
+	restoreResults := doRestoreChunkedBackup(context.Background(), mockClient, BackupConfig{DestinationBucket: "notatallarealbucket"}, index, restoreDir, "")
+
+	assert.Nil(t, restoreResults["a"])
+	assert.ErrorContains(t, restoreResults["a/evil"], "symlink")
+	assert.NoFileExists(t, filepath.Join(outside, "evil"))
+}
+
+func TestChunkedBackupSkipsFilesRemovedDuringTheRun(t *testing.T) {
+	mockTempDir := t.TempDir()
+	stateDirectory = t.TempDir()
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(mockTempDir, "kept.txt"), []byte("kept"), 0644))
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(mockTempDir, "removed.txt"), []byte("removed"), 0644))
+
+	// the file is removed after the walk saw it
+	concreteWalkFunc = func(folder string, opts WalkOptions, fn FileWalkFunc) error {
+		walkErr := walkDirectory(folder, opts, fn)
+		assert.Nil(t, os.Remove(filepath.Join(mockTempDir, "removed.txt")))
+		return walkErr
+	}
+	mockClient := NewMockClient(map[string]ObjectInfo{})
+	mockBackupConfig := BackupConfig{SourceFolder: mockTempDir, DestinationBucket: "notatallarealbucket", Mode: BackupModeChunked}
+	indexFile, tempErr := ioutil.TempFile(t.TempDir(), "go-test-index")
+	assert.Nil(t, tempErr)
+	defer indexFile.Close()
+
+	assert.Nil(t, writeChunkedBackup(context.Background(), mockClient, mockBackupConfig, indexFile, time.Now()))
+
+	indexes, listErr := listChunkIndexes(context.Background(), mockClient, mockBackupConfig)
+	assert.Nil(t, listErr)
+	assert.Len(t, indexes, 1)
+	index, readErr := readChunkIndex(context.Background(), mockClient, "notatallarealbucket", indexes[0].Key)
+	assert.Nil(t, readErr)
+	assert.Len(t, index.Files, 1)
+	assert.Equal(t, "kept.txt", index.Files[0].Path)
+}
+
+func TestChunkedBackupsKeepTheirIndexesApart(t *testing.T) {
+	mockTempDir := t.TempDir()
+	stateDirectory = t.TempDir()
+	concreteWalkFunc = walkDirectory
+	// both folders flatten to the same name
+	underscoredFolder := filepath.Join(mockTempDir, "data", "a_b")
+	nestedFolder := filepath.Join(mockTempDir, "data_a", "b")
+	assert.Nil(t, os.MkdirAll(underscoredFolder, os.ModePerm))
+	assert.Nil(t, os.MkdirAll(nestedFolder, os.ModePerm))
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(underscoredFolder, "file.txt"), []byte("a_b"), 0644))
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(nestedFolder, "file.txt"), []byte("b"), 0644))
+	mockClient := NewMockClient(map[string]ObjectInfo{})
+	underscoredConfig := BackupConfig{SourceFolder: underscoredFolder, DestinationBucket: "notatallarealbucket", Mode: BackupModeChunked}
+	nestedConfig := BackupConfig{SourceFolder: nestedFolder, DestinationBucket: "notatallarealbucket", Mode: BackupModeChunked}
+	assert.NotEqual(t, underscoredConfig.ChunkIndexKeyPrefix(), nestedConfig.ChunkIndexKeyPrefix())
+	runBackup := func(bc BackupConfig, at time.Time) {
+		indexFile, tempErr := ioutil.TempFile(t.TempDir(), "go-test-index")
+		assert.Nil(t, tempErr)
+		defer indexFile.Close()
+		assert.Nil(t, writeChunkedBackup(context.Background(), mockClient, bc, indexFile, at))
+	}
+
+	// runs less than a second apart each keep their index
+	now := time.Date(2023, 5, 1, 12, 0, 0, 0, time.UTC)
+	runBackup(underscoredConfig, now)
+	runBackup(underscoredConfig, now.Add(100*time.Millisecond))
+	runBackup(nestedConfig, now)
+
+	indexes, listErr := listChunkIndexes(context.Background(), mockClient, underscoredConfig)
+	assert.Nil(t, listErr)
+	assert.Len(t, indexes, 2)
+	assert.Equal(t, now.Add(100*time.Millisecond), indexes[1].CreatedAt)
+	indexes, listErr = listChunkIndexes(context.Background(), mockClient, nestedConfig)
+	assert.Nil(t, listErr)
+	assert.Len(t, indexes, 1)
+	index, readErr := readChunkIndex(context.Background(), mockClient, "notatallarealbucket", indexes[0].Key)
+	assert.Nil(t, readErr)
+	assert.Equal(t, nestedFolder, index.SourceFolder)
+}
+
+func TestChunkedBackupCollectsGarbage(t *testing.T) {
+	mockTempDir := t.TempDir()
+	stateDirectory = filepath.Join(mockTempDir, "state")
+	sourceFolder := filepath.Join(mockTempDir, "share")
+	otherFolder := filepath.Join(mockTempDir, "other")
+	assert.Nil(t, os.MkdirAll(sourceFolder, os.ModePerm))
+	assert.Nil(t, os.MkdirAll(otherFolder, os.ModePerm))
+
+	oldData := make([]byte, 2*1024*1024)
+	rand.New(rand.NewSource(3)).Read(oldData)
+	newData := make([]byte, 2*1024*1024)
+	rand.New(rand.NewSource(4)).Read(newData)
+	sharedData := make([]byte, 1024*1024)
+	rand.New(rand.NewSource(5)).Read(sharedData)
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(sourceFolder, "file.bin"), oldData, 0644))
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(sourceFolder, "shared.bin"), sharedData, 0644))
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(otherFolder, "shared.bin"), sharedData, 0644))
+
+	concreteWalkFunc = walkDirectory
+	mockClient := NewMockClient(map[string]ObjectInfo{})
+	mockBackupConfig := BackupConfig{SourceFolder: sourceFolder, DestinationBucket: "notatallarealbucket", Mode: BackupModeChunked, Retention: 1}
+	otherBackupConfig := BackupConfig{SourceFolder: otherFolder, DestinationBucket: "notatallarealbucket", Mode: BackupModeChunked}
+	monday := time.Date(2023, 5, 1, 12, 0, 0, 0, time.UTC)
+	runBackup := func(bc BackupConfig, at time.Time) {
+		indexFile, tempErr := ioutil.TempFile(mockTempDir, "go-test-index")
+		assert.Nil(t, tempErr)
+		defer indexFile.Close()
+		assert.Nil(t, writeChunkedBackup(context.Background(), mockClient, bc, indexFile, at))
+	}
+
+	runBackup(mockBackupConfig, monday)
+	assert.Contains(t, mockClient.ListPrefixes, chunkKeyPrefix)
+	// the other backup finds its chunk in the cache instead of listing the chunk store
+	listed := len(mockClient.ListPrefixes)
+	runBackup(otherBackupConfig, monday)
+	assert.NotContains(t, mockClient.ListPrefixes[listed:], chunkKeyPrefix)
+	storedBefore := countChunkUploads(mockClient)
+
+	// the file is replaced, its old chunks are only referenced by the first index
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(sourceFolder, "file.bin"), newData, 0644))
+	assert.Nil(t, os.Chtimes(filepath.Join(sourceFolder, "file.bin"), monday, monday.Add(48*time.Hour)))
+	runBackup(mockBackupConfig, monday.Add(48*time.Hour))
+
+	indexes, listErr := listChunkIndexes(context.Background(), mockClient, mockBackupConfig)
+	assert.Nil(t, listErr)
+	assert.Len(t, indexes, 1)
+	assert.Equal(t, monday.Add(48*time.Hour), indexes[0].CreatedAt)
+	storedChunks := make(map[string]bool)
+	for key := range mockClient.mockList {
+		if strings.HasPrefix(key, chunkKeyPrefix) {
+			storedChunks[path.Base(key)] = true
+		}
+	}
+	expectedChunks := make(map[string]bool)
+	for _, data := range [][]byte{newData, sharedData} {
+		for _, hash := range chunkHashes(t, data) {
+			expectedChunks[hex.EncodeToString(hash[:])] = true
+		}
+	}
+	assert.Equal(t, expectedChunks, storedChunks)
+	assert.Greater(t, countChunkUploads(mockClient), storedBefore)
+
+	// the swept chunks are gone from the cache too, so they are uploaded again when they come back
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(sourceFolder, "file.bin"), oldData, 0644))
+	assert.Nil(t, os.Chtimes(filepath.Join(sourceFolder, "file.bin"), monday, monday.Add(72*time.Hour)))
+	runBackup(mockBackupConfig, monday.Add(72*time.Hour))
+	for _, hash := range chunkHashes(t, oldData) {
+		assert.Contains(t, mockClient.mockList, validChunkKey(t, hex.EncodeToString(hash[:])))
+	}
+}
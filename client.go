@@ -1,18 +1,136 @@
 package main
 
 import (
-	"os"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
 	"time"
 )
 
+// metadataSymlinkTarget marks an object as a symlink preserved by a sync or backup. The object body
+// is the link target as well so size comparisons keep working with listings that have no metadata.
+const metadataSymlinkTarget = "warden-symlink-target"
+
+// deleteBatchSize is the most keys passed to a single DeleteObjects call, it matches the S3 limit for
+// a multi-object delete.
+const deleteBatchSize = 1000
+
+// ErrStopWalk can be returned from an ObjectWalkFunc to stop walking a bucket early without
+// WalkObjects returning an error.
+var ErrStopWalk = errors.New("stop walking objects")
+
 type BucketClient interface {
-	ListObjects(string) (map[string]ObjectInfo, error)
-	UploadFile(bucketName string, key string, file *os.File) error
-	CopyObject(sourceBucket string, destinationBucket string, key string) error
-	DeleteObject(bucket string, key string) error
+	WalkObjects(ctx context.Context, bucketName string, opts ListOptions, walkFn ObjectWalkFunc) error
+	UploadFile(ctx context.Context, bucketName string, key string, body io.Reader, metadata map[string]string) error
+	DownloadObject(ctx context.Context, bucketName string, key string, w io.Writer) (ObjectInfo, error)
+	// DownloadObjectVersion downloads a specific version of an object, as returned by ObjectVersion.
+	// This includes versions that are no longer current because the object was deleted.
+	DownloadObjectVersion(ctx context.Context, bucketName string, key string, versionID string, w io.Writer) (ObjectInfo, error)
+	// ObjectMetadata returns the metadata stored with an object without downloading it, nil when it
+	// was stored without any.
+	ObjectMetadata(ctx context.Context, bucketName string, key string) (map[string]string, error)
+	CopyObject(ctx context.Context, sourceBucket, sourceKey, destinationBucket, destinationKey string, opts CopyOptions) error
+	DeleteObject(ctx context.Context, bucket string, key string) error
+	// DeleteObjects deletes up to deleteBatchSize keys and returns the error for each key that
+	// couldn't be deleted. Keys missing from the result were deleted.
+	DeleteObjects(ctx context.Context, bucket string, keys []string) map[string]error
+	// ObjectVersion returns the current version of an object, or an empty string when the bucket
+	// doesn't have versioning enabled.
+	ObjectVersion(ctx context.Context, bucket string, key string) (string, error)
+	// DeleteObjectVersioned deletes an object from a versioned bucket and returns the version the
+	// delete made noncurrent, taken from the delete itself so an object replaced just before it's
+	// deleted is never recorded with a stale version. Callers check the bucket is versioned with
+	// ObjectVersion first, providers that can't tell after the fact would delete it for good.
+	DeleteObjectVersioned(ctx context.Context, bucket string, key string) (string, error)
+}
+
+// CopyOptions changes how CopyObject writes the destination object. Empty fields keep the
+// provider's defaults.
+type CopyOptions struct {
+	StorageClass string
+	// SourceVersion copies a specific version of the source object rather than the current one
+	SourceVersion string
 }
 
 type ObjectInfo struct {
 	ModTime time.Time
 	Size    int64
+	// IsPrefix is set for common prefixes returned when listing with a delimiter, ModTime and
+	// Size are not populated for these.
+	IsPrefix bool
+	// Hash is the hex encoded MD5 of the object's content when the provider exposes it, S3 multipart
+	// uploads and GCS composite objects don't have one.
+	Hash string
+	// Metadata is populated when an object is downloaded, and in listings for providers that
+	// include it there (GCS). S3 listings never include it.
+	Metadata map[string]string
+}
+
+// ListOptions scopes a listing to keys starting with Prefix. When Delimiter is set, keys
+// containing the delimiter after the prefix are rolled up into a single common prefix entry.
+type ListOptions struct {
+	Prefix    string
+	Delimiter string
+}
+
+// ObjectWalkFunc is called for every object, or common prefix, found by WalkObjects. Objects are
+// streamed page by page so memory use doesn't grow with the size of the bucket.
+type ObjectWalkFunc func(key string, info ObjectInfo) error
+
+// ListObjects collects a listing into a map. This is only suitable for listings that are known
+// to be small, WalkObjects should be used for anything the size of a bucket.
+func ListObjects(ctx context.Context, client BucketClient, bucketName string, opts ListOptions) (map[string]ObjectInfo, error) {
+	objectMap := make(map[string]ObjectInfo)
+	walkErr := client.WalkObjects(ctx, bucketName, opts, func(key string, info ObjectInfo) error {
+		objectMap[key] = info
+		return nil
+	})
+
+	return objectMap, walkErr
+}
+
+// notVersionedError is returned when a delete that has to keep the object's version is asked of a
+// bucket that doesn't keep versions.
+func notVersionedError(bucket string) error {
+	return fmt.Errorf("Bucket %s does not have versioning enabled, refusing to delete", bucket)
+}
+
+// deleteParallelism is how many deletes deleteInParallel runs at once
+const deleteParallelism = 16
+
+// deleteInParallel implements DeleteObjects for providers that only delete one key per request.
+func deleteInParallel(ctx context.Context, bucket string, keys []string, deleteFn func(context.Context, string, string) error) map[string]error {
+	keyErrs := make(map[string]error)
+	var lock sync.Mutex
+	var wg sync.WaitGroup
+	keyChan := make(chan string)
+	for i := 0; i < deleteParallelism; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for key := range keyChan {
+				if delErr := deleteFn(ctx, bucket, key); delErr != nil {
+					lock.Lock()
+					keyErrs[key] = delErr
+					lock.Unlock()
+				}
+			}
+		}()
+	}
+	for _, key := range keys {
+		keyChan <- key
+	}
+	close(keyChan)
+	wg.Wait()
+
+	return keyErrs
+}
+
+func ignoreStopWalk(walkErr error) error {
+	if errors.Is(walkErr, ErrStopWalk) {
+		return nil
+	}
+	return walkErr
 }
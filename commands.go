@@ -0,0 +1,370 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"path/filepath"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// commands are one-off subcommands run instead of the scheduler, IE: `warden restore -source ...`
+var commands = map[string]func(context.Context, []string) error{
+	"restore":   runRestoreCommand,
+	"undelete":  runUndeleteCommand,
+	"snapshots": runSnapshotsCommand,
+	"approve":   runApproveCommand,
+	// restores chunked backups and tarballs split into volumes, other tarballs are plain tar.gz files
+	"restore-backup": runRestoreBackupCommand,
+}
+
+func runRestoreCommand(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("restore", flag.ExitOnError)
+	configFilePath := flags.String("configfile", "/etc/warden.yml", "Configuration File Path")
+	debugLogging := flags.Bool("debug", false, "enable debug logging")
+	source := flags.String("source", "", "source folder of the sync job to restore")
+	destinationName := flags.String("destination", "", "destination to restore from as provider:bucket, defaults to the first destination of the job")
+	target := flags.String("target", "", "folder to restore into")
+	prefix := flags.String("prefix", "", "only restore paths under this prefix, relative to the source folder")
+	at := flags.String("at", "", "restore the tree as it was at this time from the latest snapshot taken by then (RFC3339 or YYYY-MM-DD)")
+	flags.Parse(args)
+
+	setupLogging(*debugLogging)
+	if *source == "" || *target == "" {
+		return fmt.Errorf("restore requires -source and -target")
+	}
+	atTime, timeErr := parseFlagTime(*at)
+	if timeErr != nil {
+		return timeErr
+	}
+
+	appConfig, configErr := InitAppConfig(*configFilePath)
+	if configErr != nil {
+		return configErr
+	}
+	sc, destination, client, lookupErr := syncJobFromFlags(appConfig, *source, *destinationName)
+	if lookupErr != nil {
+		return lookupErr
+	}
+
+	var restoreResults map[string]error
+	if atTime.IsZero() {
+		var restoreErr error
+		restoreResults, restoreErr = doRestore(ctx, client, sc, destination, *target, *prefix)
+		if restoreErr != nil {
+			return fmt.Errorf("Error listing %s: %s", destination.Name(), restoreErr)
+		}
+	} else {
+		snapshots, listErr := listSnapshots(ctx, client, sc, destination)
+		if listErr != nil {
+			return fmt.Errorf("Error listing snapshots in %s: %s", destination.Name(), listErr)
+		}
+		snapshot, ok := snapshotAt(snapshots, atTime)
+		if !ok {
+			return fmt.Errorf("No snapshot of %s in %s was taken by %s", sc.SourceFolder, destination.Name(), atTime.Format(time.RFC3339))
+		}
+		manifest, readErr := readSnapshot(ctx, client, destination.Bucket, snapshot.Key)
+		if readErr != nil {
+			return fmt.Errorf("Error reading snapshot %s: %s", snapshot.Key, readErr)
+		}
+		log.Info(fmt.Sprintf("Restoring snapshot taken %s", snapshot.CreatedAt.Local().Format(time.RFC3339)))
+		restoreResults = doRestoreSnapshot(ctx, client, sc, destination, manifest, *target, *prefix)
+	}
+
+	failed := 0
+	for _, keyErr := range restoreResults {
+		if keyErr != nil {
+			failed++
+		}
+	}
+	if failed != 0 {
+		return fmt.Errorf("%d of %d objects failed to restore", failed, len(restoreResults))
+	}
+
+	return nil
+}
+
+func runUndeleteCommand(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("undelete", flag.ExitOnError)
+	configFilePath := flags.String("configfile", "/etc/warden.yml", "Configuration File Path")
+	debugLogging := flags.Bool("debug", false, "enable debug logging")
+	source := flags.String("source", "", "source folder of the sync job to undelete for")
+	destinationName := flags.String("destination", "", "destination to undelete in as provider:bucket, defaults to the first destination of the job")
+	target := flags.String("target", "", "folder to restore into, by default keys are restored back into the destination bucket")
+	prefix := flags.String("prefix", "", "only undelete paths under this prefix, relative to the source folder")
+	from := flags.String("from", "", "only undelete keys tombstoned at or after this time (RFC3339 or YYYY-MM-DD)")
+	to := flags.String("to", "", "only undelete keys tombstoned at or before this time (RFC3339 or YYYY-MM-DD)")
+	flags.Parse(args)
+
+	setupLogging(*debugLogging)
+	if *source == "" {
+		return fmt.Errorf("undelete requires -source")
+	}
+	opts := UndeleteOptions{SubPrefix: *prefix, TargetFolder: *target}
+	var timeErr error
+	if opts.From, timeErr = parseFlagTime(*from); timeErr != nil {
+		return timeErr
+	}
+	if opts.To, timeErr = parseFlagTime(*to); timeErr != nil {
+		return timeErr
+	}
+
+	appConfig, configErr := InitAppConfig(*configFilePath)
+	if configErr != nil {
+		return configErr
+	}
+	sc, destination, client, lookupErr := syncJobFromFlags(appConfig, *source, *destinationName)
+	if lookupErr != nil {
+		return lookupErr
+	}
+
+	undeleteResults, undeleteErr := doUndelete(ctx, client, sc, destination, opts)
+	if undeleteErr != nil {
+		return fmt.Errorf("Error listing tombstones for %s: %s", destination.Name(), undeleteErr)
+	}
+
+	failed := 0
+	for _, keyErr := range undeleteResults {
+		if keyErr != nil {
+			failed++
+		}
+	}
+	if failed != 0 {
+		return fmt.Errorf("%d of %d keys failed to undelete", failed, len(undeleteResults))
+	}
+
+	return nil
+}
+
+func runSnapshotsCommand(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("snapshots", flag.ExitOnError)
+	configFilePath := flags.String("configfile", "/etc/warden.yml", "Configuration File Path")
+	debugLogging := flags.Bool("debug", false, "enable debug logging")
+	source := flags.String("source", "", "source folder of the sync job to list snapshots for")
+	destinationName := flags.String("destination", "", "destination to list snapshots in as provider:bucket, defaults to the first destination of the job")
+	flags.Parse(args)
+
+	setupLogging(*debugLogging)
+	if *source == "" {
+		return fmt.Errorf("snapshots requires -source")
+	}
+
+	appConfig, configErr := InitAppConfig(*configFilePath)
+	if configErr != nil {
+		return configErr
+	}
+	sc, destination, client, lookupErr := syncJobFromFlags(appConfig, *source, *destinationName)
+	if lookupErr != nil {
+		return lookupErr
+	}
+
+	snapshots, listErr := listSnapshots(ctx, client, sc, destination)
+	if listErr != nil {
+		return fmt.Errorf("Error listing snapshots in %s: %s", destination.Name(), listErr)
+	}
+	for _, snapshot := range snapshots {
+		fmt.Printf("%s\t%s\n", snapshot.CreatedAt.Local().Format(time.RFC3339), snapshot.Key)
+	}
+
+	return nil
+}
+
+func runApproveCommand(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("approve", flag.ExitOnError)
+	configFilePath := flags.String("configfile", "/etc/warden.yml", "Configuration File Path")
+	debugLogging := flags.Bool("debug", false, "enable debug logging")
+	source := flags.String("source", "", "source folder of the paused sync job")
+	destinationName := flags.String("destination", "", "destination to resume as provider:bucket, defaults to every paused destination of the job")
+	flags.Parse(args)
+
+	setupLogging(*debugLogging)
+	if *source == "" {
+		return fmt.Errorf("approve requires -source")
+	}
+
+	appConfig, configErr := InitAppConfig(*configFilePath)
+	if configErr != nil {
+		return configErr
+	}
+	sc, lookupErr := syncJobForSource(appConfig, *source)
+	if lookupErr != nil {
+		return lookupErr
+	}
+
+	approved := 0
+	for _, destination := range sc.DestinationList() {
+		if *destinationName != "" && destination.Name() != *destinationName {
+			continue
+		}
+		paused, approveErr := approveAnomaly(sc, destination)
+		if approveErr != nil {
+			return fmt.Errorf("Error approving %s: %s", destination.Name(), approveErr)
+		}
+		if paused {
+			log.Info(fmt.Sprintf("Approved %s, the next sync will apply its pending changes", destination.Name()))
+			approved++
+		}
+	}
+	if approved == 0 {
+		return fmt.Errorf("Sync for %s has no paused destinations", sc.SourceFolder)
+	}
+
+	return nil
+}
+
+func runRestoreBackupCommand(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("restore-backup", flag.ExitOnError)
+	configFilePath := flags.String("configfile", "/etc/warden.yml", "Configuration File Path")
+	debugLogging := flags.Bool("debug", false, "enable debug logging")
+	source := flags.String("source", "", "source folder of the chunked or volume backup job to restore")
+	target := flags.String("target", "", "folder to restore into")
+	prefix := flags.String("prefix", "", "only restore paths under this prefix, relative to the source folder")
+	at := flags.String("at", "", "restore the latest backup taken at or before this time (RFC3339 or YYYY-MM-DD), defaults to the latest backup")
+	list := flags.Bool("list", false, "list the job's backups instead of restoring")
+	flags.Parse(args)
+
+	setupLogging(*debugLogging)
+	if *source == "" || (*target == "" && !*list) {
+		return fmt.Errorf("restore-backup requires -source and -target")
+	}
+	atTime, timeErr := parseFlagTime(*at)
+	if timeErr != nil {
+		return timeErr
+	}
+
+	appConfig, configErr := InitAppConfig(*configFilePath)
+	if configErr != nil {
+		return configErr
+	}
+	var bc BackupConfig
+	found := false
+	for _, candidate := range appConfig.Backup {
+		if filepath.Clean(candidate.SourceFolder) == filepath.Clean(*source) {
+			bc = candidate
+			found = true
+			break
+		}
+	}
+	if !found {
+		return fmt.Errorf("No backup job configured for %s", *source)
+	}
+	bucketClients, clientErr := BucketClientFromConfig(appConfig)
+	if clientErr != nil {
+		return clientErr
+	}
+	client, providerErr := ClientForProvider(bucketClients, bc.Provider)
+	if providerErr != nil {
+		return providerErr
+	}
+
+	listIndexes := listChunkIndexes
+	if bc.Mode != BackupModeChunked {
+		listIndexes = listVolumeIndexes
+	}
+	indexes, listErr := listIndexes(ctx, client, bc)
+	if listErr != nil {
+		return fmt.Errorf("Error listing backups in %s: %s", bc.DestinationBucket, listErr)
+	}
+	if *list {
+		for _, index := range indexes {
+			fmt.Printf("%s\t%s\n", index.CreatedAt.Local().Format(time.RFC3339), index.Key)
+		}
+		return nil
+	}
+	if atTime.IsZero() {
+		atTime = time.Now()
+	}
+	selected, ok := snapshotAt(indexes, atTime)
+	if !ok {
+		return fmt.Errorf("No restorable backup of %s in %s was taken by %s", bc.SourceFolder, bc.DestinationBucket, atTime.Format(time.RFC3339))
+	}
+	log.Info(fmt.Sprintf("Restoring backup taken %s", selected.CreatedAt.Local().Format(time.RFC3339)))
+
+	var restoreResults map[string]error
+	if bc.Mode == BackupModeChunked {
+		index, readErr := readChunkIndex(ctx, client, bc.DestinationBucket, selected.Key)
+		if readErr != nil {
+			return fmt.Errorf("Error reading backup index %s: %s", selected.Key, readErr)
+		}
+		restoreResults = doRestoreChunkedBackup(ctx, client, bc, index, *target, *prefix)
+	} else {
+		index, readErr := readVolumeIndex(ctx, client, bc.DestinationBucket, selected.Key)
+		if readErr != nil {
+			return fmt.Errorf("Error reading backup index %s: %s", selected.Key, readErr)
+		}
+		var extractErr error
+		restoreResults, extractErr = doRestoreVolumeBackup(ctx, client, bc, index, *target, *prefix)
+		if extractErr != nil {
+			return fmt.Errorf("Error reading backup %s: %s", index.Archive, extractErr)
+		}
+	}
+	failed := 0
+	for _, fileErr := range restoreResults {
+		if fileErr != nil {
+			failed++
+		}
+	}
+	if failed != 0 {
+		return fmt.Errorf("%d of %d files failed to restore", failed, len(restoreResults))
+	}
+
+	return nil
+}
+
+// parseFlagTime parses a time given on the command line as RFC3339 or a local date, an empty value
+// is the zero time.
+func parseFlagTime(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if parsed, parseErr := time.Parse(time.RFC3339, value); parseErr == nil {
+		return parsed, nil
+	}
+	parsed, parseErr := time.ParseInLocation("2006-01-02", value, time.Local)
+	if parseErr != nil {
+		return parsed, fmt.Errorf("%q is not an RFC3339 time or YYYY-MM-DD date", value)
+	}
+	return parsed, nil
+}
+
+// syncJobFromFlags finds the sync job for a source folder along with the destination, and a client
+// for it, that a command should operate on. An empty destinationName picks the first destination.
+func syncJobFromFlags(appConfig AppConfig, source, destinationName string) (SyncConfig, SyncDestination, BucketClient, error) {
+	var destination SyncDestination
+	sc, lookupErr := syncJobForSource(appConfig, source)
+	if lookupErr != nil {
+		return sc, destination, nil, lookupErr
+	}
+
+	found := false
+	for _, candidate := range sc.DestinationList() {
+		if destinationName == "" || candidate.Name() == destinationName {
+			destination = candidate
+			found = true
+			break
+		}
+	}
+	if !found {
+		return sc, destination, nil, fmt.Errorf("Sync for %s has no destination %s", source, destinationName)
+	}
+
+	bucketClients, clientErr := BucketClientFromConfig(appConfig)
+	if clientErr != nil {
+		return sc, destination, nil, clientErr
+	}
+	client, providerErr := ClientForProvider(bucketClients, destination.Provider)
+
+	return sc, destination, client, providerErr
+}
+
+// syncJobForSource finds the sync job configured for a source folder.
+func syncJobForSource(appConfig AppConfig, source string) (SyncConfig, error) {
+	for _, candidate := range appConfig.Sync {
+		if filepath.Clean(candidate.SourceFolder) == filepath.Clean(source) {
+			return candidate, nil
+		}
+	}
+	return SyncConfig{}, fmt.Errorf("No sync job configured for %s", source)
+}
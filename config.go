@@ -8,15 +8,25 @@ import (
 
 var (
 	bucketClientFactoryMap = map[string]BucketClientFactory{
-		"aws": NewS3BucketClient,
-		"gcs": NewGCSBucketClient,
+		"aws":    NewS3BucketClient,
+		"gcs":    NewGCSBucketClient,
+		"azure":  NewAzureBucketClient,
+		"sftp":   NewSFTPBucketClient,
+		"webdav": NewWebDAVBucketClient,
 	}
 	notifierFactoryMap = map[string]NotifierFactory{
 		"sns": NewSNSNotifier,
 	}
-	semaphore chan int
+	// workQueue runs object operations for all jobs with AppConfig.Concurrency workers
+	workQueue *WorkQueue
+	// stateDirectory holds state that has to survive restarts, IE: bidirectional sync baselines
+	stateDirectory string
 )
 
+// defaultProviderID is the name given to the top level provider block so configs written before
+// named providers existed keep working, and jobs that don't name a provider fall back to it.
+const defaultProviderID = "default"
+
 func InitAppConfig(filepath string) (AppConfig, error) {
 	var appConfig AppConfig
 	configErr := configor.Load(&appConfig, filepath)
@@ -24,24 +34,51 @@ func InitAppConfig(filepath string) (AppConfig, error) {
 		return appConfig, configErr
 	}
 
-	semaphore = make(chan int, appConfig.Concurrency)
+	validateErr := appConfig.Validate()
+	if validateErr != nil {
+		return appConfig, validateErr
+	}
+
+	workQueue = NewWorkQueue(appConfig.Concurrency)
+	stateDirectory = appConfig.StateDir
+	uploadLimiter, _ = NewRateLimiter(appConfig.Bandwidth)
+	appTimeouts = appConfig.Timeouts
 
 	return appConfig, nil
 }
 
 type AppConfig struct {
 	Provider    CloudProviderConfig
+	Providers   []CloudProviderConfig
 	Notify      NotifyConfig
-	Concurrency int `default:"1"`
-	Sync        []SyncConfig
-	Backup      []BackupConfig
+	Concurrency int    `default:"1"`
+	StateDir    string `default:"/var/lib/warden"`
+	Bandwidth   BandwidthConfig
+	Timeouts    TimeoutConfig
+	// AbandonedUploadDays is how old an incomplete multipart upload gets before it's aborted
+	AbandonedUploadDays int `default:"7"`
+	Sync                []SyncConfig
+	Backup              []BackupConfig
 }
 
 type CloudProviderConfig struct {
-	Name           string `required:"true"`
+	ID             string
+	Name           string
 	Profile        string
 	CredentialFile string
-	Region         string `required:"true"`
+	Region         string
+	Endpoint       string
+	// Account, AccountKey, ConnectionString and SASToken authenticate azure providers
+	Account          string
+	AccountKey       string
+	ConnectionString string
+	SASToken         string
+	// User, KeyFile and KnownHostsFile connect to sftp providers, the endpoint is the host
+	User           string
+	KeyFile        string
+	KnownHostsFile string
+	// Password authenticates the user of webdav providers
+	Password string
 }
 
 type NotifyConfig struct {
@@ -53,31 +90,276 @@ type NotifyConfig struct {
 
 type SyncConfig struct {
 	SourceFolder      string `required:"true"`
-	DestinationBucket string `required:"true"`
+	DestinationBucket string
 	TombstoneBucket   string
+	Provider          string
+	Destinations      []SyncDestination
+	Prefix            string
+	Rewrite           []RewriteRule
 	Interval          int `required:"true"`
 	Exclude           []string
+	Ignore            []string
+	Include           []string
+	IgnoreFile        string
+	Filters           FileFilterConfig
+	Symlinks          string `default:"follow"`
+	Mode              string `default:"push"`
+	ConflictPolicy    string `default:"newest"`
+	DetectMoves       bool
+	// TombstoneStrategy is one of bucket, versioning or prefix
+	TombstoneStrategy     string `default:"bucket"`
+	TombstonePrefix       string `default:"tombstone/"`
+	TombstoneStorageClass string
+	// TombstoneRetention is how many days tombstones are kept, 0 keeps them forever
+	TombstoneRetention int
+	// Snapshots records a manifest of the destination after every successful sync
+	Snapshots bool
+	// SnapshotRetention is how many days snapshots are kept, 0 keeps them forever. Objects no
+	// snapshot in the bucket references any more are deleted from the snapshot store.
+	SnapshotRetention int
+	Anomaly           AnomalyConfig
+	Bandwidth         BandwidthConfig
+	Timeouts          TimeoutConfig
+	Concurrency       int
+	Priority          int
 	Destructive       bool `default:"true"`
 }
 
+type SyncDestination struct {
+	Provider        string
+	Bucket          string `required:"true"`
+	TombstoneBucket string
+}
+
+// Name identifies a destination in logs, results and notifications.
+func (d SyncDestination) Name() string {
+	return fmt.Sprintf("%s:%s", providerIDOrDefault(d.Provider), d.Bucket)
+}
+
+// DestinationList returns every destination a sync job replicates to. Jobs configured with the
+// single destinationbucket/tombstonebucket/provider keys are treated as one destination.
+func (sc SyncConfig) DestinationList() []SyncDestination {
+	if len(sc.Destinations) != 0 {
+		return sc.Destinations
+	}
+
+	return []SyncDestination{
+		{
+			Provider:        sc.Provider,
+			Bucket:          sc.DestinationBucket,
+			TombstoneBucket: sc.TombstoneBucket,
+		},
+	}
+}
+
 type BackupConfig struct {
 	SourceFolder      string `required:"true"`
 	DestinationBucket string `required:"true"`
-	At                string `required:"true"`
+	Provider          string
+	Symlinks          string `default:"follow"`
+	// Mode is tarball or chunked
+	Mode string `default:"tarball"`
+	// VolumeSize splits tarballs into volumes of at most this size, IE: 5GB
+	VolumeSize string
+	// Retention is how many days chunked backup indexes are kept, 0 keeps them forever. Chunks no
+	// index references any more are deleted along with expired indexes
+	Retention   int
+	Bandwidth   BandwidthConfig
+	Timeouts    TimeoutConfig
+	Concurrency int
+	Priority    int
+	At          string `required:"true"`
 }
 
-type BucketClientFactory func(AppConfig) (BucketClient, error)
+type BucketClientFactory func(CloudProviderConfig) (BucketClient, error)
 type NotifierFactory func(AppConfig) (Notifier, error)
 
-func BucketClientFromConfig(appConfig AppConfig) (BucketClient, error) {
-	var bucketClient BucketClient
-	clientFactory, ok := bucketClientFactoryMap[appConfig.Provider.Name]
-	if !ok {
-		return nil, fmt.Errorf("Unknown cloud object storage provider: %s", appConfig.Provider.Name)
+// ProviderConfigs returns every configured provider keyed by ID. The legacy top level provider
+// block is included as defaultProviderID when it has been set.
+func (c AppConfig) ProviderConfigs() map[string]CloudProviderConfig {
+	providers := make(map[string]CloudProviderConfig)
+	if c.Provider.Name != "" {
+		legacy := c.Provider
+		legacy.ID = defaultProviderID
+		providers[defaultProviderID] = legacy
+	}
+	for _, provider := range c.Providers {
+		providers[provider.ID] = provider
 	}
 
-	bucketClient, bucketClientErr := clientFactory(appConfig)
-	return bucketClient, bucketClientErr
+	return providers
+}
+
+func (c AppConfig) Validate() error {
+	if c.Provider.Name != "" && c.Provider.Region == "" {
+		return fmt.Errorf("Region is required for provider %s", defaultProviderID)
+	}
+
+	seen := make(map[string]bool)
+	for _, provider := range c.Providers {
+		if provider.ID == "" {
+			return fmt.Errorf("Every entry in providers requires an id")
+		}
+		if provider.ID == defaultProviderID && c.Provider.Name != "" {
+			return fmt.Errorf("Provider id %s is reserved for the top level provider block", defaultProviderID)
+		}
+		if seen[provider.ID] {
+			return fmt.Errorf("Duplicate provider id: %s", provider.ID)
+		}
+		if provider.Name == "" {
+			return fmt.Errorf("Provider %s is missing a name", provider.ID)
+		}
+		// the S3 client signs every request for a region, custom endpoints included
+		if provider.Name == "aws" && provider.Region == "" {
+			return fmt.Errorf("Region is required for provider %s", provider.ID)
+		}
+		seen[provider.ID] = true
+	}
+
+	if _, bandwidthErr := NewRateLimiter(c.Bandwidth); bandwidthErr != nil {
+		return fmt.Errorf("Invalid bandwidth: %s", bandwidthErr)
+	}
+	if timeoutErr := c.Timeouts.Validate(); timeoutErr != nil {
+		return fmt.Errorf("Invalid timeout: %s", timeoutErr)
+	}
+	if c.AbandonedUploadDays < 0 {
+		return fmt.Errorf("Abandoned upload days can't be negative")
+	}
+
+	providers := c.ProviderConfigs()
+	for _, sc := range c.Sync {
+		if sc.DestinationBucket != "" && len(sc.Destinations) != 0 {
+			return fmt.Errorf("Sync for %s sets both destinationbucket and destinations", sc.SourceFolder)
+		}
+		if !validSymlinkPolicy(sc.Symlinks) {
+			return fmt.Errorf("Sync for %s has unknown symlink policy: %s", sc.SourceFolder, sc.Symlinks)
+		}
+		if !validSyncMode(sc.Mode) {
+			return fmt.Errorf("Sync for %s has unknown mode: %s", sc.SourceFolder, sc.Mode)
+		}
+		if !validConflictPolicy(sc.ConflictPolicy) {
+			return fmt.Errorf("Sync for %s has unknown conflict policy: %s", sc.SourceFolder, sc.ConflictPolicy)
+		}
+		if !validTombstoneStrategy(sc.TombstoneStrategy) {
+			return fmt.Errorf("Sync for %s has unknown tombstone strategy: %s", sc.SourceFolder, sc.TombstoneStrategy)
+		}
+		if sc.TombstoneRetention < 0 {
+			return fmt.Errorf("Sync for %s has a negative tombstone retention", sc.SourceFolder)
+		}
+		if sc.SnapshotRetention < 0 {
+			return fmt.Errorf("Sync for %s has a negative snapshot retention", sc.SourceFolder)
+		} else if sc.SnapshotRetention > 0 && !sc.Snapshots {
+			return fmt.Errorf("Sync for %s can only keep snapshots for a number of days when snapshots are enabled", sc.SourceFolder)
+		}
+		if sc.Mode == SyncModeBidirectional && len(sc.DestinationList()) != 1 {
+			return fmt.Errorf("Bidirectional sync for %s requires exactly one destination", sc.SourceFolder)
+		}
+		if _, filterErr := NewFileFilter(sc.Filters); filterErr != nil {
+			return fmt.Errorf("Sync for %s has invalid filters: %s", sc.SourceFolder, filterErr)
+		}
+		if _, bandwidthErr := NewRateLimiter(sc.Bandwidth); bandwidthErr != nil {
+			return fmt.Errorf("Sync for %s has invalid bandwidth: %s", sc.SourceFolder, bandwidthErr)
+		}
+		if timeoutErr := sc.Timeouts.Validate(); timeoutErr != nil {
+			return fmt.Errorf("Sync for %s has an invalid timeout: %s", sc.SourceFolder, timeoutErr)
+		}
+		if sc.Concurrency < 0 {
+			return fmt.Errorf("Sync for %s has a negative concurrency", sc.SourceFolder)
+		}
+		if sc.Anomaly.ChangeRatio < 0 || sc.Anomaly.ChangeRatio > 1 {
+			return fmt.Errorf("Sync for %s has an anomaly change ratio outside of 0 to 1", sc.SourceFolder)
+		}
+		if sc.Anomaly.MinKeys < 0 || sc.Anomaly.EntropyFiles < 0 {
+			return fmt.Errorf("Sync for %s has negative anomaly thresholds", sc.SourceFolder)
+		}
+		if sc.Anomaly.Enabled && sc.Mode == SyncModeBidirectional {
+			return fmt.Errorf("Sync for %s can't use anomaly detection, it only guards push syncs and not bidirectional ones", sc.SourceFolder)
+		}
+		destinationNames := make(map[string]bool)
+		for _, destination := range sc.DestinationList() {
+			if destination.Bucket == "" {
+				return fmt.Errorf("Sync for %s is missing a destination bucket", sc.SourceFolder)
+			}
+			if _, ok := providers[providerIDOrDefault(destination.Provider)]; !ok {
+				return fmt.Errorf("Sync for %s references unknown provider: %s", sc.SourceFolder, providerIDOrDefault(destination.Provider))
+			}
+			if destination.TombstoneBucket != "" && sc.TombstonePolicy(destination).Strategy != TombstoneStrategyBucket {
+				return fmt.Errorf("Sync for %s sets a tombstone bucket but uses the %s tombstone strategy", sc.SourceFolder, sc.TombstoneStrategy)
+			}
+			if destinationNames[destination.Name()] {
+				return fmt.Errorf("Sync for %s lists destination %s more than once", sc.SourceFolder, destination.Name())
+			}
+			destinationNames[destination.Name()] = true
+		}
+	}
+	for _, bc := range c.Backup {
+		if !validSymlinkPolicy(bc.Symlinks) {
+			return fmt.Errorf("Backup for %s has unknown symlink policy: %s", bc.SourceFolder, bc.Symlinks)
+		}
+		if !validBackupMode(bc.Mode) {
+			return fmt.Errorf("Backup for %s has unknown mode: %s", bc.SourceFolder, bc.Mode)
+		}
+		if volumeSize, sizeErr := parseByteSize(bc.VolumeSize); sizeErr != nil {
+			return fmt.Errorf("Backup for %s has an invalid volume size: %s", bc.SourceFolder, sizeErr)
+		} else if bc.VolumeSize != "" && (volumeSize == 0 || bc.Mode == BackupModeChunked) {
+			return fmt.Errorf("Backup for %s can only split non-empty tarballs into volumes", bc.SourceFolder)
+		}
+		if bc.Retention < 0 {
+			return fmt.Errorf("Backup for %s has a negative retention", bc.SourceFolder)
+		} else if bc.Retention > 0 && bc.Mode != BackupModeChunked {
+			return fmt.Errorf("Backup for %s can only keep chunked backups for a number of days", bc.SourceFolder)
+		}
+		if _, bandwidthErr := NewRateLimiter(bc.Bandwidth); bandwidthErr != nil {
+			return fmt.Errorf("Backup for %s has invalid bandwidth: %s", bc.SourceFolder, bandwidthErr)
+		}
+		if timeoutErr := bc.Timeouts.Validate(); timeoutErr != nil {
+			return fmt.Errorf("Backup for %s has an invalid timeout: %s", bc.SourceFolder, timeoutErr)
+		}
+		if bc.Concurrency < 0 {
+			return fmt.Errorf("Backup for %s has a negative concurrency", bc.SourceFolder)
+		}
+		if _, ok := providers[providerIDOrDefault(bc.Provider)]; !ok {
+			return fmt.Errorf("Backup for %s references unknown provider: %s", bc.SourceFolder, providerIDOrDefault(bc.Provider))
+		}
+	}
+
+	return nil
+}
+
+func providerIDOrDefault(providerID string) string {
+	if providerID == "" {
+		return defaultProviderID
+	}
+	return providerID
+}
+
+// BucketClientFromConfig builds one client per configured provider, keyed by provider ID.
+func BucketClientFromConfig(appConfig AppConfig) (map[string]BucketClient, error) {
+	bucketClients := make(map[string]BucketClient)
+	for providerID, providerConfig := range appConfig.ProviderConfigs() {
+		clientFactory, ok := bucketClientFactoryMap[providerConfig.Name]
+		if !ok {
+			return nil, fmt.Errorf("Unknown cloud object storage provider: %s", providerConfig.Name)
+		}
+
+		bucketClient, bucketClientErr := clientFactory(providerConfig)
+		if bucketClientErr != nil {
+			return nil, fmt.Errorf("Error creating client for provider %s: %s", providerID, bucketClientErr)
+		}
+		bucketClients[providerID] = bucketClient
+	}
+
+	return bucketClients, nil
+}
+
+// ClientForProvider looks up the client a job should use, falling back to the default provider
+// when the job doesn't name one.
+func ClientForProvider(bucketClients map[string]BucketClient, providerID string) (BucketClient, error) {
+	bucketClient, ok := bucketClients[providerIDOrDefault(providerID)]
+	if !ok {
+		return nil, fmt.Errorf("No client configured for provider: %s", providerIDOrDefault(providerID))
+	}
+	return bucketClient, nil
 }
 
 func NotifierFromConfig(appConfig AppConfig) (Notifier, error) {
@@ -94,9 +376,21 @@ func NotifierFromConfig(appConfig AppConfig) (Notifier, error) {
 
 func (c AppConfig) ConfigStringArray() []string {
 	configStrArr := make([]string, 0)
-	configStrArr = append(configStrArr, fmt.Sprintf("  - Region: %s", c.Provider.Region))
-	configStrArr = append(configStrArr, fmt.Sprintf("  - IAMProfile: %s", c.Provider.Profile))
-	configStrArr = append(configStrArr, fmt.Sprintf("  - CredentialFile: %s", c.Provider.CredentialFile))
+	for providerID, provider := range c.ProviderConfigs() {
+		configStrArr = append(configStrArr, fmt.Sprintf("Provider %s (%s):", providerID, provider.Name))
+		configStrArr = append(configStrArr, fmt.Sprintf("  - Region: %s", provider.Region))
+		configStrArr = append(configStrArr, fmt.Sprintf("  - IAMProfile: %s", provider.Profile))
+		configStrArr = append(configStrArr, fmt.Sprintf("  - CredentialFile: %s", provider.CredentialFile))
+		if provider.Endpoint != "" {
+			configStrArr = append(configStrArr, fmt.Sprintf("  - Endpoint: %s", provider.Endpoint))
+		}
+		if provider.Account != "" {
+			configStrArr = append(configStrArr, fmt.Sprintf("  - Account: %s", provider.Account))
+		}
+		if provider.User != "" {
+			configStrArr = append(configStrArr, fmt.Sprintf("  - User: %s", provider.User))
+		}
+	}
 	configStrArr = append(configStrArr, fmt.Sprintf("  - Concurrent Uploads: %d", c.Concurrency))
 
 	configStrArr = append(configStrArr, "Folders To Sync:")
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLegacyProviderIsDefault(t *testing.T) {
+	mockAppConfig := AppConfig{
+		Provider: CloudProviderConfig{Name: "aws", Region: "us-east-2"},
+		Sync: []SyncConfig{
+			{SourceFolder: "/folder1", DestinationBucket: "not-real-bucket"},
+		},
+	}
+
+	providers := mockAppConfig.ProviderConfigs()
+
+	assert.Nil(t, mockAppConfig.Validate())
+	assert.Len(t, providers, 1)
+	assert.Contains(t, providers, defaultProviderID)
+}
+
+func TestNamedProvidersSelectedPerJob(t *testing.T) {
+	mockAppConfig := AppConfig{
+		Providers: []CloudProviderConfig{
+			{ID: "aws-prod", Name: "aws", Region: "us-east-2"},
+			{ID: "gcs-archive", Name: "gcs"},
+		},
+		Sync: []SyncConfig{
+			{SourceFolder: "/folder1", DestinationBucket: "not-real-bucket", Provider: "aws-prod"},
+		},
+		Backup: []BackupConfig{
+			{SourceFolder: "/folder2", DestinationBucket: "not-real-bucket", Provider: "gcs-archive"},
+		},
+	}
+	awsClient := NewMockClient(map[string]ObjectInfo{})
+	gcsClient := NewMockClient(map[string]ObjectInfo{})
+	mockClients := map[string]BucketClient{"aws-prod": awsClient, "gcs-archive": gcsClient}
+
+	syncClient, syncErr := ClientForProvider(mockClients, mockAppConfig.Sync[0].Provider)
+	backupClient, backupErr := ClientForProvider(mockClients, mockAppConfig.Backup[0].Provider)
+
+	assert.Nil(t, mockAppConfig.Validate())
+	assert.Nil(t, syncErr)
+	assert.Nil(t, backupErr)
+	assert.Same(t, awsClient, syncClient)
+	assert.Same(t, gcsClient, backupClient)
+}
+
+func TestUnknownProviderFailsValidation(t *testing.T) {
+	mockAppConfig := AppConfig{
+		Providers: []CloudProviderConfig{
+			{ID: "aws-prod", Name: "aws", Region: "us-east-2"},
+		},
+		Sync: []SyncConfig{
+			{SourceFolder: "/folder1", DestinationBucket: "not-real-bucket"},
+		},
+	}
+
+	validateErr := mockAppConfig.Validate()
+
+	assert.ErrorContains(t, validateErr, "unknown provider: default")
+}
+
+func TestAWSProviderRequiresRegion(t *testing.T) {
+	mockAppConfig := AppConfig{
+		Providers: []CloudProviderConfig{
+			{ID: "gcs-archive", Name: "gcs"},
+			{ID: "local-minio", Name: "aws", Endpoint: "http://minio.local:9000"},
+		},
+	}
+
+	assert.ErrorContains(t, mockAppConfig.Validate(), "Region is required for provider local-minio")
+}
+
+func TestNegativeFilterAgeFailsValidation(t *testing.T) {
+	mockAppConfig := AppConfig{
+		Provider: CloudProviderConfig{Name: "aws", Region: "us-east-2"},
+		Sync: []SyncConfig{
+			{SourceFolder: "/folder1", DestinationBucket: "not-real-bucket", Filters: FileFilterConfig{MaxAge: -60}},
+		},
+	}
+
+	assert.ErrorContains(t, mockAppConfig.Validate(), "minage and maxage can't be negative")
+}
+
+func TestSnapshotRetentionRequiresSnapshots(t *testing.T) {
+	mockAppConfig := AppConfig{
+		Provider: CloudProviderConfig{Name: "aws", Region: "us-east-2"},
+		Sync: []SyncConfig{
+			{SourceFolder: "/folder1", DestinationBucket: "not-real-bucket", SnapshotRetention: 30},
+		},
+	}
+
+	assert.ErrorContains(t, mockAppConfig.Validate(), "only keep snapshots for a number of days when snapshots are enabled")
+	mockAppConfig.Sync[0].Snapshots = true
+	assert.Nil(t, mockAppConfig.Validate())
+}
+
+func TestAnomalyDetectionRequiresPushSync(t *testing.T) {
+	mockAppConfig := AppConfig{
+		Provider: CloudProviderConfig{Name: "aws", Region: "us-east-2"},
+		Sync: []SyncConfig{
+			{SourceFolder: "/folder1", DestinationBucket: "not-real-bucket", Mode: SyncModeBidirectional, Anomaly: AnomalyConfig{Enabled: true}},
+		},
+	}
+
+	assert.ErrorContains(t, mockAppConfig.Validate(), "can't use anomaly detection")
+	mockAppConfig.Sync[0].Mode = ""
+	assert.Nil(t, mockAppConfig.Validate())
+}
@@ -3,35 +3,181 @@ package main
 import (
 	"archive/tar"
 	"compress/gzip"
+	"fmt"
 	"io"
 	"os"
 	"path/filepath"
+	"sort"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// SymlinkFollow uploads whatever a link points to as if it lived at the link path, directory
+	// links are walked into.
+	SymlinkFollow = "follow"
+	// SymlinkSkip ignores links entirely.
+	SymlinkSkip = "skip"
+	// SymlinkPreserve stores the link itself, as a link target in object metadata for syncs or
+	// as a symlink entry in backup tarballs, and recreates it on restore.
+	SymlinkPreserve = "preserve"
 )
 
-type walkFunc func(string) (map[string]os.FileInfo, error)
+type WalkOptions struct {
+	Filter   *PathFilter
+	Symlinks string
+}
+
+// FileWalkFunc is called for every file found by a walk, returning an error stops the walk.
+type FileWalkFunc func(path string, info os.FileInfo) error
+
+type walkFunc func(string, WalkOptions, FileWalkFunc) error
+
+func validSymlinkPolicy(policy string) bool {
+	return policy == "" || policy == SymlinkFollow || policy == SymlinkSkip || policy == SymlinkPreserve
+}
 
-func walkDirectory(dirPath string) (map[string]os.FileInfo, error) {
+// walkDirectory calls fn for every file under dirPath. When a filter is given, ignore files are
+// loaded as directories are entered and excluded directories are pruned so the walk never goes into
+// them. Excluded files are still walked, it's up to the caller to skip them.
+//
+// Files are walked in the byte order of their path relative to dirPath, which is the order buckets
+// list keys in, so a walk can be compared against a listing without holding either in memory.
+//
+// Symlinks are handled according to opts.Symlinks. When following links the FileInfo returned is
+// for the link target, when preserving them it is for the link itself.
+func walkDirectory(dirPath string, opts WalkOptions, fn FileWalkFunc) error {
+	rootInfo, statErr := os.Stat(dirPath)
+	if statErr != nil {
+		return statErr
+	}
+	if !rootInfo.IsDir() {
+		return fmt.Errorf("%s is not a directory", dirPath)
+	}
+
+	realRoot, realErr := filepath.EvalSymlinks(dirPath)
+	if realErr != nil {
+		return realErr
+	}
+	return walkDirectoryRecursive(dirPath, opts, map[string]bool{realRoot: true}, fn)
+}
+
+// collectFiles walks dirPath with concreteWalkFunc and returns every file found. It's only meant
+// for callers that need the whole tree at once anyway, IE: building a backup archive.
+func collectFiles(dirPath string, opts WalkOptions) (map[string]os.FileInfo, error) {
 	fileMap := make(map[string]os.FileInfo)
-	walkErr := filepath.Walk(dirPath, func(path string, f os.FileInfo, err error) error {
-		if !f.IsDir() {
-			fileMap[path] = f
+	walkErr := concreteWalkFunc(dirPath, opts, func(path string, info os.FileInfo) error {
+		fileMap[path] = info
+		return nil
+	})
+	return fileMap, walkErr
+}
+
+// walkEntry is a directory entry with any followed link resolved, sortName is its name with a
+// trailing slash for directories so they sort among their siblings the way their keys would.
+type walkEntry struct {
+	path     string
+	info     os.FileInfo
+	sortName string
+}
+
+// ancestors holds the real paths of every directory currently being walked. Following a link back
+// into one of them would loop forever so those links are skipped.
+func walkDirectoryRecursive(dirPath string, opts WalkOptions, ancestors map[string]bool, fn FileWalkFunc) error {
+	if loadErr := opts.Filter.LoadIgnoreFile(dirPath); loadErr != nil {
+		return loadErr
+	}
 
+	dirEntries, readErr := os.ReadDir(dirPath)
+	if readErr != nil {
+		return readErr
+	}
+
+	entries := make([]walkEntry, 0, len(dirEntries))
+	for _, dirEntry := range dirEntries {
+		path := filepath.Join(dirPath, dirEntry.Name())
+		info, infoErr := dirEntry.Info()
+		if os.IsNotExist(infoErr) {
+			// removed since the directory was read
+			continue
 		}
-		return nil
+		if infoErr != nil {
+			return infoErr
+		}
+
+		if info.Mode()&os.ModeSymlink != 0 && opts.Symlinks != SymlinkPreserve {
+			if opts.Symlinks == SymlinkSkip {
+				log.Debug(fmt.Sprintf("%s is a symlink, skipping", path))
+				continue
+			}
+			targetInfo, targetErr := os.Stat(path)
+			if targetErr != nil {
+				log.Warn(fmt.Sprintf("%s is a broken symlink, skipping: %s", path, targetErr))
+				continue
+			}
+			info = targetInfo
+		}
+
+		sortName := dirEntry.Name()
+		if info.IsDir() {
+			sortName += "/"
+		}
+		entries = append(entries, walkEntry{path: path, info: info, sortName: sortName})
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].sortName < entries[j].sortName
 	})
 
-	return fileMap, walkErr
+	for _, entry := range entries {
+		if !entry.info.IsDir() {
+			if walkErr := fn(entry.path, entry.info); walkErr != nil {
+				return walkErr
+			}
+			continue
+		}
+		if opts.Filter.Excluded(entry.path, true) {
+			continue
+		}
+
+		realPath, realErr := filepath.EvalSymlinks(entry.path)
+		if realErr != nil {
+			return realErr
+		}
+		if ancestors[realPath] {
+			log.Warn(fmt.Sprintf("%s links back to %s, skipping to avoid a loop", entry.path, realPath))
+			continue
+		}
+		ancestors[realPath] = true
+		walkErr := walkDirectoryRecursive(entry.path, opts, ancestors, fn)
+		delete(ancestors, realPath)
+		if walkErr != nil {
+			return walkErr
+		}
+	}
+
+	return nil
 }
 
-func createArchive(files []string, buf io.Writer) error {
+// createArchive writes every file in fileMap to a gzipped tarball. Files are added in sorted order
+// so the same tree always produces the same archive.
+func createArchive(fileMap map[string]os.FileInfo, buf io.Writer) error {
 	gw := gzip.NewWriter(buf)
 	defer gw.Close()
 	tw := tar.NewWriter(gw)
 	defer tw.Close()
 
+	files := make([]string, 0, len(fileMap))
+	for file, _ := range fileMap {
+		files = append(files, file)
+	}
+	sort.Strings(files)
+
+	// hard links are stored as tar link entries pointing at the first path seen for the inode
+	hardLinks := make(map[fileID]string)
+
 	// Iterate over files and add them to the tar archive
 	for _, file := range files {
-		err := addToArchive(tw, file)
+		err := addToArchive(tw, file, fileMap[file], hardLinks)
 		if err != nil {
 			return err
 
@@ -41,7 +187,23 @@ func createArchive(files []string, buf io.Writer) error {
 	return nil
 }
 
-func addToArchive(tw *tar.Writer, filename string) error {
+func addToArchive(tw *tar.Writer, filename string, info os.FileInfo, hardLinks map[fileID]string) error {
+	// symlinks only show up here when they are being preserved, followed links have the target's info
+	if info.Mode()&os.ModeSymlink != 0 {
+		linkTarget, err := os.Readlink(filename)
+		if err != nil {
+			return err
+
+		}
+		header, err := tar.FileInfoHeader(info, linkTarget)
+		if err != nil {
+			return err
+
+		}
+		header.Name = filename
+		return tw.WriteHeader(header)
+	}
+
 	file, err := os.Open(filename)
 	if err != nil {
 		return err
@@ -49,7 +211,7 @@ func addToArchive(tw *tar.Writer, filename string) error {
 	}
 	defer file.Close()
 
-	info, err := file.Stat()
+	info, err = file.Stat()
 	if err != nil {
 		return err
 
@@ -63,6 +225,16 @@ func addToArchive(tw *tar.Writer, filename string) error {
 
 	header.Name = filename
 
+	if id, ok := hardLinkID(info); ok {
+		if firstPath, seen := hardLinks[id]; seen {
+			header.Typeflag = tar.TypeLink
+			header.Linkname = firstPath
+			header.Size = 0
+			return tw.WriteHeader(header)
+		}
+		hardLinks[id] = filename
+	}
+
 	err = tw.WriteHeader(header)
 	if err != nil {
 		return err
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// walkDirectoryFiles collects a walk of dirPath into a map
+func walkDirectoryFiles(dirPath string, opts WalkOptions) (map[string]os.FileInfo, error) {
+	fileMap := make(map[string]os.FileInfo)
+	walkErr := walkDirectory(dirPath, opts, func(path string, info os.FileInfo) error {
+		fileMap[path] = info
+		return nil
+	})
+	return fileMap, walkErr
+}
+
+// createMockLinkTree builds a tree with a file symlink, a directory symlink, a symlink looping back
+// to the root and a broken symlink
+func createMockLinkTree(t *testing.T) string {
+	mockTempDir, mockTempDirErr := ioutil.TempDir(os.TempDir(), "go-test-stuff")
+	assert.Nil(t, mockTempDirErr)
+
+	assert.Nil(t, os.MkdirAll(filepath.Join(mockTempDir, "real/nested"), os.ModePerm))
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(mockTempDir, "real/nested/file"), []byte("data"), 0644))
+	assert.Nil(t, os.Symlink("real/nested/file", filepath.Join(mockTempDir, "file-link")))
+	assert.Nil(t, os.Symlink("real", filepath.Join(mockTempDir, "dir-link")))
+	assert.Nil(t, os.Symlink("..", filepath.Join(mockTempDir, "real/loop-link")))
+	assert.Nil(t, os.Symlink("does-not-exist", filepath.Join(mockTempDir, "broken-link")))
+
+	return mockTempDir
+}
+
+func TestWalkInKeyOrder(t *testing.T) {
+	mockTempDir := t.TempDir()
+	assert.Nil(t, os.MkdirAll(filepath.Join(mockTempDir, "a/b"), os.ModePerm))
+	for _, file := range []string{"a.txt", "a/b/c", "a/z", "a-b", "b"} {
+		assert.Nil(t, ioutil.WriteFile(filepath.Join(mockTempDir, file), []byte("data"), 0644))
+	}
+
+	walked := make([]string, 0)
+	walkErr := walkDirectory(mockTempDir, WalkOptions{}, func(path string, info os.FileInfo) error {
+		relativePath, _ := filepath.Rel(mockTempDir, path)
+		walked = append(walked, filepath.ToSlash(relativePath))
+		return nil
+	})
+
+	// the byte order of the keys, "a.txt" sorts before anything under "a/"
+	assert.Nil(t, walkErr)
+	assert.Equal(t, []string{"a-b", "a.txt", "a/b/c", "a/z", "b"}, walked)
+}
+
+func TestWalkFollowSymlinks(t *testing.T) {
+	mockTempDir := createMockLinkTree(t)
+	defer os.RemoveAll(mockTempDir)
+
+	fileMap, walkErr := walkDirectoryFiles(mockTempDir, WalkOptions{Symlinks: SymlinkFollow})
+
+	assert.Nil(t, walkErr)
+	assert.Len(t, fileMap, 3)
+	assert.Contains(t, fileMap, filepath.Join(mockTempDir, "real/nested/file"))
+	assert.Contains(t, fileMap, filepath.Join(mockTempDir, "dir-link/nested/file"))
+	assert.Contains(t, fileMap, filepath.Join(mockTempDir, "file-link"))
+	assert.Equal(t, int64(4), fileMap[filepath.Join(mockTempDir, "file-link")].Size())
+}
+
+func TestWalkSkipSymlinks(t *testing.T) {
+	mockTempDir := createMockLinkTree(t)
+	defer os.RemoveAll(mockTempDir)
+
+	fileMap, walkErr := walkDirectoryFiles(mockTempDir, WalkOptions{Symlinks: SymlinkSkip})
+
+	assert.Nil(t, walkErr)
+	assert.Len(t, fileMap, 1)
+	assert.Contains(t, fileMap, filepath.Join(mockTempDir, "real/nested/file"))
+}
+
+func TestWalkPreserveSymlinks(t *testing.T) {
+	mockTempDir := createMockLinkTree(t)
+	defer os.RemoveAll(mockTempDir)
+
+	fileMap, walkErr := walkDirectoryFiles(mockTempDir, WalkOptions{Symlinks: SymlinkPreserve})
+
+	assert.Nil(t, walkErr)
+	assert.Len(t, fileMap, 5)
+	for _, link := range []string{"file-link", "dir-link", "real/loop-link", "broken-link"} {
+		assert.Contains(t, fileMap, filepath.Join(mockTempDir, link))
+		assert.NotZero(t, fileMap[filepath.Join(mockTempDir, link)].Mode()&os.ModeSymlink)
+	}
+}
+
+func TestArchivePreservesLinks(t *testing.T) {
+	mockTempDir, mockTempDirErr := ioutil.TempDir(os.TempDir(), "go-test-stuff")
+	assert.Nil(t, mockTempDirErr)
+	defer os.RemoveAll(mockTempDir)
+
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(mockTempDir, "a-file"), []byte("data"), 0644))
+	assert.Nil(t, os.Link(filepath.Join(mockTempDir, "a-file"), filepath.Join(mockTempDir, "b-hardlink")))
+	assert.Nil(t, os.Symlink("a-file", filepath.Join(mockTempDir, "c-symlink")))
+	fileMap, walkErr := walkDirectoryFiles(mockTempDir, WalkOptions{Symlinks: SymlinkPreserve})
+	assert.Nil(t, walkErr)
+
+	var archive bytes.Buffer
+	assert.Nil(t, createArchive(fileMap, &archive))
+
+	gr, gzipErr := gzip.NewReader(&archive)
+	assert.Nil(t, gzipErr)
+	tr := tar.NewReader(gr)
+	headers := make(map[string]*tar.Header)
+	for {
+		header, readErr := tr.Next()
+		if readErr == io.EOF {
+			break
+		}
+		assert.Nil(t, readErr)
+		headers[filepath.Base(header.Name)] = header
+	}
+
+	assert.Len(t, headers, 3)
+	assert.Equal(t, byte(tar.TypeReg), headers["a-file"].Typeflag)
+	assert.Equal(t, byte(tar.TypeLink), headers["b-hardlink"].Typeflag)
+	assert.Equal(t, filepath.Join(mockTempDir, "a-file"), headers["b-hardlink"].Linkname)
+	assert.Equal(t, byte(tar.TypeSymlink), headers["c-symlink"].Typeflag)
+	assert.Equal(t, "a-file", headers["c-symlink"].Linkname)
+}
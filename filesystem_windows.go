@@ -0,0 +1,19 @@
+//go:build windows
+
+package main
+
+import (
+	"os"
+)
+
+type fileID struct{}
+
+// hardLinkID always reports false, hard links aren't detected on windows.
+func hardLinkID(info os.FileInfo) (fileID, bool) {
+	return fileID{}, false
+}
+
+// fileOwner always reports false, windows has no uid/gid.
+func fileOwner(info os.FileInfo) (int, int, bool) {
+	return 0, 0, false
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// byteSizeUnits is keyed by unit with any trailing B or iB removed, so K, KB and KiB all match
+var byteSizeUnits = map[string]int64{
+	"":  1,
+	"K": 1 << 10,
+	"M": 1 << 20,
+	"G": 1 << 30,
+	"T": 1 << 40,
+}
+
+// FileFilterConfig limits which files are uploaded by a sync. Sizes accept a unit suffix (IE: 500MB),
+// ages are in minutes.
+type FileFilterConfig struct {
+	MinSize     string
+	MaxSize     string
+	MinAge      int
+	MaxAge      int
+	SkipSpecial bool
+}
+
+type FileFilter struct {
+	minSize     int64
+	maxSize     int64
+	minAge      time.Duration
+	maxAge      time.Duration
+	skipSpecial bool
+}
+
+func NewFileFilter(fc FileFilterConfig) (FileFilter, error) {
+	fileFilter := FileFilter{
+		minAge:      time.Duration(fc.MinAge) * time.Minute,
+		maxAge:      time.Duration(fc.MaxAge) * time.Minute,
+		skipSpecial: fc.SkipSpecial,
+	}
+
+	if fc.MinAge < 0 || fc.MaxAge < 0 {
+		return fileFilter, fmt.Errorf("minage and maxage can't be negative")
+	}
+
+	var sizeErr error
+	if fileFilter.minSize, sizeErr = parseByteSize(fc.MinSize); sizeErr != nil {
+		return fileFilter, fmt.Errorf("Invalid minsize: %s", sizeErr)
+	}
+	if fileFilter.maxSize, sizeErr = parseByteSize(fc.MaxSize); sizeErr != nil {
+		return fileFilter, fmt.Errorf("Invalid maxsize: %s", sizeErr)
+	}
+	if fileFilter.maxSize != 0 && fileFilter.minSize > fileFilter.maxSize {
+		return fileFilter, fmt.Errorf("minsize %s is larger than maxsize %s", fc.MinSize, fc.MaxSize)
+	}
+	if fileFilter.maxAge != 0 && fileFilter.minAge > fileFilter.maxAge {
+		return fileFilter, fmt.Errorf("minage %d is larger than maxage %d", fc.MinAge, fc.MaxAge)
+	}
+
+	return fileFilter, nil
+}
+
+// Skip reports if a file should be left out of a sync and why.
+func (f FileFilter) Skip(info os.FileInfo, now time.Time) (bool, string) {
+	if f.skipSpecial && info.Mode()&(os.ModeSocket|os.ModeNamedPipe|os.ModeDevice|os.ModeCharDevice|os.ModeIrregular) != 0 {
+		return true, fmt.Sprintf("special file of type %s", info.Mode().Type())
+	}
+	if f.minSize != 0 && info.Size() < f.minSize {
+		return true, fmt.Sprintf("size %d is below the minimum", info.Size())
+	}
+	if f.maxSize != 0 && info.Size() > f.maxSize {
+		return true, fmt.Sprintf("size %d is above the maximum", info.Size())
+	}
+
+	age := now.Sub(info.ModTime())
+	if f.minAge != 0 && age < f.minAge {
+		return true, fmt.Sprintf("modified %s ago, may still be written to", age.Round(time.Second))
+	}
+	if f.maxAge != 0 && age > f.maxAge {
+		return true, fmt.Sprintf("modified %s ago, older than the maximum age", age.Round(time.Second))
+	}
+
+	return false, ""
+}
+
+// parseByteSize parses a size such as 512, 10KB or 1.5GB into bytes. An empty string is 0.
+func parseByteSize(sizeStr string) (int64, error) {
+	sizeStr = strings.ToUpper(strings.TrimSpace(sizeStr))
+	if sizeStr == "" {
+		return 0, nil
+	}
+
+	numberEnd := strings.IndexFunc(sizeStr, func(r rune) bool {
+		return (r < '0' || r > '9') && r != '.'
+	})
+	if numberEnd == -1 {
+		numberEnd = len(sizeStr)
+	}
+	number, parseErr := strconv.ParseFloat(sizeStr[:numberEnd], 64)
+	if parseErr != nil {
+		return 0, fmt.Errorf("%q is not a valid size", sizeStr)
+	}
+	unit := strings.TrimSpace(sizeStr[numberEnd:])
+	unit = strings.TrimSuffix(strings.TrimSuffix(unit, "IB"), "B")
+	multiplier, ok := byteSizeUnits[unit]
+	if !ok || number < 0 {
+		return 0, fmt.Errorf("%q is not a valid size", sizeStr)
+	}
+
+	return int64(number * float64(multiplier)), nil
+}
@@ -2,10 +2,13 @@ package main
 
 import (
 	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"fmt"
 	"io"
-	"os"
+	"strconv"
 	"strings"
+	"sync"
 
 	"cloud.google.com/go/storage"
 	"google.golang.org/api/iterator"
@@ -14,11 +17,17 @@ import (
 
 type GCSClient struct {
 	Client *storage.Client
+	// versioning caches if a bucket has object versioning enabled, keyed by bucket name
+	versioning sync.Map
 }
 
-func NewGCSBucketClient(appConfig AppConfig) (BucketClient, error) {
+func NewGCSBucketClient(providerConfig CloudProviderConfig) (BucketClient, error) {
 	var bucketClient BucketClient
-	client, err := storage.NewClient(context.TODO(), option.WithCredentialsFile(appConfig.Provider.CredentialFile))
+	clientOpts := []option.ClientOption{option.WithCredentialsFile(providerConfig.CredentialFile)}
+	if providerConfig.Endpoint != "" {
+		clientOpts = append(clientOpts, option.WithEndpoint(providerConfig.Endpoint))
+	}
+	client, err := storage.NewClient(context.Background(), clientOpts...)
 	if err != nil {
 		return bucketClient, fmt.Errorf("storage.NewClient: %v", err)
 
@@ -28,9 +37,9 @@ func NewGCSBucketClient(appConfig AppConfig) (BucketClient, error) {
 	return bucketClient, nil
 }
 
-func (s *GCSClient) ListObjects(bucketName string) (map[string]ObjectInfo, error) {
-	objectMap := make(map[string]ObjectInfo)
-	objIter := s.Client.Bucket(bucketName).Objects(context.TODO(), nil)
+func (s *GCSClient) WalkObjects(ctx context.Context, bucketName string, opts ListOptions, walkFn ObjectWalkFunc) error {
+	query := &storage.Query{Prefix: opts.Prefix, Delimiter: opts.Delimiter}
+	objIter := s.Client.Bucket(bucketName).Objects(ctx, query)
 	for {
 		attrs, err := objIter.Next()
 		if err == iterator.Done {
@@ -38,19 +47,37 @@ func (s *GCSClient) ListObjects(bucketName string) (map[string]ObjectInfo, error
 
 		}
 		if err != nil {
-			return objectMap, fmt.Errorf("Bucket(%q).Objects: %v", bucketName, err)
+			return fmt.Errorf("Bucket(%q).Objects: %v", bucketName, err)
+
+		}
 
+		// synthetic directory entries only have Prefix populated when listing with a delimiter
+		var walkErr error
+		if attrs.Prefix != "" {
+			walkErr = walkFn(attrs.Prefix, ObjectInfo{IsPrefix: true})
+		} else {
+			objectInfo := ObjectInfo{
+				ModTime:  attrs.Updated,
+				Size:     attrs.Size,
+				Hash:     hex.EncodeToString(attrs.MD5),
+				Metadata: attrs.Metadata,
+			}
+			walkErr = walkFn(attrs.Name, objectInfo)
+		}
+		if walkErr != nil {
+			return ignoreStopWalk(walkErr)
 		}
-		objectMap[attrs.Name] = ObjectInfo{ModTime: attrs.Updated, Size: attrs.Size}
 	}
 
-	return objectMap, nil
+	return nil
 }
 
-func (s *GCSClient) UploadFile(bucketName, key string, file *os.File) error {
+func (s *GCSClient) UploadFile(ctx context.Context, bucketName, key string, body io.Reader, metadata map[string]string) error {
 	object := s.Client.Bucket(bucketName).Object(key)
-	objWriter := object.NewWriter(context.TODO())
-	if _, uploadErr := io.Copy(objWriter, file); uploadErr != nil {
+	objWriter := object.NewWriter(ctx)
+	objWriter.Metadata = metadata
+	if _, uploadErr := io.Copy(objWriter, body); uploadErr != nil {
+		objWriter.Close()
 		return uploadErr
 	}
 	if closeErr := objWriter.Close(); closeErr != nil {
@@ -60,25 +87,268 @@ func (s *GCSClient) UploadFile(bucketName, key string, file *os.File) error {
 	return nil
 }
 
-func (s *GCSClient) CopyObject(sourceBucket, destinationBucket, key string) error {
-	key = strings.TrimPrefix(key, "/")
-	src := s.Client.Bucket(sourceBucket).Object(key)
-	dst := s.Client.Bucket(destinationBucket).Object(key)
+func (s *GCSClient) DownloadObject(ctx context.Context, bucketName, key string, w io.Writer) (ObjectInfo, error) {
+	return s.DownloadObjectVersion(ctx, bucketName, key, "", w)
+}
+
+// DownloadObjectVersion downloads the given generation of an object, or the current one when
+// versionID is empty.
+func (s *GCSClient) DownloadObjectVersion(ctx context.Context, bucketName, key, versionID string, w io.Writer) (ObjectInfo, error) {
+	var objectInfo ObjectInfo
+	object := s.Client.Bucket(bucketName).Object(strings.TrimPrefix(key, "/"))
+	if versionID != "" {
+		generation, parseErr := strconv.ParseInt(versionID, 10, 64)
+		if parseErr != nil {
+			return objectInfo, fmt.Errorf("Invalid generation %s: %s", versionID, parseErr)
+		}
+		object = object.Generation(generation)
+	}
+	attrs, attrsErr := object.Attrs(ctx)
+	if attrsErr != nil {
+		return objectInfo, attrsErr
+	}
+	objectInfo = ObjectInfo{ModTime: attrs.Updated, Size: attrs.Size, Metadata: attrs.Metadata}
 
-	if _, err := dst.CopierFrom(src).Run(context.TODO()); err != nil {
+	// pin the generation so the body matches the attributes that were just read
+	objReader, readerErr := object.Generation(attrs.Generation).NewReader(ctx)
+	if readerErr != nil {
+		return objectInfo, readerErr
+	}
+	defer objReader.Close()
+	_, copyErr := io.Copy(w, objReader)
+
+	return objectInfo, copyErr
+}
+
+func (s *GCSClient) ObjectMetadata(ctx context.Context, bucketName, key string) (map[string]string, error) {
+	attrs, attrsErr := s.Client.Bucket(bucketName).Object(strings.TrimPrefix(key, "/")).Attrs(ctx)
+	if attrsErr != nil {
+		return nil, attrsErr
+	}
+	return attrs.Metadata, nil
+}
+
+func (s *GCSClient) CopyObject(ctx context.Context, sourceBucket, sourceKey, destinationBucket, destinationKey string, opts CopyOptions) error {
+	src := s.Client.Bucket(sourceBucket).Object(strings.TrimPrefix(sourceKey, "/"))
+	dst := s.Client.Bucket(destinationBucket).Object(strings.TrimPrefix(destinationKey, "/"))
+	if opts.SourceVersion != "" {
+		generation, parseErr := strconv.ParseInt(opts.SourceVersion, 10, 64)
+		if parseErr != nil {
+			return fmt.Errorf("Invalid generation %s: %s", opts.SourceVersion, parseErr)
+		}
+		src = src.Generation(generation)
+	}
+
+	copier := dst.CopierFrom(src)
+	copier.StorageClass = opts.StorageClass
+	if _, err := copier.Run(ctx); err != nil {
 		return err
 	}
 
 	return nil
 }
 
-func (s *GCSClient) DeleteObject(bucket string, key string) error {
+func (s *GCSClient) DeleteObject(ctx context.Context, bucket string, key string) error {
 	key = strings.TrimPrefix(key, "/")
 	object := s.Client.Bucket(bucket).Object(key)
 
-	if err := object.Delete(context.TODO()); err != nil {
+	if err := object.Delete(ctx); err != nil {
 		return err
 	}
 
 	return nil
 }
+
+// ObjectVersion returns the object's generation. Every GCS object has one, but it can only be
+// restored after a delete when the bucket keeps noncurrent versions.
+func (s *GCSClient) ObjectVersion(ctx context.Context, bucket string, key string) (string, error) {
+	versioningEnabled, cached := s.versioning.Load(bucket)
+	if !cached {
+		bucketAttrs, bucketErr := s.Client.Bucket(bucket).Attrs(ctx)
+		if bucketErr != nil {
+			return "", bucketErr
+		}
+		versioningEnabled = bucketAttrs.VersioningEnabled
+		s.versioning.Store(bucket, versioningEnabled)
+	}
+	if !versioningEnabled.(bool) {
+		return "", nil
+	}
+
+	attrs, attrsErr := s.Client.Bucket(bucket).Object(strings.TrimPrefix(key, "/")).Attrs(ctx)
+	if attrsErr != nil {
+		return "", attrsErr
+	}
+	return strconv.FormatInt(attrs.Generation, 10), nil
+}
+
+// DeleteObjectVersioned deletes the object only while its generation is still the one just read, so
+// the generation returned is the one the delete made noncurrent.
+func (s *GCSClient) DeleteObjectVersioned(ctx context.Context, bucket string, key string) (string, error) {
+	versionID, versionErr := s.ObjectVersion(ctx, bucket, key)
+	if versionErr != nil {
+		return "", versionErr
+	}
+	if versionID == "" {
+		return "", notVersionedError(bucket)
+	}
+	generation, _ := strconv.ParseInt(versionID, 10, 64)
+	object := s.Client.Bucket(bucket).Object(strings.TrimPrefix(key, "/"))
+	if delErr := object.If(storage.Conditions{GenerationMatch: generation}).Delete(ctx); delErr != nil {
+		return "", delErr
+	}
+	return versionID, nil
+}
+
+// DeleteObjects deletes keys in parallel, the Go client doesn't expose the JSON API's batch requests.
+func (s *GCSClient) DeleteObjects(ctx context.Context, bucket string, keys []string) map[string]error {
+	return deleteInParallel(ctx, bucket, keys, s.DeleteObject)
+}
+
+const (
+	// gcsComposeLimit is the most source objects a single compose request accepts
+	gcsComposeLimit = 32
+	// gcsMaxComponents is the most components a composite object can be made of, counting the
+	// components of every object composed into it
+	gcsMaxComponents = 1024
+)
+
+// GCS has no multipart uploads that survive a restart, so parts are uploaded as objects under
+// gcsUploadPrefix and composed into the final object. A marker object records the key and metadata.
+const (
+	gcsUploadPrefix      = wardenKeyPrefix + "uploads/"
+	gcsUploadMarker      = "upload"
+	metadataUploadKey    = "warden-upload-key"
+	gcsUploadPartPattern = "part-%05d"
+)
+
+func gcsUploadObject(uploadID, name string) string {
+	return gcsUploadPrefix + uploadID + "/" + name
+}
+
+func (s *GCSClient) CreateMultipartUpload(ctx context.Context, bucket, key string, metadata map[string]string) (string, error) {
+	idBytes := make([]byte, 16)
+	if _, randErr := rand.Read(idBytes); randErr != nil {
+		return "", randErr
+	}
+	uploadID := hex.EncodeToString(idBytes)
+
+	markerMetadata := map[string]string{metadataUploadKey: strings.TrimPrefix(key, "/")}
+	for name, value := range metadata {
+		markerMetadata[name] = value
+	}
+	if uploadErr := s.UploadFile(ctx, bucket, gcsUploadObject(uploadID, gcsUploadMarker), strings.NewReader(""), markerMetadata); uploadErr != nil {
+		return "", uploadErr
+	}
+	return uploadID, nil
+}
+
+func (s *GCSClient) UploadPart(ctx context.Context, bucket, key, uploadID string, partNumber int, body io.ReadSeeker, size int64) (string, error) {
+	partObject := s.Client.Bucket(bucket).Object(gcsUploadObject(uploadID, fmt.Sprintf(gcsUploadPartPattern, partNumber)))
+	objWriter := partObject.NewWriter(ctx)
+	if _, uploadErr := io.Copy(objWriter, body); uploadErr != nil {
+		objWriter.Close()
+		return "", uploadErr
+	}
+	if closeErr := objWriter.Close(); closeErr != nil {
+		return "", closeErr
+	}
+	return strconv.FormatInt(objWriter.Attrs().Generation, 10), nil
+}
+
+// CompleteMultipartUpload composes the parts into the final object. Uploads with more parts than a
+// compose request takes are folded into an intermediate object a batch at a time.
+func (s *GCSClient) CompleteMultipartUpload(ctx context.Context, bucket, key, uploadID string, parts []CompletedPart) error {
+	bucketHandle := s.Client.Bucket(bucket)
+	markerAttrs, markerErr := bucketHandle.Object(gcsUploadObject(uploadID, gcsUploadMarker)).Attrs(ctx)
+	if markerErr != nil {
+		return fmt.Errorf("Upload %s not found: %s", uploadID, markerErr)
+	}
+	metadata := make(map[string]string)
+	for name, value := range markerAttrs.Metadata {
+		if name != metadataUploadKey {
+			metadata[name] = value
+		}
+	}
+
+	sources := make([]*storage.ObjectHandle, 0, len(parts))
+	for _, part := range parts {
+		sources = append(sources, bucketHandle.Object(gcsUploadObject(uploadID, fmt.Sprintf(gcsUploadPartPattern, part.Number))))
+	}
+	intermediate := bucketHandle.Object(gcsUploadObject(uploadID, "composed"))
+	for len(sources) > gcsComposeLimit {
+		if _, composeErr := intermediate.ComposerFrom(sources[:gcsComposeLimit]...).Run(ctx); composeErr != nil {
+			return composeErr
+		}
+		sources = append([]*storage.ObjectHandle{intermediate}, sources[gcsComposeLimit:]...)
+	}
+	composer := bucketHandle.Object(strings.TrimPrefix(key, "/")).ComposerFrom(sources...)
+	composer.Metadata = metadata
+	if _, composeErr := composer.Run(ctx); composeErr != nil {
+		return composeErr
+	}
+
+	return s.AbortMultipartUpload(ctx, bucket, key, uploadID)
+}
+
+// AbortMultipartUpload deletes the upload's marker and every part uploaded so far
+func (s *GCSClient) AbortMultipartUpload(ctx context.Context, bucket, key, uploadID string) error {
+	uploadObjects, listErr := ListObjects(ctx, s, bucket, ListOptions{Prefix: gcsUploadPrefix + uploadID + "/"})
+	if listErr != nil {
+		return listErr
+	}
+	keys := make([]string, 0, len(uploadObjects))
+	for objectKey := range uploadObjects {
+		keys = append(keys, objectKey)
+	}
+	for objectKey, delErr := range s.DeleteObjects(ctx, bucket, keys) {
+		return fmt.Errorf("Error deleting %s: %s", objectKey, delErr)
+	}
+	return nil
+}
+
+func (s *GCSClient) ListMultipartUploads(ctx context.Context, bucket string) ([]MultipartUpload, error) {
+	uploads := make([]MultipartUpload, 0)
+	walkErr := s.WalkObjects(ctx, bucket, ListOptions{Prefix: gcsUploadPrefix}, func(objectKey string, info ObjectInfo) error {
+		uploadID := strings.TrimSuffix(strings.TrimPrefix(objectKey, gcsUploadPrefix), "/"+gcsUploadMarker)
+		if uploadID == strings.TrimPrefix(objectKey, gcsUploadPrefix) || strings.Contains(uploadID, "/") {
+			return nil
+		}
+		uploads = append(uploads, MultipartUpload{Key: info.Metadata[metadataUploadKey], UploadID: uploadID, Initiated: info.ModTime})
+		return nil
+	})
+	return uploads, walkErr
+}
+
+// ListParts lists the part objects kept under the upload's prefix, the marker has to be there too
+// or the upload was completed or aborted.
+func (s *GCSClient) ListParts(ctx context.Context, bucket, key, uploadID string) ([]CompletedPart, error) {
+	parts := make([]CompletedPart, 0)
+	found := false
+	objIter := s.Client.Bucket(bucket).Objects(ctx, &storage.Query{Prefix: gcsUploadPrefix + uploadID + "/"})
+	for {
+		attrs, err := objIter.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return parts, fmt.Errorf("Bucket(%q).Objects: %v", bucket, err)
+		}
+		name := strings.TrimPrefix(attrs.Name, gcsUploadPrefix+uploadID+"/")
+		var partNumber int
+		if name == gcsUploadMarker {
+			found = true
+		} else if _, scanErr := fmt.Sscanf(name, gcsUploadPartPattern, &partNumber); scanErr == nil {
+			parts = append(parts, CompletedPart{Number: partNumber, ETag: strconv.FormatInt(attrs.Generation, 10)})
+		}
+	}
+	if !found {
+		return parts, fmt.Errorf("Upload %s not found", uploadID)
+	}
+	return parts, nil
+}
+
+// MaxUploadParts keeps uploads within gcsMaxComponents, every part ends up a component of the object
+func (s *GCSClient) MaxUploadParts() int {
+	return gcsMaxComponents
+}
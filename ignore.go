@@ -0,0 +1,267 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// ignorePattern is a single compiled gitignore style pattern. base is the directory, relative to
+// the sync root, that the pattern was defined in. Patterns from the config have an empty base.
+type ignorePattern struct {
+	base    string
+	negate  bool
+	dirOnly bool
+	regex   *regexp.Regexp
+}
+
+// PathFilter decides which paths under a sync root are excluded. It combines the legacy regex
+// exclusion list, gitignore style ignore patterns from the config and any per directory ignore
+// files found while walking. Include patterns always win over everything else.
+type PathFilter struct {
+	root       string
+	ignoreFile string
+	exclude    *regexp.Regexp
+	ignores    []ignorePattern
+	includes   []ignorePattern
+	lock       *sync.RWMutex
+}
+
+func NewPathFilter(sc SyncConfig) (*PathFilter, error) {
+	pathFilter := &PathFilter{
+		root:       filepath.Clean(sc.SourceFolder),
+		ignoreFile: sc.IgnoreFile,
+		ignores:    make([]ignorePattern, 0),
+		includes:   make([]ignorePattern, 0),
+		lock:       new(sync.RWMutex),
+	}
+
+	// TODO: for now with a small number of exclusion matchers, this OK, but we should figure out
+	// a more efficient way to do this to handle a larger amount of exception patterns
+	if len(sc.Exclude) != 0 {
+		exclude, regexErr := regexp.Compile(strings.Join(sc.Exclude, "|"))
+		if regexErr != nil {
+			return nil, fmt.Errorf("Invalid exclude pattern: %s", regexErr)
+		}
+		pathFilter.exclude = exclude
+	}
+
+	for _, line := range sc.Ignore {
+		pattern, ok, patternErr := parseIgnorePattern("", line)
+		if patternErr != nil {
+			return nil, patternErr
+		}
+		if ok {
+			pathFilter.ignores = append(pathFilter.ignores, pattern)
+		}
+	}
+
+	for _, line := range sc.Include {
+		pattern, ok, patternErr := parseIgnorePattern("", line)
+		if patternErr != nil {
+			return nil, patternErr
+		}
+		if ok {
+			pathFilter.includes = append(pathFilter.includes, pattern)
+		}
+	}
+
+	return pathFilter, nil
+}
+
+// LoadIgnoreFile reads the per directory ignore file from dirPath, if one is configured and
+// present. Patterns in it only apply to paths under dirPath and take precedence over patterns
+// loaded from parent directories.
+func (p *PathFilter) LoadIgnoreFile(dirPath string) error {
+	if p == nil || p.ignoreFile == "" {
+		return nil
+	}
+
+	fd, openErr := os.Open(filepath.Join(dirPath, p.ignoreFile))
+	if os.IsNotExist(openErr) {
+		return nil
+	}
+	if openErr != nil {
+		return openErr
+	}
+	defer fd.Close()
+
+	base := p.relativePath(dirPath)
+	patterns := make([]ignorePattern, 0)
+	scanner := bufio.NewScanner(fd)
+	for scanner.Scan() {
+		pattern, ok, patternErr := parseIgnorePattern(base, scanner.Text())
+		if patternErr != nil {
+			return fmt.Errorf("%s: %s", filepath.Join(dirPath, p.ignoreFile), patternErr)
+		}
+		if ok {
+			patterns = append(patterns, pattern)
+		}
+	}
+	if scanErr := scanner.Err(); scanErr != nil {
+		return scanErr
+	}
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.ignores = append(p.ignores, patterns...)
+
+	return nil
+}
+
+// Excluded reports if the absolute path should be skipped. Like git, anything under an excluded
+// directory is excluded as well, which is what allows the walk to prune those directories.
+func (p *PathFilter) Excluded(absPath string, isDir bool) bool {
+	if p == nil {
+		return false
+	}
+
+	// the legacy regex list has only ever been matched against files
+	if !isDir && p.exclude != nil && p.exclude.MatchString(absPath) {
+		return !p.included(absPath, isDir)
+	}
+
+	relPath := p.relativePath(absPath)
+	if relPath == "" {
+		return false
+	}
+
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+
+	components := strings.Split(relPath, "/")
+	for i := 1; i <= len(components); i++ {
+		candidate := strings.Join(components[:i], "/")
+		candidateIsDir := isDir || i < len(components)
+		if p.ignored(candidate, candidateIsDir) {
+			return !p.included(absPath, isDir)
+		}
+	}
+
+	return false
+}
+
+// ignored applies ignore patterns in order, the last pattern to match decides the outcome so a
+// negated pattern can re-include something an earlier pattern ignored.
+func (p *PathFilter) ignored(relPath string, isDir bool) bool {
+	isIgnored := false
+	for _, pattern := range p.ignores {
+		if pattern.matches(relPath, isDir) {
+			isIgnored = !pattern.negate
+		}
+	}
+	return isIgnored
+}
+
+func (p *PathFilter) included(absPath string, isDir bool) bool {
+	relPath := p.relativePath(absPath)
+	for _, pattern := range p.includes {
+		if pattern.matches(relPath, isDir) {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *PathFilter) relativePath(absPath string) string {
+	relPath, relErr := filepath.Rel(p.root, absPath)
+	if relErr != nil || relPath == "." {
+		return ""
+	}
+	return filepath.ToSlash(relPath)
+}
+
+func (i ignorePattern) matches(relPath string, isDir bool) bool {
+	if i.dirOnly && !isDir {
+		return false
+	}
+	if i.base != "" {
+		if !strings.HasPrefix(relPath, i.base+"/") {
+			return false
+		}
+		relPath = strings.TrimPrefix(relPath, i.base+"/")
+	}
+	return i.regex.MatchString(relPath)
+}
+
+// parseIgnorePattern compiles a single line of gitignore syntax. The boolean return is false for
+// blank lines and comments.
+func parseIgnorePattern(base, line string) (ignorePattern, bool, error) {
+	pattern := ignorePattern{base: base}
+
+	line = strings.TrimRight(line, " \t\r")
+	if line == "" || strings.HasPrefix(line, "#") {
+		return pattern, false, nil
+	}
+	if strings.HasPrefix(line, "!") {
+		pattern.negate = true
+		line = line[1:]
+	} else if strings.HasPrefix(line, `\`) {
+		line = line[1:]
+	}
+	if strings.HasSuffix(line, "/") {
+		pattern.dirOnly = true
+		line = strings.TrimRight(line, "/")
+	}
+	if line == "" {
+		return pattern, false, nil
+	}
+
+	// a pattern with a slash anywhere but the end is relative to the directory it was defined in,
+	// otherwise it can match at any depth below it
+	anchored := strings.Contains(line, "/")
+	line = strings.TrimPrefix(line, "/")
+
+	regexStr := globToRegex(line)
+	if !anchored {
+		regexStr = "(?:.*/)?" + regexStr
+	}
+	regex, regexErr := regexp.Compile("^" + regexStr + "$")
+	if regexErr != nil {
+		return pattern, false, fmt.Errorf("Invalid ignore pattern %q: %s", line, regexErr)
+	}
+	pattern.regex = regex
+
+	return pattern, true, nil
+}
+
+func globToRegex(glob string) string {
+	var regexStr strings.Builder
+	for i := 0; i < len(glob); i++ {
+		c := glob[i]
+		switch {
+		case strings.HasPrefix(glob[i:], "**/") && (i == 0 || glob[i-1] == '/'):
+			regexStr.WriteString("(?:.*/)?")
+			i += 2
+		case strings.HasPrefix(glob[i:], "**"):
+			regexStr.WriteString(".*")
+			i++
+		case c == '*':
+			regexStr.WriteString("[^/]*")
+		case c == '?':
+			regexStr.WriteString("[^/]")
+		case c == '[':
+			end := strings.IndexByte(glob[i+1:], ']')
+			if end == -1 {
+				regexStr.WriteString(regexp.QuoteMeta(string(c)))
+				continue
+			}
+			class := glob[i+1 : i+1+end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			regexStr.WriteString("[" + strings.ReplaceAll(class, `\`, `\\`) + "]")
+			i += end + 1
+		case c == '\\' && i+1 < len(glob):
+			i++
+			regexStr.WriteString(regexp.QuoteMeta(string(glob[i])))
+		default:
+			regexStr.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	return regexStr.String()
+}
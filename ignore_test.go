@@ -0,0 +1,77 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIgnorePatternMatching(t *testing.T) {
+	mockSyncConfig := SyncConfig{
+		SourceFolder: "/folder1",
+		Ignore: []string{
+			"# comments and blank lines are skipped",
+			"",
+			"*.tmp",
+			"/build",
+			"node_modules/",
+			"docs/**/*.pdf",
+			"!keep.tmp",
+		},
+		Include: []string{"build/release.tar"},
+	}
+	pathFilter, filterErr := NewPathFilter(mockSyncConfig)
+	assert.Nil(t, filterErr)
+
+	assert.True(t, pathFilter.Excluded("/folder1/a/b/scratch.tmp", false))
+	assert.False(t, pathFilter.Excluded("/folder1/a/b/keep.tmp", false))
+	assert.True(t, pathFilter.Excluded("/folder1/build", true))
+	assert.True(t, pathFilter.Excluded("/folder1/build/output.bin", false))
+	assert.False(t, pathFilter.Excluded("/folder1/build/release.tar", false))
+	assert.False(t, pathFilter.Excluded("/folder1/a/build", true))
+	assert.True(t, pathFilter.Excluded("/folder1/a/node_modules/pkg/index.js", false))
+	assert.False(t, pathFilter.Excluded("/folder1/a/node_modules", false))
+	assert.True(t, pathFilter.Excluded("/folder1/docs/manual.pdf", false))
+	assert.True(t, pathFilter.Excluded("/folder1/docs/a/b/manual.pdf", false))
+	assert.False(t, pathFilter.Excluded("/folder1/other/manual.pdf", false))
+}
+
+func TestWalkPrunesIgnoredDirectoriesAndHonorsIgnoreFiles(t *testing.T) {
+	mockTempDir, mockTempDirErr := ioutil.TempDir(os.TempDir(), "go-test-stuff")
+	assert.Nil(t, mockTempDirErr)
+	defer os.RemoveAll(mockTempDir)
+
+	mockFiles := []string{
+		"app/main.js",
+		"app/node_modules/pkg/index.js",
+		"app/cache/data.bin",
+		"other/cache/data.bin",
+	}
+	for _, mockFile := range mockFiles {
+		mockPath := filepath.Join(mockTempDir, mockFile)
+		assert.Nil(t, os.MkdirAll(filepath.Dir(mockPath), os.ModePerm))
+		assert.Nil(t, ioutil.WriteFile(mockPath, []byte("data"), 0644))
+	}
+	ignoreFileErr := ioutil.WriteFile(filepath.Join(mockTempDir, "app", ".wardenignore"), []byte("cache/\n"), 0644)
+	assert.Nil(t, ignoreFileErr)
+
+	mockSyncConfig := SyncConfig{
+		SourceFolder: mockTempDir,
+		Ignore:       []string{"node_modules/"},
+		IgnoreFile:   ".wardenignore",
+	}
+	pathFilter, filterErr := NewPathFilter(mockSyncConfig)
+	assert.Nil(t, filterErr)
+
+	fileMap, walkErr := walkDirectoryFiles(mockTempDir, WalkOptions{Filter: pathFilter})
+
+	assert.Nil(t, walkErr)
+	assert.Contains(t, fileMap, filepath.Join(mockTempDir, "app/main.js"))
+	assert.Contains(t, fileMap, filepath.Join(mockTempDir, "app/.wardenignore"))
+	assert.Contains(t, fileMap, filepath.Join(mockTempDir, "other/cache/data.bin"))
+	assert.NotContains(t, fileMap, filepath.Join(mockTempDir, "app/node_modules/pkg/index.js"))
+	assert.NotContains(t, fileMap, filepath.Join(mockTempDir, "app/cache/data.bin"))
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// RewriteRule maps a path relative to SourceFolder onto a different key path. From and To are
+// matched on whole path components so "raw" won't match "rawfiles".
+type RewriteRule struct {
+	From string `required:"true"`
+	To   string
+}
+
+// KeyPrefix returns the configured destination prefix normalized to have no leading slash and a
+// trailing slash, or an empty string when keys are written to the root of the bucket.
+func (sc SyncConfig) KeyPrefix() string {
+	prefix := strings.Trim(sc.Prefix, "/")
+	if prefix == "" {
+		return ""
+	}
+	return prefix + "/"
+}
+
+// KeyForPath converts an absolute local path into the key it is synced to. Keys carry a leading
+// slash which is trimmed before the key is sent to a bucket client.
+func (sc SyncConfig) KeyForPath(localPath string) string {
+	relativePath := strings.TrimPrefix(localPath, strings.TrimSuffix(sc.SourceFolder, "/"))
+	relativePath = strings.TrimPrefix(relativePath, "/")
+
+	for _, rule := range sc.Rewrite {
+		from := strings.Trim(rule.From, "/")
+		if relativePath != from && !strings.HasPrefix(relativePath, from+"/") {
+			continue
+		}
+		to := strings.Trim(rule.To, "/")
+		relativePath = strings.TrimPrefix(path.Join(to, strings.TrimPrefix(relativePath, from)), "/")
+		break
+	}
+
+	return "/" + sc.KeyPrefix() + relativePath
+}
+
+// ManagesKey reports if a bucket key falls under the prefix owned by this sync job. Keys outside
+// of the prefix belong to someone else and must never be tombstoned or deleted, neither must keys
+// the job tombstoned under its tombstone prefix or anything warden keeps under .warden/.
+func (sc SyncConfig) ManagesKey(key string) bool {
+	key = strings.TrimPrefix(key, "/")
+	if strings.HasPrefix(key, wardenKeyPrefix) {
+		return false
+	}
+	if tombstonePrefix := sc.TombstoneKeyPrefix(); tombstonePrefix != "" && strings.HasPrefix(key, tombstonePrefix) {
+		return false
+	}
+	return strings.HasPrefix(key, sc.KeyPrefix())
+}
+
+// RelativePathForKey is the inverse of KeyForPath, returning the path relative to SourceFolder that
+// a key was synced from. The boolean is false for keys outside of the job's prefix.
+func (sc SyncConfig) RelativePathForKey(key string) (string, bool) {
+	if !sc.ManagesKey(key) {
+		return "", false
+	}
+	key = strings.TrimPrefix(key, "/")
+	relativePath := strings.TrimPrefix(key, sc.KeyPrefix())
+
+	for _, rule := range sc.Rewrite {
+		to := strings.Trim(rule.To, "/")
+		if relativePath != to && !strings.HasPrefix(relativePath, to+"/") {
+			continue
+		}
+		from := strings.Trim(rule.From, "/")
+		relativePath = strings.TrimPrefix(path.Join(from, strings.TrimPrefix(relativePath, to)), "/")
+		break
+	}
+
+	return relativePath, relativePath != ""
+}
+
+// LocalPathForKey returns where a key is written to when it's restored under folder. Keys are read
+// from the bucket and can't be trusted, see containedPath.
+func (sc SyncConfig) LocalPathForKey(folder, key string) (string, error) {
+	relativePath, ok := sc.RelativePathForKey(key)
+	if !ok {
+		return "", fmt.Errorf("Key %s isn't managed by the sync of %s", key, sc.SourceFolder)
+	}
+	return containedPath(folder, relativePath)
+}
+
+// containedPath joins a slash separated path read from a bucket onto folder. Paths that are absolute
+// or climb out of folder once cleaned (IE: prefix/../../etc/cron.d/x) are rejected, so nothing in a
+// bucket can make a restore write outside of its target.
+func containedPath(folder, relativePath string) (string, error) {
+	localRelative := filepath.Clean(filepath.FromSlash(relativePath))
+	if path.IsAbs(relativePath) || filepath.IsAbs(localRelative) || filepath.VolumeName(localRelative) != "" ||
+		localRelative == "." || localRelative == ".." || strings.HasPrefix(localRelative, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("Refusing to write %q outside of %s", relativePath, folder)
+	}
+	return filepath.Join(folder, localRelative), nil
+}
+
+// mkdirContained creates dir and any missing parents under folder. containedPath only checks a path
+// lexically, a symlink restored from a bucket could still point one of its parents outside of
+// folder, so every parent already there has to be a real directory.
+func mkdirContained(folder, dir string) error {
+	relativeDir, relErr := filepath.Rel(folder, dir)
+	if relErr != nil || relativeDir == ".." || strings.HasPrefix(relativeDir, ".."+string(filepath.Separator)) {
+		return fmt.Errorf("Refusing to write %q outside of %s", dir, folder)
+	}
+	if mkdirErr := os.MkdirAll(folder, 0755); mkdirErr != nil {
+		return mkdirErr
+	}
+	if relativeDir == "." {
+		return nil
+	}
+
+	current := folder
+	for _, component := range strings.Split(relativeDir, string(filepath.Separator)) {
+		current = filepath.Join(current, component)
+		info, statErr := os.Lstat(current)
+		if os.IsNotExist(statErr) {
+			if mkdirErr := os.Mkdir(current, 0755); mkdirErr != nil && !os.IsExist(mkdirErr) {
+				return mkdirErr
+			}
+			// made by someone else in the meantime, it has to pass the same check
+			info, statErr = os.Lstat(current)
+		}
+		if statErr != nil {
+			return statErr
+		}
+		if info.Mode()&os.ModeSymlink != 0 {
+			return fmt.Errorf("Refusing to write under %s, it's a symlink", current)
+		}
+		if !info.IsDir() {
+			return fmt.Errorf("Refusing to write under %s, it isn't a directory", current)
+		}
+	}
+	return nil
+}
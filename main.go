@@ -1,9 +1,13 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
+	"os"
+	"os/signal"
 	"sync"
+	"syscall"
 
 	//"github.com/davecgh/go-spew/spew"
 	"time"
@@ -13,17 +17,24 @@ import (
 )
 
 func main() {
+	// an interrupt or SIGTERM cancels everything in flight, scheduled jobs and one-off commands alike
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	if len(os.Args) > 1 {
+		if command, ok := commands[os.Args[1]]; ok {
+			if commandErr := command(ctx, os.Args[2:]); commandErr != nil {
+				log.Fatal(commandErr)
+			}
+			return
+		}
+	}
+
 	configFilePath := flag.String("configfile", "/etc/warden.yml", "Configuration File Path")
 	debugLogging := flag.Bool("debug", false, "enable debug logging")
 	flag.Parse()
 
-	logFormatter := new(log.TextFormatter)
-	logFormatter.TimestampFormat = "2006-01-02 15:04:05"
-	logFormatter.FullTimestamp = true
-	log.SetFormatter(logFormatter)
-	if *debugLogging {
-		log.SetLevel(log.DebugLevel)
-	}
+	setupLogging(*debugLogging)
 
 	appConfig, configErr := InitAppConfig(*configFilePath)
 	if configErr != nil {
@@ -37,7 +48,7 @@ func main() {
 	}
 	log.Info("----------")
 
-	bucketClient, clientErr := BucketClientFromConfig(appConfig)
+	bucketClients, clientErr := BucketClientFromConfig(appConfig)
 	notifier, notifierErr := NotifierFromConfig(appConfig)
 	if clientErr != nil {
 		log.Fatalf("Error creating bucket client from config: %s", clientErr)
@@ -47,17 +58,16 @@ func main() {
 	}
 
 	scheduler := gocron.NewScheduler(time.UTC)
+	// the scheduler doesn't wait for running jobs when it's stopped, so they're counted here
+	var runningJobs sync.WaitGroup
 
 	for _, sc := range appConfig.Sync {
 		syncLock := &sync.Mutex{}
 		//var syncLock sync.Mutex
-		scJob, scErr := scheduler.Every(sc.Interval).Minutes().Do(
-			doSync,
-			bucketClient,
-			sc,
-			notifier,
-			syncLock,
-		)
+		sc := sc
+		scJob, scErr := scheduler.Every(sc.Interval).Minutes().Do(trackJob(&runningJobs, func() {
+			doSync(ctx, bucketClients, sc, notifier, syncLock)
+		}))
 		if scErr != nil {
 			log.Fatal(fmt.Errorf("Error setting up sync job for %s: %s", sc.SourceFolder, scErr))
 		}
@@ -70,7 +80,14 @@ func main() {
 	}
 
 	for _, bc := range appConfig.Backup {
-		bcJob, bcErr := scheduler.Cron(bc.At).Do(doBackup, bucketClient, bc, notifier)
+		bucketClient, providerErr := ClientForProvider(bucketClients, bc.Provider)
+		if providerErr != nil {
+			log.Fatal(fmt.Errorf("Error setting up backup job for %s: %s", bc.SourceFolder, providerErr))
+		}
+		bc := bc
+		bcJob, bcErr := scheduler.Cron(bc.At).Do(trackJob(&runningJobs, func() {
+			doBackup(ctx, bucketClient, bc, notifier)
+		}))
 		if bcErr != nil {
 			log.Fatal(bcErr)
 		}
@@ -82,5 +99,60 @@ func main() {
 		log.Info(logString)
 	}
 
-	scheduler.StartBlocking()
+	if appConfig.AbandonedUploadDays > 0 {
+		_, cleanupErr := scheduler.Every(1).Day().Do(trackJob(&runningJobs, func() {
+			abortAbandonedUploads(ctx, bucketClients, appConfig)
+		}))
+		if cleanupErr != nil {
+			log.Fatal(fmt.Errorf("Error setting up abandoned upload cleanup: %s", cleanupErr))
+		}
+		log.Info(fmt.Sprintf("Scheduled daily cleanup of uploads abandoned for %d days", appConfig.AbandonedUploadDays))
+	}
+
+	scheduler.StartAsync()
+	<-ctx.Done()
+	log.Info("Shutting down, waiting for running jobs to cancel")
+	scheduler.Stop()
+	if waitForJobs(&runningJobs, shutdownTimeout) {
+		log.Info("All running jobs have stopped")
+	} else {
+		log.Warn(fmt.Sprintf("Jobs still running after %s, exiting anyway", shutdownTimeout))
+	}
+}
+
+// shutdownTimeout bounds how long running jobs get to stop once they're cancelled
+const shutdownTimeout = 30 * time.Second
+
+// trackJob counts job in runningJobs while it runs
+func trackJob(runningJobs *sync.WaitGroup, job func()) func() {
+	return func() {
+		runningJobs.Add(1)
+		defer runningJobs.Done()
+		job()
+	}
+}
+
+// waitForJobs waits for runningJobs for up to timeout, returning whether they all finished
+func waitForJobs(runningJobs *sync.WaitGroup, timeout time.Duration) bool {
+	done := make(chan struct{})
+	go func() {
+		runningJobs.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+func setupLogging(debugLogging bool) {
+	logFormatter := new(log.TextFormatter)
+	logFormatter.TimestampFormat = "2006-01-02 15:04:05"
+	logFormatter.FullTimestamp = true
+	log.SetFormatter(logFormatter)
+	if debugLogging {
+		log.SetLevel(log.DebugLevel)
+	}
 }
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestShutdownWaitsForRunningJobs(t *testing.T) {
+	var runningJobs sync.WaitGroup
+	started := make(chan struct{})
+	release := make(chan struct{})
+	go trackJob(&runningJobs, func() {
+		close(started)
+		<-release
+	})()
+	<-started
+
+	// a job that doesn't stop is only waited for up to the timeout
+	assert.False(t, waitForJobs(&runningJobs, 50*time.Millisecond))
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		close(release)
+	}()
+	assert.True(t, waitForJobs(&runningJobs, time.Second))
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// object metadata keys used to carry POSIX metadata for synced files. Keys are lower case since S3
+// lower cases user metadata keys anyway.
+const (
+	metadataMode   = "warden-mode"
+	metadataUID    = "warden-uid"
+	metadataGID    = "warden-gid"
+	metadataMtime  = "warden-mtime"
+	metadataXattrs = "warden-xattrs"
+)
+
+// posixSpecialBits maps Go's setuid, setgid and sticky mode bits to their POSIX octal values
+var posixSpecialBits = []struct {
+	goMode os.FileMode
+	posix  uint32
+}{
+	{os.ModeSetuid, 04000},
+	{os.ModeSetgid, 02000},
+	{os.ModeSticky, 01000},
+}
+
+// posixMode converts a FileMode to the octal mode chmod and stat use, IE: 4755 for a setuid binary.
+// Go keeps the special bits far away from the permission bits, so its FileMode can't be stored as is.
+func posixMode(mode os.FileMode) uint32 {
+	posix := uint32(mode.Perm())
+	for _, bit := range posixSpecialBits {
+		if mode&bit.goMode != 0 {
+			posix |= bit.posix
+		}
+	}
+	return posix
+}
+
+// parsePosixMode is the inverse of posixMode. Modes stored before the POSIX layout was used are Go
+// FileMode values, they're told apart by having bits set above the special bits.
+func parsePosixMode(modeStr string) (os.FileMode, error) {
+	mode, parseErr := strconv.ParseUint(modeStr, 8, 32)
+	if parseErr != nil {
+		return 0, parseErr
+	}
+	if mode > 07777 {
+		return os.FileMode(mode) & (os.ModePerm | os.ModeSetuid | os.ModeSetgid | os.ModeSticky), nil
+	}
+	fileMode := os.FileMode(mode).Perm()
+	for _, bit := range posixSpecialBits {
+		if uint32(mode)&bit.posix != 0 {
+			fileMode |= bit.goMode
+		}
+	}
+	return fileMode, nil
+}
+
+// maxXattrMetadataSize keeps encoded extended attributes well under the 2KB S3 allows for all user
+// metadata on an object. Files with more than this are synced without their xattrs.
+const maxXattrMetadataSize = 1536
+
+// posixMetadata collects the mode, ownership, modification time and extended attributes of a file
+// as object metadata. Anything that can't be read is left out rather than failing the upload.
+func posixMetadata(path string, info os.FileInfo) map[string]string {
+	metadata := map[string]string{
+		metadataMode:  strconv.FormatUint(uint64(posixMode(info.Mode())), 8),
+		metadataMtime: info.ModTime().UTC().Format(time.RFC3339Nano),
+	}
+
+	if uid, gid, ok := fileOwner(info); ok {
+		metadata[metadataUID] = strconv.Itoa(uid)
+		metadata[metadataGID] = strconv.Itoa(gid)
+	}
+
+	// symlink xattrs can't be restored on most platforms, so don't bother reading them
+	if info.Mode()&os.ModeSymlink != 0 {
+		return metadata
+	}
+	xattrs, xattrErr := readXattrs(path)
+	if xattrErr != nil {
+		log.Debug(fmt.Sprintf("Unable to read extended attributes for %s: %s", path, xattrErr))
+		return metadata
+	}
+	if len(xattrs) != 0 {
+		encoded, _ := json.Marshal(xattrs)
+		encodedStr := base64.StdEncoding.EncodeToString(encoded)
+		if len(encodedStr) > maxXattrMetadataSize {
+			log.Warn(fmt.Sprintf("Extended attributes for %s are too large to store as metadata, skipping them", path))
+		} else {
+			metadata[metadataXattrs] = encodedStr
+		}
+	}
+
+	return metadata
+}
+
+// metadataModTime returns the original modification time stored with an object, if there is one.
+func metadataModTime(metadata map[string]string) (time.Time, bool) {
+	mtimeStr, ok := metadata[metadataMtime]
+	if !ok {
+		return time.Time{}, false
+	}
+	mtime, parseErr := time.Parse(time.RFC3339Nano, mtimeStr)
+	return mtime, parseErr == nil
+}
+
+// applyPosixMetadata reapplies metadata stored by posixMetadata to a restored file. Ownership can
+// only be changed when running as root, failures there are logged and otherwise ignored.
+func applyPosixMetadata(path string, metadata map[string]string) error {
+	_, isSymlink := metadata[metadataSymlinkTarget]
+
+	uidStr, hasUID := metadata[metadataUID]
+	gidStr, hasGID := metadata[metadataGID]
+	if hasUID && hasGID {
+		uid, uidErr := strconv.Atoi(uidStr)
+		gid, gidErr := strconv.Atoi(gidStr)
+		if uidErr == nil && gidErr == nil {
+			if chownErr := os.Lchown(path, uid, gid); chownErr != nil {
+				log.Debug(fmt.Sprintf("Unable to restore ownership of %s: %s", path, chownErr))
+			}
+		}
+	}
+
+	// permissions and times apply to the link target, which may not be part of the restore
+	if isSymlink {
+		return nil
+	}
+
+	// xattrs go before the mode, a read only mode would keep them from being written
+	if encodedStr, ok := metadata[metadataXattrs]; ok {
+		xattrs := make(map[string][]byte)
+		encoded, decodeErr := base64.StdEncoding.DecodeString(encodedStr)
+		if decodeErr == nil {
+			decodeErr = json.Unmarshal(encoded, &xattrs)
+		}
+		if decodeErr != nil {
+			return fmt.Errorf("Invalid extended attributes: %s", decodeErr)
+		}
+		if xattrErr := writeXattrs(path, xattrs); xattrErr != nil {
+			log.Warn(fmt.Sprintf("Unable to restore extended attributes for %s: %s", path, xattrErr))
+		}
+	}
+
+	if modeStr, ok := metadata[metadataMode]; ok {
+		mode, parseErr := parsePosixMode(modeStr)
+		if parseErr != nil {
+			return fmt.Errorf("Invalid mode %s: %s", modeStr, parseErr)
+		}
+		if chmodErr := os.Chmod(path, mode); chmodErr != nil {
+			return chmodErr
+		}
+	}
+
+	// times go last, anything else touching the file could update them
+	if mtime, ok := metadataModTime(metadata); ok {
+		if chtimesErr := os.Chtimes(path, mtime, mtime); chtimesErr != nil {
+			return chtimesErr
+		}
+	}
+
+	return nil
+}
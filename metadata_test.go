@@ -0,0 +1,104 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPosixMetadataRoundTrip(t *testing.T) {
+	mockTempDir, mockTempDirErr := ioutil.TempDir(os.TempDir(), "go-test-stuff")
+	assert.Nil(t, mockTempDirErr)
+	defer os.RemoveAll(mockTempDir)
+
+	sourcePath := filepath.Join(mockTempDir, "source-file")
+	restoredPath := filepath.Join(mockTempDir, "restored-file")
+	originalModTime := time.Date(2020, 1, 2, 3, 4, 5, 6000, time.UTC)
+	assert.Nil(t, ioutil.WriteFile(sourcePath, []byte("data"), 0640))
+	assert.Nil(t, os.Chtimes(sourcePath, originalModTime, originalModTime))
+	assert.Nil(t, ioutil.WriteFile(restoredPath, []byte("data"), 0600))
+	sourceInfo, statErr := os.Stat(sourcePath)
+	assert.Nil(t, statErr)
+
+	metadata := posixMetadata(sourcePath, sourceInfo)
+	applyErr := applyPosixMetadata(restoredPath, metadata)
+
+	assert.Nil(t, applyErr)
+	assert.Equal(t, "640", metadata[metadataMode])
+	restoredInfo, statErr := os.Stat(restoredPath)
+	assert.Nil(t, statErr)
+	assert.Equal(t, os.FileMode(0640), restoredInfo.Mode())
+	assert.True(t, originalModTime.Equal(restoredInfo.ModTime()))
+}
+
+func TestPosixModeKeepsSpecialBits(t *testing.T) {
+	mockTempDir := t.TempDir()
+	sourcePath := filepath.Join(mockTempDir, "source-file")
+	restoredPath := filepath.Join(mockTempDir, "restored-file")
+	assert.Nil(t, ioutil.WriteFile(sourcePath, []byte("data"), 0755))
+	assert.Nil(t, os.Chmod(sourcePath, 0755|os.ModeSetuid|os.ModeSetgid))
+	assert.Nil(t, ioutil.WriteFile(restoredPath, []byte("data"), 0600))
+	sourceInfo, statErr := os.Stat(sourcePath)
+	assert.Nil(t, statErr)
+
+	metadata := posixMetadata(sourcePath, sourceInfo)
+	assert.Equal(t, "6755", metadata[metadataMode])
+	assert.Nil(t, applyPosixMetadata(restoredPath, metadata))
+
+	restoredInfo, statErr := os.Stat(restoredPath)
+	assert.Nil(t, statErr)
+	assert.Equal(t, 0755|os.ModeSetuid|os.ModeSetgid, restoredInfo.Mode())
+
+	// modes stored as Go FileMode values before the POSIX layout are still read
+	legacyMode, parseErr := parsePosixMode("4000777")
+	assert.Nil(t, parseErr)
+	assert.Equal(t, 0777|os.ModeSticky, legacyMode)
+	stickyMode, parseErr := parsePosixMode("1777")
+	assert.Nil(t, parseErr)
+	assert.Equal(t, 0777|os.ModeSticky, stickyMode)
+}
+
+func TestStoredModTimeUsedWhenListed(t *testing.T) {
+	localModTime := time.Now().Add(-1 * time.Hour)
+	mockFileInfoResults := map[string]os.FileInfo{
+		"/folder1/folder2/unchanged-file": mockFileInfo{
+			timestamp: localModTime,
+			size:      1,
+		},
+		"/folder1/folder2/touched-file": mockFileInfo{
+			timestamp: localModTime,
+			size:      1,
+		},
+	}
+	concreteWalkFunc = createMockWalkFunc(mockFileInfoResults)
+	// the provider's timestamps are newer than the local file, only the stored mtime shows the change
+	mockBucketList := map[string]ObjectInfo{
+		"folder2/unchanged-file": {
+			ModTime:  time.Now(),
+			Size:     1,
+			Metadata: map[string]string{metadataMtime: localModTime.UTC().Format(time.RFC3339Nano)},
+		},
+		"folder2/touched-file": {
+			ModTime:  time.Now(),
+			Size:     1,
+			Metadata: map[string]string{metadataMtime: localModTime.Add(-1 * time.Minute).UTC().Format(time.RFC3339Nano)},
+		},
+	}
+	mockS3Client := NewMockClient(mockBucketList)
+	mockSyncConfig := SyncConfig{
+		SourceFolder:      "/folder1",
+		DestinationBucket: "not-real-bucket",
+	}
+
+	lock := &sync.Mutex{}
+	syncedObjects, syncErr := doSingleDestinationSync(mockS3Client, mockSyncConfig, lock)
+
+	assert.Nil(t, syncErr)
+	assert.Len(t, syncedObjects.Upload, 1)
+	assert.Contains(t, syncedObjects.Upload, "/folder2/touched-file")
+}
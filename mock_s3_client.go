@@ -1,45 +1,381 @@
 package main
 
 import (
-	"os"
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"sync"
+	"time"
 )
 
+// MockS3Client is an in memory bucket client. Uploads and deletes are applied to the mocked listing
+// so multi step syncs see their own changes. Bucket names are recorded but otherwise ignored.
 type MockS3Client struct {
 	UploadRequests []MockRequest
 	CopyRequests   []MockRequest
 	DeleteRequests []MockRequest
-	mockList       map[string]ObjectInfo
+	// PartRequests records multipart upload parts, AbortRequests aborted multipart uploads
+	PartRequests  []MockRequest
+	AbortRequests []MockRequest
+	// MaxParts overrides the most parts an upload can be completed with
+	MaxParts int
+	// ListPrefixes records the prefix of every WalkObjects call
+	ListPrefixes []string
+	// DeleteBatches counts DeleteObjects calls
+	DeleteBatches int
+	// MetadataRequests records ObjectMetadata calls
+	MetadataRequests []MockRequest
+	// ListWithoutMetadata leaves metadata out of listings, like S3 does
+	ListWithoutMetadata bool
+	// DeleteErrors makes deletes of the given keys fail
+	DeleteErrors map[string]error
+	// Versioned makes ObjectVersion return a version for existing objects
+	Versioned    bool
+	mockList     map[string]ObjectInfo
+	mockBodies   map[string][]byte
+	mockVersions map[string]mockVersion
+	mockUploads  map[string]*mockUpload
+	uploadCount  int
+	lock         sync.Mutex
+}
+
+// mockUpload is an incomplete multipart upload
+type mockUpload struct {
+	key       string
+	metadata  map[string]string
+	initiated time.Time
+	parts     map[int][]byte
+}
+
+// mockVersion is an object kept by a versioned mock after it was deleted
+type mockVersion struct {
+	objectInfo ObjectInfo
+	body       []byte
 }
 
 type MockRequest struct {
 	SourceBucket string
 	DestBucket   string
 	Key          string
+	Metadata     map[string]string
+	StorageClass string
+	PartNumber   int
 }
 
 func NewMockClient(mocked map[string]ObjectInfo) *MockS3Client {
+	if mocked == nil {
+		mocked = make(map[string]ObjectInfo)
+	}
 	return &MockS3Client{
 		UploadRequests: make([]MockRequest, 0),
 		mockList:       mocked,
+		mockBodies:     make(map[string][]byte),
+		mockVersions:   make(map[string]mockVersion),
+		mockUploads:    make(map[string]*mockUpload),
 	}
 }
 
-func (s *MockS3Client) UploadFile(bucketName string, key string, file *os.File) error {
-	s.UploadRequests = append(s.UploadRequests, MockRequest{DestBucket: bucketName, Key: key})
+// SetMockBody sets the body returned when a mocked object is downloaded
+func (s *MockS3Client) SetMockBody(key string, body []byte) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.mockBodies[strings.TrimPrefix(key, "/")] = body
+}
+
+func (s *MockS3Client) UploadFile(ctx context.Context, bucketName string, key string, body io.Reader, metadata map[string]string) error {
+	data, readErr := ioutil.ReadAll(body)
+	if readErr != nil {
+		return readErr
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.UploadRequests = append(s.UploadRequests, MockRequest{DestBucket: bucketName, Key: key, Metadata: metadata})
+	key = strings.TrimPrefix(key, "/")
+	if previous, ok := s.mockList[key]; ok && s.Versioned {
+		s.mockVersions["version-"+previous.Hash] = mockVersion{objectInfo: previous, body: s.mockBodies[key]}
+	}
+	hash := md5.Sum(data)
+	s.mockList[key] = ObjectInfo{ModTime: time.Now(), Size: int64(len(data)), Hash: hex.EncodeToString(hash[:]), Metadata: metadata}
+	s.mockBodies[key] = data
 	return nil
 }
 
-func (s *MockS3Client) ListObjects(string) (map[string]ObjectInfo, error) {
-	return s.mockList, nil
+func (s *MockS3Client) DownloadObject(ctx context.Context, bucketName string, key string, w io.Writer) (ObjectInfo, error) {
+	s.lock.Lock()
+	objectInfo, ok := s.mockList[strings.TrimPrefix(key, "/")]
+	body := s.mockBodies[strings.TrimPrefix(key, "/")]
+	s.lock.Unlock()
+	if !ok {
+		return objectInfo, fmt.Errorf("mock object %s does not exist", key)
+	}
+	_, writeErr := w.Write(body)
+	return objectInfo, writeErr
+}
+
+func (s *MockS3Client) DownloadObjectVersion(ctx context.Context, bucketName string, key string, versionID string, w io.Writer) (ObjectInfo, error) {
+	if versionID == "" {
+		return s.DownloadObject(ctx, bucketName, key, w)
+	}
+	s.lock.Lock()
+	version, ok := s.mockVersions[versionID]
+	if current, exists := s.mockList[strings.TrimPrefix(key, "/")]; exists && "version-"+current.Hash == versionID {
+		version, ok = mockVersion{objectInfo: current, body: s.mockBodies[strings.TrimPrefix(key, "/")]}, true
+	}
+	s.lock.Unlock()
+	if !ok {
+		return version.objectInfo, fmt.Errorf("mock version %s does not exist", versionID)
+	}
+	_, writeErr := w.Write(version.body)
+	return version.objectInfo, writeErr
+}
+
+func (s *MockS3Client) ObjectMetadata(ctx context.Context, bucketName string, key string) (map[string]string, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.MetadataRequests = append(s.MetadataRequests, MockRequest{DestBucket: bucketName, Key: key})
+	objectInfo, ok := s.mockList[strings.TrimPrefix(key, "/")]
+	if !ok {
+		return nil, fmt.Errorf("mock object %s does not exist", key)
+	}
+	return objectInfo.Metadata, nil
 }
 
-func (s *MockS3Client) CopyObject(sourceBucket string, destinationBucket string, key string) error {
-	request := MockRequest{SourceBucket: sourceBucket, DestBucket: destinationBucket, Key: key}
+func (s *MockS3Client) WalkObjects(ctx context.Context, bucketName string, opts ListOptions, walkFn ObjectWalkFunc) error {
+	// snapshot the listing so walkFn is free to call back into the client
+	s.lock.Lock()
+	s.ListPrefixes = append(s.ListPrefixes, opts.Prefix)
+	keys := make([]string, 0, len(s.mockList))
+	objects := make(map[string]ObjectInfo)
+	for key, objectInfo := range s.mockList {
+		if s.ListWithoutMetadata {
+			objectInfo.Metadata = nil
+		}
+		keys = append(keys, key)
+		objects[key] = objectInfo
+	}
+	s.lock.Unlock()
+	sort.Strings(keys)
+
+	commonPrefixes := make(map[string]bool)
+	for _, key := range keys {
+		if !strings.HasPrefix(key, opts.Prefix) {
+			continue
+		}
+		if opts.Delimiter != "" {
+			remainder := strings.TrimPrefix(key, opts.Prefix)
+			if idx := strings.Index(remainder, opts.Delimiter); idx != -1 {
+				commonPrefix := opts.Prefix + remainder[:idx+len(opts.Delimiter)]
+				if !commonPrefixes[commonPrefix] {
+					commonPrefixes[commonPrefix] = true
+					if walkErr := walkFn(commonPrefix, ObjectInfo{IsPrefix: true}); walkErr != nil {
+						return ignoreStopWalk(walkErr)
+					}
+				}
+				continue
+			}
+		}
+		if walkErr := walkFn(key, objects[key]); walkErr != nil {
+			return ignoreStopWalk(walkErr)
+		}
+	}
+	return nil
+}
+
+// CopyObject records every copy, copies between keys in the same bucket are applied to the mocked
+// listing. Copies to other buckets aren't since the mock only holds one bucket.
+func (s *MockS3Client) CopyObject(ctx context.Context, sourceBucket, sourceKey, destinationBucket, destinationKey string, opts CopyOptions) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	request := MockRequest{SourceBucket: sourceBucket, DestBucket: destinationBucket, Key: destinationKey, StorageClass: opts.StorageClass}
 	s.CopyRequests = append(s.CopyRequests, request)
+	if sourceBucket == destinationBucket {
+		sourceKey, destinationKey = strings.TrimPrefix(sourceKey, "/"), strings.TrimPrefix(destinationKey, "/")
+		objectInfo, ok := s.mockList[sourceKey]
+		body := s.mockBodies[sourceKey]
+		if opts.SourceVersion != "" {
+			var version mockVersion
+			version, ok = s.mockVersions[opts.SourceVersion]
+			objectInfo, body = version.objectInfo, version.body
+		}
+		if !ok {
+			return fmt.Errorf("mock object %s does not exist", sourceKey)
+		}
+		objectInfo.ModTime = time.Now()
+		s.mockList[destinationKey] = objectInfo
+		s.mockBodies[destinationKey] = body
+	}
 	return nil
 }
-func (s *MockS3Client) DeleteObject(bucket string, key string) error {
+
+func (s *MockS3Client) DeleteObject(ctx context.Context, bucket string, key string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.deleteObject(bucket, key)
+}
+
+func (s *MockS3Client) DeleteObjects(ctx context.Context, bucket string, keys []string) map[string]error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.DeleteBatches++
+	keyErrs := make(map[string]error)
+	for _, key := range keys {
+		if delErr := s.deleteObject(bucket, key); delErr != nil {
+			keyErrs[key] = delErr
+		}
+	}
+	return keyErrs
+}
+
+func (s *MockS3Client) deleteObject(bucket string, key string) error {
+	if delErr, ok := s.DeleteErrors[key]; ok {
+		return delErr
+	}
 	request := MockRequest{DestBucket: bucket, Key: key}
-	s.DeleteRequests = append(s.CopyRequests, request)
+	s.DeleteRequests = append(s.DeleteRequests, request)
+	if objectInfo, ok := s.mockList[strings.TrimPrefix(key, "/")]; ok && s.Versioned {
+		s.mockVersions["version-"+objectInfo.Hash] = mockVersion{objectInfo: objectInfo, body: s.mockBodies[strings.TrimPrefix(key, "/")]}
+	}
+	delete(s.mockList, strings.TrimPrefix(key, "/"))
+	delete(s.mockBodies, strings.TrimPrefix(key, "/"))
+	return nil
+}
+
+// ObjectVersion uses the object's hash as its version when the mock is versioned
+func (s *MockS3Client) ObjectVersion(ctx context.Context, bucket string, key string) (string, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	objectInfo, ok := s.mockList[strings.TrimPrefix(key, "/")]
+	if !ok {
+		return "", fmt.Errorf("mock object %s does not exist", key)
+	}
+	if !s.Versioned {
+		return "", nil
+	}
+	return "version-" + objectInfo.Hash, nil
+}
+
+func (s *MockS3Client) DeleteObjectVersioned(ctx context.Context, bucket string, key string) (string, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	objectInfo, ok := s.mockList[strings.TrimPrefix(key, "/")]
+	if !ok {
+		return "", fmt.Errorf("mock object %s does not exist", key)
+	}
+	if !s.Versioned {
+		return "", notVersionedError(bucket)
+	}
+	if delErr := s.deleteObject(bucket, key); delErr != nil {
+		return "", delErr
+	}
+	return "version-" + objectInfo.Hash, nil
+}
+
+// CreateMultipartUploadAt starts a multipart upload as if it was created at initiated
+func (s *MockS3Client) CreateMultipartUploadAt(key string, metadata map[string]string, initiated time.Time) string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.uploadCount++
+	uploadID := fmt.Sprintf("upload-%d", s.uploadCount)
+	s.mockUploads[uploadID] = &mockUpload{key: strings.TrimPrefix(key, "/"), metadata: metadata, initiated: initiated, parts: make(map[int][]byte)}
+	return uploadID
+}
+
+func (s *MockS3Client) CreateMultipartUpload(ctx context.Context, bucket string, key string, metadata map[string]string) (string, error) {
+	return s.CreateMultipartUploadAt(key, metadata, time.Now()), nil
+}
+
+func (s *MockS3Client) UploadPart(ctx context.Context, bucket string, key string, uploadID string, partNumber int, body io.ReadSeeker, size int64) (string, error) {
+	data, readErr := ioutil.ReadAll(body)
+	if readErr != nil {
+		return "", readErr
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	upload, ok := s.mockUploads[uploadID]
+	if !ok {
+		return "", fmt.Errorf("mock upload %s does not exist", uploadID)
+	}
+	s.PartRequests = append(s.PartRequests, MockRequest{DestBucket: bucket, Key: key, PartNumber: partNumber})
+	upload.parts[partNumber] = data
+	hash := md5.Sum(data)
+	return hex.EncodeToString(hash[:]), nil
+}
+
+// CompleteMultipartUpload concatenates the parts into the object and records it as an upload
+func (s *MockS3Client) CompleteMultipartUpload(ctx context.Context, bucket string, key string, uploadID string, parts []CompletedPart) error {
+	s.lock.Lock()
+	upload, ok := s.mockUploads[uploadID]
+	delete(s.mockUploads, uploadID)
+	s.lock.Unlock()
+	if !ok {
+		return fmt.Errorf("mock upload %s does not exist", uploadID)
+	}
+	if len(parts) > s.MaxUploadParts() {
+		return fmt.Errorf("mock upload %s has %d parts, more than %d", uploadID, len(parts), s.MaxUploadParts())
+	}
+
+	body := make([]byte, 0)
+	for _, part := range parts {
+		data, ok := upload.parts[part.Number]
+		hash := md5.Sum(data)
+		if !ok || hex.EncodeToString(hash[:]) != part.ETag {
+			return fmt.Errorf("mock upload %s has no part %d with ETag %s", uploadID, part.Number, part.ETag)
+		}
+		body = append(body, data...)
+	}
+	return s.UploadFile(ctx, bucket, upload.key, bytes.NewReader(body), upload.metadata)
+}
+
+func (s *MockS3Client) AbortMultipartUpload(ctx context.Context, bucket string, key string, uploadID string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if _, ok := s.mockUploads[uploadID]; !ok {
+		return fmt.Errorf("mock upload %s does not exist", uploadID)
+	}
+	s.AbortRequests = append(s.AbortRequests, MockRequest{DestBucket: bucket, Key: key})
+	delete(s.mockUploads, uploadID)
 	return nil
 }
+
+func (s *MockS3Client) ListMultipartUploads(ctx context.Context, bucket string) ([]MultipartUpload, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	uploads := make([]MultipartUpload, 0, len(s.mockUploads))
+	for uploadID, upload := range s.mockUploads {
+		uploads = append(uploads, MultipartUpload{Key: upload.key, UploadID: uploadID, Initiated: upload.initiated})
+	}
+	sort.Slice(uploads, func(i, j int) bool { return uploads[i].UploadID < uploads[j].UploadID })
+	return uploads, nil
+}
+
+func (s *MockS3Client) ListParts(ctx context.Context, bucket string, key string, uploadID string) ([]CompletedPart, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	upload, ok := s.mockUploads[uploadID]
+	if !ok {
+		return nil, fmt.Errorf("mock upload %s does not exist", uploadID)
+	}
+	parts := make([]CompletedPart, 0, len(upload.parts))
+	for partNumber, data := range upload.parts {
+		hash := md5.Sum(data)
+		parts = append(parts, CompletedPart{Number: partNumber, ETag: hex.EncodeToString(hash[:])})
+	}
+	sort.Slice(parts, func(i, j int) bool { return parts[i].Number < parts[j].Number })
+	return parts, nil
+}
+
+// MaxUploadParts returns MaxParts when it's set, or the S3 limit
+func (s *MockS3Client) MaxUploadParts() int {
+	if s.MaxParts != 0 {
+		return s.MaxParts
+	}
+	return s3MaxUploadParts
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// detectMoves looks for new keys whose local file has the same size and content as an object that
+// is about to be tombstoned or deleted. Those are turned into a server side copy to the new key
+// followed by a delete of the old one, which is far cheaper than uploading the file again. Only
+// local files with the same size as a removed object are hashed. Objects without a hash, IE: S3
+// multipart uploads, are never matched since nothing short of downloading them proves their content
+// is the local file's, those files are uploaded as usual.
+func detectMoves(
+	objectRequests ObjectRequests,
+	newKeys map[string]string,
+	removedObjects map[string]ObjectInfo,
+	uploadCandidates map[string]os.FileInfo,
+) ObjectRequests {
+	removedBySize := make(map[int64][]string)
+	for key, objectInfo := range removedObjects {
+		if objectInfo.Hash == "" {
+			continue
+		}
+		removedBySize[objectInfo.Size] = append(removedBySize[objectInfo.Size], key)
+	}
+	if len(removedBySize) == 0 {
+		return objectRequests
+	}
+
+	movedFrom := make(map[string]bool)
+	for newKey, localPath := range objectRequests.UploadKeys {
+		if _, ok := newKeys[newKey]; !ok {
+			continue
+		}
+		candidates := removedBySize[uploadCandidates[localPath].Size()]
+		if len(candidates) == 0 {
+			continue
+		}
+
+		localHash, hashErr := fileMD5(localPath)
+		if hashErr != nil {
+			log.Debug(fmt.Sprintf("Unable to hash %s for move detection: %s", localPath, hashErr))
+			continue
+		}
+		for _, oldKey := range candidates {
+			if movedFrom[oldKey] || removedObjects[oldKey].Hash != localHash {
+				continue
+			}
+			log.Info(fmt.Sprintf("%s looks like a move of %s, will copy instead of uploading", newKey, oldKey))
+			movedFrom[oldKey] = true
+			objectRequests.MoveKeys[newKey] = oldKey
+			delete(objectRequests.UploadKeys, newKey)
+			break
+		}
+	}
+
+	objectRequests.TombstoneKeys = withoutKeys(objectRequests.TombstoneKeys, movedFrom)
+	objectRequests.DeleteKeys = withoutKeys(objectRequests.DeleteKeys, movedFrom)
+
+	return objectRequests
+}
+
+func fileMD5(path string) (string, error) {
+	fd, openErr := os.Open(path)
+	if openErr != nil {
+		return "", openErr
+	}
+	defer fd.Close()
+
+	hash := md5.New()
+	if _, copyErr := io.Copy(hash, fd); copyErr != nil {
+		return "", copyErr
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+func withoutKeys(keys []string, remove map[string]bool) []string {
+	remaining := make([]string, 0, len(keys))
+	for _, key := range keys {
+		if !remove[key] {
+			remaining = append(remaining, key)
+		}
+	}
+	return remaining
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMovedFileCopiedInsteadOfUploaded(t *testing.T) {
+	mockTempDir, mockTempDirErr := ioutil.TempDir(os.TempDir(), "go-test-stuff")
+	assert.Nil(t, mockTempDirErr)
+	defer os.RemoveAll(mockTempDir)
+	assert.Nil(t, os.MkdirAll(filepath.Join(mockTempDir, "renamed"), os.ModePerm))
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(mockTempDir, "renamed/moved"), []byte("moved content"), 0644))
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(mockTempDir, "new"), []byte("other content"), 0644))
+
+	concreteWalkFunc = walkDirectory
+	mockS3Client := NewMockClient(map[string]ObjectInfo{})
+	mockS3Client.UploadFile(context.Background(), "not-real-bucket", "original", strings.NewReader("moved content"), nil)
+	mockS3Client.UploadFile(context.Background(), "not-real-bucket", "removed", strings.NewReader("removed content"), nil)
+	mockSyncConfig := SyncConfig{
+		SourceFolder:      mockTempDir,
+		DestinationBucket: "not-real-bucket",
+		TombstoneBucket:   "not-real-tombstone-bucket",
+		Destructive:       true,
+		DetectMoves:       true,
+	}
+
+	lock := &sync.Mutex{}
+	syncedObjects, syncErr := doSingleDestinationSync(mockS3Client, mockSyncConfig, lock)
+
+	assert.Nil(t, syncErr)
+	assert.Contains(t, syncedObjects.Move, "/renamed/moved")
+	assert.Contains(t, syncedObjects.Upload, "/new")
+	assert.NotContains(t, syncedObjects.Upload, "/renamed/moved")
+	assert.Contains(t, syncedObjects.Tombstone, "/removed")
+	assert.NotContains(t, syncedObjects.Tombstone, "/original")
+
+	remoteObjects, listErr := ListObjects(context.Background(), mockS3Client, "not-real-bucket", ListOptions{})
+	assert.Nil(t, listErr)
+	assert.Contains(t, remoteObjects, "renamed/moved")
+	assert.NotContains(t, remoteObjects, "original")
+}
+
+func TestMovesIgnoredWhenDetectionDisabled(t *testing.T) {
+	mockTempDir, mockTempDirErr := ioutil.TempDir(os.TempDir(), "go-test-stuff")
+	assert.Nil(t, mockTempDirErr)
+	defer os.RemoveAll(mockTempDir)
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(mockTempDir, "moved"), []byte("moved content"), 0644))
+
+	concreteWalkFunc = walkDirectory
+	mockS3Client := NewMockClient(map[string]ObjectInfo{})
+	mockS3Client.UploadFile(context.Background(), "not-real-bucket", "original", strings.NewReader("moved content"), nil)
+	mockSyncConfig := SyncConfig{
+		SourceFolder:      mockTempDir,
+		DestinationBucket: "not-real-bucket",
+		Destructive:       true,
+	}
+
+	lock := &sync.Mutex{}
+	syncedObjects, syncErr := doSingleDestinationSync(mockS3Client, mockSyncConfig, lock)
+
+	assert.Nil(t, syncErr)
+	assert.Len(t, syncedObjects.Move, 0)
+	assert.Contains(t, syncedObjects.Upload, "/moved")
+	assert.Contains(t, syncedObjects.Delete, "/original")
+}
+
+func TestHashlessObjectsAreNotMatchedAsMoves(t *testing.T) {
+	mockTempDir := t.TempDir()
+	modTime := time.Date(2024, 3, 1, 12, 0, 0, 123456789, time.UTC)
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(mockTempDir, "moved"), []byte("moved content"), 0644))
+	assert.Nil(t, os.Chtimes(filepath.Join(mockTempDir, "moved"), modTime, modTime))
+
+	concreteWalkFunc = walkDirectory
+	// multipart uploads have no hash, a matching size and mtime don't prove the content is the same
+	mockS3Client := NewMockClient(map[string]ObjectInfo{
+		"original": {Size: 13, Metadata: map[string]string{metadataMtime: modTime.Format(time.RFC3339Nano)}},
+	})
+	mockS3Client.ListWithoutMetadata = true
+	mockS3Client.SetMockBody("original", []byte("other content"))
+	mockSyncConfig := SyncConfig{
+		SourceFolder:      mockTempDir,
+		DestinationBucket: "not-real-bucket",
+		TombstoneBucket:   "not-real-tombstone-bucket",
+		Destructive:       true,
+		DetectMoves:       true,
+	}
+
+	lock := &sync.Mutex{}
+	syncedObjects, syncErr := doSingleDestinationSync(mockS3Client, mockSyncConfig, lock)
+
+	assert.Nil(t, syncErr)
+	assert.Len(t, syncedObjects.Move, 0)
+	assert.Contains(t, syncedObjects.Upload, "/moved")
+	assert.Contains(t, syncedObjects.Tombstone, "/original")
+	assert.Equal(t, []byte("moved content"), mockS3Client.mockBodies["moved"])
+}
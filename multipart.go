@@ -0,0 +1,319 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// resumableUploadThreshold is the smallest file uploaded in parts that survive a restart
+var resumableUploadThreshold int64 = 128 * 1024 * 1024
+
+// resumablePartSize is the smallest part size, larger files use bigger parts to stay under the
+// client's MaxUploadParts
+var resumablePartSize int64 = 64 * 1024 * 1024
+
+// resumableUploadConcurrency is how many parts of a file upload at once, as many as the upload
+// manager used for large files before uploads could resume
+const resumableUploadConcurrency = 5
+
+// MultipartClient is implemented by clients that can upload an object in parts which outlive the
+// process, so an interrupted upload of a large file can be picked up where it stopped.
+type MultipartClient interface {
+	CreateMultipartUpload(ctx context.Context, bucket string, key string, metadata map[string]string) (string, error)
+	// UploadPart uploads part partNumber, counting from 1, and returns its ETag
+	UploadPart(ctx context.Context, bucket string, key string, uploadID string, partNumber int, body io.ReadSeeker, size int64) (string, error)
+	CompleteMultipartUpload(ctx context.Context, bucket string, key string, uploadID string, parts []CompletedPart) error
+	AbortMultipartUpload(ctx context.Context, bucket string, key string, uploadID string) error
+	// ListMultipartUploads returns every upload in the bucket that hasn't been completed or aborted
+	ListMultipartUploads(ctx context.Context, bucket string) ([]MultipartUpload, error)
+	// ListParts returns the parts uploaded so far, failing when the upload doesn't exist anymore
+	ListParts(ctx context.Context, bucket string, key string, uploadID string) ([]CompletedPart, error)
+	// MaxUploadParts is the most parts an upload can be completed with
+	MaxUploadParts() int
+}
+
+// CompletedPart is a part that has been uploaded and can be used to complete its upload.
+type CompletedPart struct {
+	Number int
+	ETag   string
+}
+
+// MultipartUpload is an incomplete upload found in a bucket.
+type MultipartUpload struct {
+	Key       string
+	UploadID  string
+	Initiated time.Time
+}
+
+// multipartUploadState is kept for every resumable upload in progress. The file's size and
+// modification time tell if the parts already uploaded still match it.
+type multipartUploadState struct {
+	Bucket   string
+	Key      string
+	UploadID string
+	Size     int64
+	ModTime  time.Time
+	PartSize int64
+	Parts    []CompletedPart
+}
+
+func multipartStatePath(bucket, key string) string {
+	return filepath.Join(stateDirectory, "uploads", stateFileName(".json", bucket, key))
+}
+
+// clientWrapper is implemented by clients that wrap another client, IE: to throttle uploads. Their
+// multipart and move support comes from the wrapped client, wrapped the same way.
+type clientWrapper interface {
+	unwrap() BucketClient
+	wrapMultipart(MultipartClient) MultipartClient
+	wrapMove(MoveClient) MoveClient
+}
+
+// multipartClient returns the client's multipart support, keeping whatever the client was wrapped
+// with, IE: bandwidth limits.
+func multipartClient(client BucketClient) (MultipartClient, bool) {
+	if wrapper, ok := client.(clientWrapper); ok {
+		inner, ok := multipartClient(wrapper.unwrap())
+		if !ok {
+			return nil, false
+		}
+		return wrapper.wrapMultipart(inner), true
+	}
+	multipart, ok := client.(MultipartClient)
+	return multipart, ok
+}
+
+// partSizeFor returns the part size used for a file, growing past resumablePartSize when the file
+// would need more than maxParts parts.
+func partSizeFor(size int64, maxParts int) int64 {
+	partSize := resumablePartSize
+	if minimum := (size + int64(maxParts) - 1) / int64(maxParts); minimum > partSize {
+		partSize = minimum
+	}
+	return partSize
+}
+
+// uploadResumable uploads fd in parts of partSize, resumableUploadConcurrency parts at a time.
+// Each completed part is recorded so a later call for the same file skips it, progress is thrown
+// away when the file changed since it was made.
+func uploadResumable(ctx context.Context, client MultipartClient, bucket, key string, fd *os.File, fileInfo os.FileInfo, metadata map[string]string, partSize int64) error {
+	statePath := multipartStatePath(bucket, key)
+	var state multipartUploadState
+	if readErr := readStateFile(statePath, &state); readErr != nil {
+		log.Warn(fmt.Sprintf("Error reading upload state for %s, starting over: %s", key, readErr))
+		state = multipartUploadState{}
+	}
+	if state.UploadID != "" {
+		parts, ok := resumableParts(ctx, client, state, fileInfo)
+		if ok {
+			state.Parts = parts
+		} else {
+			log.Info(fmt.Sprintf("Discarding interrupted upload of %s", key))
+			if abortErr := client.AbortMultipartUpload(ctx, bucket, key, state.UploadID); abortErr != nil {
+				log.Warn(fmt.Sprintf("Error aborting upload %s of %s: %s", state.UploadID, key, abortErr))
+			}
+			state = multipartUploadState{}
+		}
+	}
+
+	if state.UploadID == "" {
+		uploadID, createErr := client.CreateMultipartUpload(ctx, bucket, key, metadata)
+		if createErr != nil {
+			return createErr
+		}
+		state = multipartUploadState{
+			Bucket:   bucket,
+			Key:      key,
+			UploadID: uploadID,
+			Size:     fileInfo.Size(),
+			ModTime:  fileInfo.ModTime(),
+			PartSize: partSize,
+			Parts:    make([]CompletedPart, 0),
+		}
+		if writeErr := writeStateFile(statePath, state); writeErr != nil {
+			return writeErr
+		}
+	} else {
+		log.Info(fmt.Sprintf("Resuming upload of %s, %d parts are already uploaded", key, len(state.Parts)))
+	}
+
+	uploaded := make(map[int]bool)
+	for _, part := range state.Parts {
+		uploaded[part.Number] = true
+	}
+	partCount := int((state.Size + state.PartSize - 1) / state.PartSize)
+
+	// the first failure stops the parts still waiting, the ones already uploading are left to finish
+	// so whatever they manage to upload is recorded
+	uploadCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var stateLock sync.Mutex
+	var uploadErr error
+	pending := make(chan int)
+	var wg sync.WaitGroup
+	for i := 0; i < resumableUploadConcurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for partNumber := range pending {
+				offset := int64(partNumber-1) * state.PartSize
+				size := state.Size - offset
+				if size > state.PartSize {
+					size = state.PartSize
+				}
+				etag, partErr := client.UploadPart(uploadCtx, bucket, key, state.UploadID, partNumber, io.NewSectionReader(fd, offset, size), size)
+				stateLock.Lock()
+				if partErr != nil {
+					partErr = fmt.Errorf("Part %d failed: %s", partNumber, partErr)
+				} else {
+					state.Parts = append(state.Parts, CompletedPart{Number: partNumber, ETag: etag})
+					partErr = writeStateFile(statePath, state)
+				}
+				if partErr != nil && uploadErr == nil {
+					uploadErr = partErr
+					cancel()
+				}
+				stateLock.Unlock()
+			}
+		}()
+	}
+queueParts:
+	for partNumber := 1; partNumber <= partCount; partNumber++ {
+		if uploaded[partNumber] {
+			continue
+		}
+		select {
+		case pending <- partNumber:
+		case <-uploadCtx.Done():
+			break queueParts
+		}
+	}
+	close(pending)
+	wg.Wait()
+	if uploadErr != nil {
+		return uploadErr
+	}
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+
+	sort.Slice(state.Parts, func(i, j int) bool { return state.Parts[i].Number < state.Parts[j].Number })
+	if completeErr := client.CompleteMultipartUpload(ctx, bucket, key, state.UploadID, state.Parts); completeErr != nil {
+		return completeErr
+	}
+	return os.Remove(statePath)
+}
+
+// resumableParts checks that the file still matches the recorded parts and the upload still exists,
+// it's gone when it was completed, aborted by the cleanup or the bucket lost it. The recorded parts
+// the bucket doesn't have are dropped so they're uploaded again.
+func resumableParts(ctx context.Context, client MultipartClient, state multipartUploadState, fileInfo os.FileInfo) ([]CompletedPart, bool) {
+	if state.Size != fileInfo.Size() || !state.ModTime.Equal(fileInfo.ModTime()) || state.PartSize <= 0 {
+		return nil, false
+	}
+	listedParts, listErr := client.ListParts(ctx, state.Bucket, state.Key, state.UploadID)
+	if listErr != nil {
+		return nil, false
+	}
+	listed := make(map[CompletedPart]bool)
+	for _, part := range listedParts {
+		listed[part] = true
+	}
+	parts := make([]CompletedPart, 0, len(state.Parts))
+	for _, part := range state.Parts {
+		if listed[part] {
+			parts = append(parts, part)
+		}
+	}
+	return parts, true
+}
+
+// trackedUploads returns the uploads recorded in the state directory that have made progress within
+// maxAge, keyed by upload ID. State files for uploads that stalled longer than that are returned
+// separately so they can be removed along with their upload.
+func trackedUploads(maxAge time.Duration, now time.Time) (map[string]bool, map[string]string) {
+	active := make(map[string]bool)
+	stale := make(map[string]string)
+	statePaths, _ := filepath.Glob(filepath.Join(stateDirectory, "uploads", "*.json"))
+	for _, statePath := range statePaths {
+		var state multipartUploadState
+		fileInfo, statErr := os.Stat(statePath)
+		if statErr != nil || readStateFile(statePath, &state) != nil {
+			continue
+		}
+		if now.Sub(fileInfo.ModTime()) < maxAge {
+			active[state.UploadID] = true
+		} else {
+			stale[state.UploadID] = statePath
+		}
+	}
+	return active, stale
+}
+
+// abandonedUploadBuckets returns the buckets uploads are made to, grouped by provider ID
+func abandonedUploadBuckets(appConfig AppConfig) map[string][]string {
+	seen := make(map[string]bool)
+	buckets := make(map[string][]string)
+	add := func(providerID, bucket string) {
+		providerID = providerIDOrDefault(providerID)
+		if !seen[providerID+"\x00"+bucket] {
+			seen[providerID+"\x00"+bucket] = true
+			buckets[providerID] = append(buckets[providerID], bucket)
+		}
+	}
+	for _, sc := range appConfig.Sync {
+		for _, destination := range sc.DestinationList() {
+			add(destination.Provider, destination.Bucket)
+		}
+	}
+	for _, bc := range appConfig.Backup {
+		add(bc.Provider, bc.DestinationBucket)
+	}
+	for _, providerBuckets := range buckets {
+		sort.Strings(providerBuckets)
+	}
+	return buckets
+}
+
+// abortAbandonedUploads aborts incomplete multipart uploads started more than AbandonedUploadDays
+// ago in every bucket warden uploads to. Uploads this host is still resuming are left alone, the
+// parts of an abandoned upload are otherwise billed for without ever becoming an object.
+func abortAbandonedUploads(ctx context.Context, clients map[string]BucketClient, appConfig AppConfig) {
+	now := time.Now()
+	maxAge := time.Duration(appConfig.AbandonedUploadDays) * 24 * time.Hour
+	active, stale := trackedUploads(maxAge, now)
+	for providerID, buckets := range abandonedUploadBuckets(appConfig) {
+		client, ok := multipartClient(clients[providerID])
+		if !ok {
+			continue
+		}
+		for _, bucket := range buckets {
+			uploads, listErr := client.ListMultipartUploads(ctx, bucket)
+			if listErr != nil {
+				log.Warn(fmt.Sprintf("Error listing incomplete uploads in %s: %s", bucket, listErr))
+				continue
+			}
+			for _, upload := range uploads {
+				if active[upload.UploadID] || now.Sub(upload.Initiated) < maxAge {
+					continue
+				}
+				if abortErr := client.AbortMultipartUpload(ctx, bucket, upload.Key, upload.UploadID); abortErr != nil {
+					log.Warn(fmt.Sprintf("Error aborting upload %s of %s in %s: %s", upload.UploadID, upload.Key, bucket, abortErr))
+					continue
+				}
+				log.Info(fmt.Sprintf("Aborted upload of %s in %s started %s", upload.Key, bucket, upload.Initiated.Format(time.RFC3339)))
+				if statePath, ok := stale[upload.UploadID]; ok {
+					os.Remove(statePath)
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// failingPartClient fails the first upload of the given part number
+type failingPartClient struct {
+	*MockS3Client
+	failPart int
+	lock     sync.Mutex
+	failed   bool
+}
+
+func (c *failingPartClient) UploadPart(ctx context.Context, bucket string, key string, uploadID string, partNumber int, body io.ReadSeeker, size int64) (string, error) {
+	c.lock.Lock()
+	fail := !c.failed && partNumber == c.failPart
+	c.failed = c.failed || fail
+	c.lock.Unlock()
+	if fail {
+		return "", fmt.Errorf("connection reset")
+	}
+	return c.MockS3Client.UploadPart(ctx, bucket, key, uploadID, partNumber, body, size)
+}
+
+func setupResumableUpload(t *testing.T) (string, []byte) {
+	mockStateDir, mockStateDirErr := ioutil.TempDir(os.TempDir(), "go-test-stuff")
+	assert.Nil(t, mockStateDirErr)
+	stateDirectory = mockStateDir
+	mockTempDir, mockTempDirErr := ioutil.TempDir(os.TempDir(), "go-test-stuff")
+	assert.Nil(t, mockTempDirErr)
+
+	data := make([]byte, 10*1024)
+	rand.New(rand.NewSource(1)).Read(data)
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(mockTempDir, "big.bin"), data, 0644))
+	return mockTempDir, data
+}
+
+func uploadTestFile(client MultipartClient, filePath string) error {
+	fd, openErr := os.Open(filePath)
+	if openErr != nil {
+		return openErr
+	}
+	defer fd.Close()
+	fileInfo, statErr := fd.Stat()
+	if statErr != nil {
+		return statErr
+	}
+	return uploadResumable(context.Background(), client, "not-real-bucket", "big.bin", fd, fileInfo, map[string]string{"mode": "644"}, 3*1024)
+}
+
+func partNumbers(client *MockS3Client) []int {
+	numbers := make([]int, 0)
+	for _, request := range client.PartRequests {
+		numbers = append(numbers, request.PartNumber)
+	}
+	return numbers
+}
+
+func TestResumableUploadResumesAfterFailure(t *testing.T) {
+	mockTempDir, data := setupResumableUpload(t)
+	defer os.RemoveAll(mockTempDir)
+	defer os.RemoveAll(stateDirectory)
+	mockClient := &failingPartClient{MockS3Client: NewMockClient(nil), failPart: 3}
+	filePath := filepath.Join(mockTempDir, "big.bin")
+
+	assert.ErrorContains(t, uploadTestFile(mockClient, filePath), "Part 3 failed")
+	assert.NotContains(t, partNumbers(mockClient.MockS3Client), 3)
+
+	// a new process picks the upload up from the recorded parts, none of them are uploaded twice
+	assert.Nil(t, uploadTestFile(mockClient, filePath))
+	assert.ElementsMatch(t, []int{1, 2, 3, 4}, partNumbers(mockClient.MockS3Client))
+	var uploaded bytes.Buffer
+	objectInfo, downloadErr := mockClient.DownloadObject(context.Background(), "not-real-bucket", "big.bin", &uploaded)
+	assert.Nil(t, downloadErr)
+	assert.True(t, bytes.Equal(data, uploaded.Bytes()))
+	assert.Equal(t, map[string]string{"mode": "644"}, objectInfo.Metadata)
+
+	uploads, _ := mockClient.ListMultipartUploads(context.Background(), "not-real-bucket")
+	assert.Len(t, uploads, 0)
+	_, statErr := os.Stat(multipartStatePath("not-real-bucket", "big.bin"))
+	assert.True(t, os.IsNotExist(statErr))
+}
+
+func TestResumableUploadStartsOverWhenFileChanges(t *testing.T) {
+	mockTempDir, data := setupResumableUpload(t)
+	defer os.RemoveAll(mockTempDir)
+	defer os.RemoveAll(stateDirectory)
+	mockClient := &failingPartClient{MockS3Client: NewMockClient(nil), failPart: 3}
+	filePath := filepath.Join(mockTempDir, "big.bin")
+	assert.NotNil(t, uploadTestFile(mockClient, filePath))
+	firstParts := len(mockClient.PartRequests)
+
+	changed := append(append([]byte{}, data...), []byte("appended")...)
+	assert.Nil(t, ioutil.WriteFile(filePath, changed, 0644))
+	assert.Nil(t, uploadTestFile(mockClient, filePath))
+
+	assert.Len(t, mockClient.AbortRequests, 1)
+	assert.ElementsMatch(t, []int{1, 2, 3, 4}, partNumbers(mockClient.MockS3Client)[firstParts:])
+	var uploaded bytes.Buffer
+	_, downloadErr := mockClient.DownloadObject(context.Background(), "not-real-bucket", "big.bin", &uploaded)
+	assert.Nil(t, downloadErr)
+	assert.True(t, bytes.Equal(changed, uploaded.Bytes()))
+}
+
+// slowPartClient records how many parts upload at once
+type slowPartClient struct {
+	*MockS3Client
+	lock   sync.Mutex
+	active int
+	peak   int
+}
+
+func (c *slowPartClient) UploadPart(ctx context.Context, bucket string, key string, uploadID string, partNumber int, body io.ReadSeeker, size int64) (string, error) {
+	c.lock.Lock()
+	c.active++
+	if c.active > c.peak {
+		c.peak = c.active
+	}
+	c.lock.Unlock()
+	time.Sleep(20 * time.Millisecond)
+	defer func() {
+		c.lock.Lock()
+		c.active--
+		c.lock.Unlock()
+	}()
+	return c.MockS3Client.UploadPart(ctx, bucket, key, uploadID, partNumber, body, size)
+}
+
+func TestResumableUploadSendsPartsConcurrently(t *testing.T) {
+	mockTempDir, data := setupResumableUpload(t)
+	defer os.RemoveAll(mockTempDir)
+	defer os.RemoveAll(stateDirectory)
+	mockClient := &slowPartClient{MockS3Client: NewMockClient(nil)}
+	filePath := filepath.Join(mockTempDir, "big.bin")
+	fd, openErr := os.Open(filePath)
+	assert.Nil(t, openErr)
+	defer fd.Close()
+	fileInfo, statErr := fd.Stat()
+	assert.Nil(t, statErr)
+
+	assert.Nil(t, uploadResumable(context.Background(), mockClient, "not-real-bucket", "big.bin", fd, fileInfo, nil, 1024))
+	assert.Len(t, mockClient.PartRequests, 10)
+	assert.Greater(t, mockClient.peak, 1)
+	assert.LessOrEqual(t, mockClient.peak, resumableUploadConcurrency)
+	var uploaded bytes.Buffer
+	_, downloadErr := mockClient.DownloadObject(context.Background(), "not-real-bucket", "big.bin", &uploaded)
+	assert.Nil(t, downloadErr)
+	assert.True(t, bytes.Equal(data, uploaded.Bytes()))
+}
+
+func TestUploadFileUsesResumableUploadsForLargeFiles(t *testing.T) {
+	mockTempDir, data := setupResumableUpload(t)
+	defer os.RemoveAll(mockTempDir)
+	defer os.RemoveAll(stateDirectory)
+	defer func(threshold, partSize int64) {
+		resumableUploadThreshold, resumablePartSize = threshold, partSize
+	}(resumableUploadThreshold, resumablePartSize)
+	resumableUploadThreshold, resumablePartSize = 8*1024, 3*1024
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(mockTempDir, "small.bin"), data[:1024], 0644))
+	mockClient := NewMockClient(nil)
+	resultMap := &ResultMap{}
+
+	assert.Nil(t, doUploadFile(context.Background(), mockClient, "not-real-bucket", "/small.bin", filepath.Join(mockTempDir, "small.bin"), resultMap))
+	assert.Len(t, mockClient.PartRequests, 0)
+	assert.Nil(t, doUploadFile(context.Background(), mockClient, "not-real-bucket", "/big.bin", filepath.Join(mockTempDir, "big.bin"), resultMap))
+	assert.ElementsMatch(t, []int{1, 2, 3, 4}, partNumbers(mockClient))
+
+	var uploaded bytes.Buffer
+	objectInfo, downloadErr := mockClient.DownloadObject(context.Background(), "not-real-bucket", "big.bin", &uploaded)
+	assert.Nil(t, downloadErr)
+	assert.True(t, bytes.Equal(data, uploaded.Bytes()))
+	assert.Contains(t, objectInfo.Metadata, metadataMtime)
+}
+
+func TestResumableUploadsStayWithinTheClientsPartLimit(t *testing.T) {
+	mockTempDir, data := setupResumableUpload(t)
+	defer os.RemoveAll(mockTempDir)
+	defer os.RemoveAll(stateDirectory)
+	defer func(threshold, partSize int64) {
+		resumableUploadThreshold, resumablePartSize = threshold, partSize
+	}(resumableUploadThreshold, resumablePartSize)
+	resumableUploadThreshold, resumablePartSize = 8*1024, 4
+
+	// S3 would take the 2560 parts of the smallest part size
+	assert.Equal(t, int64(4), partSizeFor(int64(len(data)), s3MaxUploadParts))
+
+	// a composite GCS object can't be made of more than 1024 parts, so the parts grow instead
+	mockClient := NewMockClient(nil)
+	mockClient.MaxParts = gcsMaxComponents
+	assert.Nil(t, doUploadFile(context.Background(), mockClient, "not-real-bucket", "/big.bin", filepath.Join(mockTempDir, "big.bin"), NewResultMap()))
+	assert.Len(t, mockClient.PartRequests, 1024)
+
+	var uploaded bytes.Buffer
+	_, downloadErr := mockClient.DownloadObject(context.Background(), "not-real-bucket", "big.bin", &uploaded)
+	assert.Nil(t, downloadErr)
+	assert.True(t, bytes.Equal(data, uploaded.Bytes()))
+}
+
+func TestAbortAbandonedUploads(t *testing.T) {
+	mockStateDir, mockStateDirErr := ioutil.TempDir(os.TempDir(), "go-test-stuff")
+	assert.Nil(t, mockStateDirErr)
+	defer os.RemoveAll(mockStateDir)
+	stateDirectory = mockStateDir
+
+	mockClient := NewMockClient(nil)
+	now := time.Now()
+	abandoned := mockClient.CreateMultipartUploadAt("abandoned.bin", nil, now.Add(-8*24*time.Hour))
+	recent := mockClient.CreateMultipartUploadAt("recent.bin", nil, now.Add(-24*time.Hour))
+	resuming := mockClient.CreateMultipartUploadAt("resuming.bin", nil, now.Add(-8*24*time.Hour))
+	stalled := mockClient.CreateMultipartUploadAt("stalled.bin", nil, now.Add(-9*24*time.Hour))
+	assert.Nil(t, writeStateFile(multipartStatePath("not-real-bucket", "resuming.bin"), multipartUploadState{UploadID: resuming}))
+	stalledState := multipartStatePath("not-real-bucket", "stalled.bin")
+	assert.Nil(t, writeStateFile(stalledState, multipartUploadState{UploadID: stalled}))
+	assert.Nil(t, os.Chtimes(stalledState, now.Add(-8*24*time.Hour), now.Add(-8*24*time.Hour)))
+
+	appConfig := AppConfig{
+		AbandonedUploadDays: 7,
+		Sync:                []SyncConfig{{SourceFolder: "/folder1", DestinationBucket: "not-real-bucket"}},
+		Backup:              []BackupConfig{{SourceFolder: "/folder1", DestinationBucket: "not-real-bucket"}},
+	}
+	// bandwidth limits don't hide a client's multipart support
+	limitedClient := limitUploads(mockClient, &RateLimiter{})
+	abortAbandonedUploads(context.Background(), map[string]BucketClient{defaultProviderID: limitedClient}, appConfig)
+
+	uploads, _ := mockClient.ListMultipartUploads(context.Background(), "not-real-bucket")
+	remaining := make([]string, 0)
+	for _, upload := range uploads {
+		remaining = append(remaining, upload.UploadID)
+	}
+	assert.ElementsMatch(t, []string{recent, resuming}, remaining)
+	assert.NotContains(t, remaining, abandoned)
+	_, statErr := os.Stat(stalledState)
+	assert.True(t, os.IsNotExist(statErr))
+}
@@ -5,6 +5,8 @@ import (
 )
 
 type Notifier interface {
-	NotifySyncResults(SyncConfig, *ResultMap) error
+	NotifySyncResults(SyncConfig, SyncDestination, *ResultMap) error
 	NotifyBackupResults(backupConfig BackupConfig, backupFile *os.File, backupErr error) error
+	// NotifyAnomaly alerts on every run of a destination paused by anomaly detection
+	NotifyAnomaly(SyncConfig, SyncDestination, AnomalyReport) error
 }
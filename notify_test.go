@@ -7,6 +7,7 @@ import (
 	"path/filepath"
 	"sync"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -45,7 +46,7 @@ Deleted:
   - uploaded-file => <nil>
 `
 
-	mockNotifier.NotifySyncResults(mockSyncConfig, mockResults)
+	mockNotifier.NotifySyncResults(mockSyncConfig, mockSyncConfig.DestinationList()[0], mockResults)
 
 	mockClient := mockNotifier.Client.(*MockSNSClient)
 	assert.Len(t, mockClient.PublishRequests, 1)
@@ -105,3 +106,35 @@ Error: unauthorized
 	assert.Equal(t, *mockClient.PublishRequests[0].Subject, expectedSubject)
 	assert.Equal(t, *mockClient.PublishRequests[0].Message, expectedMessage)
 }
+
+func TestSNSNotifyAnomaly(t *testing.T) {
+	mockNotifier := &SNSNotifier{
+		Client: NewMockSNSClient(),
+		Topic:  "mock-topic",
+	}
+	mockSyncConfig := SyncConfig{
+		SourceFolder:      "/folder1",
+		DestinationBucket: "not-real-bucket",
+	}
+	mockReport := AnomalyReport{
+		DetectedAt: time.Date(2023, 5, 1, 12, 0, 0, 0, time.UTC),
+		Reasons:    []string{"1 new or changed files have ransomware extensions, IE: /report.docx.locky"},
+		Skipped:    3,
+	}
+	expectedSubject := "Sync paused: /folder1 -> not-real-bucket"
+	expectedMessage := `Sync paused since 2023-05-01T12:00:00Z, 3 overwrites and removals were skipped this run.
+
+Reasons:
+  - 1 new or changed files have ransomware extensions, IE: /report.docx.locky
+
+Once the changes are confirmed to be legitimate resume with:
+  warden approve -source /folder1 -destination default:not-real-bucket
+`
+
+	mockNotifier.NotifyAnomaly(mockSyncConfig, mockSyncConfig.DestinationList()[0], mockReport)
+
+	mockClient := mockNotifier.Client.(*MockSNSClient)
+	assert.Len(t, mockClient.PublishRequests, 1)
+	assert.Equal(t, *mockClient.PublishRequests[0].Subject, expectedSubject)
+	assert.Equal(t, *mockClient.PublishRequests[0].Message, expectedMessage)
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// doRestore downloads every object a sync job wrote to a destination back onto disk under
+// targetFolder, recreating the tree relative to SourceFolder. subPrefix narrows the restore to a
+// path relative to SourceFolder. Per key results are returned, the error is only set when listing
+// the destination fails.
+func doRestore(ctx context.Context, client BucketClient, sc SyncConfig, destination SyncDestination, targetFolder, subPrefix string) (map[string]error, error) {
+	restoreResults := make(map[string]error)
+	listOpts := ListOptions{Prefix: sc.KeyPrefix() + strings.TrimPrefix(subPrefix, "/")}
+
+	walkErr := client.WalkObjects(ctx, destination.Bucket, listOpts, func(key string, objectInfo ObjectInfo) error {
+		if !sc.ManagesKey(key) {
+			return nil
+		}
+		localPath, restoreErr := sc.LocalPathForKey(targetFolder, key)
+		if restoreErr == nil {
+			restoreErr = restoreObject(ctx, client, destination.Bucket, key, targetFolder, localPath)
+		}
+		if restoreErr != nil {
+			log.Warn(fmt.Sprintf("Error restoring %s to %s: %s", key, targetFolder, restoreErr))
+		} else {
+			log.Info(fmt.Sprintf("Restored %s to %s", key, localPath))
+		}
+		restoreResults[key] = restoreErr
+		return nil
+	})
+
+	return restoreResults, walkErr
+}
+
+// UndeleteOptions selects which tombstones doUndelete brings back and where to.
+type UndeleteOptions struct {
+	// SubPrefix narrows the undelete to a path relative to SourceFolder
+	SubPrefix string
+	// only keys tombstoned between From and To are undeleted, zero values leave the range open
+	From time.Time
+	To   time.Time
+	// TargetFolder restores onto local disk instead of back into the destination bucket
+	TargetFolder string
+}
+
+// doUndelete brings back keys a sync job tombstoned. When a key was tombstoned more than once in
+// the time range the latest copy wins. Tombstones are left in place so an undelete can be
+// repeated. Per key results are returned, the error is only set when listing tombstones fails.
+func doUndelete(ctx context.Context, client BucketClient, sc SyncConfig, destination SyncDestination, opts UndeleteOptions) (map[string]error, error) {
+	undeleteResults := make(map[string]error)
+	tombstones, listErr := listTombstones(ctx, client, sc, destination)
+	if listErr != nil {
+		return undeleteResults, listErr
+	}
+
+	subPrefix := strings.Trim(opts.SubPrefix, "/")
+	latest := make(map[string]Tombstone)
+	for _, tombstone := range tombstones {
+		relativePath, ok := sc.RelativePathForKey(tombstone.Key)
+		if !ok || (subPrefix != "" && relativePath != subPrefix && !strings.HasPrefix(relativePath, subPrefix+"/")) {
+			continue
+		}
+		if (!opts.From.IsZero() && tombstone.TombstonedAt.Before(opts.From)) || (!opts.To.IsZero() && tombstone.TombstonedAt.After(opts.To)) {
+			continue
+		}
+		if current, ok := latest[tombstone.Key]; !ok || tombstone.TombstonedAt.After(current.TombstonedAt) {
+			latest[tombstone.Key] = tombstone
+		}
+	}
+
+	for key, tombstone := range latest {
+		var undeleteErr error
+		target := destination.Name() + ":" + key
+		if opts.TargetFolder != "" {
+			if target, undeleteErr = sc.LocalPathForKey(opts.TargetFolder, key); undeleteErr == nil {
+				undeleteErr = restoreObjectVersion(ctx, client, tombstone.Bucket, tombstone.ObjectKey, tombstone.VersionID, opts.TargetFolder, target)
+			} else {
+				target = opts.TargetFolder
+			}
+		} else {
+			copyOpts := CopyOptions{SourceVersion: tombstone.VersionID}
+			undeleteErr = client.CopyObject(ctx, tombstone.Bucket, tombstone.ObjectKey, destination.Bucket, key, copyOpts)
+		}
+		if undeleteErr != nil {
+			log.Warn(fmt.Sprintf("Error undeleting %s to %s: %s", key, target, undeleteErr))
+		} else {
+			log.Info(fmt.Sprintf("Undeleted %s, tombstoned at %s, to %s", key, tombstone.TombstonedAt.Format(time.RFC3339), target))
+		}
+		undeleteResults[key] = undeleteErr
+	}
+
+	return undeleteResults, nil
+}
+
+// restoreObject downloads a single object to localPath under folder. The object is written to a temp
+// file next to localPath and renamed into place so a failed download never leaves a partial file
+// behind. Objects uploaded from preserved symlinks are recreated as symlinks, and any POSIX metadata
+// stored with the object is reapplied. Nothing is written through a symlink between folder and
+// localPath, see mkdirContained.
+func restoreObject(ctx context.Context, client BucketClient, bucket, key, folder, localPath string) error {
+	return restoreObjectVersion(ctx, client, bucket, key, "", folder, localPath)
+}
+
+// restoreObjectVersion is restoreObject for a specific version of an object, an empty versionID
+// restores the current version.
+func restoreObjectVersion(ctx context.Context, client BucketClient, bucket, key, versionID, folder, localPath string) error {
+	if mkdirErr := mkdirContained(folder, filepath.Dir(localPath)); mkdirErr != nil {
+		return mkdirErr
+	}
+
+	tempFile, tempErr := ioutil.TempFile(filepath.Dir(localPath), ".warden-restore-*")
+	if tempErr != nil {
+		return tempErr
+	}
+	defer os.Remove(tempFile.Name())
+
+	objectInfo, downloadErr := client.DownloadObjectVersion(ctx, bucket, key, versionID, tempFile)
+	closeErr := tempFile.Close()
+	if downloadErr != nil {
+		return downloadErr
+	}
+	if closeErr != nil {
+		return closeErr
+	}
+
+	if linkTarget, ok := objectInfo.Metadata[metadataSymlinkTarget]; ok {
+		if removeErr := os.Remove(localPath); removeErr != nil && !os.IsNotExist(removeErr) {
+			return removeErr
+		}
+		if linkErr := os.Symlink(linkTarget, localPath); linkErr != nil {
+			return linkErr
+		}
+		return applyPosixMetadata(localPath, objectInfo.Metadata)
+	}
+
+	if renameErr := os.Rename(tempFile.Name(), localPath); renameErr != nil {
+		return renameErr
+	}
+	return applyPosixMetadata(localPath, objectInfo.Metadata)
+}
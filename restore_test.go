@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRestoreRecreatesFilesAndSymlinks(t *testing.T) {
+	mockTempDir, mockTempDirErr := ioutil.TempDir(os.TempDir(), "go-test-stuff")
+	assert.Nil(t, mockTempDirErr)
+	defer os.RemoveAll(mockTempDir)
+
+	mockS3Client := NewMockClient(map[string]ObjectInfo{
+		"hosts/nas01/folder2/not-real-file": {ModTime: time.Now(), Size: 4},
+		"hosts/nas01/folder2/not-real-link": {
+			ModTime:  time.Now(),
+			Size:     13,
+			Metadata: map[string]string{metadataSymlinkTarget: "not-real-file"},
+		},
+		"hosts/nas01/archive/2023/not-real-photo": {ModTime: time.Now(), Size: 4},
+		"hosts/nas02/folder2/other-hosts-file":    {ModTime: time.Now(), Size: 4},
+	})
+	mockS3Client.SetMockBody("hosts/nas01/folder2/not-real-file", []byte("data"))
+	mockS3Client.SetMockBody("hosts/nas01/folder2/not-real-link", []byte("not-real-file"))
+	mockS3Client.SetMockBody("hosts/nas01/archive/2023/not-real-photo", []byte("data"))
+	mockSyncConfig := SyncConfig{
+		SourceFolder:      "/folder1",
+		DestinationBucket: "not-real-bucket",
+		Prefix:            "hosts/nas01",
+		Rewrite:           []RewriteRule{{From: "raw/2023", To: "archive/2023"}},
+	}
+
+	restoreResults, restoreErr := doRestore(context.Background(), mockS3Client, mockSyncConfig, mockSyncConfig.DestinationList()[0], mockTempDir, "")
+
+	assert.Nil(t, restoreErr)
+	assert.Len(t, restoreResults, 3)
+	for _, keyErr := range restoreResults {
+		assert.Nil(t, keyErr)
+	}
+	restoredFile, readErr := ioutil.ReadFile(filepath.Join(mockTempDir, "folder2/not-real-file"))
+	assert.Nil(t, readErr)
+	assert.Equal(t, "data", string(restoredFile))
+	linkTarget, linkErr := os.Readlink(filepath.Join(mockTempDir, "folder2/not-real-link"))
+	assert.Nil(t, linkErr)
+	assert.Equal(t, "not-real-file", linkTarget)
+	assert.FileExists(t, filepath.Join(mockTempDir, "raw/2023/not-real-photo"))
+}
+
+func TestRestoreRejectsKeysEscapingTheTarget(t *testing.T) {
+	mockTempDir := t.TempDir()
+	targetFolder := filepath.Join(mockTempDir, "restore")
+
+	keys := []string{"hosts/nas01/../../etc/cron.d/x", "hosts/nas01/folder2/../../x", "hosts/nas01/folder2/file"}
+	mockList := make(map[string]ObjectInfo)
+	for _, key := range keys {
+		mockList[key] = ObjectInfo{ModTime: time.Now(), Size: 4}
+	}
+	mockS3Client := NewMockClient(mockList)
+	for _, key := range keys {
+		mockS3Client.SetMockBody(key, []byte("data"))
+	}
+	mockSyncConfig := SyncConfig{SourceFolder: "/folder1", DestinationBucket: "not-real-bucket", Prefix: "hosts/nas01"}
+
+	restoreResults, restoreErr := doRestore(context.Background(), mockS3Client, mockSyncConfig, mockSyncConfig.DestinationList()[0], targetFolder, "")
+
+	assert.Nil(t, restoreErr)
+	assert.Len(t, restoreResults, 3)
+	assert.ErrorContains(t, restoreResults["hosts/nas01/../../etc/cron.d/x"], "outside of")
+	assert.ErrorContains(t, restoreResults["hosts/nas01/folder2/../../x"], "outside of")
+	assert.Nil(t, restoreResults["hosts/nas01/folder2/file"])
+	assert.FileExists(t, filepath.Join(targetFolder, "folder2/file"))
+	assert.NoFileExists(t, filepath.Join(mockTempDir, "x"))
+	assert.NoDirExists(t, filepath.Join(mockTempDir, "etc"))
+}
+
+func TestRestoreRefusesToWriteThroughRestoredSymlinks(t *testing.T) {
+	mockTempDir := t.TempDir()
+	targetFolder := filepath.Join(mockTempDir, "restore")
+	outside := filepath.Join(mockTempDir, "outside")
+	assert.Nil(t, os.Mkdir(outside, 0755))
+
+	// a preserved symlink pointing outside of the target, then a key under it
+	mockS3Client := NewMockClient(map[string]ObjectInfo{
+		"hosts/nas01/a":      {ModTime: time.Now(), Size: int64(len(outside)), Metadata: map[string]string{metadataSymlinkTarget: outside}},
+		"hosts/nas01/a/evil": {ModTime: time.Now(), Size: 4},
+	})
+	mockS3Client.SetMockBody("hosts/nas01/a", []byte(outside))
+	mockS3Client.SetMockBody("hosts/nas01/a/evil", []byte("evil"))
+	mockSyncConfig := SyncConfig{SourceFolder: "/folder1", DestinationBucket: "not-real-bucket", Prefix: "hosts/nas01"}
+
+	restoreResults, restoreErr := doRestore(context.Background(), mockS3Client, mockSyncConfig, mockSyncConfig.DestinationList()[0], targetFolder, "")
+
+	assert.Nil(t, restoreErr)
+	assert.Nil(t, restoreResults["hosts/nas01/a"])
+	assert.ErrorContains(t, restoreResults["hosts/nas01/a/evil"], "symlink")
+	assert.NoFileExists(t, filepath.Join(outside, "evil"))
+	outsideFiles, _ := ioutil.ReadDir(outside)
+	assert.Len(t, outsideFiles, 0)
+}
+
+func TestMkdirContained(t *testing.T) {
+	folder := t.TempDir()
+	assert.Nil(t, mkdirContained(folder, filepath.Join(folder, "a", "b")))
+	assert.DirExists(t, filepath.Join(folder, "a", "b"))
+	assert.Nil(t, os.Symlink(t.TempDir(), filepath.Join(folder, "link")))
+	assert.ErrorContains(t, mkdirContained(folder, filepath.Join(folder, "link", "c")), "symlink")
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(folder, "file"), []byte("data"), 0644))
+	assert.ErrorContains(t, mkdirContained(folder, filepath.Join(folder, "file", "c")), "isn't a directory")
+	assert.ErrorContains(t, mkdirContained(folder, filepath.Dir(folder)), "outside of")
+}
+
+func TestContainedPath(t *testing.T) {
+	for _, relativePath := range []string{"", ".", "..", "../x", "a/../../x", "/etc/passwd"} {
+		_, containErr := containedPath("/restore", relativePath)
+		assert.Error(t, containErr, relativePath)
+	}
+	localPath, containErr := containedPath("/restore", "a/../b/./c")
+	assert.Nil(t, containErr)
+	assert.Equal(t, filepath.Join("/restore", "b", "c"), localPath)
+}
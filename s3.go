@@ -3,85 +3,437 @@ package main
 import (
 	"context"
 	"fmt"
+	"io"
 	"net/url"
-	"os"
 	"strings"
+	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
+	v4 "github.com/aws/aws-sdk-go-v2/aws/signer/v4"
 	"github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
 )
 
 type S3Client struct {
 	Client *s3.Client
 }
 
-func NewS3BucketClient(appConfig AppConfig) (BucketClient, error) {
+func NewS3BucketClient(providerConfig CloudProviderConfig) (BucketClient, error) {
 	var bucketClient BucketClient
 
-	cfg, err := config.LoadDefaultConfig(context.TODO(),
-		config.WithSharedConfigProfile(appConfig.Provider.Profile),
-		config.WithRegion(appConfig.Provider.Region))
+	cfg, err := config.LoadDefaultConfig(context.Background(),
+		config.WithSharedConfigProfile(providerConfig.Profile),
+		config.WithRegion(providerConfig.Region))
 	if err != nil {
 		return bucketClient, fmt.Errorf("Error creating s3 client: %+v\n", err)
 
 	}
-	awsS3Client := s3.NewFromConfig(cfg)
+	awsS3Client := s3.NewFromConfig(cfg, func(o *s3.Options) {
+		// S3 compatible stores like minio are usually reached by a custom endpoint with path style addressing
+		if providerConfig.Endpoint != "" {
+			o.EndpointResolver = s3.EndpointResolverFromURL(providerConfig.Endpoint)
+			o.UsePathStyle = true
+		}
+	})
 	bucketClient = &S3Client{Client: awsS3Client}
 
 	return bucketClient, nil
 }
 
-func (s *S3Client) ListObjects(bucketName string) (map[string]ObjectInfo, error) {
-	bucketFiles := make(map[string]ObjectInfo)
+func (s *S3Client) WalkObjects(ctx context.Context, bucketName string, opts ListOptions, walkFn ObjectWalkFunc) error {
 	listParams := &s3.ListObjectsV2Input{
 		Bucket: aws.String(bucketName),
 	}
+	if opts.Prefix != "" {
+		listParams.Prefix = aws.String(opts.Prefix)
+	}
+	if opts.Delimiter != "" {
+		listParams.Delimiter = aws.String(opts.Delimiter)
+	}
 	paginator := s3.NewListObjectsV2Paginator(s.Client, listParams, func(o *s3.ListObjectsV2PaginatorOptions) {})
 	for paginator.HasMorePages() {
-		currentPage, pageErr := paginator.NextPage(context.TODO())
+		currentPage, pageErr := paginator.NextPage(ctx)
 		if pageErr != nil {
-			return bucketFiles, pageErr
+			return pageErr
 
 		}
+		for _, commonPrefix := range currentPage.CommonPrefixes {
+			if walkErr := walkFn(*commonPrefix.Prefix, ObjectInfo{IsPrefix: true}); walkErr != nil {
+				return ignoreStopWalk(walkErr)
+			}
+		}
 		for _, object := range currentPage.Contents {
-			bucketFiles[*object.Key] = ObjectInfo{ModTime: *object.LastModified, Size: object.Size}
+			objectInfo := ObjectInfo{ModTime: *object.LastModified, Size: object.Size, Hash: etagHash(object.ETag)}
+			if walkErr := walkFn(*object.Key, objectInfo); walkErr != nil {
+				return ignoreStopWalk(walkErr)
+			}
 		}
 	}
 
-	return bucketFiles, nil
+	return nil
 }
 
-func (s *S3Client) UploadFile(bucketName, key string, file *os.File) error {
+func (s *S3Client) UploadFile(ctx context.Context, bucketName, key string, body io.Reader, metadata map[string]string) error {
 	uploader := manager.NewUploader(s.Client)
-	_, putErr := uploader.Upload(context.TODO(), &s3.PutObjectInput{
-		Bucket: aws.String(bucketName),
-		Key:    aws.String(key),
-		Body:   file,
+	_, putErr := uploader.Upload(ctx, &s3.PutObjectInput{
+		Bucket:   aws.String(bucketName),
+		Key:      aws.String(key),
+		Body:     body,
+		Metadata: metadata,
 	})
 
 	return putErr
 }
 
-func (s *S3Client) CopyObject(sourceBucket, destinationBucket, key string) error {
-	source := sourceBucket + "/" + strings.TrimPrefix(key, "/")
+func (s *S3Client) DownloadObject(ctx context.Context, bucketName, key string, w io.Writer) (ObjectInfo, error) {
+	return s.DownloadObjectVersion(ctx, bucketName, key, "", w)
+}
+
+func (s *S3Client) DownloadObjectVersion(ctx context.Context, bucketName, key, versionID string, w io.Writer) (ObjectInfo, error) {
+	var objectInfo ObjectInfo
+	getReq := &s3.GetObjectInput{
+		Bucket: aws.String(bucketName),
+		Key:    aws.String(strings.TrimPrefix(key, "/")),
+	}
+	if versionID != "" {
+		getReq.VersionId = aws.String(versionID)
+	}
+	getResp, getErr := s.Client.GetObject(ctx, getReq)
+	if getErr != nil {
+		return objectInfo, getErr
+	}
+	defer getResp.Body.Close()
+
+	objectInfo.Size = getResp.ContentLength
+	objectInfo.Metadata = getResp.Metadata
+	if getResp.LastModified != nil {
+		objectInfo.ModTime = *getResp.LastModified
+	}
+	_, copyErr := io.Copy(w, getResp.Body)
+
+	return objectInfo, copyErr
+}
+
+func (s *S3Client) ObjectMetadata(ctx context.Context, bucketName, key string) (map[string]string, error) {
+	headResp, headErr := s.Client.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(bucketName),
+		Key:    aws.String(strings.TrimPrefix(key, "/")),
+	})
+	if headErr != nil {
+		return nil, headErr
+	}
+	return headResp.Metadata, nil
+}
+
+func (s *S3Client) CopyObject(ctx context.Context, sourceBucket, sourceKey, destinationBucket, destinationKey string, opts CopyOptions) error {
+	source := url.PathEscape(sourceBucket + "/" + strings.TrimPrefix(sourceKey, "/"))
+	if opts.SourceVersion != "" {
+		source += "?versionId=" + url.QueryEscape(opts.SourceVersion)
+	}
 	copyReq := &s3.CopyObjectInput{
 		Bucket:     aws.String(destinationBucket),
-		CopySource: aws.String(url.PathEscape(source)),
-		Key:        aws.String(strings.TrimPrefix(key, "/")),
+		CopySource: aws.String(source),
+		Key:        aws.String(strings.TrimPrefix(destinationKey, "/")),
+	}
+	if opts.StorageClass != "" {
+		copyReq.StorageClass = types.StorageClass(opts.StorageClass)
+	}
+	_, copyErr := s.Client.CopyObject(ctx, copyReq)
+	if copyErr == nil {
+		return nil
+	}
+
+	// CopyObject is refused for objects over 5GB, those have to be copied a part at a time. The source
+	// is only looked at once a copy failed so smaller copies don't pay for the extra request.
+	headReq := &s3.HeadObjectInput{Bucket: aws.String(sourceBucket), Key: aws.String(strings.TrimPrefix(sourceKey, "/"))}
+	if opts.SourceVersion != "" {
+		headReq.VersionId = aws.String(opts.SourceVersion)
+	}
+	headResp, headErr := s.Client.HeadObject(ctx, headReq)
+	if headErr != nil || headResp.ContentLength <= s3MaxCopySize {
+		return copyErr
+	}
+	return s.copyObjectMultipart(ctx, source, headResp, destinationBucket, destinationKey, opts)
+}
+
+// s3MaxCopySize is the largest object a single CopyObject request can copy
+const s3MaxCopySize = 5 * 1024 * 1024 * 1024
+
+// s3CopyPartSize is the smallest part used by copyObjectMultipart, parts grow past it to keep objects
+// up to the 5TB limit within s3MaxUploadParts parts.
+const s3CopyPartSize = 512 * 1024 * 1024
+
+// s3MaxUploadParts is the most parts a multipart upload can have
+const s3MaxUploadParts = 10000
+
+// copyObjectMultipart copies an object too large for CopyObject with UploadPartCopy. The metadata and
+// content type are carried over from headResp since a multipart upload doesn't copy them itself.
+func (s *S3Client) copyObjectMultipart(ctx context.Context, source string, headResp *s3.HeadObjectOutput, destinationBucket, destinationKey string, opts CopyOptions) error {
+	destinationKey = strings.TrimPrefix(destinationKey, "/")
+	createReq := &s3.CreateMultipartUploadInput{
+		Bucket:      aws.String(destinationBucket),
+		Key:         aws.String(destinationKey),
+		Metadata:    headResp.Metadata,
+		ContentType: headResp.ContentType,
+	}
+	if opts.StorageClass != "" {
+		createReq.StorageClass = types.StorageClass(opts.StorageClass)
+	}
+	createResp, createErr := s.Client.CreateMultipartUpload(ctx, createReq)
+	if createErr != nil {
+		return createErr
+	}
+	uploadID := aws.ToString(createResp.UploadId)
+
+	size := headResp.ContentLength
+	partSize := int64(s3CopyPartSize)
+	if minPartSize := (size + s3MaxUploadParts - 1) / s3MaxUploadParts; minPartSize > partSize {
+		partSize = minPartSize
+	}
+	completedParts := make([]types.CompletedPart, 0, (size+partSize-1)/partSize)
+	for offset, partNumber := int64(0), int32(1); offset < size; offset, partNumber = offset+partSize, partNumber+1 {
+		end := offset + partSize - 1
+		if end >= size {
+			end = size - 1
+		}
+		partResp, partErr := s.Client.UploadPartCopy(ctx, &s3.UploadPartCopyInput{
+			Bucket:          aws.String(destinationBucket),
+			Key:             aws.String(destinationKey),
+			UploadId:        aws.String(uploadID),
+			PartNumber:      partNumber,
+			CopySource:      aws.String(source),
+			CopySourceRange: aws.String(fmt.Sprintf("bytes=%d-%d", offset, end)),
+		})
+		if partErr != nil {
+			s.AbortMultipartUpload(ctx, destinationBucket, destinationKey, uploadID)
+			return partErr
+		}
+		completedParts = append(completedParts, types.CompletedPart{PartNumber: partNumber, ETag: partResp.CopyPartResult.ETag})
+	}
+
+	_, completeErr := s.Client.CompleteMultipartUpload(ctx, &s3.CompleteMultipartUploadInput{
+		Bucket:          aws.String(destinationBucket),
+		Key:             aws.String(destinationKey),
+		UploadId:        aws.String(uploadID),
+		MultipartUpload: &types.CompletedMultipartUpload{Parts: completedParts},
+	})
+	if completeErr != nil {
+		s.AbortMultipartUpload(ctx, destinationBucket, destinationKey, uploadID)
 	}
-	_, copyErr := s.Client.CopyObject(context.TODO(), copyReq)
 
-	return copyErr
+	return completeErr
 }
 
-func (s *S3Client) DeleteObject(bucket string, key string) error {
+func (s *S3Client) DeleteObject(ctx context.Context, bucket string, key string) error {
 	delReq := &s3.DeleteObjectInput{
 		Bucket: aws.String(bucket),
 		Key:    aws.String(strings.TrimPrefix(key, "/")),
 	}
-	_, delErr := s.Client.DeleteObject(context.TODO(), delReq)
+	_, delErr := s.Client.DeleteObject(ctx, delReq)
 
 	return delErr
 }
+
+func (s *S3Client) DeleteObjects(ctx context.Context, bucket string, keys []string) map[string]error {
+	keyErrs := make(map[string]error)
+	if len(keys) == 0 {
+		return keyErrs
+	}
+
+	// S3 reports errors against the trimmed key, map them back to the keys we were given
+	objectKeys := make(map[string]string)
+	objects := make([]types.ObjectIdentifier, 0, len(keys))
+	for _, key := range keys {
+		objectKey := strings.TrimPrefix(key, "/")
+		objectKeys[objectKey] = key
+		objects = append(objects, types.ObjectIdentifier{Key: aws.String(objectKey)})
+	}
+	delReq := &s3.DeleteObjectsInput{
+		Bucket: aws.String(bucket),
+		Delete: &types.Delete{Objects: objects, Quiet: true},
+	}
+	delResp, delErr := s.Client.DeleteObjects(ctx, delReq)
+	if delErr != nil {
+		for _, key := range keys {
+			keyErrs[key] = delErr
+		}
+		return keyErrs
+	}
+
+	for _, objectErr := range delResp.Errors {
+		key := objectKeys[aws.ToString(objectErr.Key)]
+		keyErrs[key] = fmt.Errorf("%s: %s", aws.ToString(objectErr.Code), aws.ToString(objectErr.Message))
+	}
+
+	return keyErrs
+}
+
+func (s *S3Client) ObjectVersion(ctx context.Context, bucket string, key string) (string, error) {
+	headReq := &s3.HeadObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(strings.TrimPrefix(key, "/")),
+	}
+	headResp, headErr := s.Client.HeadObject(ctx, headReq)
+	if headErr != nil {
+		return "", headErr
+	}
+
+	// objects written before versioning was enabled, or in unversioned buckets, have a null version
+	versionID := aws.ToString(headResp.VersionId)
+	if versionID == "null" {
+		return "", nil
+	}
+	return versionID, nil
+}
+
+// DeleteObjectVersioned deletes the object, then lists the version right after the delete marker it
+// created. Versions of a key are listed newest first, so that's the version the delete hid.
+func (s *S3Client) DeleteObjectVersioned(ctx context.Context, bucket string, key string) (string, error) {
+	objectKey := strings.TrimPrefix(key, "/")
+	delResp, delErr := s.Client.DeleteObject(ctx, &s3.DeleteObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(objectKey),
+	})
+	if delErr != nil {
+		return "", delErr
+	}
+	if !delResp.DeleteMarker || delResp.VersionId == nil {
+		return "", fmt.Errorf("Deleting %s didn't create a delete marker, bucket %s does not have versioning enabled", key, bucket)
+	}
+
+	listResp, listErr := s.Client.ListObjectVersions(ctx, &s3.ListObjectVersionsInput{
+		Bucket:          aws.String(bucket),
+		Prefix:          aws.String(objectKey),
+		KeyMarker:       aws.String(objectKey),
+		VersionIdMarker: delResp.VersionId,
+		MaxKeys:         1,
+	})
+	if listErr != nil {
+		return "", fmt.Errorf("Error looking up the version of %s hidden by its delete marker: %s", key, listErr)
+	}
+	if len(listResp.Versions) == 0 || aws.ToString(listResp.Versions[0].Key) != objectKey {
+		return "", fmt.Errorf("No version of %s is left behind its delete marker", key)
+	}
+	return aws.ToString(listResp.Versions[0].VersionId), nil
+}
+
+func (s *S3Client) CreateMultipartUpload(ctx context.Context, bucket, key string, metadata map[string]string) (string, error) {
+	createResp, createErr := s.Client.CreateMultipartUpload(ctx, &s3.CreateMultipartUploadInput{
+		Bucket:   aws.String(bucket),
+		Key:      aws.String(strings.TrimPrefix(key, "/")),
+		Metadata: metadata,
+	})
+	if createErr != nil {
+		return "", createErr
+	}
+	return aws.ToString(createResp.UploadId), nil
+}
+
+// UploadPart sends the part unsigned, signing it would read the whole part an extra time to hash it.
+func (s *S3Client) UploadPart(ctx context.Context, bucket, key, uploadID string, partNumber int, body io.ReadSeeker, size int64) (string, error) {
+	partResp, partErr := s.Client.UploadPart(ctx, &s3.UploadPartInput{
+		Bucket:        aws.String(bucket),
+		Key:           aws.String(strings.TrimPrefix(key, "/")),
+		UploadId:      aws.String(uploadID),
+		PartNumber:    int32(partNumber),
+		Body:          body,
+		ContentLength: size,
+	}, s3.WithAPIOptions(v4.SwapComputePayloadSHA256ForUnsignedPayloadMiddleware))
+	if partErr != nil {
+		return "", partErr
+	}
+	return aws.ToString(partResp.ETag), nil
+}
+
+func (s *S3Client) CompleteMultipartUpload(ctx context.Context, bucket, key, uploadID string, parts []CompletedPart) error {
+	completedParts := make([]types.CompletedPart, 0, len(parts))
+	for _, part := range parts {
+		completedParts = append(completedParts, types.CompletedPart{PartNumber: int32(part.Number), ETag: aws.String(part.ETag)})
+	}
+	_, completeErr := s.Client.CompleteMultipartUpload(ctx, &s3.CompleteMultipartUploadInput{
+		Bucket:          aws.String(bucket),
+		Key:             aws.String(strings.TrimPrefix(key, "/")),
+		UploadId:        aws.String(uploadID),
+		MultipartUpload: &types.CompletedMultipartUpload{Parts: completedParts},
+	})
+
+	return completeErr
+}
+
+func (s *S3Client) AbortMultipartUpload(ctx context.Context, bucket, key, uploadID string) error {
+	_, abortErr := s.Client.AbortMultipartUpload(ctx, &s3.AbortMultipartUploadInput{
+		Bucket:   aws.String(bucket),
+		Key:      aws.String(strings.TrimPrefix(key, "/")),
+		UploadId: aws.String(uploadID),
+	})
+
+	return abortErr
+}
+
+func (s *S3Client) ListMultipartUploads(ctx context.Context, bucket string) ([]MultipartUpload, error) {
+	uploads := make([]MultipartUpload, 0)
+	listReq := &s3.ListMultipartUploadsInput{Bucket: aws.String(bucket)}
+	for {
+		listResp, listErr := s.Client.ListMultipartUploads(ctx, listReq)
+		if listErr != nil {
+			return uploads, listErr
+		}
+		for _, upload := range listResp.Uploads {
+			var initiated time.Time
+			if upload.Initiated != nil {
+				initiated = *upload.Initiated
+			}
+			uploads = append(uploads, MultipartUpload{
+				Key:       aws.ToString(upload.Key),
+				UploadID:  aws.ToString(upload.UploadId),
+				Initiated: initiated,
+			})
+		}
+		if !listResp.IsTruncated {
+			return uploads, nil
+		}
+		listReq.KeyMarker = listResp.NextKeyMarker
+		listReq.UploadIdMarker = listResp.NextUploadIdMarker
+	}
+}
+
+func (s *S3Client) ListParts(ctx context.Context, bucket, key, uploadID string) ([]CompletedPart, error) {
+	parts := make([]CompletedPart, 0)
+	listReq := &s3.ListPartsInput{
+		Bucket:   aws.String(bucket),
+		Key:      aws.String(strings.TrimPrefix(key, "/")),
+		UploadId: aws.String(uploadID),
+	}
+	for {
+		listResp, listErr := s.Client.ListParts(ctx, listReq)
+		if listErr != nil {
+			return parts, listErr
+		}
+		for _, part := range listResp.Parts {
+			parts = append(parts, CompletedPart{Number: int(part.PartNumber), ETag: aws.ToString(part.ETag)})
+		}
+		if !listResp.IsTruncated {
+			return parts, nil
+		}
+		listReq.PartNumberMarker = listResp.NextPartNumberMarker
+	}
+}
+
+func (s *S3Client) MaxUploadParts() int {
+	return s3MaxUploadParts
+}
+
+// etagHash returns the ETag as an MD5 hash. ETags of multipart uploads aren't the MD5 of the content
+// and are marked with a part count suffix, those return an empty string.
+func etagHash(etag *string) string {
+	if etag == nil {
+		return ""
+	}
+	hash := strings.Trim(*etag, "\"")
+	if strings.Contains(hash, "-") {
+		return ""
+	}
+	return hash
+}
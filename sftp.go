@@ -0,0 +1,529 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/sftp"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+const (
+	// sftpInternalDir holds upload temp files and object metadata under each bucket's base directory,
+	// it's outside of the key space so listings skip it.
+	sftpInternalDir = ".warden-sftp"
+	sftpDefaultPort = "22"
+	sftpDialTimeout = 30 * time.Second
+)
+
+// SFTPClient maps buckets to base directories on a remote host reached over SSH. Relative bucket
+// paths are relative to the login directory. Files have no metadata of their own, so the metadata
+// passed to UploadFile is kept in a JSON file per key under sftpInternalDir.
+type SFTPClient struct {
+	address         string
+	user            string
+	signer          ssh.Signer
+	agentSocket     string
+	hostKeyCallback ssh.HostKeyCallback
+
+	lock       sync.Mutex
+	sshClient  *ssh.Client
+	sftpClient *sftp.Client
+}
+
+// NewSFTPBucketClient authenticates with the key file and/or the ssh agent from SSH_AUTH_SOCK, the
+// host key has to be in the known hosts file. The connection is made on first use and made again
+// whenever it drops, so a host that's offline at startup doesn't stop warden from starting.
+func NewSFTPBucketClient(providerConfig CloudProviderConfig) (BucketClient, error) {
+	var bucketClient BucketClient
+	if providerConfig.Endpoint == "" {
+		return bucketClient, fmt.Errorf("SFTP provider %s needs an endpoint", providerConfig.ID)
+	}
+	if providerConfig.User == "" {
+		return bucketClient, fmt.Errorf("SFTP provider %s needs a user", providerConfig.ID)
+	}
+	address := providerConfig.Endpoint
+	if _, _, splitErr := net.SplitHostPort(address); splitErr != nil {
+		address = net.JoinHostPort(address, sftpDefaultPort)
+	}
+
+	sftpClient := &SFTPClient{
+		address:     address,
+		user:        providerConfig.User,
+		agentSocket: os.Getenv("SSH_AUTH_SOCK"),
+	}
+	if providerConfig.KeyFile != "" {
+		keyBytes, readErr := ioutil.ReadFile(providerConfig.KeyFile)
+		if readErr != nil {
+			return bucketClient, fmt.Errorf("Unable to read ssh key: %s", readErr)
+		}
+		signer, parseErr := ssh.ParsePrivateKey(keyBytes)
+		if parseErr != nil {
+			return bucketClient, fmt.Errorf("Unable to parse ssh key %s: %s", providerConfig.KeyFile, parseErr)
+		}
+		sftpClient.signer = signer
+	}
+	if sftpClient.signer == nil && sftpClient.agentSocket == "" {
+		return bucketClient, fmt.Errorf("SFTP provider %s needs a keyfile or a running ssh agent", providerConfig.ID)
+	}
+
+	knownHostsFile := providerConfig.KnownHostsFile
+	if knownHostsFile == "" {
+		homeDir, homeErr := os.UserHomeDir()
+		if homeErr != nil {
+			return bucketClient, fmt.Errorf("SFTP provider %s needs a knownhostsfile: %s", providerConfig.ID, homeErr)
+		}
+		knownHostsFile = filepath.Join(homeDir, ".ssh", "known_hosts")
+	}
+	hostKeyCallback, knownHostsErr := knownhosts.New(knownHostsFile)
+	if knownHostsErr != nil {
+		return bucketClient, fmt.Errorf("Unable to read known hosts: %s", knownHostsErr)
+	}
+	sftpClient.hostKeyCallback = hostKeyCallback
+	bucketClient = sftpClient
+
+	return bucketClient, nil
+}
+
+// connect returns the current connection, dialing a new one if there isn't one
+func (s *SFTPClient) connect(ctx context.Context) (*sftp.Client, *ssh.Client, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.sftpClient != nil {
+		return s.sftpClient, s.sshClient, nil
+	}
+
+	auth := make([]ssh.AuthMethod, 0, 2)
+	if s.signer != nil {
+		auth = append(auth, ssh.PublicKeys(s.signer))
+	}
+	if s.agentSocket != "" {
+		agentConn, agentErr := net.Dial("unix", s.agentSocket)
+		if agentErr != nil {
+			log.Warn(fmt.Sprintf("Unable to reach the ssh agent: %s", agentErr))
+		} else {
+			// the agent is only needed to sign during the handshake
+			defer agentConn.Close()
+			auth = append(auth, ssh.PublicKeysCallback(agent.NewClient(agentConn).Signers))
+		}
+	}
+
+	dialer := net.Dialer{Timeout: sftpDialTimeout}
+	conn, dialErr := dialer.DialContext(ctx, "tcp", s.address)
+	if dialErr != nil {
+		return nil, nil, dialErr
+	}
+	handshakeDeadline := time.Now().Add(sftpDialTimeout)
+	if deadline, ok := ctx.Deadline(); ok && deadline.Before(handshakeDeadline) {
+		handshakeDeadline = deadline
+	}
+	conn.SetDeadline(handshakeDeadline)
+	sshConn, chans, reqs, handshakeErr := ssh.NewClientConn(conn, s.address, &ssh.ClientConfig{
+		User:            s.user,
+		Auth:            auth,
+		HostKeyCallback: s.hostKeyCallback,
+	})
+	if handshakeErr != nil {
+		conn.Close()
+		return nil, nil, fmt.Errorf("Error connecting to %s: %s", s.address, handshakeErr)
+	}
+	conn.SetDeadline(time.Time{})
+
+	sshClient := ssh.NewClient(sshConn, chans, reqs)
+	sftpClient, sftpErr := sftp.NewClient(sshClient)
+	if sftpErr != nil {
+		sshClient.Close()
+		return nil, nil, fmt.Errorf("Error starting sftp on %s: %s", s.address, sftpErr)
+	}
+	s.sshClient = sshClient
+	s.sftpClient = sftpClient
+	go func() {
+		sshClient.Wait()
+		s.lock.Lock()
+		defer s.lock.Unlock()
+		if s.sshClient == sshClient {
+			s.sshClient = nil
+			s.sftpClient = nil
+		}
+	}()
+
+	return sftpClient, sshClient, nil
+}
+
+func sftpMetadataPath(bucketName, keyPath string) string {
+	return path.Join(bucketName, sftpInternalDir, "metadata", keyPath+".json")
+}
+
+func sftpTempPath(bucketName string) (string, error) {
+	idBytes := make([]byte, 16)
+	if _, randErr := rand.Read(idBytes); randErr != nil {
+		return "", randErr
+	}
+	return path.Join(bucketName, sftpInternalDir, "tmp", hex.EncodeToString(idBytes)), nil
+}
+
+// sweepTempFiles removes the temp files of uploads that never finished. The temp directory doesn't
+// exist until the first upload, failing to read it is ignored.
+func (s *SFTPClient) sweepTempFiles(client *sftp.Client, bucketName string, now time.Time) {
+	tempDir := path.Join(bucketName, sftpInternalDir, "tmp")
+	fileInfos, readErr := client.ReadDir(tempDir)
+	if readErr != nil {
+		return
+	}
+	for _, fileInfo := range fileInfos {
+		if now.Sub(fileInfo.ModTime()) < staleTempFileAge {
+			continue
+		}
+		tempPath := path.Join(tempDir, fileInfo.Name())
+		if removeErr := client.Remove(tempPath); removeErr != nil && !os.IsNotExist(removeErr) {
+			log.Warn(fmt.Sprintf("Error removing %s left behind by an unfinished upload: %s", tempPath, removeErr))
+			continue
+		}
+		log.Info(fmt.Sprintf("Removed %s left behind by an unfinished upload", tempPath))
+	}
+}
+
+// contextReader stops a transfer once ctx is done, sftp calls don't take a context themselves
+type contextReader struct {
+	ctx    context.Context
+	reader io.Reader
+}
+
+func (r *contextReader) Read(p []byte) (int, error) {
+	if ctxErr := r.ctx.Err(); ctxErr != nil {
+		return 0, ctxErr
+	}
+	return r.reader.Read(p)
+}
+
+func writeRemoteFile(ctx context.Context, client *sftp.Client, remotePath string, body io.Reader) error {
+	fd, createErr := client.Create(remotePath)
+	if createErr != nil {
+		return createErr
+	}
+	_, copyErr := io.Copy(fd, &contextReader{ctx: ctx, reader: body})
+	closeErr := fd.Close()
+	if copyErr != nil {
+		return copyErr
+	}
+	return closeErr
+}
+
+// replaceRemoteFile writes body to a temp file then renames it over remotePath, so the file is never
+// seen half written.
+func replaceRemoteFile(ctx context.Context, client *sftp.Client, bucketName, remotePath string, body io.Reader) error {
+	tempPath, tempErr := sftpTempPath(bucketName)
+	if tempErr != nil {
+		return tempErr
+	}
+	for _, dir := range []string{path.Dir(tempPath), path.Dir(remotePath)} {
+		if mkdirErr := client.MkdirAll(dir); mkdirErr != nil {
+			return mkdirErr
+		}
+	}
+	if writeErr := writeRemoteFile(ctx, client, tempPath, body); writeErr != nil {
+		client.Remove(tempPath)
+		return writeErr
+	}
+	if renameErr := client.PosixRename(tempPath, remotePath); renameErr != nil {
+		client.Remove(tempPath)
+		return renameErr
+	}
+	return nil
+}
+
+// removeEmptyParents removes the directories between a deleted file and root until one isn't empty
+func removeEmptyParents(client *sftp.Client, root, relPath string) {
+	for dir := path.Dir(relPath); dir != "." && dir != "/"; dir = path.Dir(dir) {
+		if client.RemoveDirectory(path.Join(root, dir)) != nil {
+			return
+		}
+	}
+}
+
+func (s *SFTPClient) writeMetadata(ctx context.Context, client *sftp.Client, bucketName, keyPath string, metadata map[string]string) error {
+	metadataPath := sftpMetadataPath(bucketName, keyPath)
+	if len(metadata) == 0 {
+		if removeErr := client.Remove(metadataPath); removeErr != nil && !os.IsNotExist(removeErr) {
+			return removeErr
+		}
+		return nil
+	}
+	metadataBytes, marshalErr := json.Marshal(metadata)
+	if marshalErr != nil {
+		return marshalErr
+	}
+	return replaceRemoteFile(ctx, client, bucketName, metadataPath, strings.NewReader(string(metadataBytes)))
+}
+
+// readMetadata returns nil for files uploaded without metadata
+func (s *SFTPClient) readMetadata(client *sftp.Client, bucketName, keyPath string) (map[string]string, error) {
+	fd, openErr := client.Open(sftpMetadataPath(bucketName, keyPath))
+	if os.IsNotExist(openErr) {
+		return nil, nil
+	}
+	if openErr != nil {
+		return nil, openErr
+	}
+	defer fd.Close()
+
+	var metadata map[string]string
+	if decodeErr := json.NewDecoder(fd).Decode(&metadata); decodeErr != nil {
+		return nil, fmt.Errorf("Invalid metadata for %s: %s", keyPath, decodeErr)
+	}
+	return metadata, nil
+}
+
+// WalkObjects lists the bucket's directory tree with walkTree. Listings have no hash or metadata,
+// the modification time is the original file's when it was uploaded with one and otherwise when it
+// was uploaded. Stale temp files are swept first.
+func (s *SFTPClient) WalkObjects(ctx context.Context, bucketName string, opts ListOptions, walkFn ObjectWalkFunc) error {
+	client, _, connErr := s.connect(ctx)
+	if connErr != nil {
+		return connErr
+	}
+	s.sweepTempFiles(client, bucketName, time.Now())
+
+	walkErr := walkTree(ctx, opts, sftpInternalDir, func(dir string) ([]treeEntry, error) {
+		fileInfos, readErr := client.ReadDir(path.Join(bucketName, dir))
+		if readErr != nil {
+			return nil, readErr
+		}
+		entries := make([]treeEntry, 0, len(fileInfos))
+		for _, fileInfo := range fileInfos {
+			if fileInfo.IsDir() || fileInfo.Mode().IsRegular() {
+				entries = append(entries, treeEntry{Name: fileInfo.Name(), IsDir: fileInfo.IsDir(), Size: fileInfo.Size(), ModTime: fileInfo.ModTime()})
+			}
+		}
+		return entries, nil
+	}, walkFn)
+	if os.IsNotExist(walkErr) && treeStartDir(opts.Prefix) != "" {
+		// nothing has been uploaded under the prefix yet
+		if _, statErr := client.Stat(bucketName); statErr == nil {
+			return nil
+		}
+	}
+
+	return walkErr
+}
+
+func (s *SFTPClient) UploadFile(ctx context.Context, bucketName, key string, body io.Reader, metadata map[string]string) error {
+	client, _, connErr := s.connect(ctx)
+	if connErr != nil {
+		return connErr
+	}
+	keyPath, keyErr := treeKeyPath(key, sftpInternalDir)
+	if keyErr != nil {
+		return keyErr
+	}
+
+	remotePath := path.Join(bucketName, keyPath)
+	if uploadErr := replaceRemoteFile(ctx, client, bucketName, remotePath, body); uploadErr != nil {
+		return uploadErr
+	}
+	if mtime, ok := metadataModTime(metadata); ok {
+		if chtimesErr := client.Chtimes(remotePath, time.Now(), sftpModTime(mtime)); chtimesErr != nil {
+			return chtimesErr
+		}
+	}
+	return s.writeMetadata(ctx, client, bucketName, keyPath, metadata)
+}
+
+// sftpModTime rounds up to whole seconds, which is all sftp keeps. Listings then show a time at or
+// after the local file's, so the file isn't mistaken for an older copy the next time it's synced.
+func sftpModTime(mtime time.Time) time.Time {
+	rounded := mtime.Truncate(time.Second)
+	if rounded.Before(mtime) {
+		rounded = rounded.Add(time.Second)
+	}
+	return rounded
+}
+
+func (s *SFTPClient) DownloadObject(ctx context.Context, bucketName, key string, w io.Writer) (ObjectInfo, error) {
+	return s.DownloadObjectVersion(ctx, bucketName, key, "", w)
+}
+
+func (s *SFTPClient) DownloadObjectVersion(ctx context.Context, bucketName, key, versionID string, w io.Writer) (ObjectInfo, error) {
+	var objectInfo ObjectInfo
+	if versionID != "" {
+		return objectInfo, fmt.Errorf("SFTP buckets don't keep object versions")
+	}
+	client, _, connErr := s.connect(ctx)
+	if connErr != nil {
+		return objectInfo, connErr
+	}
+	keyPath, keyErr := treeKeyPath(key, sftpInternalDir)
+	if keyErr != nil {
+		return objectInfo, keyErr
+	}
+
+	fd, openErr := client.Open(path.Join(bucketName, keyPath))
+	if openErr != nil {
+		return objectInfo, openErr
+	}
+	defer fd.Close()
+	fileInfo, statErr := fd.Stat()
+	if statErr != nil {
+		return objectInfo, statErr
+	}
+	objectInfo.ModTime = fileInfo.ModTime()
+	objectInfo.Size = fileInfo.Size()
+
+	metadata, metadataErr := s.readMetadata(client, bucketName, keyPath)
+	if metadataErr != nil {
+		return objectInfo, metadataErr
+	}
+	objectInfo.Metadata = metadata
+	_, copyErr := io.Copy(w, &contextReader{ctx: ctx, reader: fd})
+
+	return objectInfo, copyErr
+}
+
+func (s *SFTPClient) ObjectMetadata(ctx context.Context, bucketName, key string) (map[string]string, error) {
+	client, _, connErr := s.connect(ctx)
+	if connErr != nil {
+		return nil, connErr
+	}
+	keyPath, keyErr := treeKeyPath(key, sftpInternalDir)
+	if keyErr != nil {
+		return nil, keyErr
+	}
+	return s.readMetadata(client, bucketName, keyPath)
+}
+
+// CopyObject copies on the remote host with cp so the file doesn't make a round trip. Accounts limited
+// to sftp can't run commands, the file is streamed through warden for those instead. Storage classes
+// don't apply to a filesystem and are ignored.
+func (s *SFTPClient) CopyObject(ctx context.Context, sourceBucket, sourceKey, destinationBucket, destinationKey string, opts CopyOptions) error {
+	if opts.SourceVersion != "" {
+		return fmt.Errorf("SFTP buckets don't keep object versions")
+	}
+	client, sshClient, connErr := s.connect(ctx)
+	if connErr != nil {
+		return connErr
+	}
+	sourcePath, sourceErr := treeKeyPath(sourceKey, sftpInternalDir)
+	if sourceErr != nil {
+		return sourceErr
+	}
+	destinationPath, destinationErr := treeKeyPath(destinationKey, sftpInternalDir)
+	if destinationErr != nil {
+		return destinationErr
+	}
+	sourceFile := path.Join(sourceBucket, sourcePath)
+	sourceInfo, statErr := client.Stat(sourceFile)
+	if statErr != nil {
+		return statErr
+	}
+
+	tempPath, tempErr := sftpTempPath(destinationBucket)
+	if tempErr != nil {
+		return tempErr
+	}
+	destinationFile := path.Join(destinationBucket, destinationPath)
+	for _, dir := range []string{path.Dir(tempPath), path.Dir(destinationFile)} {
+		if mkdirErr := client.MkdirAll(dir); mkdirErr != nil {
+			return mkdirErr
+		}
+	}
+
+	if !copyOnRemote(sshClient, client, sourceFile, tempPath, sourceInfo.Size()) {
+		fd, openErr := client.Open(sourceFile)
+		if openErr != nil {
+			return openErr
+		}
+		writeErr := writeRemoteFile(ctx, client, tempPath, fd)
+		fd.Close()
+		if writeErr != nil {
+			client.Remove(tempPath)
+			return writeErr
+		}
+	}
+	if renameErr := client.PosixRename(tempPath, destinationFile); renameErr != nil {
+		client.Remove(tempPath)
+		return renameErr
+	}
+
+	metadata, metadataErr := s.readMetadata(client, sourceBucket, sourcePath)
+	if metadataErr != nil {
+		return metadataErr
+	}
+	return s.writeMetadata(ctx, client, destinationBucket, destinationPath, metadata)
+}
+
+// copyOnRemote runs cp over ssh. The copy is checked rather than trusting the exit status, hosts that
+// force sftp for every session accept the command without running it.
+func copyOnRemote(sshClient *ssh.Client, client *sftp.Client, sourceFile, destinationFile string, size int64) bool {
+	session, sessionErr := sshClient.NewSession()
+	if sessionErr != nil {
+		log.Debug(fmt.Sprintf("Unable to copy %s on the remote host: %s", sourceFile, sessionErr))
+		return false
+	}
+	defer session.Close()
+
+	if runErr := session.Run(fmt.Sprintf("cp -- %s %s", shellQuote(sourceFile), shellQuote(destinationFile))); runErr != nil {
+		log.Debug(fmt.Sprintf("Unable to copy %s on the remote host: %s", sourceFile, runErr))
+		client.Remove(destinationFile)
+		return false
+	}
+	copiedInfo, statErr := client.Stat(destinationFile)
+	return statErr == nil && copiedInfo.Size() == size
+}
+
+func shellQuote(arg string) string {
+	return "'" + strings.ReplaceAll(arg, "'", `'"'"'`) + "'"
+}
+
+// DeleteObject removes the file, its metadata and any directories left empty. Like S3, deleting a key
+// that doesn't exist isn't an error.
+func (s *SFTPClient) DeleteObject(ctx context.Context, bucket string, key string) error {
+	client, _, connErr := s.connect(ctx)
+	if connErr != nil {
+		return connErr
+	}
+	keyPath, keyErr := treeKeyPath(key, sftpInternalDir)
+	if keyErr != nil {
+		return keyErr
+	}
+
+	if removeErr := client.Remove(path.Join(bucket, keyPath)); removeErr != nil && !os.IsNotExist(removeErr) {
+		return removeErr
+	}
+	removeEmptyParents(client, bucket, keyPath)
+	metadataErr := client.Remove(sftpMetadataPath(bucket, keyPath))
+	if metadataErr == nil {
+		removeEmptyParents(client, path.Join(bucket, sftpInternalDir, "metadata"), keyPath)
+	} else if !os.IsNotExist(metadataErr) {
+		return metadataErr
+	}
+
+	return nil
+}
+
+func (s *SFTPClient) DeleteObjects(ctx context.Context, bucket string, keys []string) map[string]error {
+	return deleteInParallel(ctx, bucket, keys, s.DeleteObject)
+}
+
+// ObjectVersion always returns an empty string, files on a remote host aren't versioned
+func (s *SFTPClient) ObjectVersion(ctx context.Context, bucket string, key string) (string, error) {
+	return "", nil
+}
+
+func (s *SFTPClient) DeleteObjectVersioned(ctx context.Context, bucket string, key string) (string, error) {
+	return "", notVersionedError(bucket)
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pkg/sftp"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// startSFTPServer serves the local filesystem over sftp on a random port, exec requests are run with
+// sh when allowExec is set. It returns a provider config with a key and known hosts file to reach it.
+func startSFTPServer(t *testing.T, allowExec bool) CloudProviderConfig {
+	t.Setenv("SSH_AUTH_SOCK", "")
+	keyDir := t.TempDir()
+
+	_, hostKey, hostKeyErr := ed25519.GenerateKey(rand.Reader)
+	assert.Nil(t, hostKeyErr)
+	hostSigner, _ := ssh.NewSignerFromKey(hostKey)
+	clientKey, clientKeyErr := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Nil(t, clientKeyErr)
+	clientPublicKey, _ := ssh.NewPublicKey(&clientKey.PublicKey)
+
+	serverConfig := &ssh.ServerConfig{
+		PublicKeyCallback: func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if bytes.Equal(key.Marshal(), clientPublicKey.Marshal()) {
+				return nil, nil
+			}
+			return nil, fmt.Errorf("unknown key for %s", conn.User())
+		},
+	}
+	serverConfig.AddHostKey(hostSigner)
+
+	listener, listenErr := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, listenErr)
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, acceptErr := listener.Accept()
+			if acceptErr != nil {
+				return
+			}
+			go serveSSH(conn, serverConfig, allowExec)
+		}
+	}()
+
+	keyBytes, _ := x509.MarshalECPrivateKey(clientKey)
+	keyFile := filepath.Join(keyDir, "id_ecdsa")
+	assert.Nil(t, ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyBytes}), 0600))
+	address := listener.Addr().String()
+	knownHostsFile := filepath.Join(keyDir, "known_hosts")
+	knownHostsLine := knownhosts.Line([]string{knownhosts.Normalize(address)}, hostSigner.PublicKey())
+	assert.Nil(t, ioutil.WriteFile(knownHostsFile, []byte(knownHostsLine+"\n"), 0600))
+
+	return CloudProviderConfig{
+		ID:             "friends-box",
+		Name:           "sftp",
+		Endpoint:       address,
+		User:           "warden",
+		KeyFile:        keyFile,
+		KnownHostsFile: knownHostsFile,
+	}
+}
+
+func serveSSH(conn net.Conn, serverConfig *ssh.ServerConfig, allowExec bool) {
+	_, chans, reqs, handshakeErr := ssh.NewServerConn(conn, serverConfig)
+	if handshakeErr != nil {
+		return
+	}
+	go ssh.DiscardRequests(reqs)
+	for newChannel := range chans {
+		if newChannel.ChannelType() != "session" {
+			newChannel.Reject(ssh.UnknownChannelType, "only sessions are supported")
+			continue
+		}
+		channel, requests, acceptErr := newChannel.Accept()
+		if acceptErr != nil {
+			continue
+		}
+		go func() {
+			defer channel.Close()
+			for req := range requests {
+				switch {
+				case req.Type == "subsystem" && string(req.Payload[4:]) == "sftp":
+					req.Reply(true, nil)
+					server, _ := sftp.NewServer(channel)
+					server.Serve()
+					return
+				case req.Type == "exec" && allowExec:
+					req.Reply(true, nil)
+					var status uint32
+					runErr := exec.Command("sh", "-c", string(req.Payload[4:])).Run()
+					var exitErr *exec.ExitError
+					if errors.As(runErr, &exitErr) {
+						status = uint32(exitErr.ExitCode())
+					}
+					channel.SendRequest("exit-status", false, ssh.Marshal(struct{ Status uint32 }{status}))
+					return
+				default:
+					req.Reply(false, nil)
+				}
+			}
+		}()
+	}
+}
+
+func TestNewSFTPBucketClient(t *testing.T) {
+	providerConfig := startSFTPServer(t, false)
+
+	missingKey := providerConfig
+	missingKey.KeyFile = ""
+	_, missingKeyErr := NewSFTPBucketClient(missingKey)
+	assert.ErrorContains(t, missingKeyErr, "needs a keyfile or a running ssh agent")
+
+	// the host key has to be known
+	unknownHost := providerConfig
+	unknownHost.KnownHostsFile = filepath.Join(t.TempDir(), "known_hosts")
+	assert.Nil(t, ioutil.WriteFile(unknownHost.KnownHostsFile, nil, 0600))
+	client, clientErr := NewSFTPBucketClient(unknownHost)
+	assert.Nil(t, clientErr)
+	uploadErr := client.UploadFile(context.Background(), t.TempDir(), "/file.txt", strings.NewReader("content"), nil)
+	assert.ErrorContains(t, uploadErr, "knownhosts: key is unknown")
+}
+
+func TestSFTPClientUploadAndList(t *testing.T) {
+	client, clientErr := NewSFTPBucketClient(startSFTPServer(t, false))
+	assert.Nil(t, clientErr)
+	bucket := t.TempDir()
+	ctx := context.Background()
+
+	metadata := map[string]string{metadataMode: "644", metadataMtime: "2022-05-01T10:00:00Z"}
+	assert.Nil(t, client.UploadFile(ctx, bucket, "/photos/2020/beach.jpg", strings.NewReader("beach"), metadata))
+	assert.Nil(t, client.UploadFile(ctx, bucket, "/photos/2021/snow.jpg", strings.NewReader("snow!"), nil))
+	assert.Nil(t, client.UploadFile(ctx, bucket, "/notes.txt", strings.NewReader("notes"), nil))
+	// overwriting replaces the file in one rename
+	assert.Nil(t, client.UploadFile(ctx, bucket, "/notes.txt", strings.NewReader("new notes"), nil))
+	assert.NotNil(t, client.UploadFile(ctx, bucket, "/"+sftpInternalDir+"/file", strings.NewReader(""), nil))
+
+	allObjects, listErr := ListObjects(ctx, client, bucket, ListOptions{})
+	assert.Nil(t, listErr)
+	assert.Len(t, allObjects, 3)
+	assert.Equal(t, int64(9), allObjects["notes.txt"].Size)
+	assert.Equal(t, int64(5), allObjects["photos/2020/beach.jpg"].Size)
+	assert.False(t, allObjects["photos/2020/beach.jpg"].ModTime.IsZero())
+
+	prefixed, prefixErr := ListObjects(ctx, client, bucket, ListOptions{Prefix: "photos/202"})
+	assert.Nil(t, prefixErr)
+	assert.Len(t, prefixed, 2)
+	delimited, delimitedErr := ListObjects(ctx, client, bucket, ListOptions{Prefix: "photos/", Delimiter: "/"})
+	assert.Nil(t, delimitedErr)
+	assert.Equal(t, map[string]ObjectInfo{"photos/2020/": {IsPrefix: true}, "photos/2021/": {IsPrefix: true}}, delimited)
+	missing, missingErr := ListObjects(ctx, client, bucket, ListOptions{Prefix: "videos/"})
+	assert.Nil(t, missingErr)
+	assert.Len(t, missing, 0)
+
+	var downloaded bytes.Buffer
+	objectInfo, downloadErr := client.DownloadObject(ctx, bucket, "/photos/2020/beach.jpg", &downloaded)
+	assert.Nil(t, downloadErr)
+	assert.Equal(t, "beach", downloaded.String())
+	assert.Equal(t, metadata, objectInfo.Metadata)
+
+	// uploads are renamed into place, nothing is left in the temp directory
+	tempDir := filepath.Join(bucket, sftpInternalDir, "tmp")
+	tempFiles, _ := ioutil.ReadDir(tempDir)
+	assert.Len(t, tempFiles, 0)
+
+	// temp files of uploads that never finished are swept by the next listing, once they're stale
+	for _, name := range []string{"stale", "uploading"} {
+		assert.Nil(t, ioutil.WriteFile(filepath.Join(tempDir, name), []byte("partial"), 0644))
+	}
+	staleTime := time.Now().Add(-staleTempFileAge - time.Hour)
+	assert.Nil(t, os.Chtimes(filepath.Join(tempDir, "stale"), staleTime, staleTime))
+	_, listErr = ListObjects(ctx, client, bucket, ListOptions{Prefix: "photos/"})
+	assert.Nil(t, listErr)
+	tempFiles, _ = ioutil.ReadDir(tempDir)
+	assert.Len(t, tempFiles, 1)
+	assert.Equal(t, "uploading", tempFiles[0].Name())
+}
+
+func TestSFTPClientCopyAndDelete(t *testing.T) {
+	for _, allowExec := range []bool{true, false} {
+		client, clientErr := NewSFTPBucketClient(startSFTPServer(t, allowExec))
+		assert.Nil(t, clientErr)
+		bucket := t.TempDir()
+		tombstoneBucket := t.TempDir()
+		ctx := context.Background()
+
+		metadata := map[string]string{metadataMode: "600"}
+		assert.Nil(t, client.UploadFile(ctx, bucket, "/dir/it's here.txt", strings.NewReader("content"), metadata))
+		assert.Nil(t, client.CopyObject(ctx, bucket, "/dir/it's here.txt", tombstoneBucket, "/2022/dir/it's here.txt", CopyOptions{StorageClass: "GLACIER"}))
+
+		var copied bytes.Buffer
+		objectInfo, downloadErr := client.DownloadObject(ctx, tombstoneBucket, "/2022/dir/it's here.txt", &copied)
+		assert.Nil(t, downloadErr)
+		assert.Equal(t, "content", copied.String())
+		assert.Equal(t, metadata, objectInfo.Metadata)
+
+		deleteErrs := client.DeleteObjects(ctx, bucket, []string{"/dir/it's here.txt", "/never-uploaded.txt"})
+		assert.Len(t, deleteErrs, 0)
+		remaining, _ := ioutil.ReadDir(bucket)
+		assert.Len(t, remaining, 1, "only the internal directory should be left")
+		_, metadataErr := os.Stat(filepath.Join(bucket, sftpInternalDir, "metadata", "dir"))
+		assert.True(t, os.IsNotExist(metadataErr))
+	}
+}
+
+func TestSyncToSFTP(t *testing.T) {
+	client, clientErr := NewSFTPBucketClient(startSFTPServer(t, true))
+	assert.Nil(t, clientErr)
+	mockTempDir := t.TempDir()
+	assert.Nil(t, os.MkdirAll(filepath.Join(mockTempDir, "docs"), 0755))
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(mockTempDir, "docs", "doc1.txt"), []byte("doc1"), 0644))
+
+	concreteWalkFunc = walkDirectory
+	mockSyncConfig := SyncConfig{SourceFolder: mockTempDir, DestinationBucket: t.TempDir()}
+	syncedObjects, syncErr := doSingleDestinationSync(client, mockSyncConfig, &sync.Mutex{})
+	assert.Nil(t, syncErr)
+	assert.Len(t, syncedObjects.Upload, 1)
+
+	// nothing changed, so the second run has nothing to upload
+	syncedObjects, syncErr = doSingleDestinationSync(client, mockSyncConfig, &sync.Mutex{})
+	assert.Nil(t, syncErr)
+	assert.Len(t, syncedObjects.Upload, 0)
+
+	uploaded, readErr := ioutil.ReadFile(filepath.Join(mockSyncConfig.DestinationBucket, "docs", "doc1.txt"))
+	assert.Nil(t, readErr)
+	assert.Equal(t, "doc1", string(uploaded))
+}
@@ -0,0 +1,291 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// wardenKeyPrefix holds everything warden keeps in a bucket for itself, keys under it are never
+// synced, tombstoned or deleted.
+const wardenKeyPrefix = ".warden/"
+
+// snapshotObjectPrefix is the content addressed store snapshots refer to. In buckets without
+// versioning, objects are copied here server side when a snapshot first sees their content, so later
+// syncs can overwrite or delete the synced key without losing what the snapshot pointed at.
+const snapshotObjectPrefix = wardenKeyPrefix + "objects/"
+
+// snapshotGarbageGrace is how old an unreferenced object in the store has to be before it's swept.
+// Another job may have just copied it there for a snapshot whose manifest isn't written yet.
+const snapshotGarbageGrace = 24 * time.Hour
+
+// SnapshotEntry is one key of a snapshot, Object is where its content is kept. When VersionID is set
+// Object is the synced key itself and the content is that version of it.
+type SnapshotEntry struct {
+	Object    string
+	VersionID string `json:",omitempty"`
+	Size      int64
+	Hash      string
+	ModTime   time.Time
+}
+
+// SnapshotManifest records what every key a sync job manages held at the end of a sync.
+type SnapshotManifest struct {
+	CreatedAt    time.Time
+	SourceFolder string
+	Entries      map[string]SnapshotEntry
+}
+
+// SnapshotInfo identifies a snapshot stored in a bucket.
+type SnapshotInfo struct {
+	Key       string
+	CreatedAt time.Time
+}
+
+// SnapshotKeyPrefix is where a sync job's snapshot manifests are kept. Jobs writing under different
+// prefixes of a bucket keep their snapshots apart.
+func (sc SyncConfig) SnapshotKeyPrefix() string {
+	return wardenKeyPrefix + "snapshots/" + sc.KeyPrefix()
+}
+
+// snapshotObjectKey returns the content addressed key for an object. Providers that report a
+// content hash dedupe identical files, otherwise the key, size and modification time identify it.
+func snapshotObjectKey(key string, objectInfo ObjectInfo) string {
+	if objectInfo.Hash != "" {
+		return snapshotObjectPrefix + "md5/" + objectInfo.Hash
+	}
+	hash := sha256.Sum256([]byte(fmt.Sprintf("%s\x00%d\x00%s", key, objectInfo.Size, objectInfo.ModTime.UTC().Format(time.RFC3339Nano))))
+	return snapshotObjectPrefix + "id/" + hex.EncodeToString(hash[:])
+}
+
+// takeSnapshot records what the destination holds for the sync job. Keys unchanged since the last
+// snapshot reuse its entry. Anything else is referenced by its current version when the bucket keeps
+// versions, and copied into the content addressed store otherwise.
+func takeSnapshot(ctx context.Context, client BucketClient, job *WorkQueueJob, sc SyncConfig, destination SyncDestination, now time.Time) (string, error) {
+	previous := SnapshotManifest{Entries: make(map[string]SnapshotEntry)}
+	snapshots, listErr := listSnapshots(ctx, client, sc, destination)
+	if listErr != nil {
+		return "", fmt.Errorf("Error listing snapshots: %s", listErr)
+	}
+	if len(snapshots) != 0 {
+		latest, readErr := readSnapshot(ctx, client, destination.Bucket, snapshots[len(snapshots)-1].Key)
+		if readErr != nil {
+			return "", fmt.Errorf("Error reading snapshot %s: %s", snapshots[len(snapshots)-1].Key, readErr)
+		}
+		previous = latest
+	}
+
+	remoteObjects, remoteErr := listManagedObjects(ctx, client, sc, destination)
+	if remoteErr != nil {
+		return "", fmt.Errorf("Error listing bucket %s: %s", destination.Bucket, remoteErr)
+	}
+
+	manifest := SnapshotManifest{CreatedAt: now.UTC(), SourceFolder: sc.SourceFolder, Entries: make(map[string]SnapshotEntry)}
+	var copyLock sync.Mutex
+	var copyWg sync.WaitGroup
+	copied := make(map[string]SnapshotEntry)
+	copyErrs := make(map[string]error)
+	for key, objectInfo := range remoteObjects {
+		entry := SnapshotEntry{Size: objectInfo.Size, Hash: objectInfo.Hash, ModTime: objectInfo.ModTime}
+		if previousEntry, ok := previous.Entries[key]; ok && previousEntry.Size == entry.Size &&
+			previousEntry.Hash == entry.Hash && previousEntry.ModTime.Equal(entry.ModTime) {
+			manifest.Entries[key] = previousEntry
+			continue
+		}
+
+		key, objectInfo := key, objectInfo
+		copyWg.Add(1)
+		job.Submit(func() {
+			defer copyWg.Done()
+			versionID, snapshotErr := client.ObjectVersion(ctx, destination.Bucket, key)
+			if snapshotErr == nil && versionID != "" {
+				entry.Object, entry.VersionID = strings.TrimPrefix(key, "/"), versionID
+			} else if snapshotErr == nil {
+				entry.Object = snapshotObjectKey(key, objectInfo)
+				snapshotErr = client.CopyObject(ctx, destination.Bucket, key, destination.Bucket, entry.Object, CopyOptions{})
+			}
+			copyLock.Lock()
+			defer copyLock.Unlock()
+			if snapshotErr != nil {
+				copyErrs[key] = snapshotErr
+				return
+			}
+			copied[key] = entry
+		})
+	}
+	copyWg.Wait()
+	for key, copyErr := range copyErrs {
+		log.Warn(fmt.Sprintf("Error preserving %s for the snapshot: %s", key, copyErr))
+	}
+	if len(copyErrs) != 0 {
+		return "", fmt.Errorf("%d objects could not be preserved for the snapshot", len(copyErrs))
+	}
+	for key, entry := range copied {
+		manifest.Entries[key] = entry
+	}
+
+	manifestData, marshalErr := json.Marshal(manifest)
+	if marshalErr != nil {
+		return "", marshalErr
+	}
+	manifestKey := sc.SnapshotKeyPrefix() + manifest.CreatedAt.Format(tombstoneTimeLayout) + ".json"
+	if uploadErr := client.UploadFile(ctx, destination.Bucket, manifestKey, bytes.NewReader(manifestData), nil); uploadErr != nil {
+		return "", uploadErr
+	}
+
+	return manifestKey, nil
+}
+
+// listSnapshots returns a sync job's snapshots in a destination, oldest first.
+func listSnapshots(ctx context.Context, client BucketClient, sc SyncConfig, destination SyncDestination) ([]SnapshotInfo, error) {
+	snapshots := make([]SnapshotInfo, 0)
+	listOpts := ListOptions{Prefix: sc.SnapshotKeyPrefix(), Delimiter: "/"}
+	walkErr := client.WalkObjects(ctx, destination.Bucket, listOpts, func(key string, objectInfo ObjectInfo) error {
+		if objectInfo.IsPrefix {
+			return nil
+		}
+		name := strings.TrimSuffix(strings.TrimPrefix(key, listOpts.Prefix), ".json")
+		createdAt, parseErr := time.Parse(tombstoneTimeLayout, name)
+		if parseErr != nil {
+			return nil
+		}
+		snapshots = append(snapshots, SnapshotInfo{Key: key, CreatedAt: createdAt})
+		return nil
+	})
+	sort.Slice(snapshots, func(i, j int) bool {
+		return snapshots[i].CreatedAt.Before(snapshots[j].CreatedAt)
+	})
+
+	return snapshots, walkErr
+}
+
+// collectSnapshotGarbage deletes the job's snapshots older than its SnapshotRetention, the latest
+// snapshot is always kept. When any expire the object store is marked and swept: every manifest left
+// in the bucket, those of other jobs included, marks the objects it references and unmarked objects
+// older than snapshotGarbageGrace are deleted. Versions snapshots referenced are left to the
+// bucket's lifecycle rules. Returns how many snapshots and objects were deleted.
+func collectSnapshotGarbage(ctx context.Context, client BucketClient, sc SyncConfig, destination SyncDestination, now time.Time) (int, int, error) {
+	snapshots, listErr := listSnapshots(ctx, client, sc, destination)
+	if listErr != nil {
+		return 0, 0, fmt.Errorf("Error listing snapshots: %s", listErr)
+	}
+	cutoff := now.Add(-time.Duration(sc.SnapshotRetention) * 24 * time.Hour)
+	expiredKeys := make([]string, 0)
+	for i, snapshot := range snapshots {
+		if i < len(snapshots)-1 && snapshot.CreatedAt.Before(cutoff) {
+			expiredKeys = append(expiredKeys, snapshot.Key)
+		}
+	}
+	if len(expiredKeys) == 0 {
+		return 0, 0, nil
+	}
+	for _, batch := range deleteBatches(expiredKeys) {
+		for key, delErr := range client.DeleteObjects(ctx, destination.Bucket, batch) {
+			return 0, 0, fmt.Errorf("Error deleting snapshot %s: %s", key, delErr)
+		}
+	}
+
+	// a partial mark would sweep objects that are still referenced, so any error stops the sweep
+	marked := make(map[string]bool)
+	manifestKeys := make([]string, 0)
+	manifestWalkErr := client.WalkObjects(ctx, destination.Bucket, ListOptions{Prefix: wardenKeyPrefix + "snapshots/"}, func(key string, objectInfo ObjectInfo) error {
+		if strings.HasSuffix(key, ".json") {
+			manifestKeys = append(manifestKeys, key)
+		}
+		return nil
+	})
+	if manifestWalkErr != nil {
+		return len(expiredKeys), 0, fmt.Errorf("Error listing snapshots: %s", manifestWalkErr)
+	}
+	for _, manifestKey := range manifestKeys {
+		manifest, readErr := readSnapshot(ctx, client, destination.Bucket, manifestKey)
+		if readErr != nil {
+			return len(expiredKeys), 0, fmt.Errorf("Error reading snapshot %s: %s", manifestKey, readErr)
+		}
+		for _, entry := range manifest.Entries {
+			if entry.VersionID == "" {
+				marked[entry.Object] = true
+			}
+		}
+	}
+
+	garbageKeys := make([]string, 0)
+	objectWalkErr := client.WalkObjects(ctx, destination.Bucket, ListOptions{Prefix: snapshotObjectPrefix}, func(key string, objectInfo ObjectInfo) error {
+		if !marked[key] && objectInfo.ModTime.Before(now.Add(-snapshotGarbageGrace)) {
+			garbageKeys = append(garbageKeys, key)
+		}
+		return nil
+	})
+	if objectWalkErr != nil {
+		return len(expiredKeys), 0, fmt.Errorf("Error listing the snapshot store: %s", objectWalkErr)
+	}
+	failed := 0
+	for _, batch := range deleteBatches(garbageKeys) {
+		for key, delErr := range client.DeleteObjects(ctx, destination.Bucket, batch) {
+			log.Warn(fmt.Sprintf("Error deleting %s from the snapshot store: %s", key, delErr))
+			failed++
+		}
+	}
+	if failed != 0 {
+		return len(expiredKeys), len(garbageKeys) - failed, fmt.Errorf("%d of %d unreferenced objects could not be deleted", failed, len(garbageKeys))
+	}
+
+	return len(expiredKeys), len(garbageKeys), nil
+}
+
+// snapshotAt returns the latest snapshot taken at or before t.
+func snapshotAt(snapshots []SnapshotInfo, t time.Time) (SnapshotInfo, bool) {
+	var found SnapshotInfo
+	ok := false
+	for _, snapshot := range snapshots {
+		if snapshot.CreatedAt.After(t) {
+			break
+		}
+		found, ok = snapshot, true
+	}
+	return found, ok
+}
+
+func readSnapshot(ctx context.Context, client BucketClient, bucket, key string) (SnapshotManifest, error) {
+	var manifest SnapshotManifest
+	manifestData := &bytes.Buffer{}
+	if _, downloadErr := client.DownloadObject(ctx, bucket, key, manifestData); downloadErr != nil {
+		return manifest, downloadErr
+	}
+	unmarshalErr := json.Unmarshal(manifestData.Bytes(), &manifest)
+	return manifest, unmarshalErr
+}
+
+// doRestoreSnapshot restores the tree recorded by a snapshot under targetFolder, narrowed to
+// subPrefix relative to SourceFolder when it's set. Per key results are returned.
+func doRestoreSnapshot(ctx context.Context, client BucketClient, sc SyncConfig, destination SyncDestination, manifest SnapshotManifest, targetFolder, subPrefix string) map[string]error {
+	restoreResults := make(map[string]error)
+	subPrefix = strings.Trim(subPrefix, "/")
+	for key, entry := range manifest.Entries {
+		relativePath, ok := sc.RelativePathForKey(key)
+		if !ok || (subPrefix != "" && relativePath != subPrefix && !strings.HasPrefix(relativePath, subPrefix+"/")) {
+			continue
+		}
+		localPath, restoreErr := containedPath(targetFolder, relativePath)
+		if restoreErr == nil {
+			restoreErr = restoreObjectVersion(ctx, client, destination.Bucket, entry.Object, entry.VersionID, targetFolder, localPath)
+		}
+		if restoreErr != nil {
+			log.Warn(fmt.Sprintf("Error restoring %s to %s: %s", key, targetFolder, restoreErr))
+		} else {
+			log.Info(fmt.Sprintf("Restored %s to %s", key, localPath))
+		}
+		restoreResults[key] = restoreErr
+	}
+
+	return restoreResults
+}
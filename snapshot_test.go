@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSnapshotRestoreAt(t *testing.T) {
+	mockTempDir, mockTempDirErr := ioutil.TempDir(os.TempDir(), "go-test-stuff")
+	assert.Nil(t, mockTempDirErr)
+	defer os.RemoveAll(mockTempDir)
+
+	mockS3Client := NewMockClient(map[string]ObjectInfo{})
+	mockSyncConfig := SyncConfig{
+		SourceFolder:      "/folder1",
+		DestinationBucket: "not-real-bucket",
+		Prefix:            "nas01",
+	}
+	destination := mockSyncConfig.DestinationList()[0]
+	job := workQueue.NewJob("snapshots", 0, 0)
+	monday := time.Date(2023, 5, 1, 12, 0, 0, 0, time.UTC)
+
+	mockS3Client.UploadFile(context.Background(), "not-real-bucket", "nas01/docs/report.txt", strings.NewReader("good"), nil)
+	mockS3Client.UploadFile(context.Background(), "not-real-bucket", "nas01/docs/notes.txt", strings.NewReader("notes"), nil)
+	_, snapshotErr := takeSnapshot(context.Background(), mockS3Client, job, mockSyncConfig, destination, monday)
+	assert.Nil(t, snapshotErr)
+	assert.Len(t, mockS3Client.CopyRequests, 2)
+
+	// the next sync overwrites the report with garbage
+	mockS3Client.UploadFile(context.Background(), "not-real-bucket", "nas01/docs/report.txt", strings.NewReader("encrypted"), nil)
+	mockS3Client.UploadFile(context.Background(), "not-real-bucket", "nas01/docs/ransom.txt", strings.NewReader("pay up"), nil)
+	_, snapshotErr = takeSnapshot(context.Background(), mockS3Client, job, mockSyncConfig, destination, monday.Add(24*time.Hour))
+	assert.Nil(t, snapshotErr)
+	// only the changed and new keys are copied into the store
+	assert.Len(t, mockS3Client.CopyRequests, 4)
+
+	snapshots, listErr := listSnapshots(context.Background(), mockS3Client, mockSyncConfig, destination)
+	assert.Nil(t, listErr)
+	assert.Len(t, snapshots, 2)
+	_, ok := snapshotAt(snapshots, monday.Add(-time.Hour))
+	assert.False(t, ok)
+	snapshot, ok := snapshotAt(snapshots, monday.Add(12*time.Hour))
+	assert.True(t, ok)
+	assert.Equal(t, monday, snapshot.CreatedAt)
+
+	manifest, readErr := readSnapshot(context.Background(), mockS3Client, "not-real-bucket", snapshot.Key)
+	assert.Nil(t, readErr)
+	restoreResults := doRestoreSnapshot(context.Background(), mockS3Client, mockSyncConfig, destination, manifest, mockTempDir, "")
+	assert.Equal(t, map[string]error{"/nas01/docs/report.txt": nil, "/nas01/docs/notes.txt": nil}, restoreResults)
+	restored, readFileErr := ioutil.ReadFile(filepath.Join(mockTempDir, "docs", "report.txt"))
+	assert.Nil(t, readFileErr)
+	assert.Equal(t, "good", string(restored))
+	_, statErr := os.Stat(filepath.Join(mockTempDir, "docs", "ransom.txt"))
+	assert.True(t, os.IsNotExist(statErr))
+}
+
+func TestSyncTakesSnapshotAndKeepsStore(t *testing.T) {
+	concreteWalkFunc = createMockWalkFunc(make(map[string]os.FileInfo))
+	mockS3Client := NewMockClient(map[string]ObjectInfo{})
+	mockS3Client.UploadFile(context.Background(), "not-real-bucket", snapshotObjectPrefix+"md5/0123456789abcdef", strings.NewReader("old"), nil)
+	mockSyncConfig := SyncConfig{
+		SourceFolder:      "/folder1",
+		DestinationBucket: "not-real-bucket",
+		Snapshots:         true,
+		Destructive:       true,
+	}
+
+	lock := &sync.Mutex{}
+	syncedObjects, syncErr := doSingleDestinationSync(mockS3Client, mockSyncConfig, lock)
+
+	assert.Nil(t, syncErr)
+	assert.Len(t, syncedObjects.Delete, 0)
+	assert.Len(t, mockS3Client.DeleteRequests, 0)
+	snapshots, listErr := listSnapshots(context.Background(), mockS3Client, mockSyncConfig, mockSyncConfig.DestinationList()[0])
+	assert.Nil(t, listErr)
+	assert.Len(t, snapshots, 1)
+}
+
+func TestSnapshotRestoreRejectsKeysEscapingTheTarget(t *testing.T) {
+	mockTempDir := t.TempDir()
+	mockS3Client := NewMockClient(map[string]ObjectInfo{})
+	mockS3Client.UploadFile(context.Background(), "not-real-bucket", snapshotObjectPrefix+"md5/good", strings.NewReader("good"), nil)
+	mockSyncConfig := SyncConfig{SourceFolder: "/folder1", DestinationBucket: "not-real-bucket"}
+	// a tampered manifest can name any key
+	manifest := SnapshotManifest{Entries: map[string]SnapshotEntry{
+		"/../../etc/cron.d/x": {Object: snapshotObjectPrefix + "md5/good"},
+		"/docs/report.txt":    {Object: snapshotObjectPrefix + "md5/good"},
+	}}
+
+	targetFolder := filepath.Join(mockTempDir, "restore")
+	restoreResults := doRestoreSnapshot(context.Background(), mockS3Client, mockSyncConfig, mockSyncConfig.DestinationList()[0], manifest, targetFolder, "")
+
+	assert.Len(t, restoreResults, 2)
+	assert.ErrorContains(t, restoreResults["/../../etc/cron.d/x"], "outside of")
+	assert.Nil(t, restoreResults["/docs/report.txt"])
+	assert.NoDirExists(t, filepath.Join(mockTempDir, "etc"))
+	assert.FileExists(t, filepath.Join(targetFolder, "docs", "report.txt"))
+}
+
+func TestSnapshotReferencesVersionsInVersionedBuckets(t *testing.T) {
+	mockTempDir := t.TempDir()
+	mockS3Client := NewMockClient(map[string]ObjectInfo{})
+	mockS3Client.Versioned = true
+	mockSyncConfig := SyncConfig{SourceFolder: "/folder1", DestinationBucket: "not-real-bucket"}
+	destination := mockSyncConfig.DestinationList()[0]
+	job := workQueue.NewJob("snapshots", 0, 0)
+	monday := time.Date(2023, 5, 1, 12, 0, 0, 0, time.UTC)
+
+	mockS3Client.UploadFile(context.Background(), "not-real-bucket", "docs/report.txt", strings.NewReader("good"), nil)
+	snapshotKey, snapshotErr := takeSnapshot(context.Background(), mockS3Client, job, mockSyncConfig, destination, monday)
+	assert.Nil(t, snapshotErr)
+	// nothing is copied, the snapshot points at the version
+	assert.Len(t, mockS3Client.CopyRequests, 0)
+	mockS3Client.UploadFile(context.Background(), "not-real-bucket", "docs/report.txt", strings.NewReader("encrypted"), nil)
+
+	manifest, readErr := readSnapshot(context.Background(), mockS3Client, "not-real-bucket", snapshotKey)
+	assert.Nil(t, readErr)
+	assert.Equal(t, "docs/report.txt", manifest.Entries["/docs/report.txt"].Object)
+	assert.NotEmpty(t, manifest.Entries["/docs/report.txt"].VersionID)
+	restoreResults := doRestoreSnapshot(context.Background(), mockS3Client, mockSyncConfig, destination, manifest, mockTempDir, "")
+	assert.Equal(t, map[string]error{"/docs/report.txt": nil}, restoreResults)
+	restored, readFileErr := ioutil.ReadFile(filepath.Join(mockTempDir, "docs", "report.txt"))
+	assert.Nil(t, readFileErr)
+	assert.Equal(t, "good", string(restored))
+}
+
+func TestSnapshotGarbageCollected(t *testing.T) {
+	mockS3Client := NewMockClient(map[string]ObjectInfo{})
+	mockSyncConfig := SyncConfig{SourceFolder: "/folder1", DestinationBucket: "not-real-bucket", Prefix: "docs", Snapshots: true, SnapshotRetention: 30}
+	otherSyncConfig := SyncConfig{SourceFolder: "/folder2", DestinationBucket: "not-real-bucket", Prefix: "other"}
+	destination := mockSyncConfig.DestinationList()[0]
+	job := workQueue.NewJob("snapshots", 0, 0)
+	now := time.Now()
+
+	mockS3Client.UploadFile(context.Background(), "not-real-bucket", "docs/report.txt", strings.NewReader("good"), nil)
+	mockS3Client.UploadFile(context.Background(), "not-real-bucket", "other/shared.txt", strings.NewReader("shared"), nil)
+	_, snapshotErr := takeSnapshot(context.Background(), mockS3Client, job, mockSyncConfig, destination, now.Add(-90*24*time.Hour))
+	assert.Nil(t, snapshotErr)
+	_, snapshotErr = takeSnapshot(context.Background(), mockS3Client, job, otherSyncConfig, destination, now.Add(-90*24*time.Hour))
+	assert.Nil(t, snapshotErr)
+	mockS3Client.UploadFile(context.Background(), "not-real-bucket", "docs/report.txt", strings.NewReader("newer"), nil)
+	_, snapshotErr = takeSnapshot(context.Background(), mockS3Client, job, mockSyncConfig, destination, now.Add(-60*24*time.Hour))
+	assert.Nil(t, snapshotErr)
+	_, snapshotErr = takeSnapshot(context.Background(), mockS3Client, job, mockSyncConfig, destination, now.Add(-24*time.Hour))
+	assert.Nil(t, snapshotErr)
+	storeObjects, listErr := ListObjects(context.Background(), mockS3Client, "not-real-bucket", ListOptions{Prefix: snapshotObjectPrefix})
+	assert.Nil(t, listErr)
+	assert.Len(t, storeObjects, 3)
+
+	// the sweep has to look past objects copied within the grace period
+	expired, swept, garbageErr := collectSnapshotGarbage(context.Background(), mockS3Client, mockSyncConfig, destination, now.Add(snapshotGarbageGrace+time.Minute))
+
+	assert.Nil(t, garbageErr)
+	assert.Equal(t, 2, expired)
+	assert.Equal(t, 1, swept)
+	snapshots, listErr := listSnapshots(context.Background(), mockS3Client, mockSyncConfig, destination)
+	assert.Nil(t, listErr)
+	assert.Len(t, snapshots, 1)
+	// the other job's snapshot still references its object
+	otherSnapshots, listErr := listSnapshots(context.Background(), mockS3Client, otherSyncConfig, destination)
+	assert.Nil(t, listErr)
+	assert.Len(t, otherSnapshots, 1)
+	storeObjects, listErr = ListObjects(context.Background(), mockS3Client, "not-real-bucket", ListOptions{Prefix: snapshotObjectPrefix})
+	assert.Nil(t, listErr)
+	assert.Len(t, storeObjects, 2)
+	manifest, readErr := readSnapshot(context.Background(), mockS3Client, "not-real-bucket", snapshots[0].Key)
+	assert.Nil(t, readErr)
+	assert.Contains(t, storeObjects, manifest.Entries["/docs/report.txt"].Object)
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"fmt"
 	"os"
+	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/config"
@@ -45,40 +46,58 @@ type SNSNotifier struct {
 	Topic  string
 }
 
-func (s *SNSNotifier) NotifySyncResults(syncConfig SyncConfig, resultMap *ResultMap) error {
+func (s *SNSNotifier) NotifySyncResults(syncConfig SyncConfig, destination SyncDestination, resultMap *ResultMap) error {
 	// we only want to notify if something actually happened
-	if len(resultMap.Tombstone) == 0 && len(resultMap.Upload) == 0 {
+	if len(resultMap.Tombstone) == 0 && len(resultMap.Upload) == 0 && len(resultMap.Download) == 0 && len(resultMap.Move) == 0 &&
+		len(resultMap.LocalDelete) == 0 && resultMap.Err == nil {
 		return nil
 	}
 
 	// TODO: this has a maximum message size of 256KB, need to account for that
 	notificationBody := ""
+	if resultMap.Err != nil {
+		notificationBody += fmt.Sprintf("Error: %s\n\n", resultMap.Err)
+	}
 	if len(resultMap.Upload) != 0 {
 		notificationBody += "Uploads:\n"
-		for key, keyErr := range resultMap.Upload {
-			notificationBody += fmt.Sprintf("  - %s => %v\n", key, keyErr)
-		}
+		notificationBody += resultLines(resultMap.Upload, resultMap.UploadCount)
 
 	}
 
 	if len(resultMap.Tombstone) != 0 {
 		notificationBody += "\n\nTombstones:\n"
-		for key, keyErr := range resultMap.Tombstone {
-			notificationBody += fmt.Sprintf("  - %s => %v\n", key, keyErr)
-		}
+		notificationBody += resultLines(resultMap.Tombstone, resultMap.TombstoneCount)
 	}
 
 	if len(resultMap.Delete) != 0 {
 		notificationBody += "\n\nDeleted:\n"
-		for key, keyErr := range resultMap.Delete {
-			notificationBody += fmt.Sprintf("  - %s => %v\n", key, keyErr)
-		}
+		notificationBody += resultLines(resultMap.Delete, resultMap.DeleteCount)
+	}
+
+	if len(resultMap.Download) != 0 {
+		notificationBody += "\n\nDownloads:\n"
+		notificationBody += resultLines(resultMap.Download, resultMap.DownloadCount)
+	}
+
+	if len(resultMap.LocalDelete) != 0 {
+		notificationBody += "\n\nDeleted Locally:\n"
+		notificationBody += resultLines(resultMap.LocalDelete, resultMap.LocalDeleteCount)
+	}
+
+	if len(resultMap.Move) != 0 {
+		notificationBody += "\n\nMoved:\n"
+		notificationBody += resultLines(resultMap.Move, resultMap.MoveCount)
+	}
+
+	if len(resultMap.Conflict) != 0 {
+		notificationBody += "\n\nConflicts:\n"
+		notificationBody += resultLines(resultMap.Conflict, resultMap.ConflictCount)
 	}
 
 	snsPublishReq := &sns.PublishInput{
 		Message:  aws.String(notificationBody),
 		TopicArn: aws.String(s.Topic),
-		Subject:  aws.String(fmt.Sprintf("Sync results: %s -> %s", syncConfig.SourceFolder, syncConfig.DestinationBucket)),
+		Subject:  aws.String(fmt.Sprintf("Sync results: %s -> %s", syncConfig.SourceFolder, destination.Bucket)),
 	}
 	publishErr := s.Client.PublishMessage(snsPublishReq)
 
@@ -86,6 +105,18 @@ func (s *SNSNotifier) NotifySyncResults(syncConfig SyncConfig, resultMap *Result
 
 }
 
+// resultLines lists every key in results, followed by a summary when keys were left out to save memory
+func resultLines(results map[string]error, count ResultCount) string {
+	lines := ""
+	for key, keyErr := range results {
+		lines += fmt.Sprintf("  - %s => %v\n", key, keyErr)
+	}
+	if count.Total > len(results) {
+		lines += fmt.Sprintf("  ... %d more not listed, %d total, %d failed\n", count.Total-len(results), count.Total, count.Failed)
+	}
+	return lines
+}
+
 func (s *SNSNotifier) NotifyBackupResults(backupConfig BackupConfig, backupFile *os.File, backupErr error) error {
 	fileStat, _ := backupFile.Stat()
 
@@ -110,3 +141,20 @@ func (s *SNSNotifier) NotifyBackupResults(backupConfig BackupConfig, backupFile
 
 	return publishErr
 }
+
+func (s *SNSNotifier) NotifyAnomaly(syncConfig SyncConfig, destination SyncDestination, report AnomalyReport) error {
+	notificationBody := fmt.Sprintf("Sync paused since %s, %d overwrites and removals were skipped this run.\n\n", report.DetectedAt.Format(time.RFC3339), report.Skipped)
+	notificationBody += "Reasons:\n"
+	for _, reason := range report.Reasons {
+		notificationBody += fmt.Sprintf("  - %s\n", reason)
+	}
+	notificationBody += fmt.Sprintf("\nOnce the changes are confirmed to be legitimate resume with:\n  warden approve -source %s -destination %s\n",
+		syncConfig.SourceFolder, destination.Name())
+
+	snsPublishReq := &sns.PublishInput{
+		Message:  aws.String(notificationBody),
+		TopicArn: aws.String(s.Topic),
+		Subject:  aws.String(fmt.Sprintf("Sync paused: %s -> %s", syncConfig.SourceFolder, destination.Bucket)),
+	}
+	return s.Client.PublishMessage(snsPublishReq)
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// stateFileName builds a file name that is stable for a set of identifying strings, IE: a source
+// folder and destination, without having to escape paths into file names.
+func stateFileName(extension string, parts ...string) string {
+	hash := sha256.New()
+	for _, part := range parts {
+		hash.Write([]byte(part))
+		hash.Write([]byte{0})
+	}
+	return hex.EncodeToString(hash.Sum(nil))[:32] + extension
+}
+
+// readStateFile decodes a JSON state file into v. A missing file is not an error, v is left as is.
+func readStateFile(path string, v interface{}) error {
+	data, readErr := ioutil.ReadFile(path)
+	if os.IsNotExist(readErr) {
+		return nil
+	}
+	if readErr != nil {
+		return readErr
+	}
+	return json.Unmarshal(data, v)
+}
+
+// writeStateFile encodes v as JSON, writing to a temp file first so a crash never leaves a
+// truncated state file behind.
+func writeStateFile(path string, v interface{}) error {
+	if mkdirErr := os.MkdirAll(filepath.Dir(path), 0700); mkdirErr != nil {
+		return mkdirErr
+	}
+	data, marshalErr := json.Marshal(v)
+	if marshalErr != nil {
+		return marshalErr
+	}
+
+	tempFile, tempErr := ioutil.TempFile(filepath.Dir(path), ".warden-state-*")
+	if tempErr != nil {
+		return tempErr
+	}
+	defer os.Remove(tempFile.Name())
+	if _, writeErr := tempFile.Write(data); writeErr != nil {
+		tempFile.Close()
+		return writeErr
+	}
+	if closeErr := tempFile.Close(); closeErr != nil {
+		return closeErr
+	}
+
+	return os.Rename(tempFile.Name(), path)
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// syncBatchSize is how many requests a push sync queues together while it compares a destination.
+// At most syncBatchesInFlight batches run at once, the comparison waits for one to finish rather
+// than piling up requests, so memory stays flat however large the tree is.
+var syncBatchSize = 1000
+
+const syncBatchesInFlight = 2
+
+// localFileBuffer is how far the local walk may run ahead of the bucket listing
+const localFileBuffer = 256
+
+var errStopLocalWalk = errors.New("stop walking local files")
+
+// localFile is a file found under a sync job's source folder along with the key it syncs to.
+// Excluded and filtered files aren't candidates for upload, they're still walked so their keys are
+// never considered deleted locally.
+type localFile struct {
+	key       string
+	path      string
+	info      os.FileInfo
+	candidate bool
+}
+
+// localFileStream walks a sync job's source folder in the background and hands out its files in key
+// order. Walks follow the order of paths, rewrite rules can reorder keys so their files are sorted
+// once the walk is done, which does mean holding every file of a job that rewrites keys.
+type localFileStream struct {
+	files     chan localFile
+	done      chan struct{}
+	closeOnce sync.Once
+	lastKey   string
+	// err is set by the walk before files is closed, orderErr by Next
+	err      error
+	orderErr error
+}
+
+func streamLocalFiles(sc SyncConfig, pathFilter *PathFilter, fileFilter FileFilter, now time.Time) *localFileStream {
+	stream := &localFileStream{files: make(chan localFile, localFileBuffer), done: make(chan struct{})}
+	send := func(file localFile) error {
+		select {
+		case stream.files <- file:
+			return nil
+		case <-stream.done:
+			return errStopLocalWalk
+		}
+	}
+
+	go func() {
+		defer close(stream.files)
+		rewritten := make([]localFile, 0)
+		walkOpts := WalkOptions{Filter: pathFilter, Symlinks: sc.Symlinks}
+		walkErr := concreteWalkFunc(sc.SourceFolder, walkOpts, func(localPath string, info os.FileInfo) error {
+			file := localFile{key: sc.KeyForPath(localPath), path: localPath, info: info, candidate: true}
+			if pathFilter.Excluded(localPath, false) {
+				log.Info(fmt.Sprintf("%s matches exclusion list. skipping...", localPath))
+				file.candidate = false
+			} else if skip, reason := fileFilter.Skip(info, now); skip {
+				log.Info(fmt.Sprintf("%s filtered out: %s. skipping...", localPath, reason))
+				file.candidate = false
+			}
+			if len(sc.Rewrite) != 0 {
+				rewritten = append(rewritten, file)
+				return nil
+			}
+			return send(file)
+		})
+		if walkErr == nil && len(sc.Rewrite) != 0 {
+			sort.SliceStable(rewritten, func(i, j int) bool {
+				return rewritten[i].key < rewritten[j].key
+			})
+			for _, file := range rewritten {
+				if walkErr = send(file); walkErr != nil {
+					break
+				}
+			}
+		}
+		if walkErr != errStopLocalWalk {
+			stream.err = walkErr
+		}
+	}()
+
+	return stream
+}
+
+// Next returns the next file in key order. It returns false once the walk is over, Close tells if
+// it finished or failed. Rewrite rules can map several files onto one key, only the first is kept.
+func (s *localFileStream) Next() (localFile, bool) {
+	for file := range s.files {
+		if s.lastKey != "" && file.key <= s.lastKey {
+			if file.key == s.lastKey {
+				continue
+			}
+			s.orderErr = fmt.Errorf("%s was walked out of order, after %s", file.key, s.lastKey)
+			return localFile{}, false
+		}
+		s.lastKey = file.key
+		return file, true
+	}
+	return localFile{}, false
+}
+
+// Close stops the walk if it's still running and returns the error it failed with, if any.
+func (s *localFileStream) Close() error {
+	s.closeOnce.Do(func() { close(s.done) })
+	for range s.files {
+	}
+	if s.orderErr != nil {
+		return s.orderErr
+	}
+	return s.err
+}
+
+// requestBatcher queues a destination's requests in batches of syncBatchSize as a comparison finds
+// them. Requests that can only be decided once the comparison is over are held rather than batched,
+// they're counted along with the batches so peakQueued is every request kept in memory at once.
+type requestBatcher struct {
+	ctx         context.Context
+	client      BucketClient
+	job         *WorkQueueJob
+	destination SyncDestination
+	tombstone   TombstonePolicy
+	resultMap   *ResultMap
+	batch       ObjectRequests
+	batchLen    int
+	held        int
+	slots       chan struct{}
+	wg          sync.WaitGroup
+	lock        sync.Mutex
+	queued      int
+	peakQueued  int
+}
+
+func newObjectRequests() ObjectRequests {
+	return ObjectRequests{
+		TombstoneKeys: make([]string, 0),
+		DeleteKeys:    make([]string, 0),
+		UploadKeys:    make(map[string]string),
+		SymlinkKeys:   make(map[string]string),
+		MoveKeys:      make(map[string]string),
+	}
+}
+
+func newRequestBatcher(ctx context.Context, client BucketClient, job *WorkQueueJob, destination SyncDestination, tombstone TombstonePolicy, resultMap *ResultMap) *requestBatcher {
+	return &requestBatcher{
+		ctx:         ctx,
+		client:      client,
+		job:         job,
+		destination: destination,
+		tombstone:   tombstone,
+		resultMap:   resultMap,
+		batch:       newObjectRequests(),
+		slots:       make(chan struct{}, syncBatchesInFlight),
+	}
+}
+
+func (b *requestBatcher) count(n int) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.queued += n
+	if b.queued > b.peakQueued {
+		b.peakQueued = b.queued
+	}
+}
+
+// Upload batches an upload of localPath, or of the link itself when a symlink is being preserved
+func (b *requestBatcher) Upload(key, localPath string, info os.FileInfo) {
+	if info.Mode()&os.ModeSymlink != 0 {
+		b.batch.SymlinkKeys[key] = localPath
+	} else {
+		b.batch.UploadKeys[key] = localPath
+	}
+	b.added()
+}
+
+// Remove batches a key that no longer exists locally, tombstoning it first when the destination
+// keeps tombstones
+func (b *requestBatcher) Remove(key string) {
+	if b.tombstone.Enabled() {
+		b.batch.TombstoneKeys = append(b.batch.TombstoneKeys, key)
+	} else {
+		b.batch.DeleteKeys = append(b.batch.DeleteKeys, key)
+	}
+	b.added()
+}
+
+// Hold counts a request kept aside until the comparison is over
+func (b *requestBatcher) Hold() {
+	b.held++
+	b.count(1)
+}
+
+func (b *requestBatcher) added() {
+	b.batchLen++
+	b.count(1)
+	if b.batchLen >= syncBatchSize {
+		b.Flush()
+	}
+}
+
+// Flush queues the current batch, waiting while syncBatchesInFlight batches are already running
+func (b *requestBatcher) Flush() {
+	if b.batchLen == 0 {
+		return
+	}
+	b.run(b.batch, b.batchLen)
+	b.batch = newObjectRequests()
+	b.batchLen = 0
+}
+
+// SubmitHeld queues the held requests, once move and anomaly detection have had their say
+func (b *requestBatcher) SubmitHeld(objReqs ObjectRequests) {
+	b.run(objReqs, b.held)
+	b.held = 0
+}
+
+func (b *requestBatcher) run(objReqs ObjectRequests, n int) {
+	b.slots <- struct{}{}
+	b.wg.Add(1)
+	go func() {
+		defer b.wg.Done()
+		syncObjectRequests(b.ctx, b.client, b.job, objReqs, b.resultMap, b.destination, b.tombstone)
+		b.count(-n)
+		<-b.slots
+	}()
+}
+
+// Wait queues whatever is left of the current batch and waits for every batch to finish
+func (b *requestBatcher) Wait() {
+	b.Flush()
+	b.wg.Wait()
+}
@@ -1,11 +1,11 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"io/ioutil"
 	"os"
 	"path/filepath"
-	"regexp"
 	"strings"
 	"sync"
 	"time"
@@ -22,244 +22,805 @@ type ObjectRequests struct {
 	TombstoneKeys []string
 	DeleteKeys    []string
 	UploadKeys    map[string]string
+	// SymlinkKeys are uploads for symlinks being preserved rather than followed
+	SymlinkKeys map[string]string
+	// DownloadKeys and LocalDeleteKeys map keys to local paths, they are only used by bidirectional syncs
+	DownloadKeys    map[string]string
+	LocalDeleteKeys map[string]string
+	// LocalFolder is the folder downloads are written under, nothing is written through a symlink in it
+	LocalFolder string
+	// MoveKeys maps a new key to an existing key with the same content that is copied to it server side
+	MoveKeys map[string]string
+}
+
+// resultDetailLimit caps how many successful keys a ResultMap lists per operation so a huge diff
+// doesn't hold every key in memory, failures are always listed.
+const resultDetailLimit = 1000
+
+// ResultCount tallies an operation for every key, including ones left out of the detail maps.
+type ResultCount struct {
+	Total  int
+	Failed int
 }
 
 type ResultMap struct {
-	Upload    map[string]error
-	Tombstone map[string]error
-	Delete    map[string]error
-	lock      *sync.Mutex
+	Upload           map[string]error
+	Tombstone        map[string]error
+	Delete           map[string]error
+	Download         map[string]error
+	LocalDelete      map[string]error
+	Conflict         map[string]error
+	Move             map[string]error
+	UploadCount      ResultCount
+	TombstoneCount   ResultCount
+	DeleteCount      ResultCount
+	DownloadCount    ResultCount
+	LocalDeleteCount ResultCount
+	ConflictCount    ResultCount
+	MoveCount        ResultCount
+	// Anomaly is set when the destination is paused by anomaly detection
+	Anomaly *AnomalyReport
+	// PeakQueued is the most requests a push sync held in memory at once while comparing the
+	// destination, it stays within a few batches unless moves or anomalies have to be held back
+	PeakQueued int
+	Err        error
+	lock       *sync.Mutex
 }
 
-func (r *ResultMap) AddUploadResult(key string, result error) {
+// SyncResults holds the outcome of a sync for every destination, keyed by destination name.
+type SyncResults map[string]*ResultMap
+
+func NewResultMap() *ResultMap {
+	return &ResultMap{
+		Upload:      make(map[string]error),
+		Delete:      make(map[string]error),
+		Tombstone:   make(map[string]error),
+		Download:    make(map[string]error),
+		LocalDelete: make(map[string]error),
+		Conflict:    make(map[string]error),
+		Move:        make(map[string]error),
+		lock:        new(sync.Mutex),
+	}
+}
+
+// add records a key being queued when result is nil, and a failure otherwise
+func (r *ResultMap) add(results map[string]error, count *ResultCount, key string, result error) {
 	r.lock.Lock()
 	defer r.lock.Unlock()
-	r.Upload[key] = result
+	previous, listed := results[key]
+	if result == nil {
+		count.Total++
+		if listed || len(results) < resultDetailLimit {
+			results[key] = nil
+		}
+		return
+	}
+	if previous == nil {
+		count.Failed++
+	}
+	results[key] = result
+}
+
+func (r *ResultMap) AddUploadResult(key string, result error) {
+	r.add(r.Upload, &r.UploadCount, key, result)
 }
 
 func (r *ResultMap) AddTombstoneResult(key string, result error) {
-	r.lock.Lock()
-	defer r.lock.Unlock()
-	r.Tombstone[key] = result
+	r.add(r.Tombstone, &r.TombstoneCount, key, result)
 }
 
 func (r *ResultMap) AddDeleteResult(key string, result error) {
+	r.add(r.Delete, &r.DeleteCount, key, result)
+}
+
+func (r *ResultMap) AddDownloadResult(key string, result error) {
+	r.add(r.Download, &r.DownloadCount, key, result)
+}
+
+func (r *ResultMap) AddLocalDeleteResult(key string, result error) {
+	r.add(r.LocalDelete, &r.LocalDeleteCount, key, result)
+}
+
+func (r *ResultMap) AddConflictResult(key string, result error) {
+	r.add(r.Conflict, &r.ConflictCount, key, result)
+}
+
+func (r *ResultMap) AddMoveResult(key string, result error) {
+	r.add(r.Move, &r.MoveCount, key, result)
+}
+
+// Failed reports if any request for a key returned an error.
+func (r *ResultMap) Failed(key string) bool {
 	r.lock.Lock()
 	defer r.lock.Unlock()
-	r.Delete[key] = result
+	for _, results := range []map[string]error{r.Upload, r.Tombstone, r.Delete, r.Download, r.LocalDelete, r.Conflict, r.Move} {
+		if results[key] != nil {
+			return true
+		}
+	}
+	return false
 }
 
-func doSync(client BucketClient, sc SyncConfig, notifier Notifier, lock *sync.Mutex) (*ResultMap, error) {
-	resultMap := &ResultMap{
-		Upload:    make(map[string]error),
-		Delete:    make(map[string]error),
-		Tombstone: make(map[string]error),
-		lock:      new(sync.Mutex),
+func doSync(ctx context.Context, clients map[string]BucketClient, sc SyncConfig, notifier Notifier, lock *sync.Mutex) (SyncResults, error) {
+	destinations := sc.DestinationList()
+	syncResults := make(SyncResults)
+	for _, destination := range destinations {
+		syncResults[destination.Name()] = NewResultMap()
 	}
 	if !lock.TryLock() {
 		log.Warn("Another sync routine is already running. Skipping.")
-		return resultMap, fmt.Errorf("Unable to acquire sync lock")
+		return syncResults, fmt.Errorf("Unable to acquire sync lock")
 	}
 	defer lock.Unlock()
 	log.Info(fmt.Sprintf("Sync starting for %s.", sc.SourceFolder))
 	syncStartTime := time.Now()
+	ctx, cancel := runContext(ctx, sc.Timeouts)
+	defer cancel()
 
-	// TODO: for now with a small number of exclusion matchers, this OK, but we should figure out
-	// a more efficient way to do this to handle a larger amount of exception patterns
-	regexStr := strings.Join(sc.Exclude, "|")
-	exclude := regexp.MustCompile(regexStr)
-
-	objectRequests := ObjectRequests{
-		TombstoneKeys: make([]string, 0),
-		DeleteKeys:    make([]string, 0),
-		UploadKeys:    make(map[string]string),
+	pathFilter, pathFilterErr := NewPathFilter(sc)
+	if pathFilterErr != nil {
+		return syncResults, pathFilterErr
 	}
 
-	bucketFiles, listBucketErr := client.ListObjects(sc.DestinationBucket)
-	if listBucketErr != nil {
-		log.Warn(fmt.Sprintf("listBucket err: %s", listBucketErr))
-		return resultMap, fmt.Errorf("Error listing S3 bucket: %s", listBucketErr)
+	fileFilter, fileFilterErr := NewFileFilter(sc.Filters)
+	if fileFilterErr != nil {
+		return syncResults, fileFilterErr
 	}
-	localFiles, listLocalFilesErr := concreteWalkFunc(sc.SourceFolder)
-	if listLocalFilesErr != nil {
-		log.Warn(fmt.Sprintf("listLocalFilesErr: %s", listLocalFilesErr))
-		return resultMap, fmt.Errorf("Error walking local directory: %s", listLocalFilesErr)
+
+	jobLimiter, jobLimiterErr := NewRateLimiter(sc.Bandwidth)
+	if jobLimiterErr != nil {
+		return syncResults, jobLimiterErr
 	}
 
-	for localPath, localFileInfo := range localFiles {
-		isExcluded := len(sc.Exclude) != 0 && exclude.MatchString(localPath)
-		if isExcluded {
-			log.Info(fmt.Sprintf("%s matches exclusion list. skipping...", localPath))
-			continue
+	// bidirectional syncs compare against a baseline of the whole tree so they walk it up front, push
+	// syncs stream the walk against each destination's listing instead
+	var localFiles, uploadCandidates map[string]os.FileInfo
+	if sc.Mode == SyncModeBidirectional {
+		var listLocalFilesErr error
+		localFiles, listLocalFilesErr = collectFiles(sc.SourceFolder, WalkOptions{Filter: pathFilter, Symlinks: sc.Symlinks})
+		if listLocalFilesErr != nil {
+			log.Warn(fmt.Sprintf("listLocalFilesErr: %s", listLocalFilesErr))
+			return syncResults, fmt.Errorf("Error walking local directory: %s", listLocalFilesErr)
 		}
 
-		pathComponents := strings.Split(localPath, sc.SourceFolder)
-		uploadKey := pathComponents[1]
-		remoteObj, ok := bucketFiles[strings.TrimPrefix(uploadKey, "/")]
-
-		// S3 will apply it's own last modified timestamp when an object is uploaded, the timestamp from local file
-		// stat wont match. As long as the last modified timestamp from S3 for any given file/key combo is more recent
-		// than the local file last modified timestamp, S3 has the most recent copy. we could use our own metadata
-		// to track local file modification time, but this would require a HeadObject call for every file, and on
-		// a large drive/bucket, that's a ton of API calls which both slow this down considerably and cost more.
-		if !ok {
-			objectRequests.UploadKeys[uploadKey] = localPath
-		} else {
-			localFileSize := localFileInfo.Size()
-			timeSinceUpdate := remoteObj.ModTime.Sub(localFileInfo.ModTime())
-			if timeSinceUpdate < 0 || localFileSize != remoteObj.Size {
-				log.Info(fmt.Sprintf("%s has been modified, will update", localPath))
-				objectRequests.UploadKeys[uploadKey] = localPath
-			} else {
-				log.Debug(fmt.Sprintf("%s is in sync, no action required", localPath))
+		// excluded and filtered files are still kept in localFiles so they are never considered deleted locally
+		uploadCandidates = make(map[string]os.FileInfo)
+		for localPath, localFileInfo := range localFiles {
+			if pathFilter.Excluded(localPath, false) {
+				log.Info(fmt.Sprintf("%s matches exclusion list. skipping...", localPath))
+				continue
+			}
+			if skip, reason := fileFilter.Skip(localFileInfo, syncStartTime); skip {
+				log.Info(fmt.Sprintf("%s filtered out: %s. skipping...", localPath, reason))
+				continue
 			}
+			uploadCandidates[localPath] = localFileInfo
 		}
 	}
 
-	for key, _ := range bucketFiles {
-		if !strings.HasPrefix(key, "/") {
-			key = "/" + key
-		}
-		localPathPrefix := strings.TrimSuffix(sc.SourceFolder, "/")
-		localPathForKey := localPathPrefix + key
-		_, ok := localFiles[localPathForKey]
-		if !ok && sc.Destructive {
-			if sc.TombstoneBucket != "" {
-				objectRequests.TombstoneKeys = append(objectRequests.TombstoneKeys, key)
+	// destinations share the job's slot in the work queue, but are otherwise synced independently so
+	// a failure on one doesn't hold up the others
+	job := workQueue.NewJob(sc.SourceFolder, sc.Priority, sc.Concurrency)
+	var wg sync.WaitGroup
+	for _, destination := range destinations {
+		wg.Add(1)
+		go func(destination SyncDestination, resultMap *ResultMap) {
+			defer wg.Done()
+			client, clientErr := ClientForProvider(clients, destination.Provider)
+			if clientErr == nil {
+				client = limitOperations(limitUploads(client, jobLimiter), sc.Timeouts)
+			}
+			if clientErr != nil {
+				resultMap.Err = clientErr
+			} else if sc.Mode == SyncModeBidirectional {
+				resultMap.Err = syncBidirectional(ctx, client, job, sc, destination, pathFilter, localFiles, uploadCandidates, resultMap)
 			} else {
-				objectRequests.DeleteKeys = append(objectRequests.DeleteKeys, key)
+				resultMap.Err = syncDestination(ctx, client, job, sc, destination, fileFilter, syncStartTime, resultMap)
 			}
-		}
+			// operations cut short by the run timeout or a shutdown fail the destination as a whole
+			if resultMap.Err == nil && ctx.Err() != nil {
+				resultMap.Err = fmt.Errorf("Sync was cancelled: %s", ctx.Err())
+			}
+			if resultMap.Err != nil {
+				log.Warn(fmt.Sprintf("Sync for %s to %s failed: %s", sc.SourceFolder, destination.Name(), resultMap.Err))
+			} else if sc.TombstoneRetention > 0 {
+				purged, purgeErr := purgeTombstones(ctx, client, sc, destination, time.Now())
+				if purgeErr != nil {
+					log.Warn(fmt.Sprintf("Purging tombstones for %s failed: %s", destination.Name(), purgeErr))
+				}
+				if purged != 0 {
+					log.Info(fmt.Sprintf("Purged %d tombstones older than %d days from %s", purged, sc.TombstoneRetention, destination.Name()))
+				}
+			}
+			if resultMap.Err == nil && sc.Snapshots {
+				snapshotKey, snapshotErr := takeSnapshot(ctx, client, job, sc, destination, time.Now())
+				if snapshotErr != nil {
+					resultMap.Err = fmt.Errorf("Snapshot failed: %s", snapshotErr)
+					log.Warn(fmt.Sprintf("Snapshot of %s in %s failed: %s", sc.SourceFolder, destination.Name(), snapshotErr))
+				} else {
+					log.Info(fmt.Sprintf("Recorded snapshot %s in %s", snapshotKey, destination.Name()))
+				}
+				if snapshotErr == nil && sc.SnapshotRetention > 0 {
+					expired, swept, garbageErr := collectSnapshotGarbage(ctx, client, sc, destination, time.Now())
+					if garbageErr != nil {
+						log.Warn(fmt.Sprintf("Collecting snapshot garbage in %s failed: %s", destination.Name(), garbageErr))
+					}
+					if expired != 0 || swept != 0 {
+						log.Info(fmt.Sprintf("Deleted %d snapshots older than %d days and %d unreferenced objects from %s", expired, sc.SnapshotRetention, swept, destination.Name()))
+					}
+				}
+			}
+
+			if notifier != nil {
+				notifier.NotifySyncResults(sc, destination, resultMap)
+				if resultMap.Anomaly != nil {
+					notifier.NotifyAnomaly(sc, destination, *resultMap.Anomaly)
+				}
+			}
+		}(destination, syncResults[destination.Name()])
 	}
+	wg.Wait()
 
-	syncObjectRequests(client, objectRequests, resultMap, sc.DestinationBucket, sc.TombstoneBucket)
 	syncEndTime := time.Now()
 	duration := syncEndTime.Sub(syncStartTime)
 	log.Info(fmt.Sprintf("Sync complete for %s. Took %s", sc.SourceFolder, duration.String()))
 
-	if notifier != nil {
-		notifier.NotifySyncResults(sc, resultMap)
+	failedDestinations := make([]string, 0)
+	for _, destination := range destinations {
+		if syncResults[destination.Name()].Err != nil {
+			failedDestinations = append(failedDestinations, destination.Name())
+		}
+	}
+	if len(failedDestinations) != 0 {
+		return syncResults, fmt.Errorf("Sync failed for destinations: %s", strings.Join(failedDestinations, ", "))
 	}
 
-	return resultMap, nil
+	return syncResults, nil
 }
 
-func syncObjectRequests(client BucketClient, objReqs ObjectRequests, resultMap *ResultMap, destBucket, tombstoneBucket string) {
-	var wg sync.WaitGroup
+// syncDestination brings a destination in line with the source folder. The local walk and the
+// bucket listing both run in key order and are compared as they go, so neither is held in memory and
+// requests are queued in batches as soon as they're found. Moves and anomalies can only be told once
+// the whole listing has been seen, the requests they decide on are held until then.
+func syncDestination(
+	ctx context.Context,
+	client BucketClient,
+	job *WorkQueueJob,
+	sc SyncConfig,
+	destination SyncDestination,
+	fileFilter FileFilter,
+	syncStartTime time.Time,
+	resultMap *ResultMap,
+) error {
+	// every destination walks the source folder itself, the filter collects ignore files as it goes
+	pathFilter, pathFilterErr := NewPathFilter(sc)
+	if pathFilterErr != nil {
+		return pathFilterErr
+	}
+
+	batcher := newRequestBatcher(ctx, client, job, destination, sc.TombstonePolicy(destination), resultMap)
+	defer func() {
+		batcher.Wait()
+		resultMap.PeakQueued = batcher.peakQueued
+	}()
+
+	// moves pair new keys with removed objects, anomaly detection holds back overwrites and removals
+	// along with new keys it flags
+	held := newObjectRequests()
+	heldFiles := make(map[string]os.FileInfo)
+	newKeys := make(map[string]string)
+	removedObjects := make(map[string]ObjectInfo)
+	anomalyConfig := sc.Anomaly.withDefaults()
+	upload := func(file localFile, isNew bool) {
+		hold := (isNew && sc.DetectMoves && sc.Destructive) ||
+			(sc.Anomaly.Enabled && (!isNew || anomalyConfig.flagsExtension(file.key)))
+		if !hold {
+			batcher.Upload(file.key, file.path, file.info)
+			return
+		}
+		held.UploadKeys[file.key] = file.path
+		heldFiles[file.path] = file.info
+		if isNew {
+			newKeys[file.key] = file.path
+		}
+		batcher.Hold()
+	}
+	remove := func(key string, remoteObj ObjectInfo) {
+		if !sc.DetectMoves && !sc.Anomaly.Enabled {
+			batcher.Remove(key)
+			return
+		}
+		if sc.DetectMoves {
+			removedObjects[key] = remoteObj
+		}
+		if sc.TombstonePolicy(destination).Enabled() {
+			held.TombstoneKeys = append(held.TombstoneKeys, key)
+		} else {
+			held.DeleteKeys = append(held.DeleteKeys, key)
+		}
+		batcher.Hold()
+	}
+
+	local := streamLocalFiles(sc, pathFilter, fileFilter, syncStartTime)
+	defer local.Close()
+	var localErr error
+	file, hasLocal := local.Next()
+	// a walk that ends early must never be mistaken for files that were deleted locally
+	nextLocal := func() error {
+		if file, hasLocal = local.Next(); !hasLocal {
+			localErr = local.Close()
+		}
+		return localErr
+	}
+	if !hasLocal {
+		localErr = local.Close()
+	}
+
+	keyPrefix := sc.KeyPrefix()
+	managedKeys := 0
+	lastKey := ""
+	listOpts := ListOptions{Prefix: keyPrefix}
+	listBucketErr := localErr
+	if listBucketErr == nil {
+		listBucketErr = client.WalkObjects(ctx, destination.Bucket, listOpts, func(objectKey string, remoteObj ObjectInfo) error {
+			key := "/" + strings.TrimPrefix(objectKey, "/")
+			if !sc.ManagesKey(key) {
+				return nil
+			}
+			if key <= lastKey {
+				return fmt.Errorf("%s was listed out of order, after %s", key, lastKey)
+			}
+			lastKey = key
+			managedKeys++
+
+			for hasLocal && file.key < key {
+				if file.candidate {
+					upload(file, true)
+				}
+				if nextErr := nextLocal(); nextErr != nil {
+					return nextErr
+				}
+			}
+
+			if !hasLocal || file.key != key {
+				// keys for excluded paths are left alone, excluded directories are pruned from the walk so
+				// their files are never found locally. this can't see through rewrite rules.
+				relativeKey := strings.TrimPrefix(strings.TrimPrefix(key, "/"), keyPrefix)
+				if pathFilter.Excluded(filepath.Join(sc.SourceFolder, relativeKey), false) {
+					return nil
+				}
+				if sc.Destructive {
+					log.Debug(fmt.Sprintf("%s under prefix '%s' no longer exists locally", key, keyPrefix))
+					remove(key, remoteObj)
+				}
+				return nil
+			}
+
+			matched := file
+			if nextErr := nextLocal(); nextErr != nil {
+				return nextErr
+			}
+			if !matched.candidate {
+				// local file exists but was excluded
+				return nil
+			}
+			if objectModified(matched.info, remoteObj) {
+				log.Info(fmt.Sprintf("%s has been modified, will update", matched.path))
+				upload(matched, false)
+			} else {
+				log.Debug(fmt.Sprintf("%s is in sync, no action required", matched.path))
+			}
+			return nil
+		})
+	}
+	for listBucketErr == nil && hasLocal {
+		if file.candidate {
+			upload(file, true)
+		}
+		listBucketErr = nextLocal()
+	}
+	if localErr != nil {
+		log.Warn(fmt.Sprintf("listLocalFilesErr: %s", localErr))
+		return fmt.Errorf("Error walking local directory: %s", localErr)
+	}
+	if listBucketErr != nil {
+		log.Warn(fmt.Sprintf("listBucket err: %s", listBucketErr))
+		return fmt.Errorf("Error listing bucket %s: %s", destination.Bucket, listBucketErr)
+	}
+
+	if sc.DetectMoves {
+		held = detectMoves(held, newKeys, removedObjects, heldFiles)
+	}
+
+	if sc.Anomaly.Enabled {
+		var guardErr error
+		held, resultMap.Anomaly, guardErr = guardAnomalies(ctx, client, sc, destination, held, newKeys, managedKeys, time.Now())
+		if guardErr != nil {
+			return guardErr
+		}
+	}
+
+	for key, localPath := range held.UploadKeys {
+		if heldFiles[localPath].Mode()&os.ModeSymlink != 0 {
+			delete(held.UploadKeys, key)
+			held.SymlinkKeys[key] = localPath
+		}
+	}
+	batcher.SubmitHeld(held)
+
+	return nil
+}
+
+// objectModified compares a local file against the object it was synced to. When the provider returns
+// metadata in listings (GCS) the original modification time stored at upload is compared exactly.
+//
+// Otherwise, S3 will apply it's own last modified timestamp when an object is uploaded, the timestamp from local
+// file stat wont match. As long as the last modified timestamp from S3 for any given file/key combo is more recent
+// than the local file last modified timestamp, S3 has the most recent copy. we could use our own metadata
+// to track local file modification time, but this would require a HeadObject call for every file, and on
+// a large drive/bucket, that's a ton of API calls which both slow this down considerably and cost more.
+func objectModified(localFileInfo os.FileInfo, remoteObj ObjectInfo) bool {
+	if localFileInfo.Size() != remoteObj.Size {
+		return true
+	}
+	if originalModTime, ok := metadataModTime(remoteObj.Metadata); ok {
+		return !originalModTime.Equal(localFileInfo.ModTime())
+	}
+
+	timeSinceUpdate := remoteObj.ModTime.Sub(localFileInfo.ModTime())
+	return timeSinceUpdate < 0
+}
 
-	for fileKey, fileInfo := range objReqs.UploadKeys {
+// syncObjectRequests queues every request on the job and waits for them to finish
+func syncObjectRequests(
+	ctx context.Context,
+	client BucketClient,
+	job *WorkQueueJob,
+	objReqs ObjectRequests,
+	resultMap *ResultMap,
+	destination SyncDestination,
+	tombstone TombstonePolicy,
+) {
+	destBucket := destination.Bucket
+	var wg sync.WaitGroup
+	submit := func(task func()) {
 		wg.Add(1)
-		go doUploadFile(client, destBucket, fileKey, fileInfo, &wg, resultMap)
+		job.Submit(func() {
+			defer wg.Done()
+			task()
+		})
 	}
 
-	if tombstoneBucket != "" {
+	for fileKey, filePath := range objReqs.UploadKeys {
+		if _, ok := objReqs.DownloadKeys[fileKey]; ok {
+			continue
+		}
+		fileKey, filePath := fileKey, filePath
+		resultMap.AddUploadResult(fileKey, nil)
+		submit(func() { doUploadFile(ctx, client, destBucket, fileKey, filePath, resultMap) })
+	}
+
+	for newKey, oldKey := range objReqs.MoveKeys {
+		newKey, oldKey := newKey, oldKey
+		resultMap.AddMoveResult(newKey, nil)
+		submit(func() { doMoveObject(ctx, client, destBucket, oldKey, newKey, resultMap) })
+	}
+
+	for linkKey, linkPath := range objReqs.SymlinkKeys {
+		linkKey, linkPath := linkKey, linkPath
+		resultMap.AddUploadResult(linkKey, nil)
+		submit(func() { doUploadSymlink(ctx, client, destBucket, linkKey, linkPath, resultMap) })
+	}
+
+	if tombstone.Enabled() && len(objReqs.TombstoneKeys) != 0 {
+		var preservedLock sync.Mutex
+		var preserveWg sync.WaitGroup
+		preserved := make([]TombstoneRecord, 0)
 		for _, key := range objReqs.TombstoneKeys {
-			wg.Add(1)
-			go doTombstoneObject(client, destBucket, tombstoneBucket, key, &wg, resultMap)
+			key := key
+			resultMap.AddTombstoneResult(key, nil)
+			preserveWg.Add(1)
+			submit(func() {
+				defer preserveWg.Done()
+				if record, preserveErr := doTombstoneObject(ctx, client, destBucket, tombstone, key, resultMap); preserveErr == nil {
+					preservedLock.Lock()
+					preserved = append(preserved, record)
+					preservedLock.Unlock()
+				}
+			})
 		}
+
+		// originals are only deleted once they're safely tombstoned. The deletes get their own wait
+		// group so wg is never added to while it may already be waited on
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			preserveWg.Wait()
+			if tombstone.Strategy == TombstoneStrategyVersioning {
+				doDeleteVersioned(ctx, client, job, destination, preserved, resultMap)
+				return
+			}
+
+			preservedKeys := make([]string, 0, len(preserved))
+			for _, record := range preserved {
+				if !record.moved {
+					preservedKeys = append(preservedKeys, record.Key)
+				}
+			}
+			var deleteWg sync.WaitGroup
+			for _, batch := range deleteBatches(preservedKeys) {
+				batch := batch
+				deleteWg.Add(1)
+				job.Submit(func() {
+					defer deleteWg.Done()
+					doDeleteObjects(ctx, client, destBucket, batch, resultMap.AddTombstoneResult)
+				})
+			}
+			deleteWg.Wait()
+		}()
 	}
 
 	for _, key := range objReqs.DeleteKeys {
-		wg.Add(1)
-		go doDeleteObject(client, destBucket, key, &wg, resultMap)
+		resultMap.AddDeleteResult(key, nil)
+	}
+	for _, batch := range deleteBatches(objReqs.DeleteKeys) {
+		batch := batch
+		submit(func() { doDeleteObjects(ctx, client, destBucket, batch, resultMap.AddDeleteResult) })
+	}
+
+	for key, localPath := range objReqs.DownloadKeys {
+		key, localPath := key, localPath
+		resultMap.AddDownloadResult(key, nil)
+		uploadPath, upload := objReqs.UploadKeys[key]
+		if !upload {
+			submit(func() { doDownloadObject(ctx, client, destBucket, key, objReqs.LocalFolder, localPath, resultMap) })
+			continue
+		}
+
+		resultMap.AddUploadResult(key, nil)
+		submit(func() {
+			doKeepBoth(ctx, client, destBucket, key, objReqs.LocalFolder, localPath, uploadPath, resultMap)
+		})
+	}
+
+	for key, localPath := range objReqs.LocalDeleteKeys {
+		key, localPath := key, localPath
+		resultMap.AddLocalDeleteResult(key, nil)
+		submit(func() { doDeleteLocalFile(key, localPath, resultMap) })
 	}
 
 	wg.Wait()
 }
 
-func doUploadFile(
-	client BucketClient,
-	bucket, key, filePath string,
-	wg *sync.WaitGroup,
-	resultMap *ResultMap,
-) error {
-	resultMap.AddUploadResult(key, nil)
-	semaphore <- 1
-	defer wg.Done()
-
+func doUploadFile(ctx context.Context, client BucketClient, bucket, key, filePath string, resultMap *ResultMap) error {
 	fd, fileErr := os.Open(filePath)
 	if fileErr != nil {
 		resultMap.AddUploadResult(key, fileErr)
-		<-semaphore
 		return fileErr
 	}
 	defer fd.Close()
 
-	key = strings.TrimPrefix(key, "/")
-	uploadErr := client.UploadFile(bucket, key, fd)
+	fileInfo, statErr := fd.Stat()
+	if statErr != nil {
+		resultMap.AddUploadResult(key, statErr)
+		return statErr
+	}
+
+	// large files are uploaded in parts that are recorded locally, so a restart doesn't start them over
+	var uploadErr error
+	metadata := posixMetadata(filePath, fileInfo)
+	if multipart, ok := multipartClient(client); ok && fileInfo.Size() >= resumableUploadThreshold {
+		uploadErr = uploadResumable(ctx, multipart, bucket, strings.TrimPrefix(key, "/"), fd, fileInfo, metadata, partSizeFor(fileInfo.Size(), multipart.MaxUploadParts()))
+	} else {
+		uploadErr = client.UploadFile(ctx, bucket, strings.TrimPrefix(key, "/"), fd, metadata)
+	}
 	if uploadErr != nil {
+		log.Warn(fmt.Sprintf("Error uploading %s: %s", filePath, uploadErr))
 		resultMap.AddUploadResult(key, uploadErr)
+		return uploadErr
 	}
 	log.Info(fmt.Sprintf("Uploaded file %s as key %s", filePath, key))
-	<-semaphore
 
-	return uploadErr
+	return nil
 }
 
-func doTombstoneObject(
-	client BucketClient,
-	sourceBucket, destinationBucket, key string,
-	wg *sync.WaitGroup,
-	resultMap *ResultMap,
-) error {
-	resultMap.AddTombstoneResult(key, nil)
-	semaphore <- 1
-	defer wg.Done()
+// doUploadSymlink stores a symlink as an object whose body and metadata hold the link target, so
+// restores can recreate the link rather than a copy of what it pointed to.
+func doUploadSymlink(ctx context.Context, client BucketClient, bucket, key, linkPath string, resultMap *ResultMap) error {
+	linkInfo, statErr := os.Lstat(linkPath)
+	if statErr != nil {
+		resultMap.AddUploadResult(key, statErr)
+		return statErr
+	}
+	linkTarget, readErr := os.Readlink(linkPath)
+	if readErr != nil {
+		resultMap.AddUploadResult(key, readErr)
+		return readErr
+	}
+
+	metadata := posixMetadata(linkPath, linkInfo)
+	metadata[metadataSymlinkTarget] = linkTarget
+	uploadErr := client.UploadFile(ctx, bucket, strings.TrimPrefix(key, "/"), strings.NewReader(linkTarget), metadata)
+	if uploadErr != nil {
+		resultMap.AddUploadResult(key, uploadErr)
+		return uploadErr
+	}
+	log.Info(fmt.Sprintf("Uploaded symlink %s -> %s as key %s", linkPath, linkTarget, key))
 
-	copyErr := client.CopyObject(sourceBucket, destinationBucket, key)
-	log.Info(fmt.Sprintf("Copied %s from %s to %s", key, sourceBucket, destinationBucket))
+	return nil
+}
 
+// doMoveObject copies an object to a new key in the same bucket and removes the old key. The content
+// lives on at the new key so the old key is deleted rather than tombstoned.
+func doMoveObject(ctx context.Context, client BucketClient, bucket, oldKey, newKey string, resultMap *ResultMap) error {
+	copyErr := client.CopyObject(ctx, bucket, strings.TrimPrefix(oldKey, "/"), bucket, strings.TrimPrefix(newKey, "/"), CopyOptions{})
 	if copyErr != nil {
-		log.Warn(fmt.Sprintf("Error copying object during tombstone routine: %s", copyErr))
-		resultMap.AddTombstoneResult(key, copyErr)
-		<-semaphore
+		log.Warn(fmt.Sprintf("Error copying %s to %s during move: %s", oldKey, newKey, copyErr))
+		resultMap.AddMoveResult(newKey, copyErr)
 		return copyErr
 	}
 
-	delErr := client.DeleteObject(sourceBucket, key)
-	log.Info(fmt.Sprintf("Deleted %s from bucket %s", key, sourceBucket))
-
+	delErr := client.DeleteObject(ctx, bucket, strings.TrimPrefix(oldKey, "/"))
 	if delErr != nil {
-		log.Warn(fmt.Sprintf("Error deleting original object during tombstone routine: %s", delErr))
-		resultMap.AddTombstoneResult(key, delErr)
-		<-semaphore
+		log.Warn(fmt.Sprintf("Error deleting %s after moving it to %s: %s", oldKey, newKey, delErr))
+		resultMap.AddMoveResult(newKey, delErr)
 		return delErr
 	}
+	log.Info(fmt.Sprintf("Moved %s to %s in bucket %s", oldKey, newKey, bucket))
 
-	<-semaphore
 	return nil
 }
 
-func doDeleteObject(
-	client BucketClient,
-	bucket, key string,
-	wg *sync.WaitGroup,
-	resultMap *ResultMap,
-) error {
-	resultMap.AddDeleteResult(key, nil)
-	defer wg.Done()
-	delErr := client.DeleteObject(bucket, key)
-	log.Info(fmt.Sprintf("Deleted %s from bucket %s", key, bucket))
+// doTombstoneObject preserves an object before it's deleted, by copying it or by checking the bucket
+// will keep a version of it. The original is deleted afterwards along with the other tombstoned keys,
+// unless the client could move it to its tombstone.
+func doTombstoneObject(ctx context.Context, client BucketClient, bucket string, tombstone TombstonePolicy, key string, resultMap *ResultMap) (TombstoneRecord, error) {
+	record := TombstoneRecord{Key: key, DeletedAt: time.Now().UTC()}
+	if tombstone.Strategy == TombstoneStrategyVersioning {
+		// the version recorded comes from the delete, this only makes sure the delete keeps one
+		versionID, versionErr := client.ObjectVersion(ctx, bucket, key)
+		if versionErr == nil && versionID == "" {
+			versionErr = notVersionedError(bucket)
+		}
+		if versionErr != nil {
+			log.Warn(fmt.Sprintf("Error looking up version of %s during tombstone routine: %s", key, versionErr))
+			resultMap.AddTombstoneResult(key, versionErr)
+			return record, versionErr
+		}
+		return record, nil
+	}
 
-	if delErr != nil {
-		log.Warn(fmt.Sprintf("Error deleting: %s", delErr))
-		resultMap.AddDeleteResult(key, delErr)
-		<-semaphore
-		return delErr
+	tombstoneBucket, tombstoneKey := tombstone.TombstoneLocation(bucket, key, record.DeletedAt)
+	if mover, ok := moveClient(client); ok {
+		if moveErr := mover.MoveObject(ctx, bucket, key, tombstoneBucket, tombstoneKey); moveErr != nil {
+			log.Warn(fmt.Sprintf("Error moving object during tombstone routine: %s", moveErr))
+			resultMap.AddTombstoneResult(key, moveErr)
+			return record, moveErr
+		}
+		log.Info(fmt.Sprintf("Moved %s from %s to %s in %s", key, bucket, tombstoneKey, tombstoneBucket))
+		record.moved = true
+		return record, nil
+	}
+	copyErr := client.CopyObject(ctx, bucket, key, tombstoneBucket, tombstoneKey, CopyOptions{StorageClass: tombstone.StorageClass})
+	if copyErr != nil {
+		log.Warn(fmt.Sprintf("Error copying object during tombstone routine: %s", copyErr))
+		resultMap.AddTombstoneResult(key, copyErr)
+		return record, copyErr
+	}
+	log.Info(fmt.Sprintf("Copied %s from %s to %s in %s", key, bucket, tombstoneKey, tombstoneBucket))
+
+	return record, nil
+}
+
+// doDeleteVersioned deletes keys from a versioned bucket one at a time, the version each delete
+// made noncurrent is only known per key. Versions are journaled once their delete succeeded, so the
+// journal never names a version that wasn't the one deleted.
+func doDeleteVersioned(ctx context.Context, client BucketClient, job *WorkQueueJob, destination SyncDestination, records []TombstoneRecord, resultMap *ResultMap) {
+	var deletedLock sync.Mutex
+	var deleteWg sync.WaitGroup
+	deleted := make([]TombstoneRecord, 0, len(records))
+	for _, record := range records {
+		record := record
+		deleteWg.Add(1)
+		job.Submit(func() {
+			defer deleteWg.Done()
+			versionID, delErr := client.DeleteObjectVersioned(ctx, destination.Bucket, record.Key)
+			if delErr != nil {
+				log.Warn(fmt.Sprintf("Error deleting %s: %s", record.Key, delErr))
+				resultMap.AddTombstoneResult(record.Key, delErr)
+				return
+			}
+			record.VersionID = versionID
+			deletedLock.Lock()
+			deleted = append(deleted, record)
+			deletedLock.Unlock()
+		})
+	}
+	deleteWg.Wait()
+	if len(deleted) == 0 {
+		return
+	}
+
+	// the versions are still in the bucket, only undelete can't find them without the journal
+	if journalErr := appendTombstoneRecords(tombstoneJournalPath(destination), deleted); journalErr != nil {
+		log.Error(fmt.Sprintf("Error recording tombstoned versions: %s", journalErr))
+		for _, record := range deleted {
+			resultMap.AddTombstoneResult(record.Key, journalErr)
+		}
+		return
+	}
+	log.Info(fmt.Sprintf("Deleted %d of %d keys from versioned bucket %s", len(deleted), len(records), destination.Bucket))
+}
+
+// doDeleteObjects deletes a batch of keys, recording each key that couldn't be deleted with addResult
+func doDeleteObjects(ctx context.Context, client BucketClient, bucket string, keys []string, addResult func(string, error)) {
+	keyErrs := client.DeleteObjects(ctx, bucket, keys)
+	for key, delErr := range keyErrs {
+		log.Warn(fmt.Sprintf("Error deleting %s: %s", key, delErr))
+		addResult(key, delErr)
+	}
+	log.Info(fmt.Sprintf("Deleted %d of %d keys from bucket %s", len(keys)-len(keyErrs), len(keys), bucket))
+}
+
+// deleteBatches splits keys into batches that fit a single DeleteObjects call
+func deleteBatches(keys []string) [][]string {
+	batches := make([][]string, 0, len(keys)/deleteBatchSize+1)
+	for len(keys) > deleteBatchSize {
+		batches = append(batches, keys[:deleteBatchSize])
+		keys = keys[deleteBatchSize:]
 	}
+	if len(keys) != 0 {
+		batches = append(batches, keys)
+	}
+	return batches
+}
+
+func doDownloadObject(ctx context.Context, client BucketClient, bucket, key, folder, localPath string, resultMap *ResultMap) error {
+	downloadErr := restoreObject(ctx, client, bucket, key, folder, localPath)
+	if downloadErr != nil {
+		log.Warn(fmt.Sprintf("Error downloading %s: %s", key, downloadErr))
+		resultMap.AddDownloadResult(key, downloadErr)
+		return downloadErr
+	}
+	log.Info(fmt.Sprintf("Downloaded key %s to %s", key, localPath))
+
 	return nil
 }
 
-func doBackup(client BucketClient, bc BackupConfig, notifier Notifier) {
-	fileMap, walkErr := concreteWalkFunc(bc.SourceFolder)
-	if walkErr != nil {
-		log.Error(fmt.Sprintf("Backup directory walk failed: %s", walkErr))
+func doDeleteLocalFile(key, localPath string, resultMap *ResultMap) error {
+	removeErr := os.Remove(localPath)
+	if removeErr != nil && !os.IsNotExist(removeErr) {
+		log.Warn(fmt.Sprintf("Error deleting local file %s: %s", localPath, removeErr))
+		resultMap.AddLocalDeleteResult(key, removeErr)
+		return removeErr
+	}
+	log.Info(fmt.Sprintf("Deleted local file %s", localPath))
 
+	return nil
+}
+
+func doBackup(ctx context.Context, client BucketClient, bc BackupConfig, notifier Notifier) {
+	jobLimiter, jobLimiterErr := NewRateLimiter(bc.Bandwidth)
+	if jobLimiterErr != nil {
+		log.Error(fmt.Sprintf("Backup bandwidth config is invalid: %s", jobLimiterErr))
+		return
+	}
+	client = limitOperations(limitUploads(client, jobLimiter), bc.Timeouts)
+	ctx, cancel := runContext(ctx, bc.Timeouts)
+	defer cancel()
+	if bc.Mode == BackupModeChunked {
+		doChunkedBackup(ctx, client, bc, notifier)
+		return
+	}
+	if bc.VolumeSize != "" {
+		doVolumeBackup(ctx, client, bc, notifier)
+		return
 	}
 
-	filesToCompress := make([]string, 0)
-	for key, _ := range fileMap {
-		filesToCompress = append(filesToCompress, key)
+	fileMap, walkErr := collectFiles(bc.SourceFolder, WalkOptions{Symlinks: bc.Symlinks})
+	if walkErr != nil {
+		log.Error(fmt.Sprintf("Backup directory walk failed: %s", walkErr))
+
 	}
 
 	now := time.Now()
@@ -270,7 +831,7 @@ func doBackup(client BucketClient, bc BackupConfig, notifier Notifier) {
 	defer os.Remove(tarFile.Name())
 
 	log.Info(fmt.Sprintf("Creating backup tarball: %s", tarFile.Name()))
-	createArchive(filesToCompress, tarFile)
+	createArchive(fileMap, tarFile)
 
 	// this is janky but the way this is written, this file descripter would be closed already
 	// so....we need to open the file again
@@ -281,8 +842,16 @@ func doBackup(client BucketClient, bc BackupConfig, notifier Notifier) {
 	}
 	defer uploadFile.Close()
 
+	// the upload goes through the work queue so backups respect priorities and concurrency like syncs do
 	fileKey := filepath.Base(tarFile.Name())
-	putErr := client.UploadFile(bc.DestinationBucket, fileKey, uploadFile)
+	var putErr error
+	var wg sync.WaitGroup
+	wg.Add(1)
+	workQueue.NewJob(bc.SourceFolder, bc.Priority, bc.Concurrency).Submit(func() {
+		defer wg.Done()
+		putErr = client.UploadFile(ctx, bc.DestinationBucket, fileKey, uploadFile, nil)
+	})
+	wg.Wait()
 	if putErr != nil {
 		log.Warn("Backup upload error: ", putErr)
 	} else {
@@ -1,7 +1,12 @@
 package main
 
 import (
+	"context"
+	"fmt"
+	"io/ioutil"
 	"os"
+	"path/filepath"
+	"sort"
 	"sync"
 	"testing"
 	"time"
@@ -10,15 +15,32 @@ import (
 )
 
 func createMockWalkFunc(mockResult map[string]os.FileInfo) walkFunc {
-	return func(string) (map[string]os.FileInfo, error) {
-		return mockResult, nil
+	return func(dirPath string, opts WalkOptions, fn FileWalkFunc) error {
+		paths := make([]string, 0, len(mockResult))
+		for path := range mockResult {
+			paths = append(paths, path)
+		}
+		sort.Strings(paths)
+		for _, path := range paths {
+			if walkErr := fn(path, mockResult[path]); walkErr != nil {
+				return walkErr
+			}
+		}
+		return nil
 	}
 }
 
+// doSingleDestinationSync runs a sync against the default provider and returns the results for
+// the only destination in the config
+func doSingleDestinationSync(client BucketClient, sc SyncConfig, lock *sync.Mutex) (*ResultMap, error) {
+	syncResults, syncErr := doSync(context.Background(), map[string]BucketClient{defaultProviderID: client}, sc, nil, lock)
+	return syncResults[sc.DestinationList()[0].Name()], syncErr
+}
+
 func TestMain(m *testing.M) {
-	// semaphore is created by on config init function
-	// keep it at 1 for tests
-	semaphore = make(chan int, 1)
+	// the work queue is created by the config init function
+	// keep it at 1 worker for tests
+	workQueue = NewWorkQueue(1)
 	exitVal := m.Run()
 	os.Exit(exitVal)
 }
@@ -38,7 +60,7 @@ func TestLocalFileNotInBucket(t *testing.T) {
 	}
 
 	lock := &sync.Mutex{}
-	syncedObjects, syncErr := doSync(mockS3Client, mockSyncConfig, nil, lock)
+	syncedObjects, syncErr := doSingleDestinationSync(mockS3Client, mockSyncConfig, lock)
 
 	assert.Nil(t, syncErr)
 	assert.Len(t, syncedObjects.Tombstone, 0)
@@ -69,7 +91,7 @@ func TestLocalFileIsOlder(t *testing.T) {
 	}
 
 	lock := &sync.Mutex{}
-	syncedObjects, syncErr := doSync(mockS3Client, mockSyncConfig, nil, lock)
+	syncedObjects, syncErr := doSingleDestinationSync(mockS3Client, mockSyncConfig, lock)
 
 	assert.Nil(t, syncErr)
 	assert.Len(t, syncedObjects.Delete, 0)
@@ -99,7 +121,7 @@ func TestLocalFileIsNewer(t *testing.T) {
 	}
 
 	lock := &sync.Mutex{}
-	syncedObjects, syncErr := doSync(mockS3Client, mockSyncConfig, nil, lock)
+	syncedObjects, syncErr := doSingleDestinationSync(mockS3Client, mockSyncConfig, lock)
 
 	assert.Nil(t, syncErr)
 	assert.Len(t, syncedObjects.Tombstone, 0)
@@ -127,7 +149,7 @@ func TestBucketFileNotOnLocalFSDestructiveWithTombstone(t *testing.T) {
 	}
 
 	lock := &sync.Mutex{}
-	syncedObjects, syncErr := doSync(mockS3Client, mockSyncConfig, nil, lock)
+	syncedObjects, syncErr := doSingleDestinationSync(mockS3Client, mockSyncConfig, lock)
 
 	assert.Nil(t, syncErr)
 	assert.Len(t, syncedObjects.Tombstone, 1)
@@ -153,7 +175,7 @@ func TestBucketFileNotOnLocalFSDestructiveWithoutTombstone(t *testing.T) {
 	}
 
 	lock := &sync.Mutex{}
-	syncedObjects, syncErr := doSync(mockS3Client, mockSyncConfig, nil, lock)
+	syncedObjects, syncErr := doSingleDestinationSync(mockS3Client, mockSyncConfig, lock)
 
 	assert.Nil(t, syncErr)
 	assert.Len(t, syncedObjects.Tombstone, 0)
@@ -162,6 +184,56 @@ func TestBucketFileNotOnLocalFSDestructiveWithoutTombstone(t *testing.T) {
 	assert.Contains(t, syncedObjects.Delete, "/folder2/not-real-file")
 }
 
+func TestDeletesAreBatched(t *testing.T) {
+	oneHourAgo := time.Now().Add(-1 * time.Hour)
+	concreteWalkFunc = createMockWalkFunc(make(map[string]os.FileInfo))
+	mockBucketList := make(map[string]ObjectInfo)
+	for i := 0; i < 2500; i++ {
+		mockBucketList[fmt.Sprintf("folder2/file-%d", i)] = ObjectInfo{ModTime: oneHourAgo, Size: 1}
+	}
+	mockS3Client := NewMockClient(mockBucketList)
+	mockS3Client.DeleteErrors = map[string]error{"/folder2/file-7": fmt.Errorf("access denied")}
+	mockSyncConfig := SyncConfig{
+		SourceFolder:      "/folder1",
+		DestinationBucket: "not-real-bucket",
+		Destructive:       true,
+	}
+
+	lock := &sync.Mutex{}
+	syncedObjects, syncErr := doSingleDestinationSync(mockS3Client, mockSyncConfig, lock)
+
+	assert.Nil(t, syncErr)
+	assert.Equal(t, 3, mockS3Client.DeleteBatches)
+	assert.Len(t, mockS3Client.DeleteRequests, 2499)
+	assert.Equal(t, ResultCount{Total: 2500, Failed: 1}, syncedObjects.DeleteCount)
+	assert.True(t, syncedObjects.Failed("/folder2/file-7"))
+}
+
+func TestTombstonedOriginalsDeletedInBatches(t *testing.T) {
+	oneHourAgo := time.Now().Add(-1 * time.Hour)
+	concreteWalkFunc = createMockWalkFunc(make(map[string]os.FileInfo))
+	mockBucketList := make(map[string]ObjectInfo)
+	for i := 0; i < 1200; i++ {
+		mockBucketList[fmt.Sprintf("folder2/file-%d", i)] = ObjectInfo{ModTime: oneHourAgo, Size: 1}
+	}
+	mockS3Client := NewMockClient(mockBucketList)
+	mockSyncConfig := SyncConfig{
+		SourceFolder:      "/folder1",
+		DestinationBucket: "not-real-bucket",
+		TombstoneBucket:   "some-tombstone-bucket",
+		Destructive:       true,
+	}
+
+	lock := &sync.Mutex{}
+	syncedObjects, syncErr := doSingleDestinationSync(mockS3Client, mockSyncConfig, lock)
+
+	assert.Nil(t, syncErr)
+	assert.Len(t, mockS3Client.CopyRequests, 1200)
+	assert.Equal(t, 2, mockS3Client.DeleteBatches)
+	assert.Len(t, mockS3Client.DeleteRequests, 1200)
+	assert.Equal(t, ResultCount{Total: 1200}, syncedObjects.TombstoneCount)
+}
+
 func TestBucketFileNotOnLocalFSNonDestructive(t *testing.T) {
 	oneHourAgo := time.Now().Add(-1 * time.Hour)
 	mockFileInfoResults := make(map[string]os.FileInfo)
@@ -179,7 +251,7 @@ func TestBucketFileNotOnLocalFSNonDestructive(t *testing.T) {
 	}
 
 	lock := &sync.Mutex{}
-	syncedObjects, syncErr := doSync(mockS3Client, mockSyncConfig, nil, lock)
+	syncedObjects, syncErr := doSingleDestinationSync(mockS3Client, mockSyncConfig, lock)
 
 	assert.Nil(t, syncErr)
 	assert.Len(t, syncedObjects.Tombstone, 0)
@@ -207,7 +279,7 @@ func TestFilesMatchingExclusionNotUploaded(t *testing.T) {
 	}
 
 	lock := &sync.Mutex{}
-	syncedObjects, syncErr := doSync(mockS3Client, mockSyncConfig, nil, lock)
+	syncedObjects, syncErr := doSingleDestinationSync(mockS3Client, mockSyncConfig, lock)
 
 	assert.Nil(t, syncErr)
 	assert.Len(t, syncedObjects.Tombstone, 0)
@@ -230,7 +302,7 @@ func TestSyncRoutineErrosWhenAnotherIsRunning(t *testing.T) {
 	lock := &sync.Mutex{}
 	lock.Lock()
 	defer lock.Unlock()
-	syncedObjects, syncErr := doSync(mockS3Client, mockSyncConfig, nil, lock)
+	syncedObjects, syncErr := doSingleDestinationSync(mockS3Client, mockSyncConfig, lock)
 
 	assert.NotNil(t, syncErr)
 	assert.ErrorContains(t, syncErr, "Unable to acquire sync lock")
@@ -263,7 +335,7 @@ func TestSameModTimeFileSizeDifferent(t *testing.T) {
 	}
 
 	lock := &sync.Mutex{}
-	syncedObjects, syncErr := doSync(mockS3Client, mockSyncConfig, nil, lock)
+	syncedObjects, syncErr := doSingleDestinationSync(mockS3Client, mockSyncConfig, lock)
 
 	assert.Nil(t, syncErr)
 	assert.Len(t, syncedObjects.Upload, 1)
@@ -271,3 +343,222 @@ func TestSameModTimeFileSizeDifferent(t *testing.T) {
 	assert.Len(t, syncedObjects.Tombstone, 0)
 	assert.Contains(t, syncedObjects.Upload, "/folder2/not-real-file")
 }
+
+func TestMultipleDestinationsSyncedIndependently(t *testing.T) {
+	mockFileInfoResults := map[string]os.FileInfo{
+		"/folder1/folder2/not-real-file": mockFileInfo{
+			isDir:     false,
+			timestamp: time.Now().Add(-1 * time.Hour),
+			size:      1,
+		},
+	}
+	concreteWalkFunc = createMockWalkFunc(mockFileInfoResults)
+	inSyncClient := NewMockClient(map[string]ObjectInfo{
+		"folder2/not-real-file": {
+			ModTime: time.Now(),
+			Size:    1,
+		},
+	})
+	emptyClient := NewMockClient(map[string]ObjectInfo{})
+	mockClients := map[string]BucketClient{"aws-prod": inSyncClient, "gcs-archive": emptyClient}
+	mockSyncConfig := SyncConfig{
+		SourceFolder: "/folder1",
+		Destinations: []SyncDestination{
+			{Provider: "aws-prod", Bucket: "not-real-bucket"},
+			{Provider: "gcs-archive", Bucket: "not-real-bucket"},
+			{Provider: "not-configured", Bucket: "not-real-bucket"},
+		},
+	}
+
+	lock := &sync.Mutex{}
+	syncResults, syncErr := doSync(context.Background(), mockClients, mockSyncConfig, nil, lock)
+
+	assert.ErrorContains(t, syncErr, "not-configured:not-real-bucket")
+	assert.Len(t, syncResults, 3)
+	assert.Nil(t, syncResults["aws-prod:not-real-bucket"].Err)
+	assert.Len(t, syncResults["aws-prod:not-real-bucket"].Upload, 0)
+	assert.Nil(t, syncResults["gcs-archive:not-real-bucket"].Err)
+	assert.Len(t, syncResults["gcs-archive:not-real-bucket"].Upload, 1)
+	assert.Contains(t, syncResults["gcs-archive:not-real-bucket"].Upload, "/folder2/not-real-file")
+	assert.NotNil(t, syncResults["not-configured:not-real-bucket"].Err)
+}
+
+func TestPrefixScopesUploadsAndDeletes(t *testing.T) {
+	mockFileInfoResults := map[string]os.FileInfo{
+		"/folder1/folder2/not-real-file": mockFileInfo{
+			isDir:     false,
+			timestamp: time.Now().Add(-1 * time.Hour),
+			size:      1,
+		},
+		"/folder1/raw/2023/not-real-photo": mockFileInfo{
+			isDir:     false,
+			timestamp: time.Now().Add(-1 * time.Hour),
+			size:      1,
+		},
+	}
+	concreteWalkFunc = createMockWalkFunc(mockFileInfoResults)
+	mockBucketList := map[string]ObjectInfo{
+		"hosts/nas01/folder2/not-real-file": {
+			ModTime: time.Now(),
+			Size:    1,
+		},
+		"hosts/nas01/folder2/deleted-file": {
+			ModTime: time.Now(),
+			Size:    1,
+		},
+		"hosts/nas02/folder2/other-hosts-file": {
+			ModTime: time.Now(),
+			Size:    1,
+		},
+	}
+	mockS3Client := NewMockClient(mockBucketList)
+	mockSyncConfig := SyncConfig{
+		SourceFolder:      "/folder1",
+		DestinationBucket: "not-real-bucket",
+		Prefix:            "/hosts/nas01",
+		Rewrite:           []RewriteRule{{From: "raw/2023", To: "archive/2023"}},
+		Destructive:       true,
+	}
+
+	lock := &sync.Mutex{}
+	syncedObjects, syncErr := doSingleDestinationSync(mockS3Client, mockSyncConfig, lock)
+
+	assert.Nil(t, syncErr)
+	assert.Len(t, syncedObjects.Upload, 1)
+	assert.Contains(t, syncedObjects.Upload, "/hosts/nas01/archive/2023/not-real-photo")
+	assert.Len(t, syncedObjects.Delete, 1)
+	assert.Contains(t, syncedObjects.Delete, "/hosts/nas01/folder2/deleted-file")
+	// only the job's own prefix is listed, other hosts' keys are never read
+	assert.Equal(t, []string{"hosts/nas01/"}, mockS3Client.ListPrefixes)
+}
+
+func TestFilesFilteredBySizeAgeAndType(t *testing.T) {
+	mockFileInfoResults := map[string]os.FileInfo{
+		"/folder1/folder2/ready-file": mockFileInfo{
+			timestamp: time.Now().Add(-1 * time.Hour),
+			size:      2048,
+		},
+		"/folder1/folder2/half-written-file": mockFileInfo{
+			timestamp: time.Now(),
+			size:      2048,
+		},
+		"/folder1/folder2/tiny-file": mockFileInfo{
+			timestamp: time.Now().Add(-1 * time.Hour),
+			size:      10,
+		},
+		"/folder1/folder2/some-socket": mockFileInfo{
+			timestamp: time.Now().Add(-1 * time.Hour),
+			size:      2048,
+			mode:      os.ModeSocket,
+		},
+	}
+	concreteWalkFunc = createMockWalkFunc(mockFileInfoResults)
+	mockS3Client := NewMockClient(map[string]ObjectInfo{})
+	mockSyncConfig := SyncConfig{
+		SourceFolder:      "/folder1",
+		DestinationBucket: "not-real-bucket",
+		Filters: FileFilterConfig{
+			MinSize:     "1KB",
+			MinAge:      10,
+			SkipSpecial: true,
+		},
+	}
+
+	lock := &sync.Mutex{}
+	syncedObjects, syncErr := doSingleDestinationSync(mockS3Client, mockSyncConfig, lock)
+
+	assert.Nil(t, syncErr)
+	assert.Len(t, syncedObjects.Upload, 1)
+	assert.Contains(t, syncedObjects.Upload, "/folder2/ready-file")
+}
+
+func TestParseByteSize(t *testing.T) {
+	expectedSizes := map[string]int64{
+		"":       0,
+		"512":    512,
+		"10KB":   10 * 1024,
+		"1.5GiB": 3 * 512 * 1024 * 1024,
+		"2 mb":   2 * 1024 * 1024,
+	}
+	for sizeStr, expected := range expectedSizes {
+		size, parseErr := parseByteSize(sizeStr)
+		assert.Nil(t, parseErr)
+		assert.Equal(t, expected, size, sizeStr)
+	}
+
+	_, parseErr := parseByteSize("10XB")
+	assert.NotNil(t, parseErr)
+}
+
+func TestResultMapCapsSuccessfulKeys(t *testing.T) {
+	resultMap := NewResultMap()
+	for i := 0; i < resultDetailLimit+500; i++ {
+		resultMap.AddUploadResult(fmt.Sprintf("/file-%d", i), nil)
+	}
+	lastKey := fmt.Sprintf("/file-%d", resultDetailLimit+499)
+	resultMap.AddUploadResult(lastKey, fmt.Errorf("upload failed"))
+
+	assert.Len(t, resultMap.Upload, resultDetailLimit+1)
+	assert.Equal(t, ResultCount{Total: resultDetailLimit + 500, Failed: 1}, resultMap.UploadCount)
+	assert.True(t, resultMap.Failed(lastKey))
+	assert.False(t, resultMap.Failed("/file-0"))
+}
+
+func TestStreamingSyncHoldsAFewBatchesAtMost(t *testing.T) {
+	defer func(batchSize int) { syncBatchSize = batchSize }(syncBatchSize)
+	syncBatchSize = 50
+	mockTempDir := t.TempDir()
+	for i := 0; i < 1000; i++ {
+		assert.Nil(t, ioutil.WriteFile(filepath.Join(mockTempDir, fmt.Sprintf("file-%04d", i)), []byte("data"), 0644))
+	}
+	remoteObjects := make(map[string]ObjectInfo)
+	for i := 0; i < 500; i++ {
+		remoteObjects[fmt.Sprintf("removed-%04d", i)] = ObjectInfo{ModTime: time.Now(), Size: 4}
+	}
+
+	concreteWalkFunc = walkDirectory
+	mockS3Client := NewMockClient(remoteObjects)
+	mockSyncConfig := SyncConfig{
+		SourceFolder:      mockTempDir,
+		DestinationBucket: "not-real-bucket",
+		Destructive:       true,
+	}
+
+	lock := &sync.Mutex{}
+	syncedObjects, syncErr := doSingleDestinationSync(mockS3Client, mockSyncConfig, lock)
+
+	assert.Nil(t, syncErr)
+	assert.Equal(t, ResultCount{Total: 1000}, syncedObjects.UploadCount)
+	assert.Equal(t, ResultCount{Total: 500}, syncedObjects.DeleteCount)
+	assert.Greater(t, syncedObjects.PeakQueued, 0)
+	assert.LessOrEqual(t, syncedObjects.PeakQueued, syncBatchSize*(syncBatchesInFlight+1))
+	remaining, listErr := ListObjects(context.Background(), mockS3Client, "not-real-bucket", ListOptions{})
+	assert.Nil(t, listErr)
+	assert.Len(t, remaining, 1000)
+}
+
+func TestFailedLocalWalkRemovesNothing(t *testing.T) {
+	concreteWalkFunc = func(dirPath string, opts WalkOptions, fn FileWalkFunc) error {
+		if walkErr := fn("/folder1/a-file", mockFileInfo{timestamp: time.Now(), size: 4}); walkErr != nil {
+			return walkErr
+		}
+		return fmt.Errorf("permission denied")
+	}
+	mockS3Client := NewMockClient(map[string]ObjectInfo{
+		"a-file": {ModTime: time.Now().Add(time.Hour), Size: 4},
+		"b-file": {ModTime: time.Now(), Size: 4},
+	})
+	mockSyncConfig := SyncConfig{
+		SourceFolder:      "/folder1",
+		DestinationBucket: "not-real-bucket",
+		Destructive:       true,
+	}
+
+	lock := &sync.Mutex{}
+	syncedObjects, syncErr := doSingleDestinationSync(mockS3Client, mockSyncConfig, lock)
+
+	assert.ErrorContains(t, syncErr, "Sync failed")
+	assert.ErrorContains(t, syncedObjects.Err, "permission denied")
+	assert.Len(t, syncedObjects.Delete, 0)
+	assert.Len(t, mockS3Client.DeleteRequests, 0)
+}
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// appTimeouts are the timeouts for jobs that don't set their own
+var appTimeouts TimeoutConfig
+
+// TimeoutConfig bounds how long work may take, using Go durations (IE: 90s, 10m, 2h). An empty or
+// zero timeout never expires. Jobs fall back to the top level timeouts for fields they leave empty.
+type TimeoutConfig struct {
+	// Operation bounds each call to a provider, IE: one copy, part or batch of deletes. Uploads and
+	// downloads take as long as the file is big, they only fail when they make no progress for this
+	// long. Listings take as long as the bucket is big so they are only bounded by the run timeout.
+	Operation string
+	// Run bounds a whole sync or backup run, anything still in flight is cancelled when it expires
+	Run string
+}
+
+func parseTimeout(timeout string) (time.Duration, error) {
+	if timeout == "" {
+		return 0, nil
+	}
+	duration, parseErr := time.ParseDuration(timeout)
+	if parseErr != nil {
+		return 0, fmt.Errorf("%q is not a valid duration", timeout)
+	}
+	if duration < 0 {
+		return 0, fmt.Errorf("%q is negative", timeout)
+	}
+	return duration, nil
+}
+
+// Validate checks every timeout parses
+func (t TimeoutConfig) Validate() error {
+	for _, timeout := range []string{t.Operation, t.Run} {
+		if _, parseErr := parseTimeout(timeout); parseErr != nil {
+			return parseErr
+		}
+	}
+	return nil
+}
+
+// withDefaults fills the fields a job leaves empty from the top level timeouts
+func (t TimeoutConfig) withDefaults() TimeoutConfig {
+	if t.Operation == "" {
+		t.Operation = appTimeouts.Operation
+	}
+	if t.Run == "" {
+		t.Run = appTimeouts.Run
+	}
+	return t
+}
+
+// runContext derives the context of a single job run. The cancel func has to be called once the run
+// is over, whether or not it has a timeout.
+func runContext(ctx context.Context, timeouts TimeoutConfig) (context.Context, context.CancelFunc) {
+	runTimeout, _ := parseTimeout(timeouts.withDefaults().Run)
+	if runTimeout == 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, runTimeout)
+}
+
+// limitOperations wraps client so each call to it times out after the job's operation timeout
+func limitOperations(client BucketClient, timeouts TimeoutConfig) BucketClient {
+	operationTimeout, _ := parseTimeout(timeouts.withDefaults().Operation)
+	if operationTimeout == 0 {
+		return client
+	}
+	return timeoutClient{BucketClient: client, timeout: operationTimeout}
+}
+
+// stalledContext is cancelled once its transfer goes timeout without making progress. It reports
+// the stall as an expired deadline, same as the fixed deadlines of every other call.
+type stalledContext struct {
+	context.Context
+	lock    sync.Mutex
+	stalled bool
+}
+
+func (c *stalledContext) Err() error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.stalled {
+		return context.DeadlineExceeded
+	}
+	return c.Context.Err()
+}
+
+// stallContext derives the context of a streaming transfer, it's cancelled when progress isn't
+// called for timeout. The cancel func has to be called once the transfer is over.
+func stallContext(ctx context.Context, timeout time.Duration) (context.Context, func(), context.CancelFunc) {
+	cancelCtx, cancel := context.WithCancel(ctx)
+	stallCtx := &stalledContext{Context: cancelCtx}
+	timer := time.AfterFunc(timeout, func() {
+		stallCtx.lock.Lock()
+		stallCtx.stalled = cancelCtx.Err() == nil
+		stallCtx.lock.Unlock()
+		cancel()
+	})
+	progress := func() {
+		stallCtx.lock.Lock()
+		defer stallCtx.lock.Unlock()
+		if !stallCtx.stalled {
+			timer.Reset(timeout)
+		}
+	}
+	return stallCtx, progress, func() {
+		timer.Stop()
+		cancel()
+	}
+}
+
+// progressReader calls progress whenever a read returns data
+type progressReader struct {
+	reader   io.Reader
+	progress func()
+}
+
+func (r *progressReader) Read(p []byte) (int, error) {
+	n, readErr := r.reader.Read(p)
+	if n > 0 {
+		r.progress()
+	}
+	return n, readErr
+}
+
+// progressWriter calls progress whenever data is written
+type progressWriter struct {
+	writer   io.Writer
+	progress func()
+}
+
+func (w *progressWriter) Write(p []byte) (int, error) {
+	n, writeErr := w.writer.Write(p)
+	if n > 0 {
+		w.progress()
+	}
+	return n, writeErr
+}
+
+// timeoutClient gives every call but WalkObjects its own deadline, uploads and downloads get a stall
+// timeout instead
+type timeoutClient struct {
+	BucketClient
+	timeout time.Duration
+}
+
+func (c timeoutClient) unwrap() BucketClient {
+	return c.BucketClient
+}
+
+func (c timeoutClient) wrapMultipart(client MultipartClient) MultipartClient {
+	return timeoutMultipartClient{MultipartClient: client, timeout: c.timeout}
+}
+
+func (c timeoutClient) wrapMove(client MoveClient) MoveClient {
+	return timeoutMoveClient{MoveClient: client, timeout: c.timeout}
+}
+
+func (c timeoutClient) UploadFile(ctx context.Context, bucketName string, key string, body io.Reader, metadata map[string]string) error {
+	ctx, progress, cancel := stallContext(ctx, c.timeout)
+	defer cancel()
+	return c.BucketClient.UploadFile(ctx, bucketName, key, &progressReader{reader: body, progress: progress}, metadata)
+}
+
+func (c timeoutClient) DownloadObject(ctx context.Context, bucketName string, key string, w io.Writer) (ObjectInfo, error) {
+	ctx, progress, cancel := stallContext(ctx, c.timeout)
+	defer cancel()
+	return c.BucketClient.DownloadObject(ctx, bucketName, key, &progressWriter{writer: w, progress: progress})
+}
+
+func (c timeoutClient) DownloadObjectVersion(ctx context.Context, bucketName string, key string, versionID string, w io.Writer) (ObjectInfo, error) {
+	ctx, progress, cancel := stallContext(ctx, c.timeout)
+	defer cancel()
+	return c.BucketClient.DownloadObjectVersion(ctx, bucketName, key, versionID, &progressWriter{writer: w, progress: progress})
+}
+
+func (c timeoutClient) ObjectMetadata(ctx context.Context, bucketName string, key string) (map[string]string, error) {
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+	return c.BucketClient.ObjectMetadata(ctx, bucketName, key)
+}
+
+func (c timeoutClient) CopyObject(ctx context.Context, sourceBucket, sourceKey, destinationBucket, destinationKey string, opts CopyOptions) error {
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+	return c.BucketClient.CopyObject(ctx, sourceBucket, sourceKey, destinationBucket, destinationKey, opts)
+}
+
+func (c timeoutClient) DeleteObject(ctx context.Context, bucket string, key string) error {
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+	return c.BucketClient.DeleteObject(ctx, bucket, key)
+}
+
+func (c timeoutClient) DeleteObjects(ctx context.Context, bucket string, keys []string) map[string]error {
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+	return c.BucketClient.DeleteObjects(ctx, bucket, keys)
+}
+
+func (c timeoutClient) ObjectVersion(ctx context.Context, bucket string, key string) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+	return c.BucketClient.ObjectVersion(ctx, bucket, key)
+}
+
+func (c timeoutClient) DeleteObjectVersioned(ctx context.Context, bucket string, key string) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+	return c.BucketClient.DeleteObjectVersioned(ctx, bucket, key)
+}
+
+// timeoutMultipartClient gives each step of a multipart upload its own deadline, so a large file
+// only has to upload a part within the operation timeout rather than all of it.
+type timeoutMultipartClient struct {
+	MultipartClient
+	timeout time.Duration
+}
+
+func (c timeoutMultipartClient) CreateMultipartUpload(ctx context.Context, bucket string, key string, metadata map[string]string) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+	return c.MultipartClient.CreateMultipartUpload(ctx, bucket, key, metadata)
+}
+
+func (c timeoutMultipartClient) UploadPart(ctx context.Context, bucket string, key string, uploadID string, partNumber int, body io.ReadSeeker, size int64) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+	return c.MultipartClient.UploadPart(ctx, bucket, key, uploadID, partNumber, body, size)
+}
+
+func (c timeoutMultipartClient) CompleteMultipartUpload(ctx context.Context, bucket string, key string, uploadID string, parts []CompletedPart) error {
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+	return c.MultipartClient.CompleteMultipartUpload(ctx, bucket, key, uploadID, parts)
+}
+
+func (c timeoutMultipartClient) AbortMultipartUpload(ctx context.Context, bucket string, key string, uploadID string) error {
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+	return c.MultipartClient.AbortMultipartUpload(ctx, bucket, key, uploadID)
+}
+
+func (c timeoutMultipartClient) ListMultipartUploads(ctx context.Context, bucket string) ([]MultipartUpload, error) {
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+	return c.MultipartClient.ListMultipartUploads(ctx, bucket)
+}
+
+func (c timeoutMultipartClient) ListParts(ctx context.Context, bucket string, key string, uploadID string) ([]CompletedPart, error) {
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+	return c.MultipartClient.ListParts(ctx, bucket, key, uploadID)
+}
+
+// timeoutMoveClient gives each move its own deadline
+type timeoutMoveClient struct {
+	MoveClient
+	timeout time.Duration
+}
+
+func (c timeoutMoveClient) MoveObject(ctx context.Context, sourceBucket, sourceKey, destinationBucket, destinationKey string) error {
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+	return c.MoveClient.MoveObject(ctx, sourceBucket, sourceKey, destinationBucket, destinationKey)
+}
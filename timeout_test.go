@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// hangingClient never finishes an upload, like a connection that stopped responding
+type hangingClient struct {
+	*MockS3Client
+}
+
+func (c *hangingClient) UploadFile(ctx context.Context, bucketName string, key string, body io.Reader, metadata map[string]string) error {
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+func (c *hangingClient) UploadPart(ctx context.Context, bucket string, key string, uploadID string, partNumber int, body io.ReadSeeker, size int64) (string, error) {
+	<-ctx.Done()
+	return "", ctx.Err()
+}
+
+func TestOperationTimeoutCancelsHungCalls(t *testing.T) {
+	client := limitOperations(&hangingClient{MockS3Client: NewMockClient(nil)}, TimeoutConfig{Operation: "20ms"})
+
+	uploadErr := client.UploadFile(context.Background(), "not-real-bucket", "key", strings.NewReader("body"), nil)
+	assert.ErrorIs(t, uploadErr, context.DeadlineExceeded)
+
+	// parts of multipart uploads each get the timeout, wrapped with the bandwidth limits or not
+	multipart, ok := multipartClient(limitUploads(client, &RateLimiter{}))
+	assert.True(t, ok)
+	_, partErr := multipart.UploadPart(context.Background(), "not-real-bucket", "key", "upload-1", 1, strings.NewReader("part"), 4)
+	assert.ErrorIs(t, partErr, context.DeadlineExceeded)
+
+	// everything else still reaches the wrapped client
+	assert.Nil(t, client.CopyObject(context.Background(), "not-real-bucket", "missing", "other-bucket", "copy", CopyOptions{}))
+}
+
+// tricklingClient moves a byte at a time, taking delay between each, and fails when its context
+// was cancelled before the transfer finished
+type tricklingClient struct {
+	*MockS3Client
+	delay time.Duration
+	stall bool
+}
+
+func (c *tricklingClient) UploadFile(ctx context.Context, bucketName string, key string, body io.Reader, metadata map[string]string) error {
+	buf := make([]byte, 1)
+	for {
+		time.Sleep(c.delay)
+		if _, readErr := body.Read(buf); readErr == io.EOF {
+			break
+		}
+	}
+	return ctx.Err()
+}
+
+func (c *tricklingClient) DownloadObject(ctx context.Context, bucketName string, key string, w io.Writer) (ObjectInfo, error) {
+	for i := 0; i < 10; i++ {
+		time.Sleep(c.delay)
+		w.Write([]byte("x"))
+	}
+	if c.stall {
+		<-ctx.Done()
+	}
+	return ObjectInfo{}, ctx.Err()
+}
+
+func TestOperationTimeoutOnlyStopsStalledTransfers(t *testing.T) {
+	// ten bytes with 10ms between them take longer than the timeout, but never stall for that long
+	client := limitOperations(&tricklingClient{MockS3Client: NewMockClient(nil), delay: 10 * time.Millisecond}, TimeoutConfig{Operation: "50ms"})
+	assert.Nil(t, client.UploadFile(context.Background(), "not-real-bucket", "key", strings.NewReader("0123456789"), nil))
+	_, downloadErr := client.DownloadObject(context.Background(), "not-real-bucket", "key", ioutil.Discard)
+	assert.Nil(t, downloadErr)
+
+	stalledClient := limitOperations(&tricklingClient{MockS3Client: NewMockClient(nil), delay: 10 * time.Millisecond, stall: true}, TimeoutConfig{Operation: "50ms"})
+	_, stalledErr := stalledClient.DownloadObject(context.Background(), "not-real-bucket", "key", ioutil.Discard)
+	assert.ErrorIs(t, stalledErr, context.DeadlineExceeded)
+}
+
+func TestRunTimeoutCancelsSync(t *testing.T) {
+	mockTempDir, mockTempDirErr := ioutil.TempDir(os.TempDir(), "go-test-stuff")
+	assert.Nil(t, mockTempDirErr)
+	defer os.RemoveAll(mockTempDir)
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(mockTempDir, "file.txt"), []byte("content"), 0644))
+
+	concreteWalkFunc = walkDirectory
+	mockSyncConfig := SyncConfig{
+		SourceFolder:      mockTempDir,
+		DestinationBucket: "not-real-bucket",
+		Timeouts:          TimeoutConfig{Run: "20ms"},
+	}
+
+	started := time.Now()
+	syncedObjects, syncErr := doSingleDestinationSync(&hangingClient{MockS3Client: NewMockClient(nil)}, mockSyncConfig, &sync.Mutex{})
+
+	assert.Less(t, time.Since(started), 5*time.Second)
+	assert.NotNil(t, syncErr)
+	assert.ErrorIs(t, syncedObjects.Upload["/file.txt"], context.DeadlineExceeded)
+}
+
+func TestJobTimeoutsFallBackToAppTimeouts(t *testing.T) {
+	appTimeouts = TimeoutConfig{Operation: "1m", Run: "1h"}
+	defer func() { appTimeouts = TimeoutConfig{} }()
+
+	assert.Equal(t, TimeoutConfig{Operation: "1m", Run: "2h"}, TimeoutConfig{Run: "2h"}.withDefaults())
+
+	mockAppConfig := AppConfig{
+		Provider: CloudProviderConfig{Name: "aws", Region: "us-east-2"},
+		Sync: []SyncConfig{
+			{SourceFolder: "/folder1", DestinationBucket: "not-real-bucket", Timeouts: TimeoutConfig{Operation: "ten minutes"}},
+		},
+	}
+	assert.ErrorContains(t, mockAppConfig.Validate(), "invalid timeout")
+}
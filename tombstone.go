@@ -0,0 +1,333 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// tombstone strategies decide how an object deleted locally is kept around before it's removed
+const (
+	// TombstoneStrategyBucket copies the object to the destination's tombstone bucket
+	TombstoneStrategyBucket = "bucket"
+	// TombstoneStrategyVersioning relies on bucket versioning, the object is deleted and the version
+	// it had is recorded in the tombstone journal
+	TombstoneStrategyVersioning = "versioning"
+	// TombstoneStrategyPrefix copies the object under a prefix in the same bucket, optionally with a
+	// cheaper storage class
+	TombstoneStrategyPrefix = "prefix"
+)
+
+// tombstoned copies are stored under the original key with the time they were tombstoned appended,
+// IE: docs/report.pdf~20230102T150405.123456789Z, so the same key can be tombstoned more than once.
+// Go parses fractional seconds a layout leaves out, so tombstoneTimeLayout reads keys written with
+// either layout.
+const (
+	tombstoneTimeSeparator = "~"
+	tombstoneTimeLayout    = "20060102T150405Z"
+	tombstoneKeyTimeLayout = "20060102T150405.000000000Z"
+)
+
+func validTombstoneStrategy(strategy string) bool {
+	return strategy == "" || strategy == TombstoneStrategyBucket || strategy == TombstoneStrategyVersioning || strategy == TombstoneStrategyPrefix
+}
+
+// TombstonePolicy is how a sync job tombstones keys for one destination.
+type TombstonePolicy struct {
+	Strategy     string
+	Bucket       string
+	Prefix       string
+	StorageClass string
+}
+
+// TombstonePolicy returns the tombstone settings for a destination. The bucket strategy only
+// tombstones destinations that have a tombstone bucket, the others always do.
+func (sc SyncConfig) TombstonePolicy(destination SyncDestination) TombstonePolicy {
+	policy := TombstonePolicy{
+		Strategy:     sc.TombstoneStrategy,
+		Bucket:       destination.TombstoneBucket,
+		StorageClass: sc.TombstoneStorageClass,
+	}
+	if policy.Strategy == "" {
+		policy.Strategy = TombstoneStrategyBucket
+	}
+	if policy.Strategy == TombstoneStrategyPrefix {
+		policy.Prefix = sc.TombstoneKeyPrefix()
+	}
+	return policy
+}
+
+// TombstoneKeyPrefix returns the prefix tombstoned keys are copied under by the prefix strategy,
+// normalized to have no leading slash and a trailing slash.
+func (sc SyncConfig) TombstoneKeyPrefix() string {
+	if sc.TombstoneStrategy != TombstoneStrategyPrefix {
+		return ""
+	}
+	prefix := strings.Trim(sc.TombstonePrefix, "/")
+	if prefix == "" {
+		prefix = "tombstone"
+	}
+	return prefix + "/"
+}
+
+// Enabled reports if keys should be tombstoned rather than deleted outright.
+func (p TombstonePolicy) Enabled() bool {
+	if p.Strategy == TombstoneStrategyBucket || p.Strategy == "" {
+		return p.Bucket != ""
+	}
+	return true
+}
+
+// TombstoneLocation returns the bucket and key a key tombstoned at tombstonedAt is copied to.
+func (p TombstonePolicy) TombstoneLocation(bucket, key string, tombstonedAt time.Time) (string, string) {
+	tombstoneKey := strings.TrimPrefix(key, "/") + tombstoneTimeSeparator + tombstonedAt.UTC().Format(tombstoneKeyTimeLayout)
+	if p.Strategy == TombstoneStrategyPrefix {
+		return bucket, p.Prefix + tombstoneKey
+	}
+	return p.Bucket, tombstoneKey
+}
+
+// parseTombstoneKey splits a tombstoned copy's key into the original key and the time it was
+// tombstoned. Copies made before tombstone times were recorded return false.
+func parseTombstoneKey(tombstoneKey string) (string, time.Time, bool) {
+	separatorIndex := strings.LastIndex(tombstoneKey, tombstoneTimeSeparator)
+	if separatorIndex == -1 {
+		return tombstoneKey, time.Time{}, false
+	}
+	tombstonedAt, parseErr := time.Parse(tombstoneTimeLayout, tombstoneKey[separatorIndex+len(tombstoneTimeSeparator):])
+	if parseErr != nil {
+		return tombstoneKey, time.Time{}, false
+	}
+	return tombstoneKey[:separatorIndex], tombstonedAt, true
+}
+
+// Tombstone is a key deleted by a sync job that can still be brought back.
+type Tombstone struct {
+	// Key is the original key, with a leading slash like the rest of the sync code
+	Key string
+	// Bucket, ObjectKey and VersionID locate the preserved copy
+	Bucket       string
+	ObjectKey    string
+	VersionID    string
+	TombstonedAt time.Time
+}
+
+// listTombstones finds every tombstone a sync job left for a destination.
+func listTombstones(ctx context.Context, client BucketClient, sc SyncConfig, destination SyncDestination) ([]Tombstone, error) {
+	tombstones := make([]Tombstone, 0)
+	policy := sc.TombstonePolicy(destination)
+	if !policy.Enabled() {
+		return tombstones, nil
+	}
+
+	if policy.Strategy == TombstoneStrategyVersioning {
+		records, readErr := readTombstoneRecords(tombstoneJournalPath(destination))
+		for _, record := range records {
+			if sc.ManagesKey(record.Key) {
+				tombstones = append(tombstones, Tombstone{
+					Key:          record.Key,
+					Bucket:       destination.Bucket,
+					ObjectKey:    record.Key,
+					VersionID:    record.VersionID,
+					TombstonedAt: record.DeletedAt,
+				})
+			}
+		}
+		return tombstones, readErr
+	}
+
+	tombstoneBucket, _ := policy.TombstoneLocation(destination.Bucket, "", time.Time{})
+	listOpts := ListOptions{Prefix: policy.Prefix + sc.KeyPrefix()}
+	walkErr := client.WalkObjects(ctx, tombstoneBucket, listOpts, func(objectKey string, objectInfo ObjectInfo) error {
+		originalKey, tombstonedAt, ok := parseTombstoneKey(strings.TrimPrefix(strings.TrimPrefix(objectKey, "/"), policy.Prefix))
+		if !ok {
+			// copies made before tombstone times were recorded, the copy was made when tombstoning
+			tombstonedAt = objectInfo.ModTime
+		}
+		key := "/" + originalKey
+		if sc.ManagesKey(key) {
+			tombstones = append(tombstones, Tombstone{
+				Key:          key,
+				Bucket:       tombstoneBucket,
+				ObjectKey:    objectKey,
+				TombstonedAt: tombstonedAt,
+			})
+		}
+		return nil
+	})
+
+	return tombstones, walkErr
+}
+
+// purgeTombstones deletes tombstones older than the job's retention, returning how many were
+// deleted. Versioned tombstones are only dropped from the journal, the versions themselves are
+// expired by the bucket's lifecycle rules.
+func purgeTombstones(ctx context.Context, client BucketClient, sc SyncConfig, destination SyncDestination, now time.Time) (int, error) {
+	policy := sc.TombstonePolicy(destination)
+	if sc.TombstoneRetention <= 0 {
+		return 0, nil
+	}
+	cutoff := now.Add(-time.Duration(sc.TombstoneRetention) * 24 * time.Hour)
+	if policy.Strategy == TombstoneStrategyVersioning {
+		return pruneTombstoneRecords(tombstoneJournalPath(destination), func(record TombstoneRecord) bool {
+			return sc.ManagesKey(record.Key) && record.DeletedAt.Before(cutoff)
+		})
+	}
+
+	tombstones, listErr := listTombstones(ctx, client, sc, destination)
+	if listErr != nil {
+		return 0, fmt.Errorf("Error listing tombstones: %s", listErr)
+	}
+	expiredKeys := make([]string, 0)
+	for _, tombstone := range tombstones {
+		if tombstone.TombstonedAt.Before(cutoff) {
+			expiredKeys = append(expiredKeys, tombstone.ObjectKey)
+		}
+	}
+
+	tombstoneBucket, _ := policy.TombstoneLocation(destination.Bucket, "", now)
+	failed := 0
+	for _, batch := range deleteBatches(expiredKeys) {
+		for key, delErr := range client.DeleteObjects(ctx, tombstoneBucket, batch) {
+			log.Warn(fmt.Sprintf("Error purging tombstone %s: %s", key, delErr))
+			failed++
+		}
+	}
+	if failed != 0 {
+		return len(expiredKeys) - failed, fmt.Errorf("%d of %d expired tombstones could not be purged", failed, len(expiredKeys))
+	}
+
+	return len(expiredKeys), nil
+}
+
+// TombstoneRecord is a journal entry for a key deleted from a versioned bucket.
+type TombstoneRecord struct {
+	Key       string
+	VersionID string
+	DeletedAt time.Time
+	// moved is set when the original was moved to its tombstone, so there's nothing left to delete
+	moved bool
+}
+
+// MoveClient is implemented by clients that can move an object in one step on the server. Tombstones
+// are moved rather than copied and deleted, which on servers without cheap copies writes every
+// tombstoned file out again and leaves a window where it exists twice.
+type MoveClient interface {
+	MoveObject(ctx context.Context, sourceBucket, sourceKey, destinationBucket, destinationKey string) error
+}
+
+// moveClient returns the client's move support, keeping whatever the client was wrapped with
+func moveClient(client BucketClient) (MoveClient, bool) {
+	if wrapper, ok := client.(clientWrapper); ok {
+		inner, ok := moveClient(wrapper.unwrap())
+		if !ok {
+			return nil, false
+		}
+		return wrapper.wrapMove(inner), true
+	}
+	mover, ok := client.(MoveClient)
+	return mover, ok
+}
+
+// tombstoneJournalPath is where versioned tombstones of a destination bucket are recorded, jobs
+// sharing a bucket share the journal.
+func tombstoneJournalPath(destination SyncDestination) string {
+	return filepath.Join(stateDirectory, "tombstones", stateFileName(".jsonl", destination.Name()))
+}
+
+// tombstoneJournalLock keeps appends from landing in a journal while it's being pruned
+var tombstoneJournalLock sync.Mutex
+
+// appendTombstoneRecords adds records to the end of a journal, one JSON object per line.
+func appendTombstoneRecords(path string, records []TombstoneRecord) error {
+	tombstoneJournalLock.Lock()
+	defer tombstoneJournalLock.Unlock()
+	if mkdirErr := os.MkdirAll(filepath.Dir(path), 0700); mkdirErr != nil {
+		return mkdirErr
+	}
+	journal, openErr := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if openErr != nil {
+		return openErr
+	}
+
+	encoder := json.NewEncoder(journal)
+	for _, record := range records {
+		if encodeErr := encoder.Encode(record); encodeErr != nil {
+			journal.Close()
+			return encodeErr
+		}
+	}
+	return journal.Close()
+}
+
+// pruneTombstoneRecords rewrites a journal without the records expired returns true for, returning
+// how many were dropped. The journal is replaced in one rename so a crash never truncates it.
+func pruneTombstoneRecords(path string, expired func(TombstoneRecord) bool) (int, error) {
+	tombstoneJournalLock.Lock()
+	defer tombstoneJournalLock.Unlock()
+	records, readErr := readTombstoneRecords(path)
+	if readErr != nil {
+		return 0, fmt.Errorf("Error reading tombstone journal: %s", readErr)
+	}
+	kept := make([]TombstoneRecord, 0, len(records))
+	for _, record := range records {
+		if !expired(record) {
+			kept = append(kept, record)
+		}
+	}
+	if len(kept) == len(records) {
+		return 0, nil
+	}
+
+	tempFile, tempErr := ioutil.TempFile(filepath.Dir(path), ".warden-journal-*")
+	if tempErr != nil {
+		return 0, tempErr
+	}
+	defer os.Remove(tempFile.Name())
+	encoder := json.NewEncoder(tempFile)
+	for _, record := range kept {
+		if encodeErr := encoder.Encode(record); encodeErr != nil {
+			tempFile.Close()
+			return 0, encodeErr
+		}
+	}
+	if closeErr := tempFile.Close(); closeErr != nil {
+		return 0, closeErr
+	}
+	if renameErr := os.Rename(tempFile.Name(), path); renameErr != nil {
+		return 0, renameErr
+	}
+	return len(records) - len(kept), nil
+}
+
+// readTombstoneRecords reads every record in a journal. A missing journal has no records.
+func readTombstoneRecords(path string) ([]TombstoneRecord, error) {
+	records := make([]TombstoneRecord, 0)
+	journal, openErr := os.Open(path)
+	if os.IsNotExist(openErr) {
+		return records, nil
+	}
+	if openErr != nil {
+		return records, openErr
+	}
+	defer journal.Close()
+
+	scanner := bufio.NewScanner(journal)
+	for scanner.Scan() {
+		var record TombstoneRecord
+		if decodeErr := json.Unmarshal(scanner.Bytes(), &record); decodeErr != nil {
+			return records, decodeErr
+		}
+		records = append(records, record)
+	}
+	return records, scanner.Err()
+}
@@ -0,0 +1,342 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPrefixTombstoneStrategy(t *testing.T) {
+	concreteWalkFunc = createMockWalkFunc(make(map[string]os.FileInfo))
+	mockS3Client := NewMockClient(map[string]ObjectInfo{})
+	mockS3Client.UploadFile(context.Background(), "not-real-bucket", "folder2/deleted-file", strings.NewReader("deleted"), nil)
+	mockSyncConfig := SyncConfig{
+		SourceFolder:          "/folder1",
+		DestinationBucket:     "not-real-bucket",
+		TombstoneStrategy:     TombstoneStrategyPrefix,
+		TombstonePrefix:       "tombstone/",
+		TombstoneStorageClass: "GLACIER",
+		Destructive:           true,
+	}
+
+	lock := &sync.Mutex{}
+	syncedObjects, syncErr := doSingleDestinationSync(mockS3Client, mockSyncConfig, lock)
+
+	assert.Nil(t, syncErr)
+	assert.Contains(t, syncedObjects.Tombstone, "/folder2/deleted-file")
+	assert.Len(t, mockS3Client.CopyRequests, 1)
+	assert.Equal(t, "GLACIER", mockS3Client.CopyRequests[0].StorageClass)
+	remoteObjects, listErr := ListObjects(context.Background(), mockS3Client, "not-real-bucket", ListOptions{})
+	assert.Nil(t, listErr)
+	assert.Len(t, remoteObjects, 1)
+	assert.NotContains(t, remoteObjects, "folder2/deleted-file")
+	for tombstoneKey := range remoteObjects {
+		originalKey, tombstonedAt, ok := parseTombstoneKey(tombstoneKey)
+		assert.True(t, ok)
+		assert.Equal(t, "tombstone/folder2/deleted-file", originalKey)
+		assert.WithinDuration(t, time.Now(), tombstonedAt, time.Minute)
+	}
+
+	// tombstoned keys are never picked up as deleted locally themselves
+	syncedObjects, syncErr = doSingleDestinationSync(mockS3Client, mockSyncConfig, lock)
+	assert.Nil(t, syncErr)
+	assert.Len(t, syncedObjects.Tombstone, 0)
+	assert.Len(t, syncedObjects.Delete, 0)
+}
+
+func TestVersioningTombstoneStrategyRecordsVersion(t *testing.T) {
+	mockTempDir, mockTempDirErr := ioutil.TempDir(os.TempDir(), "go-test-stuff")
+	assert.Nil(t, mockTempDirErr)
+	defer os.RemoveAll(mockTempDir)
+	stateDirectory = mockTempDir
+
+	concreteWalkFunc = createMockWalkFunc(make(map[string]os.FileInfo))
+	mockS3Client := NewMockClient(map[string]ObjectInfo{})
+	mockS3Client.Versioned = true
+	mockS3Client.UploadFile(context.Background(), "not-real-bucket", "folder2/deleted-file", strings.NewReader("deleted"), nil)
+	mockSyncConfig := SyncConfig{
+		SourceFolder:      "/folder1",
+		DestinationBucket: "not-real-bucket",
+		TombstoneStrategy: TombstoneStrategyVersioning,
+		Destructive:       true,
+	}
+	expectedVersion, _ := mockS3Client.ObjectVersion(context.Background(), "not-real-bucket", "folder2/deleted-file")
+
+	lock := &sync.Mutex{}
+	syncedObjects, syncErr := doSingleDestinationSync(mockS3Client, mockSyncConfig, lock)
+
+	assert.Nil(t, syncErr)
+	assert.Contains(t, syncedObjects.Tombstone, "/folder2/deleted-file")
+	assert.False(t, syncedObjects.Failed("/folder2/deleted-file"))
+	assert.Len(t, mockS3Client.CopyRequests, 0)
+	assert.Len(t, mockS3Client.DeleteRequests, 1)
+
+	records, readErr := readTombstoneRecords(tombstoneJournalPath(mockSyncConfig.DestinationList()[0]))
+	assert.Nil(t, readErr)
+	assert.Len(t, records, 1)
+	assert.Equal(t, "/folder2/deleted-file", records[0].Key)
+	assert.Equal(t, expectedVersion, records[0].VersionID)
+	assert.WithinDuration(t, time.Now(), records[0].DeletedAt, time.Minute)
+}
+
+func TestVersioningTombstoneRefusesUnversionedBucket(t *testing.T) {
+	mockTempDir, mockTempDirErr := ioutil.TempDir(os.TempDir(), "go-test-stuff")
+	assert.Nil(t, mockTempDirErr)
+	defer os.RemoveAll(mockTempDir)
+	stateDirectory = mockTempDir
+
+	concreteWalkFunc = createMockWalkFunc(make(map[string]os.FileInfo))
+	mockS3Client := NewMockClient(map[string]ObjectInfo{})
+	mockS3Client.UploadFile(context.Background(), "not-real-bucket", "folder2/deleted-file", strings.NewReader("deleted"), nil)
+	mockSyncConfig := SyncConfig{
+		SourceFolder:      "/folder1",
+		DestinationBucket: "not-real-bucket",
+		TombstoneStrategy: TombstoneStrategyVersioning,
+		Destructive:       true,
+	}
+
+	lock := &sync.Mutex{}
+	syncedObjects, syncErr := doSingleDestinationSync(mockS3Client, mockSyncConfig, lock)
+
+	assert.Nil(t, syncErr)
+	assert.True(t, syncedObjects.Failed("/folder2/deleted-file"))
+	assert.Len(t, mockS3Client.DeleteRequests, 0)
+}
+
+// tombstoneAt puts a tombstoned copy of key in the mock as if the prefix strategy had tombstoned it
+func tombstoneAt(client *MockS3Client, key, body string, tombstonedAt time.Time) {
+	policy := TombstonePolicy{Strategy: TombstoneStrategyPrefix, Prefix: "tombstone/"}
+	bucket, tombstoneKey := policy.TombstoneLocation("not-real-bucket", key, tombstonedAt)
+	client.UploadFile(context.Background(), bucket, tombstoneKey, strings.NewReader(body), nil)
+}
+
+func TestUndeleteByPrefixAndTimeRange(t *testing.T) {
+	mockS3Client := NewMockClient(map[string]ObjectInfo{})
+	mockSyncConfig := SyncConfig{
+		SourceFolder:      "/folder1",
+		DestinationBucket: "not-real-bucket",
+		TombstoneStrategy: TombstoneStrategyPrefix,
+		TombstonePrefix:   "tombstone/",
+	}
+	destination := mockSyncConfig.DestinationList()[0]
+	monday := time.Date(2023, 5, 1, 12, 0, 0, 0, time.UTC)
+	tombstoneAt(mockS3Client, "/docs/report", "first draft", monday)
+	tombstoneAt(mockS3Client, "/docs/report", "second draft", monday.Add(24*time.Hour))
+	tombstoneAt(mockS3Client, "/docs/report", "third draft", monday.Add(72*time.Hour))
+	tombstoneAt(mockS3Client, "/photos/cat.jpg", "cat", monday)
+
+	undeleteResults, undeleteErr := doUndelete(context.Background(), mockS3Client, mockSyncConfig, destination, UndeleteOptions{
+		SubPrefix: "docs",
+		To:        monday.Add(48 * time.Hour),
+	})
+
+	assert.Nil(t, undeleteErr)
+	assert.Equal(t, map[string]error{"/docs/report": nil}, undeleteResults)
+	body := &bytes.Buffer{}
+	_, downloadErr := mockS3Client.DownloadObject(context.Background(), "not-real-bucket", "docs/report", body)
+	assert.Nil(t, downloadErr)
+	assert.Equal(t, "second draft", body.String())
+	_, downloadErr = mockS3Client.DownloadObject(context.Background(), "not-real-bucket", "photos/cat.jpg", body)
+	assert.NotNil(t, downloadErr)
+}
+
+func TestUndeleteVersionedToLocalDisk(t *testing.T) {
+	mockTempDir, mockTempDirErr := ioutil.TempDir(os.TempDir(), "go-test-stuff")
+	assert.Nil(t, mockTempDirErr)
+	defer os.RemoveAll(mockTempDir)
+	stateDirectory = mockTempDir
+
+	concreteWalkFunc = createMockWalkFunc(make(map[string]os.FileInfo))
+	mockS3Client := NewMockClient(map[string]ObjectInfo{})
+	mockS3Client.Versioned = true
+	mockS3Client.UploadFile(context.Background(), "not-real-bucket", "folder2/deleted-file", strings.NewReader("deleted"), nil)
+	mockSyncConfig := SyncConfig{
+		SourceFolder:      "/folder1",
+		DestinationBucket: "not-real-bucket",
+		TombstoneStrategy: TombstoneStrategyVersioning,
+		Destructive:       true,
+	}
+	lock := &sync.Mutex{}
+	_, syncErr := doSingleDestinationSync(mockS3Client, mockSyncConfig, lock)
+	assert.Nil(t, syncErr)
+
+	targetFolder := filepath.Join(mockTempDir, "undeleted")
+	undeleteResults, undeleteErr := doUndelete(context.Background(), mockS3Client, mockSyncConfig, mockSyncConfig.DestinationList()[0], UndeleteOptions{
+		TargetFolder: targetFolder,
+	})
+
+	assert.Nil(t, undeleteErr)
+	assert.Equal(t, map[string]error{"/folder2/deleted-file": nil}, undeleteResults)
+	undeleted, readErr := ioutil.ReadFile(filepath.Join(targetFolder, "folder2/deleted-file"))
+	assert.Nil(t, readErr)
+	assert.Equal(t, "deleted", string(undeleted))
+}
+
+func TestPurgeTombstonesPastRetention(t *testing.T) {
+	mockS3Client := NewMockClient(map[string]ObjectInfo{})
+	mockSyncConfig := SyncConfig{
+		SourceFolder:       "/folder1",
+		DestinationBucket:  "not-real-bucket",
+		TombstoneStrategy:  TombstoneStrategyPrefix,
+		TombstonePrefix:    "tombstone/",
+		TombstoneRetention: 30,
+	}
+	now := time.Now()
+	tombstoneAt(mockS3Client, "/old-file", "old", now.Add(-31*24*time.Hour))
+	tombstoneAt(mockS3Client, "/recent-file", "recent", now.Add(-29*24*time.Hour))
+
+	purged, purgeErr := purgeTombstones(context.Background(), mockS3Client, mockSyncConfig, mockSyncConfig.DestinationList()[0], now)
+
+	assert.Nil(t, purgeErr)
+	assert.Equal(t, 1, purged)
+	tombstones, listErr := listTombstones(context.Background(), mockS3Client, mockSyncConfig, mockSyncConfig.DestinationList()[0])
+	assert.Nil(t, listErr)
+	assert.Len(t, tombstones, 1)
+	assert.Equal(t, "/recent-file", tombstones[0].Key)
+}
+
+func TestTombstoneKeysWithinTheSameSecondDiffer(t *testing.T) {
+	policy := TombstonePolicy{Strategy: TombstoneStrategyPrefix, Prefix: "tombstone/"}
+	tombstonedAt := time.Date(2023, 5, 1, 12, 0, 0, 100, time.UTC)
+	_, firstKey := policy.TombstoneLocation("not-real-bucket", "/docs/report", tombstonedAt)
+	_, secondKey := policy.TombstoneLocation("not-real-bucket", "/docs/report", tombstonedAt.Add(time.Millisecond))
+	assert.NotEqual(t, firstKey, secondKey)
+
+	originalKey, parsedAt, ok := parseTombstoneKey(firstKey)
+	assert.True(t, ok)
+	assert.Equal(t, "tombstone/docs/report", originalKey)
+	assert.Equal(t, tombstonedAt, parsedAt)
+	// keys written before sub-second times were added still parse
+	_, parsedAt, ok = parseTombstoneKey("docs/report~20230501T120000Z")
+	assert.True(t, ok)
+	assert.Equal(t, time.Date(2023, 5, 1, 12, 0, 0, 0, time.UTC), parsedAt)
+}
+
+func TestPurgeTombstonesPrunesVersioningJournal(t *testing.T) {
+	stateDirectory = t.TempDir()
+	mockSyncConfig := SyncConfig{
+		SourceFolder:       "/folder1",
+		DestinationBucket:  "not-real-bucket",
+		Prefix:             "nas01",
+		TombstoneStrategy:  TombstoneStrategyVersioning,
+		TombstoneRetention: 30,
+	}
+	destination := mockSyncConfig.DestinationList()[0]
+	now := time.Now()
+	journalPath := tombstoneJournalPath(destination)
+	assert.Nil(t, appendTombstoneRecords(journalPath, []TombstoneRecord{
+		{Key: "/nas01/old-file", VersionID: "v1", DeletedAt: now.Add(-31 * 24 * time.Hour)},
+		{Key: "/nas01/recent-file", VersionID: "v2", DeletedAt: now.Add(-29 * 24 * time.Hour)},
+		// another job sharing the bucket keeps its own records
+		{Key: "/nas02/old-file", VersionID: "v3", DeletedAt: now.Add(-31 * 24 * time.Hour)},
+	}))
+
+	purged, purgeErr := purgeTombstones(context.Background(), NewMockClient(map[string]ObjectInfo{}), mockSyncConfig, destination, now)
+
+	assert.Nil(t, purgeErr)
+	assert.Equal(t, 1, purged)
+	records, readErr := readTombstoneRecords(journalPath)
+	assert.Nil(t, readErr)
+	assert.Len(t, records, 2)
+	assert.Equal(t, "/nas01/recent-file", records[0].Key)
+	assert.Equal(t, "/nas02/old-file", records[1].Key)
+}
+
+func TestUndeleteToLocalDiskRejectsKeysEscapingTheTarget(t *testing.T) {
+	mockTempDir := t.TempDir()
+	mockS3Client := NewMockClient(map[string]ObjectInfo{})
+	mockSyncConfig := SyncConfig{
+		SourceFolder:      "/folder1",
+		DestinationBucket: "not-real-bucket",
+		TombstoneStrategy: TombstoneStrategyPrefix,
+		TombstonePrefix:   "tombstone/",
+	}
+	tombstoneAt(mockS3Client, "/../../etc/cron.d/x", "hostile", time.Now())
+	tombstoneAt(mockS3Client, "/docs/report", "report", time.Now())
+
+	targetFolder := filepath.Join(mockTempDir, "undeleted")
+	undeleteResults, undeleteErr := doUndelete(context.Background(), mockS3Client, mockSyncConfig, mockSyncConfig.DestinationList()[0], UndeleteOptions{
+		TargetFolder: targetFolder,
+	})
+
+	assert.Nil(t, undeleteErr)
+	assert.Len(t, undeleteResults, 2)
+	assert.ErrorContains(t, undeleteResults["/../../etc/cron.d/x"], "outside of")
+	assert.Nil(t, undeleteResults["/docs/report"])
+	assert.NoDirExists(t, filepath.Join(mockTempDir, "etc"))
+	assert.FileExists(t, filepath.Join(targetFolder, "docs/report"))
+}
+
+// replacingClient replaces an object right after its version is looked up, like a writer racing the
+// sync would
+type replacingClient struct {
+	*MockS3Client
+	replacement string
+}
+
+func (c replacingClient) ObjectVersion(ctx context.Context, bucket string, key string) (string, error) {
+	versionID, versionErr := c.MockS3Client.ObjectVersion(ctx, bucket, key)
+	c.MockS3Client.UploadFile(ctx, bucket, key, strings.NewReader(c.replacement), nil)
+	return versionID, versionErr
+}
+
+func TestVersioningTombstoneRecordsTheDeletedVersion(t *testing.T) {
+	stateDirectory = t.TempDir()
+	concreteWalkFunc = createMockWalkFunc(make(map[string]os.FileInfo))
+	mockS3Client := NewMockClient(map[string]ObjectInfo{})
+	mockS3Client.Versioned = true
+	mockS3Client.UploadFile(context.Background(), "not-real-bucket", "folder2/deleted-file", strings.NewReader("listed"), nil)
+	mockSyncConfig := SyncConfig{
+		SourceFolder:      "/folder1",
+		DestinationBucket: "not-real-bucket",
+		TombstoneStrategy: TombstoneStrategyVersioning,
+		Destructive:       true,
+	}
+	client := replacingClient{MockS3Client: mockS3Client, replacement: "replaced"}
+
+	syncedObjects, syncErr := doSingleDestinationSync(client, mockSyncConfig, &sync.Mutex{})
+
+	assert.Nil(t, syncErr)
+	assert.False(t, syncedObjects.Failed("/folder2/deleted-file"))
+	records, readErr := readTombstoneRecords(tombstoneJournalPath(mockSyncConfig.DestinationList()[0]))
+	assert.Nil(t, readErr)
+	assert.Len(t, records, 1)
+	body := &bytes.Buffer{}
+	_, downloadErr := mockS3Client.DownloadObjectVersion(context.Background(), "not-real-bucket", "folder2/deleted-file", records[0].VersionID, body)
+	assert.Nil(t, downloadErr)
+	assert.Equal(t, "replaced", body.String())
+}
+
+func TestVersioningTombstoneOnlyJournalsSuccessfulDeletes(t *testing.T) {
+	stateDirectory = t.TempDir()
+	concreteWalkFunc = createMockWalkFunc(make(map[string]os.FileInfo))
+	mockS3Client := NewMockClient(map[string]ObjectInfo{})
+	mockS3Client.Versioned = true
+	mockS3Client.DeleteErrors = map[string]error{"/folder2/kept-file": fmt.Errorf("access denied")}
+	mockS3Client.UploadFile(context.Background(), "not-real-bucket", "folder2/deleted-file", strings.NewReader("deleted"), nil)
+	mockS3Client.UploadFile(context.Background(), "not-real-bucket", "folder2/kept-file", strings.NewReader("kept"), nil)
+	mockSyncConfig := SyncConfig{
+		SourceFolder:      "/folder1",
+		DestinationBucket: "not-real-bucket",
+		TombstoneStrategy: TombstoneStrategyVersioning,
+		Destructive:       true,
+	}
+
+	syncedObjects, syncErr := doSingleDestinationSync(mockS3Client, mockSyncConfig, &sync.Mutex{})
+
+	assert.Nil(t, syncErr)
+	assert.True(t, syncedObjects.Failed("/folder2/kept-file"))
+	records, readErr := readTombstoneRecords(tombstoneJournalPath(mockSyncConfig.DestinationList()[0]))
+	assert.Nil(t, readErr)
+	assert.Len(t, records, 1)
+	assert.Equal(t, "/folder2/deleted-file", records[0].Key)
+}
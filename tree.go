@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// staleTempFileAge is how long the temp file of an upload to a tree bucket can go without being
+// written to before it's taken to be left behind by an upload that never finished, IE: warden was
+// killed or timed out mid upload. Listings remove them.
+const staleTempFileAge = 24 * time.Hour
+
+// treeEntry is a file or directory in a bucket that's stored as a directory tree
+type treeEntry struct {
+	Name    string
+	IsDir   bool
+	Size    int64
+	ModTime time.Time
+}
+
+// treeReadDirFunc reads a directory given relative to the bucket's base directory, "" being the base
+// itself. Anything that isn't a regular file or a directory should be left out.
+type treeReadDirFunc func(dir string) ([]treeEntry, error)
+
+// treeKeyPath cleans a key into a path relative to the bucket's base directory, it can't climb out
+// of the base directory or into internalDir.
+func treeKeyPath(key, internalDir string) (string, error) {
+	cleaned := strings.TrimPrefix(path.Clean("/"+key), "/")
+	if cleaned == "" || cleaned == internalDir || strings.HasPrefix(cleaned, internalDir+"/") {
+		return "", fmt.Errorf("Invalid key: %s", key)
+	}
+	return cleaned, nil
+}
+
+// treeStartDir returns the deepest directory holding every key with the prefix
+func treeStartDir(prefix string) string {
+	if lastSlash := strings.LastIndex(prefix, "/"); lastSlash >= 0 {
+		return prefix[:lastSlash]
+	}
+	return ""
+}
+
+// walkTree lists a bucket stored as a directory tree the way an object store would. Only directories
+// that can hold keys with the prefix are read, and directories that roll up into a common prefix
+// aren't read at all. internalDir at the top of the tree is outside of the key space and skipped.
+func walkTree(ctx context.Context, opts ListOptions, internalDir string, readDir treeReadDirFunc, walkFn ObjectWalkFunc) error {
+	walkErr := walkTreeDirectory(ctx, treeStartDir(opts.Prefix), opts, internalDir, readDir, make(map[string]bool), walkFn)
+	return ignoreStopWalk(walkErr)
+}
+
+func walkTreeDirectory(ctx context.Context, dir string, opts ListOptions, internalDir string, readDir treeReadDirFunc, seenPrefixes map[string]bool, walkFn ObjectWalkFunc) error {
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		return ctxErr
+	}
+	entries, readErr := readDir(dir)
+	if readErr != nil {
+		return readErr
+	}
+	// directories sort on their name with a trailing slash, which is where their keys sort
+	sortName := func(entry treeEntry) string {
+		if entry.IsDir {
+			return entry.Name + "/"
+		}
+		return entry.Name
+	}
+	sort.Slice(entries, func(i, j int) bool { return sortName(entries[i]) < sortName(entries[j]) })
+
+	for _, entry := range entries {
+		if dir == "" && entry.Name == internalDir {
+			continue
+		}
+		key := path.Join(dir, entry.Name)
+		if entry.IsDir {
+			key += "/"
+			if !strings.HasPrefix(key, opts.Prefix) && !strings.HasPrefix(opts.Prefix, key) {
+				continue
+			}
+		} else if !strings.HasPrefix(key, opts.Prefix) {
+			continue
+		}
+
+		// every key under a directory rolls up into the same common prefix when the delimiter is
+		// already part of the directory's name, so it doesn't need to be read
+		if opts.Delimiter != "" && strings.HasPrefix(key, opts.Prefix) {
+			if delimiterIdx := strings.Index(key[len(opts.Prefix):], opts.Delimiter); delimiterIdx >= 0 {
+				commonPrefix := key[:len(opts.Prefix)+delimiterIdx+len(opts.Delimiter)]
+				if !seenPrefixes[commonPrefix] {
+					seenPrefixes[commonPrefix] = true
+					if walkErr := walkFn(commonPrefix, ObjectInfo{IsPrefix: true}); walkErr != nil {
+						return walkErr
+					}
+				}
+				continue
+			}
+		}
+
+		if entry.IsDir {
+			if walkErr := walkTreeDirectory(ctx, strings.TrimSuffix(key, "/"), opts, internalDir, readDir, seenPrefixes, walkFn); walkErr != nil {
+				return walkErr
+			}
+			continue
+		}
+		if walkErr := walkFn(key, ObjectInfo{ModTime: entry.ModTime, Size: entry.Size}); walkErr != nil {
+			return walkErr
+		}
+	}
+
+	return nil
+}
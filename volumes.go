@@ -0,0 +1,420 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// volumeIndexSuffix is appended to the archive name for the index object tying its volumes together
+const volumeIndexSuffix = ".index.json"
+
+// BackupVolume is one part of a tarball split into volumes.
+type BackupVolume struct {
+	Key    string
+	Size   int64
+	SHA256 string
+}
+
+// VolumeIndex lists the volumes of a tarball in order, concatenating them gives back the archive.
+type VolumeIndex struct {
+	CreatedAt    time.Time
+	SourceFolder string
+	Archive      string
+	Size         int64
+	SHA256       string
+	// VolumeSize is the size every volume but the last was cut to
+	VolumeSize int64 `json:",omitempty"`
+	Volumes    []BackupVolume
+}
+
+// volumeBackupState tracks a volume backup between runs so an interrupted upload resumes from the
+// last completed volume. The archive is kept in the state directory until every volume is uploaded.
+type volumeBackupState struct {
+	ArchivePath string
+	Index       VolumeIndex
+}
+
+func volumeStatePath(bc BackupConfig) string {
+	return filepath.Join(stateDirectory, "backups", stateFileName(".json", bc.SourceFolder, providerIDOrDefault(bc.Provider), bc.DestinationBucket))
+}
+
+// doVolumeBackup uploads a tarball split into volumes of at most VolumeSize bytes, followed by an
+// index object. When the previous run didn't finish, its archive is resumed instead of a new one
+// being created.
+func doVolumeBackup(ctx context.Context, client BucketClient, bc BackupConfig, notifier Notifier) {
+	volumeSize, _ := parseByteSize(bc.VolumeSize)
+	statePath := volumeStatePath(bc)
+	var state volumeBackupState
+	if readErr := readStateFile(statePath, &state); readErr != nil {
+		log.Warn(fmt.Sprintf("Error reading volume backup state, starting over: %s", readErr))
+		state = volumeBackupState{}
+	}
+
+	var archive *os.File
+	if state.ArchivePath != "" {
+		var openErr error
+		archive, openErr = os.Open(state.ArchivePath)
+		if openErr != nil {
+			log.Warn(fmt.Sprintf("Unable to resume backup %s, starting over: %s", state.Index.Archive, openErr))
+			archive = nil
+		} else {
+			log.Info(fmt.Sprintf("Resuming backup %s from volume %d", state.Index.Archive, len(state.Index.Volumes)+1))
+		}
+	}
+	if archive != nil && state.Index.VolumeSize == 0 && len(state.Index.Volumes) != 0 {
+		// state written before the volume size was recorded, every volume but the last has its size
+		state.Index.VolumeSize = state.Index.Volumes[0].Size
+	}
+	if archive != nil && state.Index.VolumeSize != 0 && state.Index.VolumeSize != volumeSize {
+		log.Info(fmt.Sprintf("Resuming backup %s with the volume size it was started with, %d bytes", state.Index.Archive, state.Index.VolumeSize))
+	}
+	if archive == nil {
+		var archiveErr error
+		state, archive, archiveErr = createVolumeArchive(bc, time.Now(), volumeSize)
+		if archiveErr != nil {
+			log.Error(fmt.Sprintf("Error creating backup archive: %s", archiveErr))
+			return
+		}
+		if writeErr := writeStateFile(statePath, state); writeErr != nil {
+			log.Warn(fmt.Sprintf("Error writing volume backup state, the backup can't be resumed: %s", writeErr))
+		}
+	}
+	defer archive.Close()
+
+	if state.Index.VolumeSize == 0 {
+		state.Index.VolumeSize = volumeSize
+	}
+	backupErr := uploadVolumes(ctx, client, bc, archive, &state, statePath)
+	if backupErr == nil {
+		indexData, _ := json.Marshal(state.Index)
+		backupErr = client.UploadFile(ctx, bc.DestinationBucket, state.Index.Archive+volumeIndexSuffix, bytes.NewReader(indexData), nil)
+	}
+	if backupErr != nil {
+		log.Warn(fmt.Sprintf("Backup of %s failed after %d of its volumes, it will resume on the next run: %s", bc.SourceFolder, len(state.Index.Volumes), backupErr))
+	} else {
+		log.Info(fmt.Sprintf("Upload succeded for %s in %d volumes", state.Index.Archive, len(state.Index.Volumes)))
+		os.Remove(state.ArchivePath)
+		os.Remove(statePath)
+	}
+
+	if notifier != nil {
+		notifier.NotifyBackupResults(bc, archive, backupErr)
+	}
+}
+
+// createVolumeArchive writes the tarball into the state directory so it survives until every volume
+// has been uploaded, and hashes it for the index.
+func createVolumeArchive(bc BackupConfig, now time.Time, volumeSize int64) (volumeBackupState, *os.File, error) {
+	var state volumeBackupState
+	fileMap, walkErr := collectFiles(bc.SourceFolder, WalkOptions{Symlinks: bc.Symlinks})
+	if walkErr != nil {
+		log.Error(fmt.Sprintf("Backup directory walk failed: %s", walkErr))
+	}
+
+	archiveDir := filepath.Join(stateDirectory, "backups")
+	if mkdirErr := os.MkdirAll(archiveDir, 0700); mkdirErr != nil {
+		return state, nil, mkdirErr
+	}
+	keyBase := strings.TrimPrefix(strings.ReplaceAll(bc.SourceFolder, "/", "_"), "_")
+	archive, tempErr := ioutil.TempFile(archiveDir, fmt.Sprintf("%s_%s_*.tar.gz", keyBase, now.Format(time.RFC3339)))
+	if tempErr != nil {
+		return state, nil, tempErr
+	}
+	log.Info(fmt.Sprintf("Creating backup tarball: %s", archive.Name()))
+	if archiveErr := createArchive(fileMap, archive); archiveErr != nil {
+		archive.Close()
+		os.Remove(archive.Name())
+		return state, nil, archiveErr
+	}
+
+	if _, seekErr := archive.Seek(0, io.SeekStart); seekErr != nil {
+		archive.Close()
+		return state, nil, seekErr
+	}
+	hasher := sha256.New()
+	size, hashErr := io.Copy(hasher, archive)
+	if hashErr != nil {
+		archive.Close()
+		return state, nil, hashErr
+	}
+
+	state = volumeBackupState{
+		ArchivePath: archive.Name(),
+		Index: VolumeIndex{
+			CreatedAt:    now,
+			SourceFolder: bc.SourceFolder,
+			Archive:      filepath.Base(archive.Name()),
+			Size:         size,
+			SHA256:       hex.EncodeToString(hasher.Sum(nil)),
+			VolumeSize:   volumeSize,
+			Volumes:      make([]BackupVolume, 0),
+		},
+	}
+	return state, archive, nil
+}
+
+// uploadVolumes uploads every volume after the last completed one, verifying each before it's
+// recorded in the state file. Volumes are cut to the size recorded in the index so a resumed backup
+// lines up with the volumes already uploaded, whatever VolumeSize is set to now.
+func uploadVolumes(ctx context.Context, client BucketClient, bc BackupConfig, archive *os.File, state *volumeBackupState, statePath string) error {
+	job := workQueue.NewJob(bc.SourceFolder, bc.Priority, bc.Concurrency)
+	volumeSize := state.Index.VolumeSize
+	offset := int64(0)
+	for _, volume := range state.Index.Volumes {
+		offset += volume.Size
+	}
+	for ; offset < state.Index.Size || len(state.Index.Volumes) == 0; offset += volumeSize {
+		size := state.Index.Size - offset
+		if size > volumeSize {
+			size = volumeSize
+		}
+		volume := BackupVolume{Key: fmt.Sprintf("%s.%04d", state.Index.Archive, len(state.Index.Volumes)+1), Size: size}
+		sha256Hasher, md5Hasher := sha256.New(), md5.New()
+		body := io.TeeReader(io.NewSectionReader(archive, offset, size), io.MultiWriter(sha256Hasher, md5Hasher))
+
+		var putErr error
+		var wg sync.WaitGroup
+		wg.Add(1)
+		job.Submit(func() {
+			defer wg.Done()
+			putErr = client.UploadFile(ctx, bc.DestinationBucket, volume.Key, body, nil)
+		})
+		wg.Wait()
+		if putErr != nil {
+			return fmt.Errorf("Error uploading volume %s: %s", volume.Key, putErr)
+		}
+		if verifyErr := verifyVolume(ctx, client, bc.DestinationBucket, volume, hex.EncodeToString(md5Hasher.Sum(nil))); verifyErr != nil {
+			return verifyErr
+		}
+
+		volume.SHA256 = hex.EncodeToString(sha256Hasher.Sum(nil))
+		state.Index.Volumes = append(state.Index.Volumes, volume)
+		if writeErr := writeStateFile(statePath, state); writeErr != nil {
+			log.Warn(fmt.Sprintf("Error recording volume %s, it will be uploaded again if the backup is resumed: %s", volume.Key, writeErr))
+		}
+		log.Info(fmt.Sprintf("Uploaded volume %s", volume.Key))
+	}
+	return nil
+}
+
+// verifyVolume checks the uploaded volume's size, and its MD5 when the provider reports one.
+func verifyVolume(ctx context.Context, client BucketClient, bucket string, volume BackupVolume, md5Hash string) error {
+	found := false
+	walkErr := client.WalkObjects(ctx, bucket, ListOptions{Prefix: volume.Key}, func(key string, objectInfo ObjectInfo) error {
+		if strings.TrimPrefix(key, "/") != volume.Key {
+			return nil
+		}
+		found = true
+		if objectInfo.Size != volume.Size {
+			return fmt.Errorf("Volume %s is %d bytes, expected %d", volume.Key, objectInfo.Size, volume.Size)
+		}
+		if objectInfo.Hash != "" && objectInfo.Hash != md5Hash {
+			return fmt.Errorf("Volume %s has MD5 %s, expected %s", volume.Key, objectInfo.Hash, md5Hash)
+		}
+		return nil
+	})
+	if walkErr != nil {
+		return walkErr
+	}
+	if !found {
+		return fmt.Errorf("Volume %s is missing after upload", volume.Key)
+	}
+	return nil
+}
+
+// listVolumeIndexes returns the indexes of a backup job's volume backups, oldest first.
+func listVolumeIndexes(ctx context.Context, client BucketClient, bc BackupConfig) ([]SnapshotInfo, error) {
+	indexes := make([]SnapshotInfo, 0)
+	prefix := strings.TrimPrefix(strings.ReplaceAll(bc.SourceFolder, "/", "_"), "_") + "_"
+	walkErr := client.WalkObjects(ctx, bc.DestinationBucket, ListOptions{Prefix: prefix}, func(key string, objectInfo ObjectInfo) error {
+		key = strings.TrimPrefix(key, "/")
+		if !strings.HasSuffix(key, volumeIndexSuffix) {
+			return nil
+		}
+		// archive names are <source>_<RFC3339 time>_<random>.tar.gz, anything else belongs to a
+		// source folder that shares the prefix
+		timestamp := strings.TrimPrefix(key, prefix)
+		if separator := strings.Index(timestamp, "_"); separator != -1 {
+			timestamp = timestamp[:separator]
+		}
+		createdAt, parseErr := time.Parse(time.RFC3339, timestamp)
+		if parseErr != nil {
+			return nil
+		}
+		indexes = append(indexes, SnapshotInfo{Key: key, CreatedAt: createdAt})
+		return nil
+	})
+	sort.Slice(indexes, func(i, j int) bool {
+		return indexes[i].CreatedAt.Before(indexes[j].CreatedAt)
+	})
+
+	return indexes, walkErr
+}
+
+func readVolumeIndex(ctx context.Context, client BucketClient, bucket, key string) (VolumeIndex, error) {
+	var index VolumeIndex
+	indexData := &bytes.Buffer{}
+	if _, downloadErr := client.DownloadObject(ctx, bucket, key, indexData); downloadErr != nil {
+		return index, downloadErr
+	}
+	unmarshalErr := json.Unmarshal(indexData.Bytes(), &index)
+	return index, unmarshalErr
+}
+
+// doRestoreVolumeBackup extracts a volume backup under targetFolder, narrowed to subPrefix relative
+// to SourceFolder when it's set. Volumes are downloaded one at a time and checked against their
+// hash before being streamed into the extractor, so the archive is never stored whole. Per path
+// results are returned, the error is set when the archive couldn't be read to the end.
+func doRestoreVolumeBackup(ctx context.Context, client BucketClient, bc BackupConfig, index VolumeIndex, targetFolder, subPrefix string) (map[string]error, error) {
+	archiveReader, archiveWriter := io.Pipe()
+	go func() {
+		archiveWriter.CloseWithError(streamVolumes(ctx, client, bc.DestinationBucket, index, archiveWriter))
+	}()
+	// unblocks the download if extraction stops early
+	defer archiveReader.Close()
+
+	return extractArchive(archiveReader, index.SourceFolder, targetFolder, subPrefix)
+}
+
+// streamVolumes writes each verified volume to w in order
+func streamVolumes(ctx context.Context, client BucketClient, bucket string, index VolumeIndex, w io.Writer) error {
+	for _, volume := range index.Volumes {
+		volumeFile, tempErr := ioutil.TempFile(os.TempDir(), "warden-volume-*")
+		if tempErr != nil {
+			return tempErr
+		}
+		streamErr := func() error {
+			defer os.Remove(volumeFile.Name())
+			defer volumeFile.Close()
+			hasher := sha256.New()
+			if _, downloadErr := client.DownloadObject(ctx, bucket, volume.Key, io.MultiWriter(volumeFile, hasher)); downloadErr != nil {
+				return fmt.Errorf("Error downloading volume %s: %s", volume.Key, downloadErr)
+			}
+			if hex.EncodeToString(hasher.Sum(nil)) != volume.SHA256 {
+				return fmt.Errorf("Volume %s is corrupt", volume.Key)
+			}
+			if _, seekErr := volumeFile.Seek(0, io.SeekStart); seekErr != nil {
+				return seekErr
+			}
+			_, copyErr := io.Copy(w, volumeFile)
+			return copyErr
+		}()
+		if streamErr != nil {
+			return streamErr
+		}
+	}
+	return nil
+}
+
+// extractArchive unpacks a tarball made by createArchive, whose entries are named by their absolute
+// path, under targetFolder relative to sourceFolder.
+func extractArchive(r io.Reader, sourceFolder, targetFolder, subPrefix string) (map[string]error, error) {
+	restoreResults := make(map[string]error)
+	gzipReader, gzipErr := gzip.NewReader(r)
+	if gzipErr != nil {
+		return restoreResults, gzipErr
+	}
+	tarReader := tar.NewReader(gzipReader)
+	subPrefix = strings.Trim(subPrefix, "/")
+
+	localPathFor := func(archivePath string) (string, string, bool) {
+		relativePath, relErr := filepath.Rel(sourceFolder, filepath.Clean("/"+archivePath))
+		if relErr != nil || relativePath == ".." || strings.HasPrefix(relativePath, ".."+string(filepath.Separator)) {
+			return "", "", false
+		}
+		return filepath.Join(targetFolder, relativePath), filepath.ToSlash(relativePath), true
+	}
+
+	for {
+		header, nextErr := tarReader.Next()
+		if nextErr == io.EOF {
+			return restoreResults, nil
+		}
+		if nextErr != nil {
+			return restoreResults, nextErr
+		}
+		localPath, relativePath, ok := localPathFor(header.Name)
+		if !ok {
+			log.Warn(fmt.Sprintf("Skipping %s, it's outside of %s", header.Name, sourceFolder))
+			continue
+		}
+		if subPrefix != "" && relativePath != subPrefix && !strings.HasPrefix(relativePath, subPrefix+"/") {
+			continue
+		}
+
+		// symlinks are extracted like anything else, so the parents of every entry are checked before
+		// it's written in case one of them was extracted as a symlink pointing outside the target
+		var extractErr error
+		if mkdirErr := mkdirContained(targetFolder, filepath.Dir(localPath)); mkdirErr != nil {
+			extractErr = mkdirErr
+		} else {
+			switch header.Typeflag {
+			case tar.TypeDir:
+				if mkdirErr := os.Mkdir(localPath, header.FileInfo().Mode().Perm()); mkdirErr != nil && !os.IsExist(mkdirErr) {
+					extractErr = mkdirErr
+				}
+			case tar.TypeSymlink:
+				os.Remove(localPath)
+				extractErr = os.Symlink(header.Linkname, localPath)
+			case tar.TypeLink:
+				linkTarget, _, linkOk := localPathFor(header.Linkname)
+				if !linkOk {
+					extractErr = fmt.Errorf("Hard link target %s is outside of %s", header.Linkname, sourceFolder)
+				} else {
+					os.Remove(localPath)
+					extractErr = os.Link(linkTarget, localPath)
+				}
+			case tar.TypeReg:
+				extractErr = extractFile(tarReader, header, localPath)
+			default:
+				continue
+			}
+		}
+		if extractErr != nil {
+			log.Warn(fmt.Sprintf("Error restoring %s to %s: %s", relativePath, localPath, extractErr))
+		} else {
+			log.Info(fmt.Sprintf("Restored %s to %s", relativePath, localPath))
+		}
+		restoreResults[relativePath] = extractErr
+	}
+}
+
+func extractFile(r io.Reader, header *tar.Header, localPath string) error {
+	tempFile, tempErr := ioutil.TempFile(filepath.Dir(localPath), ".warden-restore-*")
+	if tempErr != nil {
+		return tempErr
+	}
+	defer os.Remove(tempFile.Name())
+	_, copyErr := io.Copy(tempFile, r)
+	closeErr := tempFile.Close()
+	if copyErr != nil {
+		return copyErr
+	}
+	if closeErr != nil {
+		return closeErr
+	}
+	if chmodErr := os.Chmod(tempFile.Name(), header.FileInfo().Mode().Perm()); chmodErr != nil {
+		return chmodErr
+	}
+	if renameErr := os.Rename(tempFile.Name(), localPath); renameErr != nil {
+		return renameErr
+	}
+	return os.Chtimes(localPath, header.ModTime, header.ModTime)
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// failingVolumeClient fails the first upload of keys with the given suffix
+type failingVolumeClient struct {
+	*MockS3Client
+	failSuffix string
+	failed     bool
+}
+
+func (c *failingVolumeClient) UploadFile(ctx context.Context, bucketName string, key string, body io.Reader, metadata map[string]string) error {
+	if !c.failed && strings.HasSuffix(key, c.failSuffix) {
+		c.failed = true
+		return fmt.Errorf("connection reset")
+	}
+	return c.MockS3Client.UploadFile(ctx, bucketName, key, body, metadata)
+}
+
+func setupVolumeBackup(t *testing.T) (string, BackupConfig, []byte) {
+	mockStateDir, mockStateDirErr := ioutil.TempDir(os.TempDir(), "go-test-stuff")
+	assert.Nil(t, mockStateDirErr)
+	stateDirectory = mockStateDir
+	mockTempDir, mockTempDirErr := ioutil.TempDir(os.TempDir(), "go-test-stuff")
+	assert.Nil(t, mockTempDirErr)
+
+	// random data doesn't compress, so the archive spans several volumes
+	bigData := make([]byte, 300*1024)
+	rand.New(rand.NewSource(1)).Read(bigData)
+	assert.Nil(t, os.MkdirAll(filepath.Join(mockTempDir, "nested/dir"), os.ModePerm))
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(mockTempDir, "nested/dir/big.bin"), bigData, 0644))
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(mockTempDir, "small.txt"), []byte("small file"), 0600))
+
+	concreteWalkFunc = walkDirectory
+	return mockTempDir, BackupConfig{
+		SourceFolder:      mockTempDir,
+		DestinationBucket: "notatallarealbucket",
+		VolumeSize:        "100KB",
+		At:                "*/1 * * * *",
+	}, bigData
+}
+
+func volumeUploads(client *MockS3Client) []string {
+	keys := make([]string, 0)
+	for _, request := range client.UploadRequests {
+		if !strings.HasSuffix(request.Key, volumeIndexSuffix) {
+			keys = append(keys, request.Key)
+		}
+	}
+	return keys
+}
+
+func TestVolumeBackupRoundTrip(t *testing.T) {
+	mockTempDir, mockBackupConfig, bigData := setupVolumeBackup(t)
+	defer os.RemoveAll(mockTempDir)
+	defer os.RemoveAll(stateDirectory)
+	restoreDir, restoreDirErr := ioutil.TempDir(os.TempDir(), "go-test-stuff")
+	assert.Nil(t, restoreDirErr)
+	defer os.RemoveAll(restoreDir)
+	mockClient := NewMockClient(map[string]ObjectInfo{})
+
+	doBackup(context.Background(), mockClient, mockBackupConfig, nil)
+
+	assert.Len(t, volumeUploads(mockClient), 4)
+	indexes, listErr := listVolumeIndexes(context.Background(), mockClient, mockBackupConfig)
+	assert.Nil(t, listErr)
+	assert.Len(t, indexes, 1)
+	index, readErr := readVolumeIndex(context.Background(), mockClient, "notatallarealbucket", indexes[0].Key)
+	assert.Nil(t, readErr)
+	assert.Len(t, index.Volumes, 4)
+	assert.True(t, strings.HasSuffix(index.Volumes[0].Key, ".tar.gz.0001"))
+
+	restoreResults, restoreErr := doRestoreVolumeBackup(context.Background(), mockClient, mockBackupConfig, index, restoreDir, "nested")
+	assert.Nil(t, restoreErr)
+	assert.Equal(t, map[string]error{"nested/dir/big.bin": nil}, restoreResults)
+	restored, readFileErr := ioutil.ReadFile(filepath.Join(restoreDir, "nested/dir/big.bin"))
+	assert.Nil(t, readFileErr)
+	assert.True(t, bytes.Equal(bigData, restored))
+
+	// nothing is left behind once every volume is uploaded
+	leftovers, _ := ioutil.ReadDir(filepath.Join(stateDirectory, "backups"))
+	assert.Len(t, leftovers, 0)
+}
+
+func TestVolumeBackupResumesFromLastVolume(t *testing.T) {
+	mockTempDir, mockBackupConfig, _ := setupVolumeBackup(t)
+	defer os.RemoveAll(mockTempDir)
+	defer os.RemoveAll(stateDirectory)
+	mockClient := &failingVolumeClient{MockS3Client: NewMockClient(map[string]ObjectInfo{}), failSuffix: ".0003"}
+
+	doBackup(context.Background(), mockClient, mockBackupConfig, nil)
+
+	uploaded := volumeUploads(mockClient.MockS3Client)
+	assert.Len(t, uploaded, 2)
+	indexes, listErr := listVolumeIndexes(context.Background(), mockClient, mockBackupConfig)
+	assert.Nil(t, listErr)
+	assert.Len(t, indexes, 0)
+
+	// the source changing doesn't matter, the interrupted archive is finished first
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(mockTempDir, "small.txt"), []byte("changed"), 0600))
+	doBackup(context.Background(), mockClient, mockBackupConfig, nil)
+
+	resumed := volumeUploads(mockClient.MockS3Client)
+	assert.Len(t, resumed, 4)
+	assert.Equal(t, uploaded, resumed[:2])
+	assert.True(t, strings.HasSuffix(resumed[2], ".0003"))
+	indexes, listErr = listVolumeIndexes(context.Background(), mockClient, mockBackupConfig)
+	assert.Nil(t, listErr)
+	assert.Len(t, indexes, 1)
+}
+
+func TestVolumeBackupResumesWithItsOriginalVolumeSize(t *testing.T) {
+	mockTempDir, mockBackupConfig, bigData := setupVolumeBackup(t)
+	defer os.RemoveAll(mockTempDir)
+	defer os.RemoveAll(stateDirectory)
+	restoreDir := t.TempDir()
+	mockClient := &failingVolumeClient{MockS3Client: NewMockClient(map[string]ObjectInfo{}), failSuffix: ".0003"}
+
+	doBackup(context.Background(), mockClient, mockBackupConfig, nil)
+	assert.Len(t, volumeUploads(mockClient.MockS3Client), 2)
+
+	// the config changing between the failed run and its resume doesn't move the volume boundaries
+	mockBackupConfig.VolumeSize = "64KB"
+	doBackup(context.Background(), mockClient, mockBackupConfig, nil)
+
+	indexes, listErr := listVolumeIndexes(context.Background(), mockClient, mockBackupConfig)
+	assert.Nil(t, listErr)
+	assert.Len(t, indexes, 1)
+	index, readErr := readVolumeIndex(context.Background(), mockClient, "notatallarealbucket", indexes[0].Key)
+	assert.Nil(t, readErr)
+	assert.Equal(t, int64(100*1024), index.VolumeSize)
+	assert.Len(t, index.Volumes, 4)
+	total := int64(0)
+	for _, volume := range index.Volumes {
+		total += volume.Size
+	}
+	assert.Equal(t, index.Size, total)
+
+	restoreResults, restoreErr := doRestoreVolumeBackup(context.Background(), mockClient, mockBackupConfig, index, restoreDir, "nested")
+	assert.Nil(t, restoreErr)
+	assert.Equal(t, map[string]error{"nested/dir/big.bin": nil}, restoreResults)
+	restored, readFileErr := ioutil.ReadFile(filepath.Join(restoreDir, "nested/dir/big.bin"))
+	assert.Nil(t, readFileErr)
+	assert.True(t, bytes.Equal(bigData, restored))
+}
+
+func TestVolumeRestoreDetectsCorruptVolume(t *testing.T) {
+	mockTempDir, mockBackupConfig, _ := setupVolumeBackup(t)
+	defer os.RemoveAll(mockTempDir)
+	defer os.RemoveAll(stateDirectory)
+	restoreDir, restoreDirErr := ioutil.TempDir(os.TempDir(), "go-test-stuff")
+	assert.Nil(t, restoreDirErr)
+	defer os.RemoveAll(restoreDir)
+	mockClient := NewMockClient(map[string]ObjectInfo{})
+	doBackup(context.Background(), mockClient, mockBackupConfig, nil)
+	indexes, _ := listVolumeIndexes(context.Background(), mockClient, mockBackupConfig)
+	index, readErr := readVolumeIndex(context.Background(), mockClient, "notatallarealbucket", indexes[0].Key)
+	assert.Nil(t, readErr)
+
+	mockClient.SetMockBody(index.Volumes[1].Key, []byte("tampered"))
+	_, restoreErr := doRestoreVolumeBackup(context.Background(), mockClient, mockBackupConfig, index, restoreDir, "")
+
+	assert.ErrorContains(t, restoreErr, "corrupt")
+}
+
+func TestExtractArchiveRefusesToWriteThroughSymlinks(t *testing.T) {
+	mockTempDir := t.TempDir()
+	targetFolder := filepath.Join(mockTempDir, "restore")
+	outside := filepath.Join(mockTempDir, "outside")
+	assert.Nil(t, os.Mkdir(outside, 0755))
+
+	// a symlink entry pointing outside of the target, then an entry under it
+	var archive bytes.Buffer
+	gzipWriter := gzip.NewWriter(&archive)
+	tarWriter := tar.NewWriter(gzipWriter)
+	assert.Nil(t, tarWriter.WriteHeader(&tar.Header{Name: "/folder1/a", Typeflag: tar.TypeSymlink, Linkname: outside, Mode: 0777}))
+	assert.Nil(t, tarWriter.WriteHeader(&tar.Header{Name: "/folder1/a/evil", Typeflag: tar.TypeReg, Size: 4, Mode: 0644}))
+	_, writeErr := tarWriter.Write([]byte("evil"))
+	assert.Nil(t, writeErr)
+	assert.Nil(t, tarWriter.Close())
+	assert.Nil(t, gzipWriter.Close())
+
+	restoreResults, extractErr := extractArchive(&archive, "/folder1", targetFolder, "")
+	assert.Nil(t, extractErr)
+	assert.Nil(t, restoreResults["a"])
+	assert.ErrorContains(t, restoreResults["a/evil"], "symlink")
+	assert.NoFileExists(t, filepath.Join(outside, "evil"))
+}
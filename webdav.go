@@ -0,0 +1,490 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// webdavInternalDir holds upload temp files and object metadata in each bucket's collection, it's
+// outside of the key space so listings skip it.
+const webdavInternalDir = ".warden-webdav"
+
+const webdavPropfindBody = `<?xml version="1.0" encoding="utf-8"?>
+<d:propfind xmlns:d="DAV:"><d:prop><d:resourcetype/><d:getcontentlength/><d:getlastmodified/></d:prop></d:propfind>`
+
+// WebDAVClient maps buckets to collections under the endpoint URL, IE: the files of a Nextcloud user
+// at https://cloud.example.org/remote.php/dav/files/<user>/. Resources have no metadata warden can
+// rely on every server to keep, so like sftp buckets the metadata passed to UploadFile is kept in a
+// JSON file per key under webdavInternalDir.
+type WebDAVClient struct {
+	endpoint *url.URL
+	user     string
+	password string
+	client   *http.Client
+	// collections caches the collections known to exist, so uploads don't have to MKCOL every parent
+	collections sync.Map
+}
+
+// NewWebDAVBucketClient uses basic auth when a user is configured. Nextcloud users with two factor
+// auth need an app password.
+func NewWebDAVBucketClient(providerConfig CloudProviderConfig) (BucketClient, error) {
+	var bucketClient BucketClient
+	if providerConfig.Endpoint == "" {
+		return bucketClient, fmt.Errorf("WebDAV provider %s needs an endpoint", providerConfig.ID)
+	}
+	endpoint, parseErr := url.Parse(providerConfig.Endpoint)
+	if parseErr != nil || endpoint.Scheme == "" || endpoint.Host == "" {
+		return bucketClient, fmt.Errorf("WebDAV provider %s has an invalid endpoint: %s", providerConfig.ID, providerConfig.Endpoint)
+	}
+	endpoint.Path = path.Join("/", endpoint.Path)
+	endpoint.RawPath = ""
+	bucketClient = &WebDAVClient{
+		endpoint: endpoint,
+		user:     providerConfig.User,
+		password: providerConfig.Password,
+		client:   &http.Client{},
+	}
+
+	return bucketClient, nil
+}
+
+// webdavStatusError is returned for responses with an unexpected status. Missing resources match
+// os.ErrNotExist with errors.Is.
+type webdavStatusError struct {
+	Method     string
+	URL        string
+	Status     string
+	StatusCode int
+}
+
+func (e *webdavStatusError) Error() string {
+	return fmt.Sprintf("%s %s returned %s", e.Method, e.URL, e.Status)
+}
+
+func (e *webdavStatusError) Is(target error) bool {
+	return target == os.ErrNotExist && e.StatusCode == http.StatusNotFound
+}
+
+func isConflict(err error) bool {
+	var statusErr *webdavStatusError
+	return errors.As(err, &statusErr) && statusErr.StatusCode == http.StatusConflict
+}
+
+// resourceURL returns the URL of a path in a bucket, collection URLs end with a slash
+func (s *WebDAVClient) resourceURL(bucketName, resourcePath string, collection bool) string {
+	resource := *s.endpoint
+	resource.Path = path.Join(s.endpoint.Path, bucketName, resourcePath)
+	if collection {
+		resource.Path += "/"
+	}
+	return resource.String()
+}
+
+func (s *WebDAVClient) do(ctx context.Context, method, resourceURL string, body io.Reader, headers map[string]string) (*http.Response, error) {
+	req, reqErr := http.NewRequestWithContext(ctx, method, resourceURL, body)
+	if reqErr != nil {
+		return nil, reqErr
+	}
+	if s.user != "" {
+		req.SetBasicAuth(s.user, s.password)
+	}
+	for name, value := range headers {
+		req.Header.Set(name, value)
+	}
+	return s.client.Do(req)
+}
+
+// request sends a request whose response body isn't needed, it fails unless the status is one of okStatuses
+func (s *WebDAVClient) request(ctx context.Context, method, resourceURL string, body io.Reader, headers map[string]string, okStatuses ...int) error {
+	resp, doErr := s.do(ctx, method, resourceURL, body, headers)
+	if doErr != nil {
+		return doErr
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+
+	for _, status := range okStatuses {
+		if resp.StatusCode == status {
+			return nil
+		}
+	}
+	return &webdavStatusError{Method: method, URL: resourceURL, Status: resp.Status, StatusCode: resp.StatusCode}
+}
+
+// ensureCollection creates dir and its parents within the bucket, the bucket itself has to exist
+func (s *WebDAVClient) ensureCollection(ctx context.Context, bucketName, dir string) error {
+	if dir == "." || dir == "" {
+		return nil
+	}
+	cacheKey := bucketName + "/" + dir
+	if _, ok := s.collections.Load(cacheKey); ok {
+		return nil
+	}
+	if parentErr := s.ensureCollection(ctx, bucketName, path.Dir(dir)); parentErr != nil {
+		return parentErr
+	}
+	// MKCOL on a collection that already exists is not allowed
+	if mkcolErr := s.request(ctx, "MKCOL", s.resourceURL(bucketName, dir, true), nil, nil, http.StatusCreated, http.StatusMethodNotAllowed); mkcolErr != nil {
+		return mkcolErr
+	}
+	s.collections.Store(cacheKey, true)
+	return nil
+}
+
+// forgetCollections clears the cache after a collection it holds turned out to be gone, IE: someone
+// deleted a folder through the Nextcloud web interface.
+func (s *WebDAVClient) forgetCollections() {
+	s.collections.Range(func(key, value interface{}) bool {
+		s.collections.Delete(key)
+		return true
+	})
+}
+
+// transfer copies or moves a resource on the server, replacing the destination
+func (s *WebDAVClient) transfer(ctx context.Context, method, sourceBucket, sourcePath, destinationBucket, destinationPath string) error {
+	headers := map[string]string{
+		"Destination": s.resourceURL(destinationBucket, destinationPath, false),
+		"Overwrite":   "T",
+	}
+	var transferErr error
+	for attempt := 0; attempt < 2; attempt++ {
+		if ensureErr := s.ensureCollection(ctx, destinationBucket, path.Dir(destinationPath)); ensureErr != nil {
+			return ensureErr
+		}
+		transferErr = s.request(ctx, method, s.resourceURL(sourceBucket, sourcePath, false), nil, headers, http.StatusCreated, http.StatusNoContent)
+		if !isConflict(transferErr) {
+			return transferErr
+		}
+		s.forgetCollections()
+	}
+	return transferErr
+}
+
+// replaceResource uploads body to a temp file then moves it over resourcePath, so the resource is
+// never seen half written on servers that write PUT bodies in place.
+func (s *WebDAVClient) replaceResource(ctx context.Context, bucketName, resourcePath string, body io.Reader) error {
+	idBytes := make([]byte, 16)
+	if _, randErr := rand.Read(idBytes); randErr != nil {
+		return randErr
+	}
+	tempPath := path.Join(webdavInternalDir, "tmp", hex.EncodeToString(idBytes))
+	if ensureErr := s.ensureCollection(ctx, bucketName, path.Dir(tempPath)); ensureErr != nil {
+		return ensureErr
+	}
+
+	putErr := s.request(ctx, http.MethodPut, s.resourceURL(bucketName, tempPath, false), body, nil, http.StatusOK, http.StatusCreated, http.StatusNoContent)
+	if putErr == nil {
+		putErr = s.transfer(ctx, "MOVE", bucketName, tempPath, bucketName, resourcePath)
+	}
+	if putErr != nil {
+		if errors.Is(putErr, os.ErrNotExist) || isConflict(putErr) {
+			s.forgetCollections()
+		}
+		s.request(ctx, http.MethodDelete, s.resourceURL(bucketName, tempPath, false), nil, nil, http.StatusOK, http.StatusNoContent, http.StatusNotFound)
+		return putErr
+	}
+	return nil
+}
+
+func webdavMetadataPath(keyPath string) string {
+	return path.Join(webdavInternalDir, "metadata", keyPath+".json")
+}
+
+func (s *WebDAVClient) deleteResource(ctx context.Context, bucketName, resourcePath string) error {
+	return s.request(ctx, http.MethodDelete, s.resourceURL(bucketName, resourcePath, false), nil, nil, http.StatusOK, http.StatusNoContent, http.StatusNotFound)
+}
+
+func (s *WebDAVClient) writeMetadata(ctx context.Context, bucketName, keyPath string, metadata map[string]string) error {
+	if len(metadata) == 0 {
+		return s.deleteResource(ctx, bucketName, webdavMetadataPath(keyPath))
+	}
+	metadataBytes, marshalErr := json.Marshal(metadata)
+	if marshalErr != nil {
+		return marshalErr
+	}
+	return s.replaceResource(ctx, bucketName, webdavMetadataPath(keyPath), strings.NewReader(string(metadataBytes)))
+}
+
+// readMetadata returns nil for resources uploaded without metadata
+func (s *WebDAVClient) readMetadata(ctx context.Context, bucketName, keyPath string) (map[string]string, error) {
+	metadataURL := s.resourceURL(bucketName, webdavMetadataPath(keyPath), false)
+	resp, getErr := s.do(ctx, http.MethodGet, metadataURL, nil, nil)
+	if getErr != nil {
+		return nil, getErr
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, &webdavStatusError{Method: http.MethodGet, URL: metadataURL, Status: resp.Status, StatusCode: resp.StatusCode}
+	}
+
+	var metadata map[string]string
+	if decodeErr := json.NewDecoder(resp.Body).Decode(&metadata); decodeErr != nil {
+		return nil, fmt.Errorf("Invalid metadata for %s: %s", keyPath, decodeErr)
+	}
+	return metadata, nil
+}
+
+type webdavMultistatus struct {
+	Responses []webdavResponse `xml:"DAV: response"`
+}
+
+type webdavResponse struct {
+	Href      string           `xml:"DAV: href"`
+	Propstats []webdavPropstat `xml:"DAV: propstat"`
+}
+
+type webdavPropstat struct {
+	Status string     `xml:"DAV: status"`
+	Prop   webdavProp `xml:"DAV: prop"`
+}
+
+type webdavProp struct {
+	ContentLength string `xml:"DAV: getcontentlength"`
+	LastModified  string `xml:"DAV: getlastmodified"`
+	ResourceType  struct {
+		Collection *struct{} `xml:"DAV: collection"`
+	} `xml:"DAV: resourcetype"`
+}
+
+// readCollection lists the members of a collection with a depth 1 PROPFIND, servers such as Nextcloud
+// don't allow listing a whole tree at once.
+func (s *WebDAVClient) readCollection(ctx context.Context, bucketName, dir string) ([]treeEntry, error) {
+	collectionURL := s.resourceURL(bucketName, dir, true)
+	headers := map[string]string{"Depth": "1", "Content-Type": "application/xml; charset=utf-8"}
+	resp, propfindErr := s.do(ctx, "PROPFIND", collectionURL, strings.NewReader(webdavPropfindBody), headers)
+	if propfindErr != nil {
+		return nil, propfindErr
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusMultiStatus {
+		return nil, &webdavStatusError{Method: "PROPFIND", URL: collectionURL, Status: resp.Status, StatusCode: resp.StatusCode}
+	}
+	var multistatus webdavMultistatus
+	if decodeErr := xml.NewDecoder(resp.Body).Decode(&multistatus); decodeErr != nil {
+		return nil, fmt.Errorf("Invalid PROPFIND response for %s: %s", collectionURL, decodeErr)
+	}
+
+	collectionPath := path.Join(s.endpoint.Path, bucketName, dir)
+	entries := make([]treeEntry, 0, len(multistatus.Responses))
+	for _, response := range multistatus.Responses {
+		href, hrefErr := url.Parse(response.Href)
+		if hrefErr != nil {
+			return nil, fmt.Errorf("Invalid href in PROPFIND response for %s: %s", collectionURL, response.Href)
+		}
+		memberPath := path.Clean(href.Path)
+		if memberPath == collectionPath || path.Dir(memberPath) != collectionPath {
+			continue
+		}
+		for _, propstat := range response.Propstats {
+			if !strings.Contains(propstat.Status, " 200 ") {
+				continue
+			}
+			entry := treeEntry{Name: path.Base(memberPath), IsDir: propstat.Prop.ResourceType.Collection != nil}
+			if !entry.IsDir {
+				entry.Size, _ = strconv.ParseInt(strings.TrimSpace(propstat.Prop.ContentLength), 10, 64)
+				if lastModified, timeErr := http.ParseTime(propstat.Prop.LastModified); timeErr == nil {
+					// getlastmodified only has whole seconds, the end of the second is used so a file
+					// uploaded in the same second it changed isn't seen as older than the local file
+					entry.ModTime = lastModified.Add(time.Second - time.Nanosecond)
+				}
+			}
+			entries = append(entries, entry)
+		}
+	}
+
+	return entries, nil
+}
+
+// sweepTempFiles removes the temp files of uploads that never finished. The temp collection doesn't
+// exist until the first upload, failing to read it is ignored.
+func (s *WebDAVClient) sweepTempFiles(ctx context.Context, bucketName string, now time.Time) {
+	tempDir := path.Join(webdavInternalDir, "tmp")
+	entries, readErr := s.readCollection(ctx, bucketName, tempDir)
+	if readErr != nil {
+		return
+	}
+	for _, entry := range entries {
+		if entry.IsDir || now.Sub(entry.ModTime) < staleTempFileAge {
+			continue
+		}
+		tempPath := path.Join(tempDir, entry.Name)
+		if deleteErr := s.deleteResource(ctx, bucketName, tempPath); deleteErr != nil {
+			log.Warn(fmt.Sprintf("Error removing %s from %s, left behind by an unfinished upload: %s", tempPath, bucketName, deleteErr))
+			continue
+		}
+		log.Info(fmt.Sprintf("Removed %s from %s, left behind by an unfinished upload", tempPath, bucketName))
+	}
+}
+
+// WalkObjects lists the bucket's collections with walkTree. Listings have no hash or metadata, like
+// S3 the modification time is when the file was uploaded. Stale temp files are swept first.
+func (s *WebDAVClient) WalkObjects(ctx context.Context, bucketName string, opts ListOptions, walkFn ObjectWalkFunc) error {
+	s.sweepTempFiles(ctx, bucketName, time.Now())
+	walkErr := walkTree(ctx, opts, webdavInternalDir, func(dir string) ([]treeEntry, error) {
+		return s.readCollection(ctx, bucketName, dir)
+	}, walkFn)
+	if errors.Is(walkErr, os.ErrNotExist) && treeStartDir(opts.Prefix) != "" {
+		// nothing has been uploaded under the prefix yet
+		headers := map[string]string{"Depth": "0", "Content-Type": "application/xml; charset=utf-8"}
+		bucketURL := s.resourceURL(bucketName, "", true)
+		if s.request(ctx, "PROPFIND", bucketURL, strings.NewReader(webdavPropfindBody), headers, http.StatusMultiStatus) == nil {
+			return nil
+		}
+	}
+
+	return walkErr
+}
+
+func (s *WebDAVClient) UploadFile(ctx context.Context, bucketName, key string, body io.Reader, metadata map[string]string) error {
+	keyPath, keyErr := treeKeyPath(key, webdavInternalDir)
+	if keyErr != nil {
+		return keyErr
+	}
+
+	if uploadErr := s.replaceResource(ctx, bucketName, keyPath, body); uploadErr != nil {
+		return uploadErr
+	}
+	return s.writeMetadata(ctx, bucketName, keyPath, metadata)
+}
+
+func (s *WebDAVClient) DownloadObject(ctx context.Context, bucketName, key string, w io.Writer) (ObjectInfo, error) {
+	return s.DownloadObjectVersion(ctx, bucketName, key, "", w)
+}
+
+func (s *WebDAVClient) DownloadObjectVersion(ctx context.Context, bucketName, key, versionID string, w io.Writer) (ObjectInfo, error) {
+	var objectInfo ObjectInfo
+	if versionID != "" {
+		return objectInfo, fmt.Errorf("WebDAV buckets don't keep object versions")
+	}
+	keyPath, keyErr := treeKeyPath(key, webdavInternalDir)
+	if keyErr != nil {
+		return objectInfo, keyErr
+	}
+
+	metadata, metadataErr := s.readMetadata(ctx, bucketName, keyPath)
+	if metadataErr != nil {
+		return objectInfo, metadataErr
+	}
+	objectInfo.Metadata = metadata
+
+	objectURL := s.resourceURL(bucketName, keyPath, false)
+	resp, getErr := s.do(ctx, http.MethodGet, objectURL, nil, nil)
+	if getErr != nil {
+		return objectInfo, getErr
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return objectInfo, &webdavStatusError{Method: http.MethodGet, URL: objectURL, Status: resp.Status, StatusCode: resp.StatusCode}
+	}
+	if resp.ContentLength >= 0 {
+		objectInfo.Size = resp.ContentLength
+	}
+	if lastModified, timeErr := http.ParseTime(resp.Header.Get("Last-Modified")); timeErr == nil {
+		objectInfo.ModTime = lastModified
+	}
+	_, copyErr := io.Copy(w, resp.Body)
+
+	return objectInfo, copyErr
+}
+
+func (s *WebDAVClient) ObjectMetadata(ctx context.Context, bucketName, key string) (map[string]string, error) {
+	keyPath, keyErr := treeKeyPath(key, webdavInternalDir)
+	if keyErr != nil {
+		return nil, keyErr
+	}
+	return s.readMetadata(ctx, bucketName, keyPath)
+}
+
+// CopyObject copies on the server with COPY, along with the object's metadata. Storage classes don't
+// apply to WebDAV and are ignored.
+func (s *WebDAVClient) CopyObject(ctx context.Context, sourceBucket, sourceKey, destinationBucket, destinationKey string, opts CopyOptions) error {
+	if opts.SourceVersion != "" {
+		return fmt.Errorf("WebDAV buckets don't keep object versions")
+	}
+	sourcePath, sourceErr := treeKeyPath(sourceKey, webdavInternalDir)
+	if sourceErr != nil {
+		return sourceErr
+	}
+	destinationPath, destinationErr := treeKeyPath(destinationKey, webdavInternalDir)
+	if destinationErr != nil {
+		return destinationErr
+	}
+
+	if copyErr := s.transfer(ctx, "COPY", sourceBucket, sourcePath, destinationBucket, destinationPath); copyErr != nil {
+		return copyErr
+	}
+	metadataErr := s.transfer(ctx, "COPY", sourceBucket, webdavMetadataPath(sourcePath), destinationBucket, webdavMetadataPath(destinationPath))
+	if errors.Is(metadataErr, os.ErrNotExist) {
+		return s.deleteResource(ctx, destinationBucket, webdavMetadataPath(destinationPath))
+	}
+	return metadataErr
+}
+
+// MoveObject moves on the server with MOVE, along with the object's metadata. Tombstones are made
+// with it, a COPY and DELETE would have the server write the file out again.
+func (s *WebDAVClient) MoveObject(ctx context.Context, sourceBucket, sourceKey, destinationBucket, destinationKey string) error {
+	sourcePath, sourceErr := treeKeyPath(sourceKey, webdavInternalDir)
+	if sourceErr != nil {
+		return sourceErr
+	}
+	destinationPath, destinationErr := treeKeyPath(destinationKey, webdavInternalDir)
+	if destinationErr != nil {
+		return destinationErr
+	}
+
+	if moveErr := s.transfer(ctx, "MOVE", sourceBucket, sourcePath, destinationBucket, destinationPath); moveErr != nil {
+		return moveErr
+	}
+	metadataErr := s.transfer(ctx, "MOVE", sourceBucket, webdavMetadataPath(sourcePath), destinationBucket, webdavMetadataPath(destinationPath))
+	if errors.Is(metadataErr, os.ErrNotExist) {
+		return s.deleteResource(ctx, destinationBucket, webdavMetadataPath(destinationPath))
+	}
+	return metadataErr
+}
+
+// DeleteObject deletes the resource and its metadata. Collections left empty are kept, deleting a
+// collection deletes anything that was uploaded to it in the meantime as well.
+func (s *WebDAVClient) DeleteObject(ctx context.Context, bucket string, key string) error {
+	keyPath, keyErr := treeKeyPath(key, webdavInternalDir)
+	if keyErr != nil {
+		return keyErr
+	}
+
+	if deleteErr := s.deleteResource(ctx, bucket, keyPath); deleteErr != nil {
+		return deleteErr
+	}
+	return s.deleteResource(ctx, bucket, webdavMetadataPath(keyPath))
+}
+
+func (s *WebDAVClient) DeleteObjects(ctx context.Context, bucket string, keys []string) map[string]error {
+	return deleteInParallel(ctx, bucket, keys, s.DeleteObject)
+}
+
+// ObjectVersion always returns an empty string, WebDAV has no object versions warden can use
+func (s *WebDAVClient) ObjectVersion(ctx context.Context, bucket string, key string) (string, error) {
+	return "", nil
+}
+
+func (s *WebDAVClient) DeleteObjectVersioned(ctx context.Context, bucket string, key string) (string, error) {
+	return "", notVersionedError(bucket)
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/webdav"
+)
+
+// startWebDAVServer serves a temp directory over WebDAV under /remote.php/dav/files/warden/ like
+// Nextcloud does, it returns the provider config to reach it and the served directory.
+func startWebDAVServer(t *testing.T) (CloudProviderConfig, string) {
+	root := t.TempDir()
+	const prefix = "/remote.php/dav/files/warden"
+	handler := &webdav.Handler{
+		Prefix:     prefix,
+		FileSystem: webdav.Dir(root),
+		LockSystem: webdav.NewMemLS(),
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if user, password, ok := r.BasicAuth(); !ok || user != "warden" || password != "app-password" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		handler.ServeHTTP(w, r)
+	}))
+	t.Cleanup(server.Close)
+
+	return CloudProviderConfig{
+		ID:       "nextcloud",
+		Name:     "webdav",
+		Endpoint: server.URL + prefix + "/",
+		User:     "warden",
+		Password: "app-password",
+	}, root
+}
+
+func TestNewWebDAVBucketClient(t *testing.T) {
+	_, endpointErr := NewWebDAVBucketClient(CloudProviderConfig{ID: "nextcloud", Name: "webdav", Endpoint: "cloud.example.org"})
+	assert.ErrorContains(t, endpointErr, "invalid endpoint")
+
+	providerConfig, root := startWebDAVServer(t)
+	assert.Nil(t, os.Mkdir(filepath.Join(root, "backups"), 0755))
+	providerConfig.Password = "wrong"
+	client, clientErr := NewWebDAVBucketClient(providerConfig)
+	assert.Nil(t, clientErr)
+	uploadErr := client.UploadFile(context.Background(), "backups", "/file.txt", strings.NewReader("content"), nil)
+	assert.ErrorContains(t, uploadErr, "401 Unauthorized")
+}
+
+func TestWebDAVClientUploadAndList(t *testing.T) {
+	providerConfig, root := startWebDAVServer(t)
+	assert.Nil(t, os.Mkdir(filepath.Join(root, "nas photos"), 0755))
+	client, clientErr := NewWebDAVBucketClient(providerConfig)
+	assert.Nil(t, clientErr)
+	bucket := "nas photos"
+	ctx := context.Background()
+
+	metadata := map[string]string{metadataMode: "644", metadataMtime: "2022-05-01T10:00:00Z"}
+	assert.Nil(t, client.UploadFile(ctx, bucket, "/photos/2020/beach #1.jpg", strings.NewReader("beach"), metadata))
+	assert.Nil(t, client.UploadFile(ctx, bucket, "/photos/2021/snow.jpg", strings.NewReader("snow!"), nil))
+	assert.Nil(t, client.UploadFile(ctx, bucket, "/notes.txt", strings.NewReader("notes"), nil))
+	assert.Nil(t, client.UploadFile(ctx, bucket, "/notes.txt", strings.NewReader("new notes"), nil))
+
+	allObjects, listErr := ListObjects(ctx, client, bucket, ListOptions{})
+	assert.Nil(t, listErr)
+	assert.Len(t, allObjects, 3)
+	assert.Equal(t, int64(9), allObjects["notes.txt"].Size)
+	assert.Equal(t, int64(5), allObjects["photos/2020/beach #1.jpg"].Size)
+	assert.False(t, allObjects["photos/2020/beach #1.jpg"].ModTime.IsZero())
+
+	delimited, delimitedErr := ListObjects(ctx, client, bucket, ListOptions{Prefix: "photos/", Delimiter: "/"})
+	assert.Nil(t, delimitedErr)
+	assert.Equal(t, map[string]ObjectInfo{"photos/2020/": {IsPrefix: true}, "photos/2021/": {IsPrefix: true}}, delimited)
+	missing, missingErr := ListObjects(ctx, client, bucket, ListOptions{Prefix: "videos/"})
+	assert.Nil(t, missingErr)
+	assert.Len(t, missing, 0)
+	_, missingBucketErr := ListObjects(ctx, client, "not-a-collection", ListOptions{Prefix: "videos/"})
+	assert.NotNil(t, missingBucketErr)
+
+	var downloaded bytes.Buffer
+	objectInfo, downloadErr := client.DownloadObject(ctx, bucket, "/photos/2020/beach #1.jpg", &downloaded)
+	assert.Nil(t, downloadErr)
+	assert.Equal(t, "beach", downloaded.String())
+	assert.Equal(t, metadata, objectInfo.Metadata)
+
+	// uploads are moved into place, nothing is left in the temp collection
+	tempDir := filepath.Join(root, bucket, webdavInternalDir, "tmp")
+	tempFiles, _ := ioutil.ReadDir(tempDir)
+	assert.Len(t, tempFiles, 0)
+
+	// temp files of uploads that never finished are swept by the next listing, once they're stale
+	for _, name := range []string{"stale", "uploading"} {
+		assert.Nil(t, ioutil.WriteFile(filepath.Join(tempDir, name), []byte("partial"), 0644))
+	}
+	staleTime := time.Now().Add(-staleTempFileAge - time.Hour)
+	assert.Nil(t, os.Chtimes(filepath.Join(tempDir, "stale"), staleTime, staleTime))
+	_, listErr = ListObjects(ctx, client, bucket, ListOptions{Prefix: "photos/"})
+	assert.Nil(t, listErr)
+	tempFiles, _ = ioutil.ReadDir(tempDir)
+	assert.Len(t, tempFiles, 1)
+	assert.Equal(t, "uploading", tempFiles[0].Name())
+}
+
+func TestWebDAVClientCopyAndDelete(t *testing.T) {
+	providerConfig, root := startWebDAVServer(t)
+	for _, bucket := range []string{"sync", "tombstones"} {
+		assert.Nil(t, os.Mkdir(filepath.Join(root, bucket), 0755))
+	}
+	client, clientErr := NewWebDAVBucketClient(providerConfig)
+	assert.Nil(t, clientErr)
+	ctx := context.Background()
+
+	metadata := map[string]string{metadataMode: "600"}
+	assert.Nil(t, client.UploadFile(ctx, "sync", "/dir/file.txt", strings.NewReader("content"), metadata))
+	assert.Nil(t, client.CopyObject(ctx, "sync", "/dir/file.txt", "tombstones", "/2022/dir/file.txt", CopyOptions{}))
+
+	var copied bytes.Buffer
+	objectInfo, downloadErr := client.DownloadObject(ctx, "tombstones", "/2022/dir/file.txt", &copied)
+	assert.Nil(t, downloadErr)
+	assert.Equal(t, "content", copied.String())
+	assert.Equal(t, metadata, objectInfo.Metadata)
+
+	// a collection removed behind warden's back is created again
+	assert.Nil(t, os.RemoveAll(filepath.Join(root, "tombstones", "2022")))
+	assert.Nil(t, client.CopyObject(ctx, "sync", "/dir/file.txt", "tombstones", "/2022/dir/file.txt", CopyOptions{}))
+
+	deleteErrs := client.DeleteObjects(ctx, "sync", []string{"/dir/file.txt", "/never-uploaded.txt"})
+	assert.Len(t, deleteErrs, 0)
+	remaining, listErr := ListObjects(ctx, client, "sync", ListOptions{})
+	assert.Nil(t, listErr)
+	assert.Len(t, remaining, 0)
+	_, metadataErr := os.Stat(filepath.Join(root, "sync", webdavInternalDir, "metadata", "dir", "file.txt.json"))
+	assert.True(t, os.IsNotExist(metadataErr))
+}
+
+// methodRecorder records the method of every request a client sends
+type methodRecorder struct {
+	lock    sync.Mutex
+	methods []string
+}
+
+func (r *methodRecorder) RoundTrip(req *http.Request) (*http.Response, error) {
+	r.lock.Lock()
+	r.methods = append(r.methods, req.Method)
+	r.lock.Unlock()
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+func TestWebDAVTombstonesAreMoved(t *testing.T) {
+	providerConfig, root := startWebDAVServer(t)
+	for _, bucket := range []string{"sync", "tombstones"} {
+		assert.Nil(t, os.Mkdir(filepath.Join(root, bucket), 0755))
+	}
+	client, clientErr := NewWebDAVBucketClient(providerConfig)
+	assert.Nil(t, clientErr)
+	ctx := context.Background()
+	metadata := map[string]string{metadataMode: "600"}
+	assert.Nil(t, client.UploadFile(ctx, "sync", "/dir/file.txt", strings.NewReader("content"), metadata))
+
+	recorder := &methodRecorder{}
+	client.(*WebDAVClient).client = &http.Client{Transport: recorder}
+	destination := SyncDestination{Bucket: "sync", TombstoneBucket: "tombstones"}
+	tombstone := SyncConfig{}.TombstonePolicy(destination)
+	objReqs := newObjectRequests()
+	objReqs.TombstoneKeys = append(objReqs.TombstoneKeys, "/dir/file.txt")
+	resultMap := NewResultMap()
+	syncObjectRequests(ctx, limitOperations(client, TimeoutConfig{Operation: "1m"}), workQueue.NewJob("tombstones", 0, 0), objReqs, resultMap, destination, tombstone)
+	assert.Equal(t, map[string]error{"/dir/file.txt": nil}, resultMap.Tombstone)
+
+	// the file and its metadata are moved, nothing is copied or deleted afterwards
+	assert.NotContains(t, recorder.methods, "COPY")
+	assert.NotContains(t, recorder.methods, http.MethodDelete)
+	remaining, listErr := ListObjects(ctx, client, "sync", ListOptions{})
+	assert.Nil(t, listErr)
+	assert.Len(t, remaining, 0)
+	tombstones, tombstonesErr := ListObjects(ctx, client, "tombstones", ListOptions{})
+	assert.Nil(t, tombstonesErr)
+	assert.Len(t, tombstones, 1)
+	for tombstoneKey := range tombstones {
+		var moved bytes.Buffer
+		objectInfo, downloadErr := client.DownloadObject(ctx, "tombstones", tombstoneKey, &moved)
+		assert.Nil(t, downloadErr)
+		assert.Equal(t, "content", moved.String())
+		assert.Equal(t, metadata, objectInfo.Metadata)
+	}
+}
+
+func TestSyncToWebDAV(t *testing.T) {
+	providerConfig, root := startWebDAVServer(t)
+	assert.Nil(t, os.Mkdir(filepath.Join(root, "nas"), 0755))
+	client, clientErr := NewWebDAVBucketClient(providerConfig)
+	assert.Nil(t, clientErr)
+	mockTempDir := t.TempDir()
+	assert.Nil(t, os.MkdirAll(filepath.Join(mockTempDir, "docs"), 0755))
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(mockTempDir, "docs", "doc1.txt"), []byte("doc1"), 0644))
+	// docs.zip sorts before docs/doc1.txt as keys, though the docs directory sorts first by name
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(mockTempDir, "docs.zip"), []byte("zip"), 0644))
+
+	concreteWalkFunc = walkDirectory
+	mockSyncConfig := SyncConfig{SourceFolder: mockTempDir, DestinationBucket: "nas"}
+	syncedObjects, syncErr := doSingleDestinationSync(client, mockSyncConfig, &sync.Mutex{})
+	assert.Nil(t, syncErr)
+	assert.Len(t, syncedObjects.Upload, 2)
+
+	keys := make([]string, 0)
+	assert.Nil(t, client.WalkObjects(context.Background(), "nas", ListOptions{}, func(key string, info ObjectInfo) error {
+		keys = append(keys, key)
+		return nil
+	}))
+	assert.Equal(t, []string{"docs.zip", "docs/doc1.txt"}, keys)
+
+	// nothing changed, so the second run has nothing to upload
+	syncedObjects, syncErr = doSingleDestinationSync(client, mockSyncConfig, &sync.Mutex{})
+	assert.Nil(t, syncErr)
+	assert.Len(t, syncedObjects.Upload, 0)
+
+	uploaded, readErr := ioutil.ReadFile(filepath.Join(root, "nas", "docs", "doc1.txt"))
+	assert.Nil(t, readErr)
+	assert.Equal(t, "doc1", string(uploaded))
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"sync"
+)
+
+// jobBacklog is how many tasks a job can have waiting for a worker before Submit blocks. This keeps
+// memory flat however large a diff is, the producer is held back until workers catch up.
+const jobBacklog = 1000
+
+// WorkQueue runs object operations for every sync and backup job on a fixed pool of workers. When a
+// worker frees up it takes the next task from the highest priority job that is below its own
+// concurrency limit, jobs of equal priority take turns.
+type WorkQueue struct {
+	lock   sync.Mutex
+	cond   *sync.Cond
+	active []*WorkQueueJob
+	served uint64
+}
+
+// WorkQueueJob is a job's handle for submitting tasks to a WorkQueue.
+type WorkQueueJob struct {
+	Name        string
+	queue       *WorkQueue
+	priority    int
+	concurrency int
+	running     int
+	pending     []func()
+	queued      bool
+	lastServed  uint64
+}
+
+func NewWorkQueue(workers int) *WorkQueue {
+	q := &WorkQueue{}
+	q.cond = sync.NewCond(&q.lock)
+	for i := 0; i < workers; i++ {
+		go q.work()
+	}
+	return q
+}
+
+// NewJob returns a handle for a job. Higher priorities are served first, a concurrency of 0 lets the
+// job use every worker.
+func (q *WorkQueue) NewJob(name string, priority, concurrency int) *WorkQueueJob {
+	return &WorkQueueJob{
+		Name:        name,
+		queue:       q,
+		priority:    priority,
+		concurrency: concurrency,
+	}
+}
+
+// Submit queues task to run on one of the queue's workers, blocking while the job's backlog is full.
+func (j *WorkQueueJob) Submit(task func()) {
+	q := j.queue
+	q.lock.Lock()
+	for len(j.pending) >= jobBacklog {
+		q.cond.Wait()
+	}
+	j.pending = append(j.pending, task)
+	if !j.queued {
+		j.queued = true
+		q.active = append(q.active, j)
+	}
+	q.lock.Unlock()
+	q.cond.Broadcast()
+}
+
+func (q *WorkQueue) work() {
+	for {
+		q.lock.Lock()
+		job := q.next()
+		for job == nil {
+			q.cond.Wait()
+			job = q.next()
+		}
+
+		task := job.pending[0]
+		job.pending[0] = nil
+		job.pending = job.pending[1:]
+		if len(job.pending) == 0 {
+			q.removeActive(job)
+		}
+		job.running++
+		q.served++
+		job.lastServed = q.served
+		q.lock.Unlock()
+		// wakes producers waiting on a full backlog
+		q.cond.Broadcast()
+
+		task()
+
+		q.lock.Lock()
+		job.running--
+		q.lock.Unlock()
+		q.cond.Broadcast()
+	}
+}
+
+// next picks the job the next task should come from, nil when no job can run one right now. The
+// caller must hold the lock.
+func (q *WorkQueue) next() *WorkQueueJob {
+	var best *WorkQueueJob
+	for _, job := range q.active {
+		if job.concurrency > 0 && job.running >= job.concurrency {
+			continue
+		}
+		if best == nil || job.priority > best.priority ||
+			(job.priority == best.priority && job.lastServed < best.lastServed) {
+			best = job
+		}
+	}
+	return best
+}
+
+func (q *WorkQueue) removeActive(job *WorkQueueJob) {
+	job.queued = false
+	job.pending = nil
+	for i, activeJob := range q.active {
+		if activeJob == job {
+			q.active = append(q.active[:i], q.active[i+1:]...)
+			return
+		}
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// blockWorker occupies the only worker of q until the returned func is called so tests can queue
+// up tasks before any of them run
+func blockWorker(q *WorkQueue) func() {
+	release := make(chan bool)
+	started := make(chan bool)
+	q.NewJob("blocker", 0, 0).Submit(func() {
+		close(started)
+		<-release
+	})
+	<-started
+	return func() { close(release) }
+}
+
+func TestWorkQueueRunsHigherPriorityFirst(t *testing.T) {
+	q := NewWorkQueue(1)
+	release := blockWorker(q)
+
+	var lock sync.Mutex
+	var wg sync.WaitGroup
+	order := make([]string, 0)
+	record := func(name string) func() {
+		wg.Add(1)
+		return func() {
+			defer wg.Done()
+			lock.Lock()
+			order = append(order, name)
+			lock.Unlock()
+		}
+	}
+	bulk := q.NewJob("bulk", 0, 0)
+	important := q.NewJob("important", 10, 0)
+	bulk.Submit(record("bulk"))
+	bulk.Submit(record("bulk"))
+	important.Submit(record("important"))
+	important.Submit(record("important"))
+
+	release()
+	wg.Wait()
+	assert.Equal(t, []string{"important", "important", "bulk", "bulk"}, order)
+}
+
+func TestWorkQueueEqualPrioritiesTakeTurns(t *testing.T) {
+	q := NewWorkQueue(1)
+	release := blockWorker(q)
+
+	var lock sync.Mutex
+	var wg sync.WaitGroup
+	order := make([]string, 0)
+	first := q.NewJob("first", 0, 0)
+	second := q.NewJob("second", 0, 0)
+	for _, job := range []*WorkQueueJob{first, first, first, second, second, second} {
+		job := job
+		wg.Add(1)
+		job.Submit(func() {
+			defer wg.Done()
+			lock.Lock()
+			order = append(order, job.Name)
+			lock.Unlock()
+		})
+	}
+
+	release()
+	wg.Wait()
+	assert.Equal(t, []string{"first", "second", "first", "second", "first", "second"}, order)
+}
+
+func TestWorkQueueJobConcurrencyLimit(t *testing.T) {
+	q := NewWorkQueue(8)
+	job := q.NewJob("limited", 0, 2)
+
+	var running, maxRunning int32
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		job.Submit(func() {
+			defer wg.Done()
+			current := atomic.AddInt32(&running, 1)
+			for {
+				seen := atomic.LoadInt32(&maxRunning)
+				if current <= seen || atomic.CompareAndSwapInt32(&maxRunning, seen, current) {
+					break
+				}
+			}
+			time.Sleep(time.Millisecond)
+			atomic.AddInt32(&running, -1)
+		})
+	}
+
+	wg.Wait()
+	assert.Equal(t, int32(2), maxRunning)
+}
+
+func TestWorkQueueSubmitBlocksWhenBacklogFull(t *testing.T) {
+	q := NewWorkQueue(1)
+	release := blockWorker(q)
+	job := q.NewJob("bulk", 0, 0)
+	for i := 0; i < jobBacklog; i++ {
+		job.Submit(func() {})
+	}
+
+	submitted := make(chan bool)
+	go func() {
+		job.Submit(func() {})
+		close(submitted)
+	}()
+	select {
+	case <-submitted:
+		t.Fatal("Submit returned with a full backlog")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	release()
+	<-submitted
+}
@@ -0,0 +1,13 @@
+//go:build !linux && !darwin
+
+package main
+
+// extended attributes are only supported on linux and darwin
+
+func readXattrs(path string) (map[string][]byte, error) {
+	return map[string][]byte{}, nil
+}
+
+func writeXattrs(path string, xattrs map[string][]byte) error {
+	return nil
+}
@@ -0,0 +1,49 @@
+//go:build linux || darwin
+
+package main
+
+import (
+	"bytes"
+
+	"golang.org/x/sys/unix"
+)
+
+func readXattrs(path string) (map[string][]byte, error) {
+	xattrs := make(map[string][]byte)
+	size, listErr := unix.Listxattr(path, nil)
+	if listErr != nil || size == 0 {
+		return xattrs, listErr
+	}
+	names := make([]byte, size)
+	size, listErr = unix.Listxattr(path, names)
+	if listErr != nil {
+		return xattrs, listErr
+	}
+
+	for _, name := range bytes.Split(names[:size], []byte{0}) {
+		if len(name) == 0 {
+			continue
+		}
+		valueSize, getErr := unix.Getxattr(path, string(name), nil)
+		if getErr != nil {
+			return xattrs, getErr
+		}
+		value := make([]byte, valueSize)
+		valueSize, getErr = unix.Getxattr(path, string(name), value)
+		if getErr != nil {
+			return xattrs, getErr
+		}
+		xattrs[string(name)] = value[:valueSize]
+	}
+
+	return xattrs, nil
+}
+
+func writeXattrs(path string, xattrs map[string][]byte) error {
+	for name, value := range xattrs {
+		if setErr := unix.Setxattr(path, name, value, 0); setErr != nil {
+			return setErr
+		}
+	}
+	return nil
+}